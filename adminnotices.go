@@ -0,0 +1,114 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// sendAdminNotice posts an operational alert to the admin notice room, if
+// one is configured.
+func (br *SlackBridge) sendAdminNotice(format string, args ...interface{}) {
+	roomID := br.bridgeConfig().AdminNotices.Room
+	if roomID == "" {
+		return
+	}
+	_, err := br.Bot.SendNotice(roomID, fmt.Sprintf(format, args...))
+	if err != nil {
+		br.Log.Warnfln("Failed to send admin notice to %s: %v", roomID, err)
+	}
+}
+
+// trackSendFailure counts consecutive failed Matrix messages in the portal
+// and alerts the admins once the configured threshold is reached.
+func (portal *Portal) trackSendFailure(err error) {
+	if err == nil {
+		atomic.StoreInt32(&portal.sendFailures, 0)
+		return
+	}
+	failures := atomic.AddInt32(&portal.sendFailures, 1)
+	threshold := portal.bridge.bridgeConfig().AdminNotices.SendFailureThreshold
+	if threshold > 0 && int(failures) == threshold {
+		go portal.bridge.sendAdminNotice("%d messages in a row failed to send to Slack in %s (%s). Latest error: %v",
+			failures, portal.MXID, portal.Key, err)
+	}
+}
+
+func (portal *Portal) sendBackfillCompleteNotice(backfillState *database.BackfillState) {
+	if portal.bridge.bridgeConfig().AdminNotices.BackfillComplete {
+		go portal.bridge.sendAdminNotice("Finished backfilling %s (%s) with %d messages", portal.MXID, portal.Key, backfillState.MessageCount)
+	}
+}
+
+// slackWarningTransport inspects Slack API responses for deprecation
+// warnings, so that admins find out about them before the methods stop
+// working.
+type slackWarningTransport struct {
+	bridge *SlackBridge
+	base   http.RoundTripper
+}
+
+type slackAPIWarnings struct {
+	Warning          string `json:"warning"`
+	ResponseMetadata struct {
+		Warnings []string `json:"warnings"`
+	} `json:"response_metadata"`
+}
+
+func (swt *slackWarningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := swt.base.RoundTrip(req)
+	if err != nil || !swt.bridge.bridgeConfig().AdminNotices.APIWarnings ||
+		!strings.HasPrefix(req.URL.Path, "/api/") || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	swt.bridge.checkSlackAPIWarnings(strings.TrimPrefix(req.URL.Path, "/api/"), data)
+	return resp, nil
+}
+
+func (br *SlackBridge) checkSlackAPIWarnings(method string, data []byte) {
+	var parsed slackAPIWarnings
+	if json.Unmarshal(data, &parsed) != nil {
+		return
+	}
+	warnings := parsed.ResponseMetadata.Warnings
+	if parsed.Warning != "" {
+		warnings = append(warnings, strings.Split(parsed.Warning, ",")...)
+	}
+	for _, warning := range warnings {
+		if !strings.Contains(warning, "deprecat") {
+			continue
+		} else if _, alreadySeen := br.apiWarningsSeen.LoadOrStore(method+"/"+warning, struct{}{}); alreadySeen {
+			continue
+		}
+		br.Log.Warnfln("Slack API method %s returned warning %s", method, warning)
+		go br.sendAdminNotice("Slack says the API method `%s` used by the bridge is deprecated (`%s`). Check for a bridge update.", method, warning)
+	}
+}
@@ -0,0 +1,147 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/util/ffmpeg"
+)
+
+var (
+	ffmpegAvailable     bool
+	ffmpegAvailableOnce sync.Once
+)
+
+func isFFmpegAvailable() bool {
+	ffmpegAvailableOnce.Do(func() {
+		_, err := exec.LookPath("ffmpeg")
+		ffmpegAvailable = err == nil
+	})
+	return ffmpegAvailable
+}
+
+// gifConversionArgs generates a palette from the input for better colors,
+// and makes the GIF loop forever like the original animation.
+var gifConversionArgs = []string{
+	"-filter_complex", "[0:v] split [a][b];[a] palettegen=reserve_transparent=1 [p];[b][p] paletteuse",
+	"-loop", "0",
+}
+
+// isAnimatedImage checks whether image data contains more than one frame.
+// Only GIF, APNG and WebP are detected, other formats are assumed static.
+func isAnimatedImage(data []byte, mimeType string) bool {
+	switch mimeType {
+	case "image/gif":
+		return isAnimatedGIF(data)
+	case "image/png", "image/apng":
+		return isAPNG(data)
+	case "image/webp":
+		return isAnimatedWebP(data)
+	default:
+		return false
+	}
+}
+
+// isAnimatedGIF counts image descriptors without decoding the frames. It's
+// a heuristic, as the separator byte may also appear inside image data.
+func isAnimatedGIF(data []byte) bool {
+	return bytes.Count(data, []byte{0x00, 0x21, 0xF9, 0x04}) > 1
+}
+
+// isAPNG checks for an animation control chunk before the image data.
+func isAPNG(data []byte) bool {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return false
+	}
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		chunkLength := int(binary.BigEndian.Uint32(data[pos:]))
+		switch string(data[pos+4 : pos+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		pos += 12 + chunkLength
+	}
+	return false
+}
+
+// isAnimatedWebP checks for the animation flag in the extended header.
+func isAnimatedWebP(data []byte) bool {
+	const animationFlag = 0x02
+	return len(data) > 20 &&
+		string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP" &&
+		string(data[12:16]) == "VP8X" && data[20]&animationFlag != 0
+}
+
+// isMatrixGIF checks whether a Matrix video message is a GIF that was
+// converted to a video by the client or another bridge.
+func isMatrixGIF(evt *event.Event) bool {
+	info, ok := evt.Content.Raw["info"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	isGIF, _ := info["fi.mau.gif"].(bool)
+	return isGIF
+}
+
+// needsAnimationConversion checks whether a Matrix file may be an animation
+// that Slack won't play, which means it has to be downloaded fully to check.
+func (portal *Portal) needsAnimationConversion(evt *event.Event, mimeType string) bool {
+	if !portal.bridge.bridgeConfig().Media.ConvertAnimations {
+		return false
+	}
+	switch mimeType {
+	case "image/png", "image/apng", "image/webp":
+		return true
+	case "video/mp4", "video/webm":
+		return isMatrixGIF(evt)
+	default:
+		return false
+	}
+}
+
+// convertAnimationForSlack converts APNG, animated WebP and Matrix video GIFs
+// to GIF, which is the only animated format Slack plays inline. It returns the
+// original data if no conversion is needed or possible.
+func (portal *Portal) convertAnimationForSlack(ctx context.Context, evt *event.Event, data []byte, mimeType, filename string) ([]byte, string, string) {
+	if !portal.needsAnimationConversion(evt, mimeType) {
+		return data, mimeType, filename
+	} else if strings.HasPrefix(mimeType, "image/") && !isAnimatedImage(data, mimeType) {
+		return data, mimeType, filename
+	} else if !isFFmpegAvailable() {
+		portal.log.Warnfln("Not converting animation in %s to GIF: ffmpeg not found", evt.ID)
+		return data, mimeType, filename
+	}
+	converted, err := ffmpeg.ConvertBytes(ctx, data, ".gif", nil, gifConversionArgs, mimeType)
+	if err != nil {
+		portal.log.Warnfln("Failed to convert animation in %s to GIF, sending original: %v", evt.ID, err)
+		return data, mimeType, filename
+	}
+	if dot := strings.LastIndexByte(filename, '.'); dot > 0 {
+		filename = filename[:dot]
+	}
+	return converted, "image/gif", filename + ".gif"
+}
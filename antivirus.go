@@ -0,0 +1,140 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"go.mau.fi/mautrix-slack/config"
+)
+
+var (
+	errFileInfected        = errors.New("the file was blocked by the virus scanner")
+	errAntivirusScanFailed = errors.New("the file could not be scanned for viruses")
+)
+
+const clamdChunkSize = 64 * 1024
+
+// scanFile checks the file with the configured virus scanner. It returns an
+// error wrapping errFileInfected or errAntivirusScanFailed if the file must
+// not be bridged.
+func (br *SlackBridge) scanFile(ctx context.Context, name string, data []byte) error {
+	cfg := &br.bridgeConfig().Antivirus
+	if cfg.Type == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	var signature string
+	var err error
+	switch cfg.Type {
+	case config.AntivirusClamd:
+		signature, err = scanWithClamd(ctx, cfg, data)
+	case config.AntivirusExec:
+		signature, err = scanWithCommand(ctx, cfg.Command, data)
+	}
+	if err != nil {
+		br.Log.Warnfln("Failed to scan %s for viruses: %v", name, err)
+		if cfg.FailOpen {
+			return nil
+		}
+		return errAntivirusScanFailed
+	} else if signature != "" {
+		br.Log.Infofln("Virus scanner found %s in %s", signature, name)
+		return fmt.Errorf("%w (%s)", errFileInfected, signature)
+	}
+	return nil
+}
+
+// scanWithClamd sends the file to clamd using the INSTREAM command and returns
+// the name of the signature that matched, or an empty string if it's clean.
+func scanWithClamd(ctx context.Context, cfg *config.AntivirusConfig, data []byte) (string, error) {
+	var dialer net.Dialer
+	network, address := cfg.ClamdNetwork()
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	var sizeBuf [4]byte
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		data = data[len(chunk):]
+		binary.BigEndian.PutUint32(sizeBuf[:], uint32(len(chunk)))
+		if _, err = conn.Write(sizeBuf[:]); err != nil {
+			return "", err
+		} else if _, err = conn.Write(chunk); err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(sizeBuf[:], 0)
+	if _, err = conn.Write(sizeBuf[:]); err != nil {
+		return "", err
+	}
+
+	var resp bytes.Buffer
+	if _, err = resp.ReadFrom(conn); err != nil {
+		return "", err
+	}
+	// The response is "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	result := strings.TrimPrefix(strings.TrimRight(resp.String(), "\x00\n"), "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("unexpected clamd response %q", result)
+	}
+}
+
+// scanWithCommand runs the scan command with the file on stdin. Exit code 1
+// means the file is infected, in which case stdout is used as the signature.
+func scanWithCommand(ctx context.Context, command []string, data []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return "", nil
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		signature := strings.TrimSpace(string(output))
+		if signature == "" {
+			signature = "unknown signature"
+		}
+		return signature, nil
+	}
+	return "", err
+}
@@ -0,0 +1,148 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type apiPriority int
+
+const (
+	apiPriorityInteractive apiPriority = iota
+	apiPriorityBackground
+)
+
+type apiPriorityContextKey struct{}
+
+// withBackgroundPriority marks the Slack API calls made with the context as
+// part of a background job, which has to wait for interactive calls.
+func withBackgroundPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, apiPriorityContextKey{}, apiPriorityBackground)
+}
+
+// apiLimiter limits how many Slack API calls a user can have running at once.
+// Waiting interactive calls always go before background ones, and some of
+// the slots are reserved for interactive calls, so a big backfill or sync
+// can't delay live messages for long.
+type apiLimiter struct {
+	user    *User
+	active  [2]int
+	waiting [2][]chan struct{}
+	lock    sync.Mutex
+}
+
+// limits returns the total number of concurrent calls and how many of them
+// background calls can use. Zero means there's no limit.
+func (al *apiLimiter) limits() (total, background int) {
+	cfg := al.user.bridge.bridgeConfig().APIConcurrency
+	total = cfg.MaxCalls
+	// Users can only lower the limit, never raise it above the bridge config
+	if al.user.APIConcurrency != 0 && (cfg.MaxCalls <= 0 || al.user.APIConcurrency < cfg.MaxCalls) {
+		total = al.user.APIConcurrency
+	}
+	if total <= 0 {
+		return 0, 0
+	}
+	background = total - cfg.ReservedInteractive
+	if background < 1 {
+		background = 1
+	}
+	return
+}
+
+func (al *apiLimiter) canStartLocked(priority apiPriority) bool {
+	total, background := al.limits()
+	if total <= 0 {
+		return true
+	}
+	running := al.active[apiPriorityInteractive] + al.active[apiPriorityBackground]
+	if priority == apiPriorityBackground {
+		return running < total && al.active[apiPriorityBackground] < background && len(al.waiting[apiPriorityInteractive]) == 0
+	}
+	return running < total
+}
+
+func (al *apiLimiter) acquire(ctx context.Context, priority apiPriority) error {
+	al.lock.Lock()
+	if len(al.waiting[priority]) == 0 && al.canStartLocked(priority) {
+		al.active[priority]++
+		al.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	al.waiting[priority] = append(al.waiting[priority], ready)
+	al.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		al.lock.Lock()
+		defer al.lock.Unlock()
+		for i, ch := range al.waiting[priority] {
+			if ch == ready {
+				al.waiting[priority] = append(al.waiting[priority][:i], al.waiting[priority][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The slot was handed over just as the context was cancelled
+		al.active[priority]--
+		al.wakeLocked()
+		return ctx.Err()
+	}
+}
+
+func (al *apiLimiter) release(priority apiPriority) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	al.active[priority]--
+	al.wakeLocked()
+}
+
+func (al *apiLimiter) wakeLocked() {
+	for _, priority := range []apiPriority{apiPriorityInteractive, apiPriorityBackground} {
+		for len(al.waiting[priority]) > 0 && al.canStartLocked(priority) {
+			al.active[priority]++
+			close(al.waiting[priority][0])
+			al.waiting[priority] = al.waiting[priority][1:]
+		}
+	}
+}
+
+// slackLimitTransport makes every Slack API request of a user wait for a
+// slot in the user's limiter. Requests are interactive unless the request
+// context or the transport says otherwise.
+type slackLimitTransport struct {
+	limiter  *apiLimiter
+	priority apiPriority
+	base     http.RoundTripper
+}
+
+func (slt *slackLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	priority := slt.priority
+	if ctxPriority, ok := req.Context().Value(apiPriorityContextKey{}).(apiPriority); ok {
+		priority = ctxPriority
+	}
+	if err := slt.limiter.acquire(req.Context(), priority); err != nil {
+		return nil, err
+	}
+	defer slt.limiter.release(priority)
+	return slt.base.RoundTrip(req)
+}
@@ -0,0 +1,70 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+var errAppDoesNotAcceptMessages = errors.New("this Slack app doesn't accept messages")
+
+// isAppDM checks whether the portal is a DM with a Slack app or Slackbot,
+// i.e. the messages tab of the app's home.
+func (portal *Portal) isAppDM(userTeam *database.UserTeam) bool {
+	if !portal.IsPrivateChat() || portal.DMUserID == "" {
+		return false
+	} else if portal.DMUserID == "USLACKBOT" {
+		return true
+	}
+	info, err := portal.bridge.InfoCache.GetUserInfo(userTeam, portal.DMUserID)
+	if err != nil {
+		portal.log.Warnfln("Failed to check if %s is an app: %v", portal.DMUserID, err)
+		return false
+	}
+	return info.IsBot
+}
+
+// isBotMessageAllowed checks whether a message from a bot should be bridged.
+// Everything in app DMs is sent by the app, so those are always bridged.
+func (portal *Portal) isBotMessageAllowed(userTeam *database.UserTeam, msg *slack.Msg) bool {
+	isBot := msg.SubType == "bot_message" || msg.BotID != ""
+	return !isBot || portal.BridgeBotMessages || portal.isAppDM(userTeam)
+}
+
+// getAppDMAuthor returns the Slack user that messages from the app's bot
+// should be sent as, so that they come from the DM's ghost rather than a
+// separate bot ghost.
+func (portal *Portal) getAppDMAuthor(userTeam *database.UserTeam, msg *slack.Msg) string {
+	if msg.User == "" && msg.BotID != "" && portal.isAppDM(userTeam) {
+		return portal.DMUserID
+	}
+	return ""
+}
+
+// checkAppDMError converts the errors Slack returns when sending a message to
+// an app that has disabled its messages tab.
+func checkAppDMError(err error) error {
+	if err != nil && (err.Error() == "cannot_dm_bot" || err.Error() == "messages_tab_disabled") {
+		return fmt.Errorf("%w (%v)", errAppDoesNotAcceptMessages, err)
+	}
+	return err
+}
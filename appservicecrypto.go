@@ -0,0 +1,103 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Registration flags that the homeserver needs to push encryption data to
+// the bridge in appservice transactions. MSC2409 covers to-device events and
+// MSC3202 covers device list changes and one-time key counts.
+var appserviceEncryptionRegistrationFlags = []string{
+	"push_ephemeral",
+	"de.sorunome.msc2409.push_ephemeral",
+	"org.matrix.msc3202",
+}
+
+func (br *SlackBridge) useAppserviceEncryption() bool {
+	return br.bridgeConfig().Encryption.Allow && br.bridgeConfig().Encryption.Appservice
+}
+
+// checkAppserviceEncryption makes sure the bridge is configured to receive
+// encrypted events, to-device events and device lists through appservice
+// transactions when end-to-bridge encryption is in appservice mode.
+func (br *SlackBridge) checkAppserviceEncryption() {
+	if !br.useAppserviceEncryption() {
+		return
+	}
+	if !br.Config.AppService.EphemeralEvents {
+		br.Log.Fatalln("Appservice mode for end-to-bridge encryption requires appservice -> ephemeral_events to be enabled")
+		os.Exit(14)
+	}
+	if br.Config.Bridge.SyncWithCustomPuppets {
+		br.Log.Warnln("Not syncing with double puppets, as end-to-bridge encryption is in appservice mode")
+		br.Config.Bridge.SyncWithCustomPuppets = false
+	}
+	added, err := ensureRegistrationFlags(br.RegistrationPath, appserviceEncryptionRegistrationFlags)
+	if err != nil {
+		br.Log.Warnfln("Failed to check registration for appservice encryption support: %v. Make sure it has %s set to true.",
+			err, strings.Join(appserviceEncryptionRegistrationFlags, ", "))
+	} else if len(added) > 0 {
+		br.Log.Warnfln("Added %s to the registration file, the homeserver must be restarted to apply the change", strings.Join(added, ", "))
+	}
+}
+
+// ensureRegistrationFlags enables the given top-level flags in the registration
+// file, returning the ones that were added.
+func ensureRegistrationFlags(path string, flags []string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var registration map[string]interface{}
+	err = yaml.Unmarshal(data, &registration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registration: %w", err)
+	}
+
+	var missing []string
+	for _, flag := range flags {
+		value, exists := registration[flag]
+		if !exists {
+			missing = append(missing, flag)
+		} else if enabled, ok := value.(bool); !ok || !enabled {
+			return nil, fmt.Errorf("%s is disabled in the registration", flag)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	var appended strings.Builder
+	appended.Write(data)
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		appended.WriteByte('\n')
+	}
+	for _, flag := range missing {
+		_, _ = fmt.Fprintf(&appended, "%s: true\n", flag)
+	}
+	err = os.WriteFile(path, []byte(appended.String()), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save registration: %w", err)
+	}
+	return missing, nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"image"
+	"io"
 	"strings"
 
 	"maunium.net/go/mautrix/crypto/attachment"
@@ -13,32 +15,21 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-func (portal *Portal) downloadMatrixAttachment(content *event.MessageEventContent) ([]byte, error) {
-	var file *event.EncryptedFileInfo
-	rawMXC := content.URL
-
-	if content.File != nil {
-		file = content.File
-		rawMXC = file.URL
-	}
-
-	mxc, err := rawMXC.Parse()
+func (portal *Portal) downloadMatrixAttachment(ctx context.Context, content *event.MessageEventContent) ([]byte, error) {
+	reader, err := portal.openMatrixAttachment(ctx, content)
 	if err != nil {
 		return nil, err
 	}
-
-	data, err := portal.MainIntent().DownloadBytes(mxc)
+	data, err := io.ReadAll(reader)
 	if err != nil {
+		_ = reader.Close()
 		return nil, err
 	}
-
-	if file != nil {
-		err = file.DecryptInPlace(data)
-		if err != nil {
-			return nil, err
-		}
+	// Closing checks the hash of encrypted files
+	err = reader.Close()
+	if err != nil {
+		return nil, err
 	}
-
 	return data, nil
 }
 
@@ -0,0 +1,80 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// audit records an admin or destructive action in the audit log and posts
+// a notice about it to the configured notice room. Params must not contain
+// secrets like tokens or passwords.
+func (br *SlackBridge) audit(actor id.UserID, action, target string, params map[string]string) {
+	cfg := br.bridgeConfig().AuditLog
+	if !cfg.Enable {
+		return
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		br.Log.Warnfln("Failed to marshal audit log params for %s: %v", action, err)
+		return
+	}
+	entry := br.DB.AuditLog.New()
+	entry.Actor = actor
+	entry.Action = action
+	entry.Target = target
+	entry.Params = string(data)
+	entry.Timestamp = time.Now()
+	entry.Insert()
+
+	if cfg.NoticeRoom != "" {
+		go br.sendAuditNotice(cfg.NoticeRoom, entry.Actor, action, target, params)
+	}
+}
+
+func (br *SlackBridge) sendAuditNotice(roomID id.RoomID, actor id.UserID, action, target string, params map[string]string) {
+	_, err := br.Bot.SendNotice(roomID, formatAuditEntry(actor, action, target, params))
+	if err != nil {
+		br.Log.Warnfln("Failed to send audit notice for %s by %s: %v", action, actor, err)
+	}
+}
+
+func formatAuditEntry(actor id.UserID, action, target string, params map[string]string) string {
+	var text strings.Builder
+	_, _ = fmt.Fprintf(&text, "%s: %s", actor, action)
+	if target != "" {
+		_, _ = fmt.Fprintf(&text, " %s", target)
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(&text, " %s=%q", key, params[key])
+	}
+	return text.String()
+}
@@ -48,8 +48,11 @@ type signinResponse struct {
 	TeamID    string `json:"team"`
 }
 
+// HTTPClient is used for all requests made while logging in.
+var HTTPClient = http.DefaultClient
+
 func post(log log.Logger, method string, form url.Values, data interface{}) error {
-	resp, err := http.Post(
+	resp, err := HTTPClient.Post(
 		baseURL+method,
 		"application/x-www-form-urlencoded",
 		strings.NewReader(form.Encode()),
@@ -163,7 +166,7 @@ func LoginPassword(l log.Logger, email, team, password string) (*Info, error) {
 }
 
 func LoginToken(token string, cookieToken string) (*Info, error) {
-	client := slack.New(token, slack.OptionCookie("d", cookieToken))
+	client := slack.New(token, slack.OptionCookie("d", cookieToken), slack.OptionHTTPClient(HTTPClient))
 
 	clientBoot, err := client.ClientBoot()
 	if err != nil {
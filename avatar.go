@@ -25,13 +25,13 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-func uploadAvatar(intent *appservice.IntentAPI, url string) (id.ContentURI, error) {
+func uploadAvatar(client *http.Client, intent *appservice.IntentAPI, url string) (id.ContentURI, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return id.ContentURI{}, fmt.Errorf("failed to prepare request: %w", err)
 	}
 
-	getResp, err := http.DefaultClient.Do(req)
+	getResp, err := client.Do(req)
 	if err != nil {
 		return id.ContentURI{}, fmt.Errorf("failed to download avatar: %w", err)
 	}
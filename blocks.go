@@ -10,19 +10,20 @@ import (
 	"strings"
 
 	"github.com/slack-go/slack"
-	"github.com/yuin/goldmark"
 	"go.mau.fi/mautrix-slack/database"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 )
 
 func (portal *Portal) renderImageBlock(block slack.ImageBlock) (*event.MessageEventContent, error) {
-	client := http.Client{}
+	client := portal.bridge.getSlackHTTPClient(portal.Key.TeamID)
 	resp, err := client.Get(block.ImageURL)
 	if err != nil {
 		portal.log.Errorfln("Error fetching image: %v", err)
 		return nil, err
-	} else if resp.StatusCode != 200 {
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
 		portal.log.Errorfln("HTTP error %d fetching image", resp.StatusCode)
 		return nil, fmt.Errorf(resp.Status)
 	}
@@ -49,29 +50,11 @@ func (portal *Portal) renderImageBlock(block slack.ImageBlock) (*event.MessageEv
 	return &content, nil
 }
 
-func (portal *Portal) mrkdwnToMatrixHtml(mrkdwn string) string {
-	mrkdwn = replaceShortcodesWithEmojis(mrkdwn)
-
-	mrkdwn = escapeFixer.ReplaceAllStringFunc(mrkdwn, func(s string) string {
-		return s[:2] + `\` + s[2:]
-	})
-
-	mdRenderer := goldmark.New(
-		format.Extensions, format.HTMLOptions,
-		goldmark.WithExtensions(&SlackTag{portal}),
-	)
-
-	var buf strings.Builder
-	mdRenderer.Convert([]byte(mrkdwn), &buf)
-
-	return format.UnwrapSingleParagraph(buf.String())
-}
-
 func (portal *Portal) renderSlackTextBlock(block slack.TextBlockObject) string {
 	if block.Type == slack.PlainTextType {
 		return html.EscapeString(html.UnescapeString(block.Text))
 	} else if block.Type == slack.MarkdownType {
-		return portal.mrkdwnToMatrixHtml(block.Text)
+		return portal.mrkdwnToHTML(block.Text)
 	} else {
 		return ""
 	}
@@ -118,6 +101,8 @@ func (portal *Portal) renderRichTextSectionElements(elements []slack.RichTextSec
 			} else { // TODO: register puppet and get info if not exist
 				htmlText.WriteString(fmt.Sprintf("@%s", e.UserID))
 			}
+		case *slack.RichTextSectionUserGroupElement:
+			htmlText.WriteString(fmt.Sprintf("@%s", portal.getUsergroupHandle(e.UsergroupID)))
 		case *slack.RichTextSectionChannelElement:
 			p := portal.bridge.DB.Portal.GetByID(database.PortalKey{
 				TeamID:    portal.Key.TeamID,
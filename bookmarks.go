@@ -0,0 +1,177 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// SlackBookmarkEvent is sent when a channel bookmark is added, edited or
+// removed. slackgo doesn't know about these, so they're added to the RTM
+// event mapping in init.
+type SlackBookmarkEvent struct {
+	Type      string         `json:"type"`
+	ChannelID string         `json:"channel_id"`
+	Bookmark  slack.Bookmark `json:"bookmark"`
+}
+
+func init() {
+	for _, evtType := range []string{"bookmark_added", "bookmark_updated", "bookmark_removed"} {
+		slack.EventMapping[evtType] = SlackBookmarkEvent{}
+	}
+}
+
+func (user *User) handleSlackBookmarkEvent(userTeam *database.UserTeam, evt *SlackBookmarkEvent) {
+	channelID := evt.ChannelID
+	if channelID == "" {
+		channelID = evt.Bookmark.ChannelID
+	}
+	portal := user.bridge.GetPortalByID(database.NewPortalKey(userTeam.Key.TeamID, channelID))
+	if portal != nil {
+		portal.syncBookmarks(context.Background(), userTeam)
+	}
+}
+
+// syncAllBookmarks syncs the bookmarks of every portal of the team one by one
+// after a sync. Listing bookmarks takes a call per channel, so it's done as a
+// background job instead of holding up the sync.
+func (user *User) syncAllBookmarks(userTeam *database.UserTeam) {
+	if !user.bridge.bridgeConfig().Bookmarks {
+		return
+	}
+	ctx := withBackgroundPriority(context.Background())
+	for _, dbPortal := range user.bridge.DB.Portal.GetAllForUserTeam(userTeam.Key) {
+		if userTeam.Client == nil {
+			return
+		}
+		portal := user.bridge.GetPortalByID(dbPortal.Key)
+		if portal != nil {
+			portal.syncBookmarks(ctx, userTeam)
+		}
+	}
+}
+
+// syncBookmarks keeps a pinned message listing the channel's bookmarks up to
+// date. The message is edited when the bookmarks change, and redacted and
+// unpinned when the last bookmark is removed.
+func (portal *Portal) syncBookmarks(ctx context.Context, userTeam *database.UserTeam) {
+	if !portal.bridge.bridgeConfig().Bookmarks || portal.MXID == "" || userTeam.Client == nil {
+		return
+	}
+	portal.bookmarksLock.Lock()
+	defer portal.bookmarksLock.Unlock()
+
+	bookmarks, err := userTeam.Client.ListBookmarksContext(ctx, portal.Key.ChannelID)
+	if err != nil {
+		portal.log.Warnfln("Failed to list bookmarks through %s: %v", userTeam.Key.SlackID, err)
+		return
+	}
+	eventID, oldBody := portal.bridge.DB.Bookmarks.Get(portal.Key)
+	intent := portal.MainIntent()
+	if len(bookmarks) == 0 {
+		if eventID != "" {
+			portal.setBookmarksPinned(eventID, false)
+			_, err = intent.RedactEvent(portal.MXID, eventID)
+			if err != nil {
+				portal.log.Warnfln("Failed to redact bookmarks message %s: %v", eventID, err)
+			}
+			portal.bridge.DB.Bookmarks.Delete(portal.Key)
+		}
+		return
+	}
+
+	content := renderBookmarks(bookmarks)
+	body := content.Body
+	if body == oldBody {
+		return
+	}
+	if eventID != "" {
+		content.SetEdit(eventID)
+	}
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, 0)
+	if err != nil {
+		portal.log.Warnln("Failed to send bookmarks message:", err)
+		return
+	}
+	if eventID == "" {
+		eventID = resp.EventID
+		portal.setBookmarksPinned(eventID, true)
+	}
+	portal.bridge.DB.Bookmarks.Set(portal.Key, eventID, body)
+}
+
+func renderBookmarks(bookmarks []slack.Bookmark) *event.MessageEventContent {
+	sort.SliceStable(bookmarks, func(i, j int) bool {
+		return bookmarks[i].Rank < bookmarks[j].Rank
+	})
+	var body, formatted strings.Builder
+	body.WriteString("Bookmarks:\n")
+	formatted.WriteString("<p><strong>Bookmarks</strong></p><ul>")
+	for _, bookmark := range bookmarks {
+		title := bookmark.Title
+		if bookmark.Emoji != "" {
+			title = shortcodeToEmoji(bookmark.Emoji) + " " + title
+		}
+		_, _ = fmt.Fprintf(&body, "* %s: %s\n", title, bookmark.Link)
+		_, _ = fmt.Fprintf(&formatted, `<li><a href="%s">%s</a></li>`, html.EscapeString(bookmark.Link), html.EscapeString(title))
+	}
+	formatted.WriteString("</ul>")
+	return &event.MessageEventContent{
+		MsgType:       event.MsgNotice,
+		Body:          strings.TrimSuffix(body.String(), "\n"),
+		Format:        event.FormatHTML,
+		FormattedBody: formatted.String(),
+	}
+}
+
+func (portal *Portal) setBookmarksPinned(eventID id.EventID, pinned bool) {
+	intent := portal.MainIntent()
+	var content event.PinnedEventsEventContent
+	err := intent.StateEvent(portal.MXID, event.StatePinnedEvents, "", &content)
+	if err != nil {
+		portal.log.Debugln("Failed to get pinned events, assuming there are none:", err)
+	}
+	pinnedIndex := -1
+	for i, pinnedID := range content.Pinned {
+		if pinnedID == eventID {
+			pinnedIndex = i
+			break
+		}
+	}
+	if pinned && pinnedIndex < 0 {
+		content.Pinned = append(content.Pinned, eventID)
+	} else if !pinned && pinnedIndex >= 0 {
+		content.Pinned = append(content.Pinned[:pinnedIndex], content.Pinned[pinnedIndex+1:]...)
+	} else {
+		return
+	}
+	_, err = intent.SendStateEvent(portal.MXID, event.StatePinnedEvents, "", &content)
+	if err != nil {
+		portal.log.Warnln("Failed to update pinned events:", err)
+	}
+}
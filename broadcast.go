@@ -0,0 +1,92 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// broadcastSlackMessage cross-posts a Matrix message that was just sent to
+// Slack to the portal's broadcast targets, or relays an edit of it to the
+// existing copies. Messages are only cross-posted to the targets the sender
+// added themselves, and never for messages sent through the relay, as they're
+// posted with the sender's own Slack account. Thread replies stay in the
+// portal's own channel, as the thread roots don't exist in the other channels.
+func (portal *Portal) broadcastSlackMessage(userTeam *database.UserTeam, evt *event.Event, options []slack.MsgOption, slackID, threadTs string) {
+	if slackID == "" || threadTs != "" || userTeam.Key.MXID != evt.Sender {
+		return
+	}
+	circuitBreaker := portal.bridge.getCircuitBreaker(userTeam)
+	if content := evt.Content.AsMessage(); content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace {
+		for _, cp := range portal.bridge.DB.Broadcast.GetCopies(portal.Key, slackID) {
+			// MsgOptionPost clears the original timestamp so that only the copy's one is sent
+			_, _, _, err := userTeam.Client.SendMessage(cp.ChannelID,
+				slack.MsgOptionCompose(options...), slack.MsgOptionPost(), slack.MsgOptionUpdate(cp.Ts))
+			circuitBreaker.Record(err)
+			if err != nil {
+				portal.log.Warnfln("Failed to edit broadcast copy of %s in %s: %v", slackID, cp.ChannelID, err)
+			}
+		}
+		return
+	}
+	for _, target := range portal.bridge.DB.Broadcast.GetTargets(portal.Key) {
+		if target.AddedBy != evt.Sender {
+			continue
+		}
+		_, ts, err := userTeam.Client.PostMessage(target.ChannelID, slack.MsgOptionAsUser(true), slack.MsgOptionCompose(options...))
+		circuitBreaker.Record(err)
+		if err != nil {
+			portal.log.Warnfln("Failed to broadcast %s to %s: %v", evt.ID, target.ChannelID, err)
+			continue
+		}
+		portal.bridge.DB.Broadcast.AddCopy(portal.Key, slackID, target.ChannelID, ts)
+	}
+}
+
+// deleteBroadcastCopies deletes the cross-posted copies of a Slack message
+// after the original was deleted for a Matrix redaction.
+func (portal *Portal) deleteBroadcastCopies(userTeam *database.UserTeam, slackID string) {
+	for _, cp := range portal.bridge.DB.Broadcast.GetCopies(portal.Key, slackID) {
+		err := portal.deleteSlackMessage(userTeam, cp.ChannelID, cp.Ts)
+		if err != nil {
+			portal.log.Warnfln("Failed to delete broadcast copy of %s in %s: %v", slackID, cp.ChannelID, err)
+			continue
+		}
+		portal.bridge.DB.Broadcast.DeleteCopy(portal.Key, slackID, cp.ChannelID)
+	}
+}
+
+// isRoomAdmin checks whether the user is a bridge admin or has the power level
+// required to change the power levels of the portal room.
+func (portal *Portal) isRoomAdmin(user *User) bool {
+	if user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return true
+	} else if portal.MXID == "" {
+		return false
+	}
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get power levels to check if %s is an admin: %v", user.MXID, err)
+		return false
+	}
+	return levels.GetUserLevel(user.MXID) >= levels.GetEventLevel(event.StatePowerLevels)
+}
@@ -0,0 +1,192 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+var (
+	errSlackUnavailable = errors.New("the Slack API is currently failing, the message will be sent when it recovers")
+	errSlackCircuitOpen = errors.New("the Slack API is currently failing")
+)
+
+// Slack error codes that mean the API as a whole is unusable for the team,
+// as opposed to errors caused by the specific request.
+var slackAPIFailureCodes = map[string]bool{
+	"invalid_auth":        true,
+	"not_authed":          true,
+	"token_revoked":       true,
+	"token_expired":       true,
+	"account_inactive":    true,
+	"fatal_error":         true,
+	"internal_error":      true,
+	"request_timeout":     true,
+	"service_unavailable": true,
+}
+
+func isSlackAPIFailure(err error) bool {
+	var statusErr slack.StatusCodeError
+	var slackErr slack.SlackErrorResponse
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &statusErr):
+		return statusErr.Code >= 500
+	case errors.As(err, &slackErr):
+		return slackAPIFailureCodes[slackErr.Err]
+	case errors.As(err, &netErr):
+		return true
+	default:
+		return false
+	}
+}
+
+// circuitBreaker tracks consecutive API failures of a userteam. Once too many
+// requests have failed, the breaker opens: outgoing messages wait instead of
+// being sent, and the API is probed periodically until it works again.
+type circuitBreaker struct {
+	bridge *SlackBridge
+	log    log.Logger
+
+	lock     sync.Mutex
+	userTeam *database.UserTeam
+	failures int
+	open     bool
+	closed   chan struct{}
+}
+
+func (br *SlackBridge) getCircuitBreaker(userTeam *database.UserTeam) *circuitBreaker {
+	br.circuitBreakersLock.Lock()
+	defer br.circuitBreakersLock.Unlock()
+
+	key := userTeam.Key.String()
+	breaker, ok := br.circuitBreakers[key]
+	if !ok {
+		breaker = &circuitBreaker{
+			bridge: br,
+			log:    br.Log.Sub("CircuitBreaker").Sub(key),
+		}
+		br.circuitBreakers[key] = breaker
+	}
+	// The userteam object is replaced on re-login, so always probe with the latest one.
+	breaker.lock.Lock()
+	breaker.userTeam = userTeam
+	breaker.lock.Unlock()
+	return breaker
+}
+
+func (cb *circuitBreaker) getUserTeam() *database.UserTeam {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.userTeam
+}
+
+func (cb *circuitBreaker) IsOpen() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.open
+}
+
+// Wait blocks until the breaker is closed. If the context doesn't have a
+// deadline, it fails immediately instead of waiting for an unknown amount of time.
+func (cb *circuitBreaker) Wait(ctx context.Context) error {
+	cb.lock.Lock()
+	if !cb.open {
+		cb.lock.Unlock()
+		return nil
+	}
+	closed := cb.closed
+	cb.lock.Unlock()
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		return errSlackCircuitOpen
+	}
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Record updates the breaker with the result of an API call.
+func (cb *circuitBreaker) Record(err error) {
+	threshold := cb.bridge.bridgeConfig().CircuitBreaker.FailureThreshold
+	if threshold <= 0 {
+		return
+	}
+	if err == nil {
+		cb.reset()
+		return
+	} else if !isSlackAPIFailure(err) {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.failures++
+	if !cb.open && cb.failures >= threshold {
+		cb.log.Warnfln("Pausing outgoing messages after %d consecutive Slack API failures (last error: %v)", cb.failures, err)
+		cb.open = true
+		cb.closed = make(chan struct{})
+		go cb.probeLoop()
+	}
+}
+
+func (cb *circuitBreaker) reset() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.failures = 0
+	if cb.open {
+		cb.log.Infoln("Slack API is working again, resuming outgoing messages")
+		cb.open = false
+		close(cb.closed)
+	}
+}
+
+func (cb *circuitBreaker) probeLoop() {
+	ticker := time.NewTicker(cb.bridge.bridgeConfig().CircuitBreaker.ProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !cb.IsOpen() {
+			return
+		}
+		client := cb.getUserTeam().Client
+		if client == nil {
+			// The userteam was logged out, there's nothing left to wait for.
+			cb.reset()
+			return
+		}
+		_, err := client.AuthTest()
+		if err == nil {
+			cb.reset()
+			return
+		}
+		cb.log.Debugln("Slack API probe failed:", err)
+	}
+}
@@ -0,0 +1,119 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const clipInfoTimeout = 30 * time.Second
+
+// slackClipInfo contains the fields of a Slack file that are only present for
+// audio and video clips recorded in the Slack client. They're missing from the
+// File struct in slack-go, so they're fetched separately from files.info.
+type slackClipInfo struct {
+	Subtype          string `json:"subtype"`
+	MediaDisplayType string `json:"media_display_type"`
+	DurationMS       int    `json:"duration_ms"`
+	Transcription    struct {
+		Status  string `json:"status"`
+		Locale  string `json:"locale"`
+		Preview struct {
+			Content string `json:"content"`
+			HasMore bool   `json:"has_more"`
+		} `json:"preview"`
+	} `json:"transcription"`
+}
+
+type slackClipInfoResponse struct {
+	slack.SlackResponse
+	File slackClipInfo `json:"file"`
+}
+
+func (info *slackClipInfo) IsClip() bool {
+	return info.Subtype == "slack_audio" || info.Subtype == "slack_video"
+}
+
+func (info *slackClipInfo) IsAudio() bool {
+	return info.Subtype == "slack_audio" || info.MediaDisplayType == "audio"
+}
+
+func (info *slackClipInfo) Transcript() string {
+	if info.Transcription.Status != "complete" {
+		return ""
+	}
+	transcript := strings.TrimSpace(info.Transcription.Preview.Content)
+	if transcript != "" && info.Transcription.Preview.HasMore {
+		transcript += "…"
+	}
+	return transcript
+}
+
+func (portal *Portal) getSlackClipInfo(userTeam *database.UserTeam, fileID string) (*slackClipInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clipInfoTimeout)
+	defer cancel()
+	var resp slackClipInfoResponse
+	// The external uploader already knows how to make raw authenticated API calls
+	err := portal.newExternalUploader(userTeam).callMethod(ctx, "files.info", url.Values{"file": {fileID}}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.File, nil
+}
+
+// convertSlackClip turns audio and video clips recorded in Slack into Matrix
+// voice messages and videos with durations, and adds the transcript Slack
+// generated for the clip as a caption. Other files are left unchanged.
+func (portal *Portal) convertSlackClip(userTeam *database.UserTeam, file *slack.File, content *event.MessageEventContent) map[string]interface{} {
+	if !strings.HasPrefix(file.Mimetype, "audio/") && !strings.HasPrefix(file.Mimetype, "video/") {
+		return nil
+	}
+	info, err := portal.getSlackClipInfo(userTeam, file.ID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get clip info for file %s: %v", file.ID, err)
+		return nil
+	} else if !info.IsClip() {
+		return nil
+	}
+	content.Info.Duration = info.DurationMS
+	var extra map[string]interface{}
+	if info.IsAudio() {
+		content.MsgType = event.MsgAudio
+		extra = map[string]interface{}{
+			"org.matrix.msc1767.audio": map[string]interface{}{
+				"duration": info.DurationMS,
+			},
+			"org.matrix.msc3245.voice": map[string]interface{}{},
+		}
+	} else {
+		content.MsgType = event.MsgVideo
+	}
+	if transcript := info.Transcript(); transcript != "" && portal.bridge.bridgeConfig().Media.ClipTranscripts {
+		// Clients that support captions (MSC2530) show the body as the caption when the filename is set separately
+		content.FileName = content.Body
+		content.Body = transcript
+	}
+	return extra
+}
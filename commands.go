@@ -17,11 +17,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/config"
+	"go.mau.fi/mautrix-slack/database"
+)
+
+var (
+	HelpSectionPortalManagement = commands.HelpSection{Name: "Portal management", Order: 20}
 )
 
 type WrappedCommandEvent struct {
@@ -29,6 +46,25 @@ type WrappedCommandEvent struct {
 	Bridge *SlackBridge
 	User   *User
 	Portal *Portal
+
+	usageError bool
+}
+
+// ReplyUsage replies with a usage hint. Commands answered with one don't keep
+// their cooldown, as they didn't actually run.
+func (ce *WrappedCommandEvent) ReplyUsage(msg string, args ...interface{}) {
+	ce.usageError = true
+	ce.Reply(msg, args...)
+}
+
+// checkRoomAdmin checks that the user is allowed to change the settings of the
+// portal, and replies with an error if not.
+func (ce *WrappedCommandEvent) checkRoomAdmin() bool {
+	if ce.Portal.isRoomAdmin(ce.User) {
+		return true
+	}
+	ce.Reply("Only room admins can change the settings of this room.")
+	return false
 }
 
 func (br *SlackBridge) RegisterCommands() {
@@ -39,7 +75,39 @@ func (br *SlackBridge) RegisterCommands() {
 		cmdLoginToken,
 		cmdLogout,
 		cmdSyncTeams,
+		cmdList,
+		cmdCreateChannel,
+		cmdInvite,
+		cmdWhois,
+		cmdSetStatus,
+		cmdClearStatus,
+		cmdDND,
+		cmdAPIConcurrency,
+		cmdStats,
+		cmdToggle,
+		cmdRotation,
+		cmdTimeouts,
+		cmdBroadcast,
+		cmdMediaPolicy,
+		cmdRelayTemplate,
+		cmdThreadMode,
+		cmdEditHistory,
+		cmdUnfurl,
+		cmdNoticePolicy,
+		cmdRetention,
+		cmdTranslate,
+		cmdSummary,
+		cmdRetry,
+		cmdSave,
 		cmdDeletePortal,
+		cmdDeleteAllPortals,
+		cmdReplayEvent,
+		cmdDBMaintenance,
+		cmdAuditLog,
+		cmdReloadConfig,
+		cmdMigrateGhosts,
+		cmdDoctor,
+		cmdAPIStats,
 	)
 }
 
@@ -51,7 +119,38 @@ func wrapCommand(handler func(*WrappedCommandEvent)) func(*commands.Event) {
 			portal = ce.Portal.(*Portal)
 		}
 		br := ce.Bridge.Child.(*SlackBridge)
-		handler(&WrappedCommandEvent{ce, br, user, portal})
+
+		name := ce.Command
+		if fh, ok := ce.Handler.(*commands.FullHandler); ok {
+			name = fh.Name
+		}
+		if level, ok := br.bridgeConfig().CommandPermissions[name]; ok && user.PermissionLevel < level {
+			ce.Reply("You don't have permission to use that command.")
+			return
+		}
+		remaining, release := user.reserveCommand(name)
+		if remaining > 0 {
+			ce.Reply("That command is on cooldown, try again in %s.", remaining.Round(time.Second))
+			return
+		}
+
+		if fh, ok := ce.Handler.(*commands.FullHandler); ok && fh.RequiresAdmin {
+			var target string
+			if portal != nil {
+				target = portal.Key.String()
+			}
+			br.audit(user.MXID, "command", target, map[string]string{
+				"command": name,
+				"args":    strings.Join(ce.Args, " "),
+				"room_id": ce.RoomID.String(),
+			})
+		}
+
+		wce := &WrappedCommandEvent{Event: ce, Bridge: br, User: user, Portal: portal}
+		handler(wce)
+		if wce.usageError {
+			release()
+		}
 	}
 }
 
@@ -94,7 +193,7 @@ var cmdLoginPassword = &commands.FullHandler{
 
 func fnLoginPassword(ce *WrappedCommandEvent) {
 	if len(ce.Args) != 3 {
-		ce.Reply("**Usage**: $cmdprefix login-password <email> <domain> <password>")
+		ce.ReplyUsage("**Usage**: $cmdprefix login-password <email> <domain> <password>")
 		return
 	}
 
@@ -126,7 +225,7 @@ var cmdLoginToken = &commands.FullHandler{
 
 func fnLoginToken(ce *WrappedCommandEvent) {
 	if len(ce.Args) != 2 {
-		ce.Reply("**Usage**: $cmdprefix login-token <token> <cookieToken>")
+		ce.ReplyUsage("**Usage**: $cmdprefix login-token <token> <cookieToken>")
 		return
 	}
 
@@ -154,7 +253,7 @@ var cmdLogout = &commands.FullHandler{
 
 func fnLogout(ce *WrappedCommandEvent) {
 	if len(ce.Args) != 2 {
-		ce.Reply("**Usage**: $cmdprefix logout <email> <domain>")
+		ce.ReplyUsage("**Usage**: $cmdprefix logout <email> <domain>")
 
 		return
 	}
@@ -186,14 +285,1807 @@ func fnSyncTeams(ce *WrappedCommandEvent) {
 	ce.Reply("Done syncing teams.")
 }
 
-var cmdDeletePortal = &commands.FullHandler{
-	Func:           wrapCommand(fnDeletePortal),
-	Name:           "delete-portal",
+var cmdList = &commands.FullHandler{
+	Func:    wrapCommand(fnList),
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "List your Slack conversations and whether they're bridged",
+		Args:        "[--unbridged] [--prefix <prefix>] [page]",
+	},
+	RequiresLogin: true,
+}
+
+const listPageSize = 50
+
+type listEntry struct {
+	name   string
+	kind   string
+	team   string
+	portal *database.Portal
+}
+
+func (ce *WrappedCommandEvent) conversationName(userTeam *database.UserTeam, channel *slack.Channel) string {
+	if channel.IsIM {
+		puppet := ce.Bridge.GetPuppetByID(userTeam.Key.TeamID, channel.User)
+		if puppet.Name != "" {
+			return puppet.Name
+		}
+		return channel.User
+	} else if channel.IsMpIM {
+		return strings.TrimPrefix(channel.Name, "mpdm-")
+	}
+	return "#" + channel.Name
+}
+
+func fnList(ce *WrappedCommandEvent) {
+	var onlyUnbridged bool
+	var prefix string
+	page := 1
+	for i := 0; i < len(ce.Args); i++ {
+		switch arg := ce.Args[i]; {
+		case arg == "--unbridged":
+			onlyUnbridged = true
+		case arg == "--prefix" && i+1 < len(ce.Args):
+			i++
+			prefix = strings.ToLower(strings.TrimPrefix(ce.Args[i], "#"))
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(arg, "--prefix="), "#"))
+		default:
+			var err error
+			page, err = strconv.Atoi(arg)
+			if err != nil || page < 1 {
+				ce.ReplyUsage("**Usage**: $cmdprefix list [--unbridged] [--prefix <prefix>] [page]")
+				return
+			}
+		}
+	}
+
+	var entries []listEntry
+	for _, userTeam := range ce.User.GetLoggedInTeams() {
+		if userTeam.Client == nil {
+			ce.Reply("Not connected to team %s, skipping it", userTeam.TeamName)
+			continue
+		}
+		channels, err := ce.User.getConversations(userTeam, "public_channel", "private_channel", "mpim", "im")
+		if err != nil {
+			ce.Reply("Failed to fetch conversations in %s: %v", userTeam.TeamName, err)
+			if len(channels) == 0 {
+				continue
+			}
+		}
+		for i := range channels {
+			channel := &channels[i]
+			entry := listEntry{
+				name: ce.conversationName(userTeam, channel),
+				team: userTeam.TeamName,
+			}
+			switch {
+			case channel.IsIM:
+				entry.kind = "DM"
+			case channel.IsMpIM:
+				entry.kind = "group DM"
+			case channel.IsPrivate:
+				entry.kind = "private channel"
+			default:
+				entry.kind = "channel"
+			}
+			if prefix != "" && !strings.HasPrefix(strings.ToLower(strings.TrimPrefix(entry.name, "#")), prefix) {
+				continue
+			}
+			entry.portal = ce.Bridge.DB.Portal.GetByID(database.NewPortalKey(userTeam.Key.TeamID, channel.ID))
+			if entry.portal != nil && entry.portal.MXID == "" {
+				entry.portal = nil
+			}
+			if onlyUnbridged && entry.portal != nil {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(entries) == 0 {
+		ce.Reply("No matching conversations found.")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].team != entries[j].team {
+			return entries[i].team < entries[j].team
+		}
+		return strings.ToLower(entries[i].name) < strings.ToLower(entries[j].name)
+	})
+
+	maxPage := (len(entries) + listPageSize - 1) / listPageSize
+	if page > maxPage {
+		ce.Reply("Page %d doesn't exist, there are only %d pages", page, maxPage)
+		return
+	}
+	start := (page - 1) * listPageSize
+	end := start + listPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("Conversations (page %d of %d, %d total):\n\n", page, maxPage, len(entries)))
+	for _, entry := range entries[start:end] {
+		text.WriteString(fmt.Sprintf("* %s (%s in %s)", entry.name, entry.kind, entry.team))
+		if entry.portal != nil {
+			text.WriteString(fmt.Sprintf(" - [bridged](https://matrix.to/#/%s)", entry.portal.MXID))
+		} else {
+			text.WriteString(" - not bridged")
+		}
+		text.WriteRune('\n')
+	}
+	if page < maxPage {
+		nextArgs := []string{ce.Bridge.bridgeConfig().CommandPrefix, "list"}
+		if onlyUnbridged {
+			nextArgs = append(nextArgs, "--unbridged")
+		}
+		if prefix != "" {
+			nextArgs = append(nextArgs, "--prefix", prefix)
+		}
+		nextArgs = append(nextArgs, strconv.Itoa(page+1))
+		text.WriteString(fmt.Sprintf("\nUse `%s` to see the next page.", strings.Join(nextArgs, " ")))
+	}
+	ce.Reply("%s", text.String())
+}
+
+// getUserTeam finds the Slack team a command should act on: the portal's team
+// when the command is ran in a portal, otherwise the team with the given domain
+// or the user's only logged-in team.
+func (ce *WrappedCommandEvent) getUserTeam(domain string) *database.UserTeam {
+	if ce.Portal != nil {
+		return ce.User.GetUserTeam(ce.Portal.Key.TeamID)
+	}
+	teams := ce.User.GetLoggedInTeams()
+	if domain == "" {
+		if len(teams) == 1 {
+			return teams[0]
+		}
+		return nil
+	}
+	domain = strings.TrimSuffix(domain, ".slack.com")
+	for _, userTeam := range teams {
+		teamInfo := ce.Bridge.DB.TeamInfo.GetBySlackTeam(userTeam.Key.TeamID)
+		if teamInfo != nil && teamInfo.TeamDomain == domain {
+			return userTeam
+		}
+	}
+	return nil
+}
+
+var slackUserIDRegex = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
+
+// resolveSlackUser finds a Slack user by their ghost's Matrix ID, their Slack
+// user ID or their Slack handle (with or without the leading @).
+func (ce *WrappedCommandEvent) resolveSlackUser(userTeam *database.UserTeam, query string) (*slack.User, error) {
+	query = strings.TrimPrefix(query, "https://matrix.to/#/")
+	if strings.HasPrefix(query, "@") && strings.ContainsRune(query, ':') {
+		teamID, userID, ok := ce.Bridge.ParsePuppetMXID(id.UserID(query))
+		if !ok {
+			return nil, fmt.Errorf("%s is not a Slack user", query)
+		} else if !strings.EqualFold(teamID, userTeam.Key.TeamID) {
+			return nil, fmt.Errorf("%s is not in the same Slack team", query)
+		}
+		return userTeam.Client.GetUserInfo(strings.ToUpper(userID))
+	} else if slackUserIDRegex.MatchString(query) {
+		return userTeam.Client.GetUserInfo(query)
+	}
+
+	handle := strings.ToLower(strings.TrimPrefix(query, "@"))
+	users, err := userTeam.Client.GetUsers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user list: %w", err)
+	}
+	for i, user := range users {
+		if strings.ToLower(user.Name) == handle || strings.ToLower(user.Profile.DisplayName) == handle {
+			return &users[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no user found with handle @%s", handle)
+}
+
+var cmdCreateChannel = &commands.FullHandler{
+	Func: wrapCommand(fnCreateChannel),
+	Name: "create-channel",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Create a new Slack channel and a portal for it",
+		Args:        "[--private] <name> [team domain]",
+	},
+	RequiresLogin: true,
+}
+
+func fnCreateChannel(ce *WrappedCommandEvent) {
+	args := ce.Args
+	isPrivate := len(args) > 0 && args[0] == "--private"
+	if isPrivate {
+		args = args[1:]
+	}
+	if len(args) < 1 || len(args) > 2 {
+		ce.ReplyUsage("**Usage**: $cmdprefix create-channel [--private] <name> [team domain]")
+		return
+	}
+	var domain string
+	if len(args) == 2 {
+		domain = args[1]
+	}
+	userTeam := ce.getUserTeam(domain)
+	if userTeam == nil {
+		ce.Reply("Couldn't figure out which team to create the channel in, please specify the team domain")
+		return
+	} else if userTeam.Client == nil {
+		ce.Reply("You're not connected to that Slack team")
+		return
+	}
+
+	name := strings.TrimPrefix(args[0], "#")
+	channel, err := userTeam.Client.CreateConversation(name, isPrivate)
+	if err != nil {
+		ce.Reply("Failed to create channel: %v", err)
+		return
+	}
+
+	portal := ce.Bridge.GetPortalByID(database.NewPortalKey(userTeam.Key.TeamID, channel.ID))
+	err = portal.CreateMatrixRoom(ce.User, userTeam, channel, false)
+	if err != nil {
+		ce.Reply("Created #%s on Slack, but failed to create portal: %v", channel.Name, err)
+		return
+	}
+	ce.Reply("Created #%s and its portal [%s](https://matrix.to/#/%s)", channel.Name, portal.Name, portal.MXID)
+}
+
+var cmdInvite = &commands.FullHandler{
+	Func: wrapCommand(fnInvite),
+	Name: "invite",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Invite Slack users to the channel of this portal",
+		Args:        "<_ghost mention_|@_handle_> ...",
+	},
+	RequiresLogin:  true,
 	RequiresPortal: true,
 }
 
-func fnDeletePortal(ce *WrappedCommandEvent) {
-	ce.Portal.delete()
-	ce.Portal.cleanup(false)
-	ce.Log.Infofln("Deleted portal")
+func fnInvite(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.ReplyUsage("**Usage**: $cmdprefix invite <ghost mention|@handle> ...")
+		return
+	} else if ce.Portal.Type != database.ChannelTypeChannel {
+		ce.Reply("Users can only be invited to channels")
+		return
+	}
+	userTeam := ce.User.GetUserTeam(ce.Portal.Key.TeamID)
+	if userTeam == nil || userTeam.Client == nil {
+		ce.Reply("You're not connected to the Slack team of this portal")
+		return
+	}
+
+	var userIDs []string
+	var names []string
+	for _, arg := range ce.Args {
+		user, err := ce.resolveSlackUser(userTeam, arg)
+		if err != nil {
+			ce.Reply("Failed to find %s: %v", arg, err)
+			return
+		}
+		userIDs = append(userIDs, user.ID)
+		names = append(names, "@"+user.Name)
+	}
+
+	_, err := userTeam.Client.InviteUsersToConversation(ce.Portal.Key.ChannelID, userIDs...)
+	if err != nil {
+		ce.Reply("Failed to invite users: %v", err)
+		return
+	}
+	for _, userID := range userIDs {
+		puppet := ce.Bridge.GetPuppetByID(userTeam.Key.TeamID, userID)
+		puppet.UpdateInfo(userTeam, nil)
+		if err = puppet.IntentFor(ce.Portal).EnsureJoined(ce.Portal.MXID); err != nil {
+			ce.Portal.log.Warnfln("Failed to make puppet of %s join %s: %v", userID, ce.Portal.MXID, err)
+		}
+	}
+	ce.Reply("Invited %s", strings.Join(names, ", "))
+}
+
+var cmdWhois = &commands.FullHandler{
+	Func:    wrapCommand(fnWhois),
+	Name:    "whois",
+	Aliases: []string{"profile"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show the Slack profile of a user",
+		Args:        "<_ghost mention_|@_handle_> [team domain]",
+	},
+	RequiresLogin: true,
+}
+
+func fnWhois(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 1 || len(ce.Args) > 2 {
+		ce.ReplyUsage("**Usage**: $cmdprefix whois <ghost mention|@handle> [team domain]")
+		return
+	}
+	var domain string
+	if len(ce.Args) == 2 {
+		domain = ce.Args[1]
+	}
+	userTeam := ce.getUserTeam(domain)
+	if userTeam == nil || userTeam.Client == nil {
+		ce.Reply("Couldn't determine which Slack team to use, please specify the team domain")
+		return
+	}
+	user, err := ce.resolveSlackUser(userTeam, ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to find user: %v", err)
+		return
+	}
+
+	var text strings.Builder
+	name := user.Profile.RealName
+	if name == "" {
+		name = user.RealName
+	}
+	puppet := ce.Bridge.GetPuppetByID(userTeam.Key.TeamID, user.ID)
+	_, _ = fmt.Fprintf(&text, "**%s** (@%s, [%s](https://matrix.to/#/%s))\n\n", name, user.Name, user.ID, puppet.MXID)
+	if user.Profile.DisplayName != "" && user.Profile.DisplayName != name {
+		_, _ = fmt.Fprintf(&text, "* Display name: %s\n", user.Profile.DisplayName)
+	}
+	if user.Profile.Title != "" {
+		_, _ = fmt.Fprintf(&text, "* Title: %s\n", user.Profile.Title)
+	}
+	if user.Profile.Email != "" {
+		_, _ = fmt.Fprintf(&text, "* Email: %s\n", user.Profile.Email)
+	}
+	if user.Profile.Phone != "" {
+		_, _ = fmt.Fprintf(&text, "* Phone: %s\n", user.Profile.Phone)
+	}
+	if user.Profile.StatusText != "" || user.Profile.StatusEmoji != "" {
+		status := strings.TrimSpace(shortcodeToEmoji(user.Profile.StatusEmoji) + " " + user.Profile.StatusText)
+		if user.Profile.StatusExpiration > 0 {
+			status += fmt.Sprintf(" (until %s)", time.Unix(int64(user.Profile.StatusExpiration), 0).UTC().Format(time.RFC1123))
+		}
+		_, _ = fmt.Fprintf(&text, "* Status: %s\n", status)
+	}
+	if user.TZ != "" {
+		loc, err := time.LoadLocation(user.TZ)
+		if err != nil {
+			loc = time.FixedZone(user.TZLabel, user.TZOffset)
+		}
+		_, _ = fmt.Fprintf(&text, "* Timezone: %s (local time %s)\n", user.TZLabel, time.Now().In(loc).Format("Mon 15:04"))
+	}
+	switch {
+	case user.Deleted:
+		text.WriteString("* Account deactivated\n")
+	case user.IsBot:
+		text.WriteString("* Bot user\n")
+	case user.IsPrimaryOwner:
+		text.WriteString("* Primary owner of the workspace\n")
+	case user.IsOwner:
+		text.WriteString("* Owner of the workspace\n")
+	case user.IsAdmin:
+		text.WriteString("* Admin of the workspace\n")
+	case user.IsUltraRestricted:
+		text.WriteString("* Single-channel guest\n")
+	case user.IsRestricted:
+		text.WriteString("* Multi-channel guest\n")
+	}
+	ce.Reply("%s", text.String())
+}
+
+var cmdSetStatus = &commands.FullHandler{
+	Func: wrapCommand(fnSetStatus),
+	Name: "set-status",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Set your Slack custom status. With `--auto`, the status is also set automatically whenever the bridge connects and you don't have another status.",
+		Args:        "[--auto] [--for <_duration_>] [_emoji_] <_text_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetStatus(ce *WrappedCommandEvent) {
+	args := ce.Args
+	var auto bool
+	var expiration int64
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if args[0] == "--auto" {
+			auto = true
+			args = args[1:]
+		} else if args[0] == "--for" && len(args) > 1 {
+			duration, err := time.ParseDuration(args[1])
+			if err != nil || duration <= 0 {
+				ce.Reply("Invalid duration %q, use something like `30m` or `2h`", args[1])
+				return
+			}
+			expiration = time.Now().Add(duration).Unix()
+			args = args[2:]
+		} else {
+			break
+		}
+	}
+	if len(args) == 0 || (auto && expiration != 0) {
+		ce.ReplyUsage("**Usage**: $cmdprefix set-status [--auto] [--for <duration>] [emoji] <text>")
+		return
+	}
+
+	var emoji string
+	if strings.HasPrefix(args[0], ":") && strings.HasSuffix(args[0], ":") && len(args[0]) > 2 {
+		emoji = args[0]
+		args = args[1:]
+	} else if shortcode := emojiToShortcode(args[0]); shortcode != "" {
+		emoji = ":" + shortcode + ":"
+		args = args[1:]
+	}
+	text := strings.Join(args, " ")
+
+	if auto {
+		ce.User.AutoStatusText = text
+		ce.User.AutoStatusEmoji = emoji
+		ce.User.Update()
+	}
+	for _, userTeam := range ce.User.GetLoggedInTeams() {
+		if userTeam.Client == nil {
+			ce.Reply("Not connected to %s, status wasn't set there", userTeam.TeamName)
+			continue
+		}
+		err := userTeam.Client.SetUserCustomStatus(text, emoji, expiration)
+		if err != nil {
+			ce.Reply("Failed to set status in %s: %v", userTeam.TeamName, err)
+		}
+	}
+	if auto {
+		ce.Reply("Status set, and it will be set automatically in the future.")
+	} else {
+		ce.Reply("Status set.")
+	}
+}
+
+var cmdClearStatus = &commands.FullHandler{
+	Func: wrapCommand(fnClearStatus),
+	Name: "clear-status",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Clear your Slack custom status. With `--auto`, also stop setting it automatically.",
+		Args:        "[--auto]",
+	},
+	RequiresLogin: true,
+}
+
+func fnClearStatus(ce *WrappedCommandEvent) {
+	if len(ce.Args) > 0 && ce.Args[0] == "--auto" {
+		ce.User.AutoStatusText = ""
+		ce.User.AutoStatusEmoji = ""
+		ce.User.Update()
+	}
+	for _, userTeam := range ce.User.GetLoggedInTeams() {
+		if userTeam.Client == nil {
+			ce.Reply("Not connected to %s, status wasn't cleared there", userTeam.TeamName)
+			continue
+		}
+		err := userTeam.Client.UnsetUserCustomStatus()
+		if err != nil {
+			ce.Reply("Failed to clear status in %s: %v", userTeam.TeamName, err)
+		}
+	}
+	ce.Reply("Status cleared.")
+}
+
+var cmdDND = &commands.FullHandler{
+	Func: wrapCommand(fnDND),
+	Name: "dnd",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Snooze Slack notifications for the given duration, end the snooze with `off`, or show the current snooze status.",
+		Args:        "[_duration_ | off]",
+	},
+	RequiresLogin: true,
+}
+
+func fnDND(ce *WrappedCommandEvent) {
+	var minutes int
+	if len(ce.Args) > 0 && ce.Args[0] != "off" {
+		duration, err := time.ParseDuration(ce.Args[0])
+		if err != nil || duration < time.Minute {
+			ce.Reply("Invalid duration %q, use something like `30m` or `2h`", ce.Args[0])
+			return
+		}
+		minutes = int(duration / time.Minute)
+	}
+	for _, userTeam := range ce.User.GetLoggedInTeams() {
+		if userTeam.Client == nil {
+			ce.Reply("Not connected to %s", userTeam.TeamName)
+			continue
+		}
+		var status *slack.DNDStatus
+		var err error
+		if len(ce.Args) == 0 {
+			status, err = userTeam.Client.GetDNDInfo(nil)
+		} else if minutes == 0 {
+			status, err = userTeam.Client.EndSnooze()
+		} else {
+			status, err = userTeam.Client.SetSnooze(minutes)
+		}
+		if err != nil {
+			ce.Reply("Failed to update snooze in %s: %v", userTeam.TeamName, err)
+		} else if status.SnoozeEnabled {
+			ce.Reply("Notifications are snoozed in %s until %s", userTeam.TeamName, formatSnoozeEnd(status))
+		} else {
+			ce.Reply("Notifications aren't snoozed in %s", userTeam.TeamName)
+		}
+	}
+}
+
+var cmdAPIConcurrency = &commands.FullHandler{
+	Func: wrapCommand(fnAPIConcurrency),
+	Name: "api-concurrency",
+	Help: commands.HelpMeta{
+		Section: commands.HelpSectionGeneral,
+		Description: "Show or change how many Slack API calls the bridge can make for you at once. " +
+			"Lower values make big syncs and backfills slower, use `default` to go back to the bridge config. The limit can't be raised above the bridge config.",
+		Args: "[_number_ | default]",
+	},
+}
+
+func fnAPIConcurrency(ce *WrappedCommandEvent) {
+	if len(ce.Args) > 0 {
+		if strings.ToLower(ce.Args[0]) == "default" {
+			ce.User.APIConcurrency = 0
+		} else if limit, err := strconv.Atoi(ce.Args[0]); err != nil || limit < 1 {
+			ce.ReplyUsage("**Usage**: $cmdprefix api-concurrency [number | default]")
+			return
+		} else if maxCalls := ce.Bridge.bridgeConfig().APIConcurrency.MaxCalls; maxCalls > 0 && limit > maxCalls {
+			ce.Reply("The limit can't be higher than %d, the maximum set in the bridge config.", maxCalls)
+			return
+		} else {
+			ce.User.APIConcurrency = limit
+		}
+		ce.User.Update()
+	}
+	total, background := ce.User.apiLimiter.limits()
+	if total <= 0 {
+		ce.Reply("The number of concurrent Slack API calls isn't limited.")
+	} else {
+		ce.Reply("The bridge makes at most %d Slack API calls for you at once, %d of which can be used by background jobs.", total, background)
+	}
+}
+
+var cmdStats = &commands.FullHandler{
+	Func: wrapCommand(fnStats),
+	Name: "stats",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show how much the bridge has bridged for you. Bridge admins can view the stats of other users and reset them.",
+		Args:        "[_Matrix user ID_] [reset]",
+	},
+}
+
+func fnStats(ce *WrappedCommandEvent) {
+	if !ce.Bridge.bridgeConfig().UsageStats {
+		ce.Reply("Usage stats are disabled in the bridge config.")
+		return
+	}
+	args, reset := hasFlag(ce.Args, "reset")
+	target := ce.User.MXID
+	if reset && ce.User.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+		ce.Reply("Only bridge admins can reset usage stats.")
+		return
+	} else if len(args) > 0 {
+		if ce.User.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+			ce.Reply("Only bridge admins can view the stats of other users.")
+			return
+		}
+		target = id.UserID(args[0])
+	}
+	if reset {
+		ce.Bridge.DB.UserStats.Reset(target)
+		ce.Reply("Usage stats of %s were reset.", target)
+		return
+	}
+	stats := ce.Bridge.DB.UserStats.Get(target)
+	if stats == nil {
+		ce.Reply("Failed to get usage stats, check the bridge logs for details.")
+		return
+	}
+	ce.Reply("%s", formatUserStats(stats))
+}
+
+var cmdToggle = &commands.FullHandler{
+	Func: wrapCommand(fnToggle),
+	Name: "toggle",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Toggle a bridging setting for this room only, or show the current settings.",
+		Args:        "[relay | error-notices | bot-messages | join-leave | require-verification | read-only]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func onOff(value bool) string {
+	if value {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func fnToggle(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		relay := "disabled"
+		if portal.HasRelaybot() {
+			relay = fmt.Sprintf("enabled (through %s)", portal.RelayUserID)
+		}
+		ce.Reply("Settings for this room:\n\n"+
+			"* **relay**: %s\n"+
+			"* **error-notices**: %s\n"+
+			"* **bot-messages**: %s\n"+
+			"* **join-leave**: %s\n"+
+			"* **require-verification**: %s\n"+
+			"* **read-only**: %s",
+			relay, onOff(portal.ErrorNotices), onOff(portal.BridgeBotMessages), onOff(portal.BridgeJoinLeave),
+			onOff(portal.RequireVerification), onOff(portal.ReadOnly))
+		return
+	}
+	// The relay user can always disable relay mode again, all other settings need room admin power
+	disablingOwnRelay := strings.ToLower(ce.Args[0]) == "relay" && portal.RelayUserID == ce.User.MXID
+	if !disablingOwnRelay && !ce.checkRoomAdmin() {
+		return
+	}
+
+	var setting, note string
+	var value bool
+	switch strings.ToLower(ce.Args[0]) {
+	case "relay":
+		relayConfig := ce.Bridge.getTeamConfig(portal.Key.TeamID).Relay
+		if portal.RelayUserID != "" {
+			portal.RelayUserID = ""
+		} else if !relayConfig.Enabled {
+			ce.Reply("Relay mode is disabled for this Slack team in the bridge config")
+			return
+		} else if relayConfig.AdminOnly && ce.User.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+			ce.Reply("Only bridge admins can enable relay mode for this Slack team")
+			return
+		} else if ce.User.GetUserTeam(portal.Key.TeamID) == nil {
+			ce.Reply("You must be logged into the Slack team of this room to become its relay user")
+			return
+		} else {
+			portal.RelayUserID = ce.User.MXID
+		}
+		setting, value = "Relay mode", portal.HasRelaybot()
+	case "error-notices":
+		portal.ErrorNotices = !portal.ErrorNotices
+		setting, value = "Error notices", portal.ErrorNotices
+		if value && !ce.Bridge.bridgeConfig().MessageErrorNotices {
+			note = " Note that error notices are disabled in the bridge config, so none will be sent."
+		}
+	case "bot-messages":
+		portal.BridgeBotMessages = !portal.BridgeBotMessages
+		setting, value = "Bridging bot messages", portal.BridgeBotMessages
+	case "join-leave":
+		portal.BridgeJoinLeave = !portal.BridgeJoinLeave
+		setting, value = "Bridging joins and leaves", portal.BridgeJoinLeave
+	case "require-verification":
+		portal.RequireVerification = !portal.RequireVerification
+		setting, value = "Requiring verified devices", portal.RequireVerification
+		if value && !portal.Encrypted {
+			note = " Note that this room isn't encrypted, so this has no effect until encryption is enabled."
+		}
+	case "read-only":
+		portal.ReadOnly = !portal.ReadOnly
+		setting, value = "Read-only mode", portal.ReadOnly
+		if !value && portal.isReadOnly() {
+			note = " Note that this room is still read-only because of the bridge config."
+		}
+	default:
+		ce.ReplyUsage("Unknown setting `%s`. Usage: `$cmdprefix toggle [relay | error-notices | bot-messages | join-leave | require-verification | read-only]`", ce.Args[0])
+		return
+	}
+	portal.Update(nil)
+	ce.Reply("%s is now %s in this room.%s", setting, onOff(value), note)
+}
+
+var cmdRotation = &commands.FullHandler{
+	Func: wrapCommand(fnRotation),
+	Name: "rotation",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Show or change how often the encryption session of this room is rotated. Use `default` to go back to the bridge config.",
+		Args:        "[period <_duration_ | default>] [messages <_count_ | default>]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRotation(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		content := portal.getEncryptionEventContent()
+		period, messages := "not set", "not set"
+		if content.RotationPeriodMillis > 0 {
+			period = (time.Duration(content.RotationPeriodMillis) * time.Millisecond).String()
+		}
+		if content.RotationPeriodMessages > 0 {
+			messages = strconv.Itoa(content.RotationPeriodMessages)
+		}
+		ce.Reply("Encryption session rotation in this room:\n\n"+
+			"* **period**: %s\n"+
+			"* **messages**: %s", period, messages)
+		return
+	} else if len(ce.Args)%2 != 0 {
+		ce.ReplyUsage("**Usage**: $cmdprefix rotation [period <duration | default>] [messages <count | default>]")
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+
+	for i := 0; i < len(ce.Args); i += 2 {
+		value := strings.ToLower(ce.Args[i+1])
+		switch strings.ToLower(ce.Args[i]) {
+		case "period":
+			if value == "default" {
+				portal.RotationPeriodMillis = 0
+				continue
+			}
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration < time.Minute {
+				ce.Reply("Invalid period %q, use something like `24h` (minimum 1m)", value)
+				return
+			}
+			portal.RotationPeriodMillis = duration.Milliseconds()
+		case "messages":
+			if value == "default" {
+				portal.RotationPeriodMessages = 0
+				continue
+			}
+			count, err := strconv.Atoi(value)
+			if err != nil || count <= 0 {
+				ce.Reply("Invalid message count %q", value)
+				return
+			}
+			portal.RotationPeriodMessages = count
+		default:
+			ce.Reply("Unknown rotation setting `%s`, must be `period` or `messages`", ce.Args[i])
+			return
+		}
+	}
+	portal.Update(nil)
+
+	err := portal.UpdateEncryptionSettings()
+	if err != nil {
+		ce.Reply("Saved the new rotation settings, but failed to send them to the room: %v", err)
+		return
+	} else if !portal.Encrypted {
+		ce.Reply("Saved the new rotation settings. They'll apply if encryption is enabled in this room.")
+		return
+	}
+	ce.Reply("Rotation settings updated, the next message will start a new encryption session.")
+}
+
+var cmdTimeouts = &commands.FullHandler{
+	Func: wrapCommand(fnTimeouts),
+	Name: "timeouts",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change how long Matrix messages in this room can take to bridge before a warning is sent (`error-after`) " +
+			"and before bridging them is cancelled (`deadline`). Use `off` to disable a timeout or `default` to go back to the bridge config.",
+		Args: "[error-after <_duration_ | off | default>] [deadline <_duration_ | off | default>]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func formatTimeout(duration time.Duration) string {
+	if duration <= 0 {
+		return "off"
+	}
+	return duration.String()
+}
+
+func fnTimeouts(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		errorAfter, deadline := portal.getMessageHandlingTimeouts()
+		ce.Reply("Message handling timeouts in this room:\n\n"+
+			"* **error-after**: %s\n"+
+			"* **deadline**: %s", formatTimeout(errorAfter), formatTimeout(deadline))
+		return
+	} else if len(ce.Args)%2 != 0 {
+		ce.ReplyUsage("**Usage**: $cmdprefix timeouts [error-after <duration | off | default>] [deadline <duration | off | default>]")
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+
+	for i := 0; i < len(ce.Args); i += 2 {
+		var target *int64
+		switch strings.ToLower(ce.Args[i]) {
+		case "error-after":
+			target = &portal.TimeoutErrorAfterMillis
+		case "deadline":
+			target = &portal.TimeoutDeadlineMillis
+		default:
+			ce.Reply("Unknown timeout `%s`, must be `error-after` or `deadline`", ce.Args[i])
+			return
+		}
+		value := strings.ToLower(ce.Args[i+1])
+		switch value {
+		case "default":
+			*target = 0
+		case "off":
+			*target = -1
+		default:
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration < time.Second {
+				ce.Reply("Invalid duration %q, use something like `30s` or `2m`", value)
+				return
+			}
+			*target = duration.Milliseconds()
+		}
+	}
+	portal.Update(nil)
+	errorAfter, deadline := portal.getMessageHandlingTimeouts()
+	ce.Reply("Message handling timeouts updated: error-after is %s and deadline is %s.", formatTimeout(errorAfter), formatTimeout(deadline))
+}
+
+var cmdBroadcast = &commands.FullHandler{
+	Func: wrapCommand(fnBroadcast),
+	Name: "broadcast",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "List, add or remove other Slack channels in the same team that your messages sent from Matrix in this room are cross-posted to. " +
+			"Edits and deletions are relayed to the copies, thread replies are only sent to this room's channel. Adding targets requires room admin power.",
+		Args: "[add | remove <_channel ID_>]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnBroadcast(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		targets := ce.Bridge.DB.Broadcast.GetTargets(portal.Key)
+		if len(targets) == 0 {
+			ce.Reply("Messages in this room aren't broadcast to any other channels.")
+			return
+		}
+		lines := make([]string, len(targets))
+		for i, target := range targets {
+			addedBy := target.AddedBy.String()
+			if addedBy == "" {
+				addedBy = "unknown user, re-add it to enable"
+			}
+			lines[i] = fmt.Sprintf("%s (messages of %s)", target.ChannelID, addedBy)
+		}
+		ce.Reply("Messages in this room are broadcast to:\n\n* %s", strings.Join(lines, "\n* "))
+		return
+	} else if len(ce.Args) != 2 {
+		ce.ReplyUsage("**Usage**: $cmdprefix broadcast [add | remove <channel ID>]")
+		return
+	}
+
+	target := strings.ToUpper(ce.Args[1])
+	switch strings.ToLower(ce.Args[0]) {
+	case "add":
+		if !portal.isRoomAdmin(ce.User) {
+			ce.Reply("Only room admins can add broadcast targets.")
+			return
+		} else if target == portal.Key.ChannelID {
+			ce.Reply("Messages can't be broadcast to the room's own channel.")
+			return
+		}
+		userTeam := ce.User.GetUserTeam(portal.Key.TeamID)
+		if userTeam == nil || userTeam.Client == nil {
+			ce.Reply("You're not logged into the team of this room.")
+			return
+		}
+		info, err := ce.Bridge.InfoCache.GetConversationInfo(userTeam, target)
+		if err != nil {
+			ce.Reply("Failed to find channel %s: %v", target, err)
+			return
+		}
+		ce.Bridge.DB.Broadcast.AddTarget(portal.Key, target, ce.User.MXID)
+		ce.Reply("Your messages sent in this room will now also be posted to #%s (%s).", info.Name, target)
+	case "remove":
+		var existing *database.BroadcastTarget
+		for _, t := range ce.Bridge.DB.Broadcast.GetTargets(portal.Key) {
+			if t.ChannelID == target {
+				existing = &t
+				break
+			}
+		}
+		if existing == nil {
+			ce.Reply("Messages in this room aren't broadcast to %s.", target)
+			return
+		} else if existing.AddedBy != ce.User.MXID && !portal.isRoomAdmin(ce.User) {
+			ce.Reply("Only room admins can remove broadcast targets added by other users.")
+			return
+		}
+		ce.Bridge.DB.Broadcast.RemoveTarget(portal.Key, target)
+		ce.Reply("Messages sent in this room will no longer be posted to %s.", target)
+	default:
+		ce.ReplyUsage("**Usage**: $cmdprefix broadcast [add | remove <channel ID>]")
+	}
+}
+
+var cmdMediaPolicy = &commands.FullHandler{
+	Func: wrapCommand(fnMediaPolicy),
+	Name: "media-policy",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change how files are bridged in this room: `bridge` re-uploads all files, `link` sends links to Slack, " +
+			"`proxy` sends links through the bridge, `block` doesn't bridge files in either direction and `default` follows the bridge config.",
+		Args: "[bridge | link | proxy | block | default]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnMediaPolicy(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		policy := string(portal.MediaPolicy)
+		if policy == "" {
+			policy = "default"
+		}
+		ce.Reply("The media policy of this room is `%s`.", policy)
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	policy := database.MediaPolicy(strings.ToLower(ce.Args[0]))
+	if policy == "default" {
+		policy = database.MediaPolicyDefault
+	} else if !policy.IsValid() {
+		ce.ReplyUsage("**Usage**: $cmdprefix media-policy [bridge | link | proxy | block | default]")
+		return
+	} else if policy == database.MediaPolicyProxy && ce.Bridge.bridgeConfig().Media.PublicAddress == "" {
+		ce.Reply("The `proxy` policy requires `public_address` to be set in the media section of the bridge config.")
+		return
+	}
+	portal.MediaPolicy = policy
+	portal.Update(nil)
+	ce.Bridge.audit(ce.User.MXID, "media_policy", portal.Key.String(), map[string]string{
+		"policy": ce.Args[0],
+	})
+	ce.Reply("Media policy of this room set to `%s`.", strings.ToLower(ce.Args[0]))
+}
+
+var cmdThreadMode = &commands.FullHandler{
+	Func: wrapCommand(fnThreadMode),
+	Name: "thread-mode",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change how Slack threads are shown in this room: `thread` uses Matrix threads, `reply` makes thread messages " +
+			"reply to each other, `flatten` sends them as normal messages quoting the thread root and `default` follows the bridge config.",
+		Args: "[thread | reply | flatten | default]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnThreadMode(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		if portal.ThreadMode == database.ThreadModeDefault {
+			ce.Reply("This room uses the default thread mode `%s`.", portal.getThreadMode())
+		} else {
+			ce.Reply("The thread mode of this room is `%s`.", portal.ThreadMode)
+		}
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	mode := database.ThreadMode(strings.ToLower(ce.Args[0]))
+	if mode == "default" {
+		mode = database.ThreadModeDefault
+	} else if !mode.IsValid() {
+		ce.ReplyUsage("**Usage**: $cmdprefix thread-mode [thread | reply | flatten | default]")
+		return
+	}
+	portal.ThreadMode = mode
+	portal.Update(nil)
+	ce.Reply("Thread mode of this room set to `%s`. It only applies to new messages.", portal.getThreadMode())
+}
+
+var cmdEditHistory = &commands.FullHandler{
+	Func: wrapCommand(fnEditHistory),
+	Name: "edit-history",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change whether the previous version of messages edited in Slack is kept in this room: `off` only sends the edit, " +
+			"`field` includes the previous text in the edit event, `thread` also sends it as a notice in the thread and `default` follows the bridge config.",
+		Args: "[off | field | thread | default]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnEditHistory(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		if portal.EditHistory == database.EditHistoryDefault {
+			ce.Reply("This room uses the default edit history mode `%s`.", portal.getEditHistoryMode())
+		} else {
+			ce.Reply("The edit history mode of this room is `%s`.", portal.EditHistory)
+		}
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	mode := database.EditHistoryMode(strings.ToLower(ce.Args[0]))
+	if mode == "default" {
+		mode = database.EditHistoryDefault
+	} else if !mode.IsValid() {
+		ce.ReplyUsage("**Usage**: $cmdprefix edit-history [off | field | thread | default]")
+		return
+	}
+	portal.EditHistory = mode
+	portal.Update(nil)
+	ce.Reply("Edit history mode of this room set to `%s`.", portal.getEditHistoryMode())
+}
+
+var cmdUnfurl = &commands.FullHandler{
+	Func: wrapCommand(fnUnfurl),
+	Name: "unfurl",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change which previews Slack generates for links sent from this room: `all` previews links and media, " +
+			"`links` only previews normal links, `media` only previews media, `none` previews nothing and `default` follows the bridge config.",
+		Args: "[all | links | media | none | default]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnUnfurl(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		if portal.Unfurl == database.UnfurlDefault {
+			ce.Reply("This room uses the default unfurl mode `%s`.", portal.getUnfurlMode())
+		} else {
+			ce.Reply("The unfurl mode of this room is `%s`.", portal.Unfurl)
+		}
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	mode := database.UnfurlMode(strings.ToLower(ce.Args[0]))
+	if mode == "default" {
+		mode = database.UnfurlDefault
+	} else if !mode.IsValid() {
+		ce.ReplyUsage("**Usage**: $cmdprefix unfurl [all | links | media | none | default]")
+		return
+	}
+	portal.Unfurl = mode
+	portal.Update(nil)
+	ce.Reply("Unfurl mode of this room set to `%s`.", portal.getUnfurlMode())
+}
+
+var cmdNoticePolicy = &commands.FullHandler{
+	Func: wrapCommand(fnNoticePolicy),
+	Name: "notice-policy",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change how m.notice messages from Matrix bots are bridged to Slack: `drop` doesn't bridge them, " +
+			"`plain` bridges them like normal messages, `prefix` adds the configured notice prefix and `default` follows the bridge config.",
+		Args: "[drop | plain | prefix | default]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnNoticePolicy(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		if portal.Notices == database.NoticePolicyDefault {
+			ce.Reply("This room uses the default notice policy `%s`.", portal.getNoticePolicy())
+		} else {
+			ce.Reply("The notice policy of this room is `%s`.", portal.Notices)
+		}
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	policy := database.NoticePolicy(strings.ToLower(ce.Args[0]))
+	if policy == "default" {
+		policy = database.NoticePolicyDefault
+	} else if !policy.IsValid() {
+		ce.ReplyUsage("**Usage**: $cmdprefix notice-policy [drop | plain | prefix | default]")
+		return
+	}
+	portal.Notices = policy
+	portal.Update(nil)
+	ce.Reply("Notice policy of this room set to `%s`.", portal.getNoticePolicy())
+}
+
+var cmdRetention = &commands.FullHandler{
+	Func: wrapCommand(fnRetention),
+	Name: "retention",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change how many days bridged messages are kept in this room before they're redacted. " +
+			"Use `off` to keep messages forever or `default` to go back to the bridge config.",
+		Args: "[<_days_> | off | default] [--confirm]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRetention(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	args, confirmed := hasFlag(ce.Args, "--confirm")
+	if len(args) == 0 {
+		if days := portal.getRetentionDays(); days == 0 {
+			ce.Reply("Messages in this room are kept forever.")
+		} else {
+			ce.Reply("Messages in this room are redacted after %d days.", days)
+		}
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	var retentionDays int
+	switch value := strings.ToLower(args[0]); value {
+	case "default":
+		retentionDays = 0
+	case "off":
+		retentionDays = -1
+	default:
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			ce.ReplyUsage("**Usage**: $cmdprefix retention [<days> | off | default] [--confirm]")
+			return
+		}
+		retentionDays = days
+	}
+	previousDays, previousValue := portal.getRetentionDays(), portal.RetentionDays
+	portal.RetentionDays = retentionDays
+	if days := portal.getRetentionDays(); days > 0 && (previousDays == 0 || days < previousDays) && !confirmed {
+		portal.RetentionDays = previousValue
+		ce.Reply("This will redact all bridged messages older than %d days in this room. "+
+			"Run the command again with `--confirm` to continue.", days)
+		return
+	}
+	portal.Update(nil)
+	portal.syncRetentionState()
+	if days := portal.getRetentionDays(); days == 0 {
+		ce.Reply("Messages in this room will be kept forever.")
+	} else {
+		ce.Reply("Messages in this room will be redacted after %d days.", days)
+		go portal.enforceRetention()
+	}
+}
+
+var cmdTranslate = &commands.FullHandler{
+	Func: wrapCommand(fnTranslate),
+	Name: "translate",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change machine translation of messages in this room. The direction is `slack_to_matrix` or `matrix_to_slack`. " +
+			"`append` adds the translation below the original text and `replace` only bridges the translation.",
+		Args: "[<_direction_> <_language_ | off> [append | replace]]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnTranslate(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if ce.Bridge.Translator == nil {
+		ce.Reply("Translation is not enabled in the bridge config.")
+		return
+	} else if len(ce.Args) == 0 {
+		var text strings.Builder
+		for _, direction := range []database.TranslationDirection{database.TranslationSlackToMatrix, database.TranslationMatrixToSlack} {
+			if setting := portal.getTranslation(direction); setting != nil {
+				_, _ = fmt.Fprintf(&text, "* `%s`: translated to `%s` (%s)\n", direction, setting.TargetLang, setting.Mode)
+			} else {
+				_, _ = fmt.Fprintf(&text, "* `%s`: not translated\n", direction)
+			}
+		}
+		ce.Reply("%s", text.String())
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+	direction := database.TranslationDirection(strings.ToLower(ce.Args[0]))
+	if len(ce.Args) < 2 || len(ce.Args) > 3 || !direction.IsValid() {
+		ce.ReplyUsage("**Usage**: $cmdprefix translate [<direction> <language | off> [append | replace]]")
+		return
+	}
+	lang := ce.Args[1]
+	if strings.ToLower(lang) == "off" {
+		delete(portal.Translation, direction)
+		portal.Update(nil)
+		ce.Reply("Messages bridged `%s` will no longer be translated.", direction)
+		return
+	}
+	var mode database.TranslationMode
+	if len(ce.Args) == 3 {
+		mode = database.TranslationMode(strings.ToLower(ce.Args[2]))
+		if !mode.IsValid() {
+			ce.ReplyUsage("**Usage**: $cmdprefix translate [<direction> <language | off> [append | replace]]")
+			return
+		}
+	}
+	if portal.Translation == nil {
+		portal.Translation = make(map[database.TranslationDirection]database.TranslationSetting)
+	}
+	portal.Translation[direction] = database.TranslationSetting{TargetLang: lang, Mode: mode}
+	portal.Update(nil)
+	setting := portal.getTranslation(direction)
+	ce.Reply("Messages bridged `%s` will be translated to `%s` (%s).", direction, setting.TargetLang, setting.Mode)
+}
+
+var cmdSummary = &commands.FullHandler{
+	Func: wrapCommand(fnSummary),
+	Name: "summary",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Show the top senders, message counts and busiest hours of the messages bridged in this room in the last days (7 by default).",
+		Args:        "[_days_]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSummary(ce *WrappedCommandEvent) {
+	days := 7
+	if len(ce.Args) > 0 {
+		var err error
+		days, err = strconv.Atoi(ce.Args[0])
+		if err != nil || days < 1 || days > 365 {
+			ce.ReplyUsage("**Usage**: $cmdprefix summary [days], where days is between 1 and 365")
+			return
+		}
+	}
+	ce.Reply("%s", ce.Portal.buildSummary(days))
+}
+
+var cmdRelayTemplate = &commands.FullHandler{
+	Func: wrapCommand(fnRelayTemplate),
+	Name: "relay-template",
+	Help: commands.HelpMeta{
+		Section: HelpSectionPortalManagement,
+		Description: "Show or change the relay templates of this room. Keys are `username`, `icon_url` or a message type like `m.text`. " +
+			"Wrap the template in quotes to keep spaces at the start or end. Use `reset` to go back to the bridge config.",
+		Args: "[<_key_> <_template_ | reset>]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRelayTemplate(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if len(ce.Args) == 0 {
+		if len(portal.RelayTemplates) == 0 {
+			ce.Reply("This room uses the relay templates from the bridge config.")
+			return
+		}
+		keys := make([]string, 0, len(portal.RelayTemplates))
+		for key := range portal.RelayTemplates {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		lines := make([]string, len(keys))
+		for i, key := range keys {
+			lines[i] = fmt.Sprintf("* **%s**: `%s`", key, portal.RelayTemplates[key])
+		}
+		ce.Reply("Relay templates in this room:\n\n%s", strings.Join(lines, "\n"))
+		return
+	} else if len(ce.Args) < 2 {
+		ce.ReplyUsage("**Usage**: $cmdprefix relay-template [<key> <template | reset>]")
+		return
+	} else if !ce.checkRoomAdmin() {
+		return
+	}
+
+	key := ce.Args[0]
+	if !config.IsValidRelayTemplateKey(key) {
+		ce.Reply("Unknown relay template `%s`, must be `username`, `icon_url` or a message type like `m.text`", key)
+		return
+	}
+	source := strings.Join(ce.Args[1:], " ")
+	if strings.ToLower(source) == "reset" {
+		delete(portal.RelayTemplates, key)
+		portal.Update(nil)
+		ce.Reply("Relay template `%s` reset to the bridge config.", key)
+		return
+	}
+	if len(source) >= 2 && source[0] == '"' && source[len(source)-1] == '"' {
+		source = source[1 : len(source)-1]
+	}
+	_, err := config.ParseRelayTemplate(key, source)
+	if err != nil {
+		ce.Reply("Invalid template: %v", err)
+		return
+	}
+	if portal.RelayTemplates == nil {
+		portal.RelayTemplates = make(map[string]string)
+	}
+	portal.RelayTemplates[key] = source
+	portal.Update(nil)
+	ce.Reply("Relay template `%s` set to `%s`.", key, source)
+}
+
+var cmdRetry = &commands.FullHandler{
+	Func: wrapCommand(fnRetry),
+	Name: "retry",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Try bridging a failed message again. Reply to the message or its error notice, or pass its event ID.",
+		Args:        "[event ID]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func (ce *WrappedCommandEvent) fetchEvent(eventID id.EventID) (*event.Event, error) {
+	return ce.Bridge.fetchMatrixEvent(ce.MainIntent(), ce.RoomID, eventID)
+}
+
+func fnRetry(ce *WrappedCommandEvent) {
+	target := ce.ReplyTo
+	if len(ce.Args) > 0 {
+		target = id.EventID(ce.Args[0])
+	}
+	if target == "" {
+		ce.ReplyUsage("Usage: `$cmdprefix retry <event ID>`, or reply to the failed message with `$cmdprefix retry`")
+		return
+	}
+
+	evt, err := ce.fetchEvent(target)
+	if err != nil {
+		ce.Reply("Failed to get event %s: %v", target, err)
+		return
+	}
+	var errorNotice id.EventID
+	if evt.Sender == ce.Portal.MainIntent().UserID || evt.Sender == ce.Bot.UserID {
+		// This is probably an error notice, find the message it's replying to
+		content := evt.Content.AsMessage()
+		if content.MsgType != event.MsgNotice || content.RelatesTo.GetReplyTo() == "" {
+			ce.Reply("That isn't a bridging error notice")
+			return
+		}
+		errorNotice = evt.ID
+		evt, err = ce.fetchEvent(content.RelatesTo.GetReplyTo())
+		if err != nil {
+			ce.Reply("Failed to get the message the error notice refers to: %v", err)
+			return
+		}
+	}
+
+	if evt.Type != event.EventMessage {
+		ce.Reply("Only messages can be retried")
+		return
+	} else if evt.Sender != ce.User.MXID && ce.User.PermissionLevel < bridgeconfig.PermissionLevelAdmin {
+		ce.Reply("You can only retry your own messages")
+		return
+	} else if ce.Bridge.DB.Message.GetByMatrixID(ce.Portal.Key, evt.ID) != nil {
+		ce.Reply("That message has already been bridged")
+		return
+	}
+	sender := ce.User
+	if evt.Sender != ce.User.MXID {
+		sender = ce.Bridge.GetUserByMXID(evt.Sender)
+		if sender == nil {
+			ce.Reply("The sender of that message isn't a bridge user")
+			return
+		}
+	}
+
+	ce.Portal.RetryMatrixMessage(sender, evt, errorNotice)
+	ce.Reply("Retrying %s", evt.ID)
+}
+
+var cmdSave = &commands.FullHandler{
+	Func:    wrapCommand(fnSave),
+	Name:    "save",
+	Aliases: []string{"unsave"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Add a message to your saved items in Slack, or remove it with `unsave`. Reply to the message or pass its event ID.",
+		Args:        "[event ID]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSave(ce *WrappedCommandEvent) {
+	target := ce.ReplyTo
+	if len(ce.Args) > 0 {
+		target = id.EventID(ce.Args[0])
+	}
+	if target == "" {
+		ce.ReplyUsage("Usage: `$cmdprefix %s <event ID>`, or reply to the message with `$cmdprefix %s`", ce.Command, ce.Command)
+		return
+	}
+	userTeam := ce.User.GetUserTeam(ce.Portal.Key.TeamID)
+	if userTeam == nil || userTeam.Client == nil {
+		ce.Reply("You're not logged into this Slack workspace")
+		return
+	}
+	slackID := ce.Portal.getSlackMessageID(target)
+	if slackID == "" {
+		ce.Reply("That message isn't bridged to Slack")
+		return
+	}
+	saved := ce.Command == "save"
+	err := ce.Portal.setSlackMessageSaved(userTeam, slackID, saved)
+	if err != nil {
+		ce.Reply("Failed to update saved items: %v", err)
+	} else if saved {
+		ce.Reply("Added the message to your saved items")
+	} else {
+		ce.Reply("Removed the message from your saved items")
+	}
+}
+
+var cmdDeletePortal = &commands.FullHandler{
+	Func: wrapCommand(fnDeletePortal),
+	Name: "delete-portal",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Remove everyone from this room and forget it. With `--delete-room`, also delete the room from the homeserver.",
+		Args:        "[--delete-room]",
+	},
+	RequiresAdmin:  true,
+	RequiresPortal: true,
+}
+
+func hasFlag(args []string, flag string) ([]string, bool) {
+	for i, arg := range args {
+		if arg == flag {
+			return append(args[:i:i], args[i+1:]...), true
+		}
+	}
+	return args, false
+}
+
+func fnDeletePortal(ce *WrappedCommandEvent) {
+	_, deleteRoom := hasFlag(ce.Args, "--delete-room")
+	ce.Bridge.audit(ce.User.MXID, "delete_portal", ce.Portal.Key.String(), map[string]string{
+		"room_id":     ce.Portal.MXID.String(),
+		"delete_room": strconv.FormatBool(deleteRoom),
+	})
+	ce.Portal.delete()
+	if deleteRoom {
+		ce.Portal.deleteRoom()
+	} else {
+		ce.Portal.cleanup(false)
+	}
+	ce.Log.Infofln("Deleted portal")
+}
+
+var cmdDeleteAllPortals = &commands.FullHandler{
+	Func: wrapCommand(fnDeleteAllPortals),
+	Name: "delete-all-portals",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Delete all portals, or only the portals of one Slack team.",
+		Args:        "[--delete-room] [--confirm] [team ID]",
+	},
+	RequiresAdmin: true,
+}
+
+func fnDeleteAllPortals(ce *WrappedCommandEvent) {
+	args, deleteRoom := hasFlag(ce.Args, "--delete-room")
+	args, confirmed := hasFlag(args, "--confirm")
+
+	portals := ce.Bridge.GetAllPortals()
+	if len(args) > 0 {
+		teamID := strings.ToUpper(args[0])
+		filtered := portals[:0]
+		for _, portal := range portals {
+			if portal.Key.TeamID == teamID {
+				filtered = append(filtered, portal)
+			}
+		}
+		portals = filtered
+	}
+	if len(portals) == 0 {
+		ce.Reply("There are no portals to delete")
+		return
+	} else if !confirmed {
+		ce.Reply("This will delete %d portals. Run the command again with `--confirm` to continue.", len(portals))
+		return
+	}
+
+	ce.Reply("Deleting %d portals...", len(portals))
+	go func() {
+		for _, portal := range portals {
+			ce.Bridge.audit(ce.User.MXID, "delete_portal", portal.Key.String(), map[string]string{
+				"room_id":     portal.MXID.String(),
+				"delete_room": strconv.FormatBool(deleteRoom),
+			})
+			portal.delete()
+			if deleteRoom {
+				portal.deleteRoom()
+			} else {
+				portal.cleanup(false)
+			}
+		}
+		ce.Log.Infofln("Deleted %d portals", len(portals))
+		ce.Reply("Finished deleting %d portals", len(portals))
+	}()
+}
+
+var cmdReplayEvent = &commands.FullHandler{
+	Func: wrapCommand(fnReplayEvent),
+	Name: "replay-event",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Handle an archived Slack event again, or list the latest archived events.",
+		Args:        "[archive ID]",
+	},
+	RequiresAdmin: true,
+}
+
+func fnReplayEvent(ce *WrappedCommandEvent) {
+	if !ce.Bridge.bridgeConfig().EventArchive.Enable {
+		ce.Reply("The event archive is not enabled in the bridge config")
+		return
+	}
+	if len(ce.Args) == 0 {
+		events := ce.Bridge.DB.EventArchive.GetLatest(10)
+		if len(events) == 0 {
+			ce.Reply("There are no archived events")
+			return
+		}
+		var text strings.Builder
+		text.WriteString("Latest archived events:\n\n")
+		for _, evt := range events {
+			_, _ = fmt.Fprintf(&text, "* `%d`: %s in %s for %s at %s\n", evt.ArchiveID, evt.EventType, evt.TeamID, evt.UserMXID, evt.ReceivedAt.UTC().Format(time.RFC3339))
+		}
+		ce.Reply("%s", text.String())
+		return
+	}
+
+	archiveID, err := strconv.Atoi(ce.Args[0])
+	if err != nil {
+		ce.ReplyUsage("**Usage**: $cmdprefix replay-event [archive ID]")
+		return
+	}
+	archived := ce.Bridge.DB.EventArchive.GetByID(archiveID)
+	if archived == nil {
+		ce.Reply("Archived event %d not found", archiveID)
+		return
+	}
+	err = ce.Bridge.replayArchivedEvent(archived)
+	if err != nil {
+		ce.Reply("Failed to replay event %d: %v", archiveID, err)
+	} else {
+		ce.Reply("Replayed %s event %d", archived.EventType, archiveID)
+	}
+}
+
+var cmdAuditLog = &commands.FullHandler{
+	Func: wrapCommand(fnAuditLog),
+	Name: "audit-log",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "List the latest entries in the audit log.",
+		Args:        "[limit]",
+	},
+	RequiresAdmin: true,
+}
+
+func fnAuditLog(ce *WrappedCommandEvent) {
+	if !ce.Bridge.bridgeConfig().AuditLog.Enable {
+		ce.Reply("The audit log is not enabled in the bridge config")
+		return
+	}
+	limit := 20
+	if len(ce.Args) > 0 {
+		var err error
+		limit, err = strconv.Atoi(ce.Args[0])
+		if err != nil || limit <= 0 {
+			ce.ReplyUsage("**Usage**: $cmdprefix audit-log [limit]")
+			return
+		}
+	}
+	entries := ce.Bridge.DB.AuditLog.GetLatest(limit)
+	if len(entries) == 0 {
+		ce.Reply("The audit log is empty")
+		return
+	}
+	var text strings.Builder
+	text.WriteString("Latest audit log entries:\n\n")
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(&text, "* `%d` at %s: %s %s %s `%s`\n", entry.AuditID, entry.Timestamp.UTC().Format(time.RFC3339), entry.Actor, entry.Action, entry.Target, entry.Params)
+	}
+	ce.Reply("%s", text.String())
+}
+
+var cmdDBMaintenance = &commands.FullHandler{
+	Func: wrapCommand(fnDBMaintenance),
+	Name: "db-maintenance",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Show database table sizes and remove orphaned rows. Without `--clean`, only reports what would be removed.",
+		Args:        "[--clean] [--puppets] [--vacuum]",
+	},
+	RequiresAdmin: true,
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func fnDBMaintenance(ce *WrappedCommandEvent) {
+	args, clean := hasFlag(ce.Args, "--clean")
+	args, includePuppets := hasFlag(args, "--puppets")
+	_, vacuum := hasFlag(args, "--vacuum")
+
+	var text strings.Builder
+	stats, err := ce.Bridge.DB.GetTableStats()
+	if err != nil {
+		ce.Reply("Failed to get table stats: %v", err)
+		return
+	}
+	text.WriteString("**Tables**:\n\n")
+	for _, table := range stats {
+		if table.Size >= 0 {
+			_, _ = fmt.Fprintf(&text, "* %s: %d rows, %s\n", table.Name, table.Rows, formatBytes(table.Size))
+		} else {
+			_, _ = fmt.Fprintf(&text, "* %s: %d rows\n", table.Name, table.Rows)
+		}
+	}
+
+	orphans, err := ce.Bridge.DB.CleanOrphans(!clean, includePuppets)
+	if err != nil {
+		ce.Reply("%s\nFailed to check orphaned rows: %v", text.String(), err)
+		return
+	}
+	if clean {
+		text.WriteString("\n**Removed orphaned rows**:\n\n")
+	} else {
+		text.WriteString("\n**Orphaned rows** (run with `--clean` to remove):\n\n")
+	}
+	for _, orphan := range orphans {
+		_, _ = fmt.Fprintf(&text, "* %s: %d\n", orphan.Description, orphan.Count)
+	}
+	if clean && includePuppets {
+		// Forget cached puppets so deleted ones aren't used without a database row
+		ce.Bridge.puppetsLock.Lock()
+		ce.Bridge.puppets.removeIf(func(puppet *Puppet) bool {
+			return puppet.CustomMXID == ""
+		})
+		ce.Bridge.puppetsLock.Unlock()
+	}
+
+	if vacuum {
+		err = ce.Bridge.DB.Optimize()
+		if err != nil {
+			_, _ = fmt.Fprintf(&text, "\nFailed to optimize database: %v\n", err)
+		} else {
+			text.WriteString("\nDatabase vacuumed and analyzed\n")
+		}
+	}
+	ce.Reply("%s", text.String())
+}
+
+var cmdReloadConfig = &commands.FullHandler{
+	Func: wrapCommand(fnReloadConfig),
+	Name: "reload-config",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Reload settings that can change at runtime from the config file.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnReloadConfig(ce *WrappedCommandEvent) {
+	changed, needsRestart, err := ce.Bridge.ReloadConfig()
+	ce.Bridge.logConfigReload(changed, needsRestart, err)
+	if err != nil {
+		ce.Reply("Failed to reload config: %v", err)
+		return
+	}
+	var changedText string
+	if len(changed) == 0 {
+		changedText = "No runtime settings changed."
+	} else {
+		changedText = fmt.Sprintf("Changed settings: `%s`.", strings.Join(changed, "`, `"))
+	}
+	if needsRestart {
+		changedText += " Some other settings changed too, but they only apply after restarting the bridge."
+	}
+	ce.Reply("Reloaded config. %s", changedText)
+}
+
+var cmdMigrateGhosts = &commands.FullHandler{
+	Func: wrapCommand(fnMigrateGhosts),
+	Name: "migrate-ghosts",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Move Slack ghosts to new Matrix user IDs after changing the username template or homeserver domain.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnMigrateGhosts(ce *WrappedCommandEvent) {
+	oldTemplate, oldDomain := ce.Bridge.getStoredGhostFormat()
+	if !ce.Bridge.ghostFormatChanged(oldTemplate, oldDomain) {
+		ce.Reply("The ghost user ID format hasn't changed, there's nothing to migrate.")
+		return
+	}
+	ce.Reply("Migrating ghosts from `%s` on %s to `%s` on %s, this may take a while...",
+		oldTemplate, oldDomain, ce.Bridge.bridgeConfig().UsernameTemplate, ce.Bridge.Config.Homeserver.Domain)
+	ghosts, rooms, err := ce.Bridge.migrateGhosts(oldTemplate, oldDomain)
+	if err != nil {
+		ce.Reply("Failed to migrate ghosts: %v", err)
+		return
+	}
+	ce.Reply("Migrated %d ghosts in %d rooms", ghosts, rooms)
+}
+
+var cmdDoctor = &commands.FullHandler{
+	Func: wrapCommand(fnDoctor),
+	Name: "doctor",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Check the homeserver connection, registration, database, Slack logins and media proxy.",
+	},
+	RequiresAdmin: true,
+}
+
+func fnDoctor(ce *WrappedCommandEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*doctorCheckTimeout)
+	defer cancel()
+	report := ce.Bridge.runDoctor(ctx, true)
+	ce.Reply("%s", report.String())
+}
+
+var cmdAPIStats = &commands.FullHandler{
+	Func: wrapCommand(fnAPIStats),
+	Name: "api-stats",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAdmin,
+		Description: "Show how many Slack API calls the bridge made per team and method since it started, or reset the counters.",
+		Args:        "[team ID] [reset]",
+	},
+	RequiresAdmin: true,
+}
+
+func fnAPIStats(ce *WrappedCommandEvent) {
+	args, reset := hasFlag(ce.Args, "reset")
+	var teamID string
+	if len(args) > 0 {
+		teamID = strings.ToUpper(args[0])
+	}
+	if reset {
+		ce.Bridge.apiStats.reset(teamID)
+		ce.Reply("Slack API stats were reset.")
+		return
+	}
+	teams := ce.Bridge.apiStats.snapshot()
+	teamIDs := make([]string, 0, len(teams))
+	for key := range teams {
+		if teamID == "" || key == teamID {
+			teamIDs = append(teamIDs, key)
+		}
+	}
+	if len(teamIDs) == 0 {
+		ce.Reply("No Slack API calls have been made yet.")
+		return
+	}
+	sort.Strings(teamIDs)
+	var out strings.Builder
+	for _, key := range teamIDs {
+		out.WriteString(formatSlackAPIStats(key, teams[key]))
+		out.WriteByte('\n')
+	}
+	ce.Reply("%s", out.String())
 }
@@ -19,13 +19,17 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/slack-go/slack"
+	"gopkg.in/yaml.v3"
 
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-slack/database"
 )
@@ -55,12 +59,73 @@ func (mb *MaxMessages) GetMaxMessagesFor(t database.ChannelType) int {
 	}
 }
 
+type BackfillConfig struct {
+	Enable bool `yaml:"enable"`
+
+	UnreadHoursThreshold int `yaml:"unread_hours_threshold"`
+
+	ImmediateMessages int `yaml:"immediate_messages"`
+
+	Incremental IncrementalConfig `yaml:"incremental"`
+}
+
+type SpacesConfig struct {
+	Enable   bool `yaml:"enable"`
+	Sections bool `yaml:"sections"`
+}
+
+type SavedItemsConfig struct {
+	Sync     bool   `yaml:"sync"`
+	Reaction string `yaml:"reaction"`
+}
+
+type RedactionsConfig struct {
+	MatrixToSlack string `yaml:"matrix_to_slack"`
+	SlackToMatrix string `yaml:"slack_to_matrix"`
+	Placeholder   string `yaml:"placeholder"`
+	BulkRate      int    `yaml:"bulk_rate"`
+}
+
+type DNDConfig struct {
+	Notices         bool `yaml:"notices"`
+	SnoozePushRules bool `yaml:"snooze_push_rules"`
+}
+
 type BridgeConfig struct {
 	UsernameTemplate       string `yaml:"username_template"`
 	DisplaynameTemplate    string `yaml:"displayname_template"`
 	BotDisplaynameTemplate string `yaml:"bot_displayname_template"`
 	ChannelNameTemplate    string `yaml:"channel_name_template"`
-	PrivateChatPortalMeta  bool   `yaml:"private_chat_portal_meta"`
+
+	DeactivatedSuffix      string `yaml:"deactivated_displayname_suffix"`
+	GuestSuffix            string `yaml:"guest_displayname_suffix"`
+	GuestChannelMembership bool   `yaml:"guest_channel_membership"`
+	SenderLocalTime        string `yaml:"sender_local_time"`
+	StatusEmoji            bool   `yaml:"status_emoji_in_displayname"`
+	PrivateChatPortalMeta  string `yaml:"private_chat_portal_meta"`
+	TeamIconFallback       bool   `yaml:"team_icon_fallback"`
+	Bookmarks              bool   `yaml:"bookmarks"`
+
+	Spaces     SpacesConfig     `yaml:"spaces"`
+	SavedItems SavedItemsConfig `yaml:"saved_items"`
+	DND        DNDConfig        `yaml:"dnd"`
+	Redactions RedactionsConfig `yaml:"redactions"`
+
+	SyncFavourites bool `yaml:"sync_favourites"`
+	SyncMutes      bool `yaml:"sync_mutes"`
+
+	ThreadMode  database.ThreadMode      `yaml:"thread_mode"`
+	EditHistory database.EditHistoryMode `yaml:"edit_history"`
+	Unfurl      database.UnfurlMode      `yaml:"unfurl"`
+
+	EmoteTemplate string `yaml:"emote_template"`
+
+	NoticePolicy database.NoticePolicy `yaml:"notice_policy"`
+	NoticePrefix string                `yaml:"notice_prefix"`
+
+	EphemeralMessages bool `yaml:"ephemeral_messages"`
+
+	DateTimezone string `yaml:"date_timezone"`
 
 	CommandPrefix string `yaml:"command_prefix"`
 
@@ -68,10 +133,33 @@ type BridgeConfig struct {
 	ResendBridgeInfo    bool `yaml:"resend_bridge_info"`
 	MessageStatusEvents bool `yaml:"message_status_events"`
 	MessageErrorNotices bool `yaml:"message_error_notices"`
+	UsageStats          bool `yaml:"usage_stats"`
+
+	StatusBatching struct {
+		IntervalStr string `yaml:"interval"`
+		MaxPerRoom  int    `yaml:"max_per_room"`
+
+		Interval time.Duration `yaml:"-"`
+	} `yaml:"status_batching"`
+
+	APIConcurrency struct {
+		MaxCalls            int `yaml:"max_calls"`
+		ReservedInteractive int `yaml:"reserved_interactive"`
+	} `yaml:"api_concurrency"`
+
+	LoopPrevention struct {
+		GatewayBots   []string `yaml:"gateway_bots"`
+		EchoWindowStr string   `yaml:"echo_window"`
+		Notice        bool     `yaml:"notice"`
+
+		EchoWindow time.Duration `yaml:"-"`
+	} `yaml:"loop_prevention"`
 
 	ManagementRoomText bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
 
 	PortalMessageBuffer int `yaml:"portal_message_buffer"`
+	PortalWorkers       int `yaml:"portal_workers"`
+	SlackEventWorkers   int `yaml:"slack_event_workers"`
 
 	SyncWithCustomPuppets bool `yaml:"sync_with_custom_puppets"`
 	SyncDirectChatList    bool `yaml:"sync_direct_chat_list"`
@@ -85,9 +173,15 @@ type BridgeConfig struct {
 	MessageHandlingTimeout struct {
 		ErrorAfterStr string `yaml:"error_after"`
 		DeadlineStr   string `yaml:"deadline"`
+		MaxAgeStr     string `yaml:"max_age"`
+
+		RetryAfterRestart bool   `yaml:"retry_after_restart"`
+		BridgeDelayed     bool   `yaml:"bridge_delayed"`
+		DelayedMarker     string `yaml:"delayed_marker"`
 
 		ErrorAfter time.Duration `yaml:"-"`
 		Deadline   time.Duration `yaml:"-"`
+		MaxAge     time.Duration `yaml:"-"`
 	} `yaml:"message_handling_timeout"`
 
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
@@ -99,22 +193,130 @@ type BridgeConfig struct {
 
 	Permissions bridgeconfig.PermissionConfig `yaml:"permissions"`
 
-	Backfill struct {
-		Enable bool `yaml:"enable"`
+	TokenEncryptionKey string `yaml:"token_encryption_key"`
+
+	CommandPermissions  bridgeconfig.PermissionConfig `yaml:"command_permissions"`
+	CommandCooldownsStr map[string]string             `yaml:"command_cooldowns"`
+
+	CommandCooldowns map[string]time.Duration `yaml:"-"`
+
+	Backfill BackfillConfig `yaml:"backfill"`
+
+	EventArchive struct {
+		Enable    bool   `yaml:"enable"`
+		MaxEvents int    `yaml:"max_events"`
+		MaxAgeStr string `yaml:"max_age"`
+
+		MaxAge time.Duration `yaml:"-"`
+	} `yaml:"event_archive"`
+
+	AuditLog struct {
+		Enable     bool      `yaml:"enable"`
+		NoticeRoom id.RoomID `yaml:"notice_room"`
+	} `yaml:"audit_log"`
+
+	AdminNotices struct {
+		Room                 id.RoomID `yaml:"room"`
+		TokenExpiry          bool      `yaml:"token_expiry"`
+		SendFailureThreshold int       `yaml:"send_failure_threshold"`
+		APIWarnings          bool      `yaml:"api_warnings"`
+		BackfillComplete     bool      `yaml:"backfill_complete"`
+		StartStop            bool      `yaml:"start_stop"`
+	} `yaml:"admin_notices"`
+
+	Filter        FilterConfig        `yaml:"filter"`
+	ContentFilter ContentFilterConfig `yaml:"content_filter"`
+	Translation   TranslationConfig   `yaml:"translation"`
+
+	Media     MediaConfig     `yaml:"media"`
+	Antivirus AntivirusConfig `yaml:"antivirus"`
+
+	Proxy       string            `yaml:"proxy"`
+	TeamProxies map[string]string `yaml:"team_proxies"`
+
+	ShutdownTimeoutStr string        `yaml:"shutdown_timeout"`
+	ShutdownTimeout    time.Duration `yaml:"-"`
+
+	Sentry struct {
+		DSN         string  `yaml:"dsn"`
+		Environment string  `yaml:"environment"`
+		SampleRate  float64 `yaml:"sample_rate"`
+	} `yaml:"sentry"`
+
+	DebugListener string `yaml:"debug_listener"`
+
+	APIStats struct {
+		LogCalls     bool    `yaml:"log_calls"`
+		QuotaWarning float64 `yaml:"quota_warning"`
+	} `yaml:"api_stats"`
 
-		UnreadHoursThreshold int `yaml:"unread_hours_threshold"`
+	SlackApp struct {
+		SigningSecret string `yaml:"signing_secret"`
+	} `yaml:"slack_app"`
 
-		ImmediateMessages int `yaml:"immediate_messages"`
+	CircuitBreaker struct {
+		FailureThreshold int    `yaml:"failure_threshold"`
+		ProbeIntervalStr string `yaml:"probe_interval"`
 
-		Incremental IncrementalConfig `yaml:"incremental"`
-	} `yaml:"backfill"`
+		ProbeInterval time.Duration `yaml:"-"`
+	} `yaml:"circuit_breaker"`
+
+	ReactionResync struct {
+		IntervalStr string `yaml:"interval"`
+		Messages    int    `yaml:"messages"`
+
+		Interval time.Duration `yaml:"-"`
+	} `yaml:"reaction_resync"`
+
+	Retention struct {
+		IntervalStr string `yaml:"interval"`
+		Days        int    `yaml:"days"`
+		DMDays      int    `yaml:"dm_days"`
+
+		Interval time.Duration `yaml:"-"`
+	} `yaml:"retention"`
+
+	InfoCache struct {
+		UserTTLStr    string `yaml:"user_ttl"`
+		ChannelTTLStr string `yaml:"channel_ttl"`
+		MaxEntries    int    `yaml:"max_entries"`
+
+		UserTTL    time.Duration `yaml:"-"`
+		ChannelTTL time.Duration `yaml:"-"`
+	} `yaml:"info_cache"`
+
+	SyncProgress struct {
+		IntervalStr string `yaml:"interval"`
+		Notices     bool   `yaml:"notices"`
+
+		Interval time.Duration `yaml:"-"`
+	} `yaml:"sync_progress"`
+
+	PuppetCacheSize  int `yaml:"puppet_cache_size"`
+	MessageCacheSize int `yaml:"message_cache_size"`
+
+	Relay RelayConfig `yaml:"relay"`
+
+	TeamOverrides map[string]yaml.Node `yaml:"team_overrides"`
+
+	SQLite struct {
+		JournalMode string `yaml:"journal_mode"`
+		BusyTimeout int    `yaml:"busy_timeout"`
+		Synchronous string `yaml:"synchronous"`
+	} `yaml:"sqlite"`
 
 	usernameTemplate       *template.Template `yaml:"-"`
 	displaynameTemplate    *template.Template `yaml:"-"`
 	botDisplaynameTemplate *template.Template `yaml:"-"`
 	channelNameTemplate    *template.Template `yaml:"-"`
+	emoteTemplate          *template.Template `yaml:"-"`
+	dateLocation           *time.Location     `yaml:"-"`
+
+	teamConfigs map[string]*BridgeConfig `yaml:"-"`
 }
 
+var validLocalpart = regexp.MustCompile(`^[a-z0-9._=/-]+$`)
+
 type umBridgeConfig BridgeConfig
 
 func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -126,10 +328,243 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	bc.usernameTemplate, err = template.New("username").Parse(bc.UsernameTemplate)
 	if err != nil {
 		return err
-	} else if !strings.Contains(bc.FormatUsername("1234567890"), "1234567890") {
-		return fmt.Errorf("username template is missing user ID placeholder")
+	} else if strings.Count(bc.FormatUsername("1234567890"), "1234567890") != 1 {
+		return fmt.Errorf("username template must contain the user ID placeholder exactly once")
+	} else if sample := bc.FormatUsername("t0123abc-u0123abc"); !validLocalpart.MatchString(sample) {
+		return fmt.Errorf("username template produces invalid localpart %q, only a-z, 0-9 and ._=-/ are allowed", sample)
 	}
 
+	err = bc.parseNameTemplates()
+	if err != nil {
+		return err
+	}
+	if bc.EmoteTemplate != "" {
+		bc.emoteTemplate, err = template.New("emote").Parse(bc.EmoteTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid emote template: %w", err)
+		}
+	}
+	if bc.DateTimezone == "" {
+		bc.DateTimezone = "UTC"
+	}
+	bc.dateLocation, err = time.LoadLocation(bc.DateTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid date_timezone: %w", err)
+	}
+
+	switch bc.SenderLocalTime {
+	case "":
+		bc.SenderLocalTime = "off"
+	case "off", "message", "profile":
+	default:
+		return fmt.Errorf("invalid sender_local_time %q, must be off, message or profile", bc.SenderLocalTime)
+	}
+
+	switch bc.PrivateChatPortalMeta {
+	case "":
+		bc.PrivateChatPortalMeta = "default"
+	case "default", "always", "never":
+	default:
+		return fmt.Errorf("invalid private_chat_portal_meta %q, must be default, always or never", bc.PrivateChatPortalMeta)
+	}
+
+	switch bc.Redactions.MatrixToSlack {
+	case "":
+		bc.Redactions.MatrixToSlack = "delete"
+	case "delete", "replace", "delete_or_replace":
+	default:
+		return fmt.Errorf("invalid redactions.matrix_to_slack %q, must be delete, replace or delete_or_replace", bc.Redactions.MatrixToSlack)
+	}
+	switch bc.Redactions.SlackToMatrix {
+	case "":
+		bc.Redactions.SlackToMatrix = "redact"
+	case "redact", "edit":
+	default:
+		return fmt.Errorf("invalid redactions.slack_to_matrix %q, must be redact or edit", bc.Redactions.SlackToMatrix)
+	}
+	if bc.Redactions.Placeholder == "" {
+		bc.Redactions.Placeholder = "[deleted]"
+	}
+	if bc.Redactions.BulkRate < 0 {
+		return errors.New("redactions.bulk_rate can't be negative")
+	}
+
+	if bc.ThreadMode == database.ThreadModeDefault {
+		bc.ThreadMode = database.ThreadModeThread
+	} else if !bc.ThreadMode.IsValid() {
+		return fmt.Errorf("invalid thread mode %q", bc.ThreadMode)
+	}
+	if bc.EditHistory == database.EditHistoryDefault {
+		bc.EditHistory = database.EditHistoryOff
+	} else if !bc.EditHistory.IsValid() {
+		return fmt.Errorf("invalid edit history mode %q", bc.EditHistory)
+	}
+	if bc.Unfurl == database.UnfurlDefault {
+		bc.Unfurl = database.UnfurlAll
+	} else if !bc.Unfurl.IsValid() {
+		return fmt.Errorf("invalid unfurl mode %q", bc.Unfurl)
+	}
+	if bc.NoticePolicy == database.NoticePolicyDefault {
+		bc.NoticePolicy = database.NoticePolicyPlain
+	} else if !bc.NoticePolicy.IsValid() {
+		return fmt.Errorf("invalid notice policy %q", bc.NoticePolicy)
+	}
+
+	if bc.MessageHandlingTimeout.ErrorAfterStr != "" {
+		bc.MessageHandlingTimeout.ErrorAfter, err = time.ParseDuration(bc.MessageHandlingTimeout.ErrorAfterStr)
+		if err != nil {
+			return fmt.Errorf("invalid message handling error_after: %w", err)
+		}
+	}
+	if bc.MessageHandlingTimeout.DeadlineStr != "" {
+		bc.MessageHandlingTimeout.Deadline, err = time.ParseDuration(bc.MessageHandlingTimeout.DeadlineStr)
+		if err != nil {
+			return fmt.Errorf("invalid message handling deadline: %w", err)
+		}
+	}
+	if bc.MessageHandlingTimeout.MaxAgeStr != "" {
+		bc.MessageHandlingTimeout.MaxAge, err = time.ParseDuration(bc.MessageHandlingTimeout.MaxAgeStr)
+		if err != nil {
+			return fmt.Errorf("invalid message handling max_age: %w", err)
+		} else if bc.MessageHandlingTimeout.MaxAge < 0 {
+			return errors.New("message_handling_timeout.max_age can't be negative")
+		}
+	}
+
+	if bc.SyncProgress.IntervalStr != "" {
+		bc.SyncProgress.Interval, err = time.ParseDuration(bc.SyncProgress.IntervalStr)
+		if err != nil {
+			return fmt.Errorf("invalid sync progress interval: %w", err)
+		}
+	}
+
+	if bc.StatusBatching.IntervalStr != "" {
+		bc.StatusBatching.Interval, err = time.ParseDuration(bc.StatusBatching.IntervalStr)
+		if err != nil {
+			return fmt.Errorf("invalid status batching interval: %w", err)
+		} else if bc.StatusBatching.Interval > 0 && bc.StatusBatching.MaxPerRoom <= 0 {
+			return fmt.Errorf("status_batching.max_per_room must be positive")
+		}
+	}
+
+	if bc.LoopPrevention.EchoWindowStr != "" {
+		bc.LoopPrevention.EchoWindow, err = time.ParseDuration(bc.LoopPrevention.EchoWindowStr)
+		if err != nil {
+			return fmt.Errorf("invalid loop prevention echo window: %w", err)
+		}
+	}
+
+	if bc.EventArchive.MaxAgeStr != "" {
+		bc.EventArchive.MaxAge, err = time.ParseDuration(bc.EventArchive.MaxAgeStr)
+		if err != nil {
+			return fmt.Errorf("invalid event archive max age: %w", err)
+		}
+	}
+
+	err = bc.Filter.validate()
+	if err != nil {
+		return err
+	}
+	err = bc.ContentFilter.validate()
+	if err != nil {
+		return err
+	}
+	err = bc.Translation.validate()
+	if err != nil {
+		return err
+	}
+	err = bc.Media.validate()
+	if err != nil {
+		return err
+	}
+	err = bc.Antivirus.validate()
+	if err != nil {
+		return err
+	}
+
+	err = validateProxyURL(bc.Proxy)
+	if err != nil {
+		return err
+	}
+	for teamID, proxy := range bc.TeamProxies {
+		if err = validateProxyURL(proxy); err != nil {
+			return fmt.Errorf("team %s: %w", teamID, err)
+		}
+	}
+
+	if bc.APIStats.QuotaWarning < 0 || bc.APIStats.QuotaWarning > 1 {
+		return errors.New("api_stats.quota_warning must be between 0 and 1")
+	}
+
+	if bc.PortalWorkers < 1 || bc.PortalMessageBuffer < 1 {
+		return fmt.Errorf("portal_workers and portal_message_buffer must be at least 1")
+	} else if bc.SlackEventWorkers < 1 {
+		return errors.New("slack_event_workers must be at least 1")
+	}
+
+	bc.ShutdownTimeout = 30 * time.Second
+	if bc.ShutdownTimeoutStr != "" {
+		bc.ShutdownTimeout, err = time.ParseDuration(bc.ShutdownTimeoutStr)
+		if err != nil {
+			return fmt.Errorf("invalid shutdown timeout: %w", err)
+		}
+	}
+
+	if bc.Sentry.SampleRate < 0 || bc.Sentry.SampleRate > 1 {
+		return fmt.Errorf("sentry sample rate must be between 0 and 1")
+	}
+
+	bc.CircuitBreaker.ProbeInterval = 30 * time.Second
+	if bc.CircuitBreaker.ProbeIntervalStr != "" {
+		bc.CircuitBreaker.ProbeInterval, err = time.ParseDuration(bc.CircuitBreaker.ProbeIntervalStr)
+		if err != nil {
+			return fmt.Errorf("invalid circuit breaker probe interval: %w", err)
+		} else if bc.CircuitBreaker.ProbeInterval <= 0 {
+			return fmt.Errorf("circuit breaker probe interval must be positive")
+		}
+	}
+
+	if bc.ReactionResync.IntervalStr != "" {
+		bc.ReactionResync.Interval, err = time.ParseDuration(bc.ReactionResync.IntervalStr)
+		if err != nil {
+			return fmt.Errorf("invalid reaction resync interval: %w", err)
+		}
+	}
+	bc.Retention.Interval = 1 * time.Hour
+	if bc.Retention.IntervalStr != "" {
+		bc.Retention.Interval, err = time.ParseDuration(bc.Retention.IntervalStr)
+		if err != nil {
+			return fmt.Errorf("invalid retention interval: %w", err)
+		} else if bc.Retention.Interval <= 0 {
+			return errors.New("retention interval must be positive")
+		}
+	}
+
+	if bc.InfoCache.UserTTLStr != "" {
+		bc.InfoCache.UserTTL, err = time.ParseDuration(bc.InfoCache.UserTTLStr)
+		if err != nil {
+			return fmt.Errorf("invalid user info cache TTL: %w", err)
+		}
+	}
+	if bc.InfoCache.ChannelTTLStr != "" {
+		bc.InfoCache.ChannelTTL, err = time.ParseDuration(bc.InfoCache.ChannelTTLStr)
+		if err != nil {
+			return fmt.Errorf("invalid channel info cache TTL: %w", err)
+		}
+	}
+
+	bc.CommandCooldowns = make(map[string]time.Duration, len(bc.CommandCooldownsStr))
+	for command, cooldownStr := range bc.CommandCooldownsStr {
+		bc.CommandCooldowns[command], err = time.ParseDuration(cooldownStr)
+		if err != nil {
+			return fmt.Errorf("invalid cooldown for command %s: %w", command, err)
+		}
+	}
+
+	return bc.parseTeamOverrides()
+}
+
+func (bc *BridgeConfig) parseNameTemplates() (err error) {
 	bc.displaynameTemplate, err = template.New("displayname").Parse(bc.DisplaynameTemplate)
 	if err != nil {
 		return err
@@ -141,11 +576,23 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 
 	bc.channelNameTemplate, err = template.New("channel_name").Parse(bc.ChannelNameTemplate)
+	return err
+}
+
+func validateProxyURL(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	parsed, err := url.Parse(proxy)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", parsed.Scheme)
 	}
-
-	return nil
 }
 
 var _ bridgeconfig.BridgeConfig = (*BridgeConfig)(nil)
@@ -171,15 +618,73 @@ func (bc BridgeConfig) FormatUsername(userid string) string {
 func (bc BridgeConfig) FormatDisplayname(user *slack.User) string {
 	var buffer strings.Builder
 	_ = bc.displaynameTemplate.Execute(&buffer, user.Profile)
+	if bc.SenderLocalTime == "profile" && user.TZ != "" {
+		_, _ = fmt.Fprintf(&buffer, " (%s)", FormatUTCOffset(user.TZOffset))
+	}
+	if user.IsRestricted || user.IsUltraRestricted {
+		buffer.WriteString(bc.GuestSuffix)
+	}
+	if user.Deleted {
+		buffer.WriteString(bc.DeactivatedSuffix)
+	}
 	return buffer.String()
 }
 
+// FormatUTCOffset formats a timezone offset in seconds like UTC+2 or UTC-3:30.
+func FormatUTCOffset(offset int) string {
+	if offset == 0 {
+		return "UTC"
+	}
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	hours, minutes := offset/3600, offset%3600/60
+	if minutes != 0 {
+		return fmt.Sprintf("UTC%c%d:%02d", sign, hours, minutes)
+	}
+	return fmt.Sprintf("UTC%c%d", sign, hours)
+}
+
 func (bc BridgeConfig) FormatBotDisplayname(bot *slack.Bot) string {
 	var buffer strings.Builder
 	_ = bc.botDisplaynameTemplate.Execute(&buffer, bot)
 	return buffer.String()
 }
 
+type EmoteTemplateData struct {
+	Displayname string
+	Text        string
+}
+
+// UseNativeEmotes returns whether emotes should be sent as Slack /me messages
+// instead of being formatted with the emote template.
+func (bc BridgeConfig) UseNativeEmotes() bool {
+	return bc.emoteTemplate == nil
+}
+
+func (bc BridgeConfig) FormatEmote(displayname, text string) string {
+	tpl := bc.emoteTemplate
+	if tpl == nil {
+		tpl = defaultEmoteTemplate
+	}
+	var buffer strings.Builder
+	_ = tpl.Execute(&buffer, &EmoteTemplateData{Displayname: displayname, Text: text})
+	return buffer.String()
+}
+
+// DateLocation returns the timezone that Slack date tokens are shown in.
+func (bc BridgeConfig) DateLocation() *time.Location {
+	if bc.dateLocation == nil {
+		return time.UTC
+	}
+	return bc.dateLocation
+}
+
+// defaultEmoteTemplate is used for emotes that can't be sent as Slack /me
+// messages when no emote template is configured.
+var defaultEmoteTemplate = template.Must(template.New("emote").Parse("_{{.Displayname}} {{.Text}}_"))
+
 type ChannelNameParams struct {
 	Name string
 	Type database.ChannelType
@@ -0,0 +1,170 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+	up "maunium.net/go/mautrix/util/configupgrade"
+)
+
+var envVarRegex = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// substituteEnv replaces ${VAR} in the value with the environment variable
+// VAR. Use $${ to write a literal ${.
+func substituteEnv(value string) (string, error) {
+	var missing string
+	result := envVarRegex.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		name := match[2 : len(match)-1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return envValue
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is referenced in the config, but isn't set", missing)
+	}
+	return result, nil
+}
+
+// substituteEnvInNode substitutes environment variables in all scalar values
+// of the YAML tree. Map keys are left as-is.
+func substituteEnvInNode(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !envVarRegex.MatchString(node.Value) {
+			return nil
+		}
+		value, err := substituteEnv(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		node.Value = value
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle|yaml.TaggedStyle) == 0 {
+			// Let plain values like ${PORT} resolve to the type of the substituted value
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := substituteEnvInNode(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := substituteEnvInNode(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type envReference struct {
+	path  []string
+	node  *yaml.Node
+	raw   string
+	tag   string
+	style yaml.Style
+}
+
+// resolveEnvForUpgrade substitutes environment variables in the scalar values
+// of the YAML tree like substituteEnvInNode, but remembers the original
+// references so that they can be put back after the upgrade. Values that
+// reference unset variables are left as-is.
+func resolveEnvForUpgrade(node *yaml.Node, path []string, refs []envReference) []envReference {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !envVarRegex.MatchString(node.Value) {
+			return refs
+		}
+		refs = append(refs, envReference{
+			path:  append([]string{}, path...),
+			node:  node,
+			raw:   node.Value,
+			tag:   node.Tag,
+			style: node.Style,
+		})
+		value, err := substituteEnv(node.Value)
+		if err != nil {
+			return refs
+		}
+		node.Value = value
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle|yaml.TaggedStyle) == 0 {
+			// Re-resolve the tag so that the upgrader's type checks see the substituted value's type
+			var resolved yaml.Node
+			if yaml.Unmarshal([]byte(value), &resolved) == nil && len(resolved.Content) == 1 && resolved.Content[0].Kind == yaml.ScalarNode {
+				node.Tag = resolved.Content[0].Tag
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			refs = resolveEnvForUpgrade(node.Content[i], append(path, node.Content[i-1].Value), refs)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			refs = resolveEnvForUpgrade(child, append(path, fmt.Sprintf("[%d]", i)), refs)
+		}
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			refs = resolveEnvForUpgrade(child, path, refs)
+		}
+	}
+	return refs
+}
+
+// EnvUpgrader wraps the config upgrader so that values referencing
+// environment variables pass its type checks. The references themselves are
+// what ends up in the upgraded config, so the substituted values are never
+// written to disk.
+type EnvUpgrader struct {
+	*up.StructUpgrader
+}
+
+func (eu EnvUpgrader) DoUpgrade(helper *up.Helper) {
+	refs := resolveEnvForUpgrade(helper.Config.Node, nil, nil)
+	eu.StructUpgrader.DoUpgrade(helper)
+	for _, ref := range refs {
+		// Lists and maps are copied by reference, so restoring the source
+		// node covers values inside them.
+		ref.node.Value, ref.node.Tag, ref.node.Style = ref.raw, ref.tag, ref.style
+		// Scalars are copied by value, so they have to be restored in the
+		// upgraded config separately.
+		if base := helper.GetBaseNode(ref.path...); base != nil && base.Kind == yaml.ScalarNode {
+			base.Value, base.Tag, base.Style = ref.raw, ref.tag, ref.style
+		}
+	}
+}
+
+type umConfig Config
+
+// UnmarshalYAML substitutes ${VAR} references with environment variables
+// before parsing, so that secrets don't have to be stored in the config file.
+// The file itself is never rewritten with the substituted values.
+func (config *Config) UnmarshalYAML(node *yaml.Node) error {
+	if err := substituteEnvInNode(node); err != nil {
+		return err
+	}
+	return node.Decode((*umConfig)(config))
+}
@@ -0,0 +1,174 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var slackChannelIDRegex = regexp.MustCompile(`^[CDG][A-Z0-9]+$`)
+
+type FilterMode string
+
+const (
+	FilterModeAllow FilterMode = "allow"
+	FilterModeDeny  FilterMode = "deny"
+)
+
+// FilterList is either an allowlist or a blocklist, depending on the mode.
+type FilterList struct {
+	Mode FilterMode `yaml:"mode"`
+	List []string   `yaml:"list"`
+}
+
+func (fl *FilterList) validate() error {
+	switch fl.Mode {
+	case "":
+		fl.Mode = FilterModeDeny
+	case FilterModeAllow, FilterModeDeny:
+	default:
+		return fmt.Errorf("unknown filter mode %q", fl.Mode)
+	}
+	for _, entry := range fl.List {
+		if _, err := path.Match(strings.TrimPrefix(entry, "#"), ""); err != nil {
+			return fmt.Errorf("invalid filter pattern %q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+func (fl *FilterList) allows(matches func(entry string) bool) bool {
+	matched := false
+	for _, entry := range fl.List {
+		if matches(entry) {
+			matched = true
+			break
+		}
+	}
+	if fl.Mode == FilterModeAllow {
+		return matched
+	}
+	return !matched
+}
+
+type FilterConfig struct {
+	Channels  FilterList `yaml:"channels"`
+	Users     FilterList `yaml:"users"`
+	BlockBots bool       `yaml:"block_bots"`
+
+	ReadOnlyChannels []string `yaml:"read_only_channels"`
+}
+
+func (fc *FilterConfig) validate() error {
+	if err := fc.Channels.validate(); err != nil {
+		return fmt.Errorf("channel filter: %w", err)
+	} else if err = fc.Users.validate(); err != nil {
+		return fmt.Errorf("user filter: %w", err)
+	}
+	for _, entry := range fc.ReadOnlyChannels {
+		if _, err := path.Match(strings.TrimPrefix(entry, "#"), ""); err != nil {
+			return fmt.Errorf("invalid read-only channel pattern %q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+func matchesChannel(entry, channelID, name string) bool {
+	if slackChannelIDRegex.MatchString(entry) {
+		return entry == channelID
+	} else if name == "" {
+		return false
+	}
+	matched, _ := path.Match(strings.TrimPrefix(entry, "#"), name)
+	return matched
+}
+
+// IsChannelAllowed checks the channel filter. Entries that look like channel
+// IDs are compared to the ID, anything else is a glob pattern for the channel
+// name. DMs and group DMs don't have names, so they can only be matched by ID.
+func (fc *FilterConfig) IsChannelAllowed(channelID, name string) bool {
+	return fc.Channels.allows(func(entry string) bool {
+		return matchesChannel(entry, channelID, name)
+	})
+}
+
+// IsChannelReadOnly checks whether the channel matches any of the read-only
+// channel entries, which are matched the same way as the channel filter.
+func (fc *FilterConfig) IsChannelReadOnly(channelID, name string) bool {
+	for _, entry := range fc.ReadOnlyChannels {
+		if matchesChannel(entry, channelID, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserAllowed checks the user filter for a Slack user or bot ID.
+func (fc *FilterConfig) IsUserAllowed(userID string) bool {
+	if userID == "" {
+		return true
+	}
+	return fc.Users.allows(func(entry string) bool {
+		return strings.EqualFold(entry, userID)
+	})
+}
+
+type ContentFilterType string
+
+const (
+	ContentFilterExec ContentFilterType = "exec"
+	ContentFilterHTTP ContentFilterType = "http"
+)
+
+type ContentFilterConfig struct {
+	Type       ContentFilterType `yaml:"type"`
+	Command    []string          `yaml:"command"`
+	URL        string            `yaml:"url"`
+	TimeoutStr string            `yaml:"timeout"`
+	FailOpen   bool              `yaml:"fail_open"`
+
+	Timeout time.Duration `yaml:"-"`
+}
+
+func (cfc *ContentFilterConfig) validate() (err error) {
+	switch cfc.Type {
+	case "":
+		return nil
+	case ContentFilterExec:
+		if len(cfc.Command) == 0 {
+			return fmt.Errorf("exec content filter is missing command")
+		}
+	case ContentFilterHTTP:
+		if cfc.URL == "" {
+			return fmt.Errorf("http content filter is missing URL")
+		}
+	default:
+		return fmt.Errorf("unknown content filter type %q", cfc.Type)
+	}
+	cfc.Timeout = 5 * time.Second
+	if cfc.TimeoutStr != "" {
+		cfc.Timeout, err = time.ParseDuration(cfc.TimeoutStr)
+		if err != nil {
+			return fmt.Errorf("invalid content filter timeout: %w", err)
+		}
+	}
+	return nil
+}
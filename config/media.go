@@ -0,0 +1,111 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type MediaConfig struct {
+	StripEXIF         bool `yaml:"strip_exif"`
+	MaxImageDimension int  `yaml:"max_image_dimension"`
+	Blurhash          bool `yaml:"blurhash"`
+	Thumbnails        bool `yaml:"thumbnails"`
+	ConvertAnimations bool `yaml:"convert_animations"`
+	ClipTranscripts   bool `yaml:"clip_transcripts"`
+
+	MaxFileSize int64 `yaml:"max_file_size"`
+
+	ExternalUploadThreshold int64 `yaml:"external_upload_threshold"`
+	UploadRetries           int   `yaml:"upload_retries"`
+
+	LinkThreshold        int64  `yaml:"link_threshold"`
+	ProxyLinks           bool   `yaml:"proxy_links"`
+	ProxyLinkLifetimeStr string `yaml:"proxy_link_lifetime"`
+	PublicAddress        string `yaml:"public_address"`
+
+	ProxyLinkLifetime time.Duration `yaml:"-"`
+}
+
+func (mc *MediaConfig) validate() (err error) {
+	if mc.ProxyLinks && mc.PublicAddress == "" {
+		return fmt.Errorf("media.proxy_links requires media.public_address to be set")
+	}
+	mc.ProxyLinkLifetime = 7 * 24 * time.Hour
+	if mc.ProxyLinkLifetimeStr != "" {
+		mc.ProxyLinkLifetime, err = time.ParseDuration(mc.ProxyLinkLifetimeStr)
+		if err != nil {
+			return fmt.Errorf("invalid media.proxy_link_lifetime: %w", err)
+		} else if mc.ProxyLinkLifetime <= 0 {
+			return fmt.Errorf("media.proxy_link_lifetime must be positive")
+		}
+	}
+	return nil
+}
+
+type AntivirusType string
+
+const (
+	AntivirusClamd AntivirusType = "clamd"
+	AntivirusExec  AntivirusType = "exec"
+)
+
+type AntivirusConfig struct {
+	Type         AntivirusType `yaml:"type"`
+	ClamdAddress string        `yaml:"clamd_address"`
+	Command      []string      `yaml:"command"`
+	TimeoutStr   string        `yaml:"timeout"`
+	FailOpen     bool          `yaml:"fail_open"`
+
+	Timeout time.Duration `yaml:"-"`
+}
+
+// ClamdNetwork splits the clamd address into a network and an address that
+// can be passed to net.Dial.
+func (ac *AntivirusConfig) ClamdNetwork() (network, address string) {
+	if strings.HasPrefix(ac.ClamdAddress, "unix:") {
+		return "unix", strings.TrimPrefix(ac.ClamdAddress, "unix:")
+	}
+	return "tcp", strings.TrimPrefix(ac.ClamdAddress, "tcp:")
+}
+
+func (ac *AntivirusConfig) validate() (err error) {
+	switch ac.Type {
+	case "":
+		return nil
+	case AntivirusClamd:
+		if ac.ClamdAddress == "" {
+			return fmt.Errorf("clamd antivirus is missing address")
+		}
+	case AntivirusExec:
+		if len(ac.Command) == 0 {
+			return fmt.Errorf("exec antivirus is missing command")
+		}
+	default:
+		return fmt.Errorf("unknown antivirus type %q", ac.Type)
+	}
+	ac.Timeout = 30 * time.Second
+	if ac.TimeoutStr != "" {
+		ac.Timeout, err = time.ParseDuration(ac.TimeoutStr)
+		if err != nil {
+			return fmt.Errorf("invalid antivirus timeout: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	RelayTemplateUsername = "username"
+	RelayTemplateIconURL  = "icon_url"
+)
+
+type RelayConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	AdminOnly bool `yaml:"admin_only"`
+
+	UsernameTemplate string                       `yaml:"username_template"`
+	IconURLTemplate  string                       `yaml:"icon_url_template"`
+	MessageFormats   map[event.MessageType]string `yaml:"message_formats"`
+
+	templates map[string]*template.Template `yaml:"-"`
+}
+
+// RelayTemplateData is passed to relay templates when a message from a Matrix
+// user without a Slack login is sent through the relay user.
+type RelayTemplateData struct {
+	UserID      id.UserID
+	Displayname string
+	AvatarURL   string
+	MsgType     event.MessageType
+}
+
+type umRelayConfig RelayConfig
+
+func (rc *RelayConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Team overrides are decoded on top of the global config, so the map must not be shared
+	formats := make(map[event.MessageType]string, len(rc.MessageFormats))
+	for msgType, format := range rc.MessageFormats {
+		formats[msgType] = format
+	}
+	rc.MessageFormats = formats
+	err := unmarshal((*umRelayConfig)(rc))
+	if err != nil {
+		return err
+	}
+
+	rc.templates = make(map[string]*template.Template, len(rc.MessageFormats)+2)
+	sources := map[string]string{
+		RelayTemplateUsername: rc.UsernameTemplate,
+		RelayTemplateIconURL:  rc.IconURLTemplate,
+	}
+	for msgType, format := range rc.MessageFormats {
+		sources[string(msgType)] = format
+	}
+	for key, source := range sources {
+		rc.templates[key], err = ParseRelayTemplate(key, source)
+		if err != nil {
+			return fmt.Errorf("invalid relay template %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// IsValidRelayTemplateKey checks whether the key is the username or icon URL
+// template, or a message type that relayed messages can have.
+func IsValidRelayTemplateKey(key string) bool {
+	switch key {
+	case RelayTemplateUsername, RelayTemplateIconURL:
+		return true
+	}
+	switch event.MessageType(key) {
+	case event.MsgText, event.MsgNotice, event.MsgEmote,
+		event.MsgImage, event.MsgFile, event.MsgAudio, event.MsgVideo:
+		return true
+	}
+	return false
+}
+
+func ParseRelayTemplate(key, source string) (*template.Template, error) {
+	return template.New(key).Parse(source)
+}
+
+// GetTemplate returns the relay template for the username, icon URL or a
+// message type. Media types fall back to the m.file template.
+func (rc *RelayConfig) GetTemplate(key string) *template.Template {
+	if tpl, ok := rc.templates[key]; ok {
+		return tpl
+	}
+	switch event.MessageType(key) {
+	case event.MsgImage, event.MsgAudio, event.MsgVideo:
+		return rc.templates[string(event.MsgFile)]
+	}
+	return nil
+}
+
+func ExecuteRelayTemplate(tpl *template.Template, data *RelayTemplateData) string {
+	if tpl == nil {
+		return ""
+	}
+	var buffer strings.Builder
+	_ = tpl.Execute(&buffer, data)
+	return buffer.String()
+}
@@ -0,0 +1,115 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ApplyReloadable copies the settings that can safely change while the bridge
+// is running from another config, and returns the names of the ones that
+// changed. Everything else only takes effect after a restart. It must not be
+// called on a config that other goroutines may be reading.
+func (bc *BridgeConfig) ApplyReloadable(from *BridgeConfig) (changed []string) {
+	apply := func(name string, dst, src interface{}) {
+		dstVal, srcVal := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+		if !reflect.DeepEqual(dstVal.Interface(), srcVal.Interface()) {
+			dstVal.Set(srcVal)
+			changed = append(changed, name)
+		}
+	}
+	apply("permissions", &bc.Permissions, &from.Permissions)
+	apply("command_permissions", &bc.CommandPermissions, &from.CommandPermissions)
+	apply("command_cooldowns", &bc.CommandCooldowns, &from.CommandCooldowns)
+	bc.CommandCooldownsStr = from.CommandCooldownsStr
+	apply("management_room_text", &bc.ManagementRoomText, &from.ManagementRoomText)
+	apply("message_handling_timeout", &bc.MessageHandlingTimeout, &from.MessageHandlingTimeout)
+	apply("backfill", &bc.Backfill, &from.Backfill)
+	apply("filter", &bc.Filter, &from.Filter)
+	apply("thread_mode", &bc.ThreadMode, &from.ThreadMode)
+	apply("edit_history", &bc.EditHistory, &from.EditHistory)
+	apply("unfurl", &bc.Unfurl, &from.Unfurl)
+	apply("notice_policy", &bc.NoticePolicy, &from.NoticePolicy)
+	apply("notice_prefix", &bc.NoticePrefix, &from.NoticePrefix)
+	apply("ephemeral_messages", &bc.EphemeralMessages, &from.EphemeralMessages)
+	apply("admin_notices", &bc.AdminNotices, &from.AdminNotices)
+	apply("private_chat_portal_meta", &bc.PrivateChatPortalMeta, &from.PrivateChatPortalMeta)
+	apply("team_icon_fallback", &bc.TeamIconFallback, &from.TeamIconFallback)
+	apply("bookmarks", &bc.Bookmarks, &from.Bookmarks)
+	apply("saved_items", &bc.SavedItems, &from.SavedItems)
+	apply("sync_favourites", &bc.SyncFavourites, &from.SyncFavourites)
+	apply("sync_mutes", &bc.SyncMutes, &from.SyncMutes)
+	apply("dnd", &bc.DND, &from.DND)
+	apply("redactions", &bc.Redactions, &from.Redactions)
+	apply("loop_prevention", &bc.LoopPrevention, &from.LoopPrevention)
+	apply("api_concurrency", &bc.APIConcurrency, &from.APIConcurrency)
+	apply("usage_stats", &bc.UsageStats, &from.UsageStats)
+	apply("reaction_resync", &bc.ReactionResync, &from.ReactionResync)
+	apply("retention", &bc.Retention, &from.Retention)
+	apply("deactivated_displayname_suffix", &bc.DeactivatedSuffix, &from.DeactivatedSuffix)
+	apply("guest_displayname_suffix", &bc.GuestSuffix, &from.GuestSuffix)
+	apply("guest_channel_membership", &bc.GuestChannelMembership, &from.GuestChannelMembership)
+	apply("sender_local_time", &bc.SenderLocalTime, &from.SenderLocalTime)
+	apply("status_emoji_in_displayname", &bc.StatusEmoji, &from.StatusEmoji)
+	apply("message_cache_size", &bc.MessageCacheSize, &from.MessageCacheSize)
+	apply("puppet_cache_size", &bc.PuppetCacheSize, &from.PuppetCacheSize)
+	apply("sync_progress", &bc.SyncProgress, &from.SyncProgress)
+	apply("api_stats", &bc.APIStats, &from.APIStats)
+	if !yamlEqual(bc.Relay, from.Relay) {
+		bc.Relay = from.Relay
+		changed = append(changed, "relay")
+	}
+
+	if bc.DisplaynameTemplate != from.DisplaynameTemplate {
+		bc.DisplaynameTemplate, bc.displaynameTemplate = from.DisplaynameTemplate, from.displaynameTemplate
+		changed = append(changed, "displayname_template")
+	}
+	if bc.BotDisplaynameTemplate != from.BotDisplaynameTemplate {
+		bc.BotDisplaynameTemplate, bc.botDisplaynameTemplate = from.BotDisplaynameTemplate, from.botDisplaynameTemplate
+		changed = append(changed, "bot_displayname_template")
+	}
+	if bc.EmoteTemplate != from.EmoteTemplate {
+		bc.EmoteTemplate, bc.emoteTemplate = from.EmoteTemplate, from.emoteTemplate
+		changed = append(changed, "emote_template")
+	}
+	if bc.DateTimezone != from.DateTimezone {
+		bc.DateTimezone, bc.dateLocation = from.DateTimezone, from.dateLocation
+		changed = append(changed, "date_timezone")
+	}
+	if bc.ChannelNameTemplate != from.ChannelNameTemplate {
+		bc.ChannelNameTemplate, bc.channelNameTemplate = from.ChannelNameTemplate, from.channelNameTemplate
+		changed = append(changed, "channel_name_template")
+	}
+	if !yamlEqual(bc.TeamOverrides, from.TeamOverrides) {
+		bc.TeamOverrides = from.TeamOverrides
+		changed = append(changed, "team_overrides")
+	}
+	// Team configs are copies of the whole config, so they're always replaced to pick up the other changes
+	bc.teamConfigs = from.teamConfigs
+	return
+}
+
+// yamlEqual compares values by their YAML encoding, which ignores the
+// positions stored in yaml.Node.
+func yamlEqual(a, b interface{}) bool {
+	aData, errA := yaml.Marshal(a)
+	bData, errB := yaml.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aData, bData)
+}
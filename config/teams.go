@@ -0,0 +1,109 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// TeamOverride contains the settings that can be changed for a single Slack
+// team. Anything that isn't set in the override is inherited from the global
+// bridge config.
+type TeamOverride struct {
+	Backfill BackfillConfig `yaml:"backfill"`
+	Relay    RelayConfig    `yaml:"relay"`
+	Filter   FilterConfig   `yaml:"filter"`
+
+	ThreadMode database.ThreadMode `yaml:"thread_mode"`
+
+	DisplaynameTemplate    string `yaml:"displayname_template"`
+	BotDisplaynameTemplate string `yaml:"bot_displayname_template"`
+	ChannelNameTemplate    string `yaml:"channel_name_template"`
+}
+
+func (bc *BridgeConfig) parseTeamOverrides() error {
+	bc.teamConfigs = make(map[string]*BridgeConfig, len(bc.TeamOverrides))
+	for key, node := range bc.TeamOverrides {
+		// Decoding on top of the global values means only the fields in the override are replaced
+		override := TeamOverride{
+			Backfill:               bc.Backfill,
+			Relay:                  bc.Relay,
+			Filter:                 bc.Filter,
+			ThreadMode:             bc.ThreadMode,
+			DisplaynameTemplate:    bc.DisplaynameTemplate,
+			BotDisplaynameTemplate: bc.BotDisplaynameTemplate,
+			ChannelNameTemplate:    bc.ChannelNameTemplate,
+		}
+		err := node.Decode(&override)
+		if err != nil {
+			return fmt.Errorf("invalid override for team %s: %w", key, err)
+		}
+		err = override.Filter.validate()
+		if err != nil {
+			return fmt.Errorf("invalid filter override for team %s: %w", key, err)
+		} else if override.ThreadMode == database.ThreadModeDefault || !override.ThreadMode.IsValid() {
+			return fmt.Errorf("invalid thread mode override for team %s: %q", key, override.ThreadMode)
+		}
+
+		teamConfig := *bc
+		teamConfig.TeamOverrides = nil
+		teamConfig.teamConfigs = nil
+		teamConfig.Backfill = override.Backfill
+		teamConfig.Relay = override.Relay
+		teamConfig.Filter = override.Filter
+		teamConfig.ThreadMode = override.ThreadMode
+		teamConfig.DisplaynameTemplate = override.DisplaynameTemplate
+		teamConfig.BotDisplaynameTemplate = override.BotDisplaynameTemplate
+		teamConfig.ChannelNameTemplate = override.ChannelNameTemplate
+		err = teamConfig.parseNameTemplates()
+		if err != nil {
+			return fmt.Errorf("invalid name template override for team %s: %w", key, err)
+		}
+		bc.teamConfigs[key] = &teamConfig
+	}
+	return nil
+}
+
+// ForTeam returns the bridge config with the overrides of the given team
+// applied. Overrides are looked up by team ID first, and then by the team's
+// domain, which is only fetched if there's no override for the ID.
+func (bc *BridgeConfig) ForTeam(teamID string, getDomain func() string) *BridgeConfig {
+	if len(bc.teamConfigs) == 0 {
+		return bc
+	} else if teamConfig, ok := bc.teamConfigs[teamID]; ok {
+		return teamConfig
+	} else if teamConfig, ok = bc.teamConfigs[getDomain()]; ok {
+		return teamConfig
+	}
+	return bc
+}
+
+// BackfillEnabledForAnyTeam checks whether backfill is enabled globally or in
+// any team override.
+func (bc *BridgeConfig) BackfillEnabledForAnyTeam() bool {
+	if bc.Backfill.Enable {
+		return true
+	}
+	for _, teamConfig := range bc.teamConfigs {
+		if teamConfig.Backfill.Enable {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+type TranslationBackend string
+
+const (
+	TranslationLibreTranslate TranslationBackend = "libretranslate"
+	TranslationDeepL          TranslationBackend = "deepl"
+)
+
+type TranslationConfig struct {
+	Backend     TranslationBackend       `yaml:"backend"`
+	URL         string                   `yaml:"url"`
+	APIKey      string                   `yaml:"api_key"`
+	DefaultMode database.TranslationMode `yaml:"default_mode"`
+	TimeoutStr  string                   `yaml:"timeout"`
+
+	Timeout time.Duration `yaml:"-"`
+}
+
+func (tc *TranslationConfig) validate() (err error) {
+	switch tc.Backend {
+	case "":
+		return nil
+	case TranslationLibreTranslate, TranslationDeepL:
+		if tc.URL == "" {
+			return fmt.Errorf("%s translation backend is missing URL", tc.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown translation backend %q", tc.Backend)
+	}
+	if tc.DefaultMode == "" {
+		tc.DefaultMode = database.TranslationAppend
+	} else if !tc.DefaultMode.IsValid() {
+		return fmt.Errorf("invalid translation default_mode %q, must be append or replace", tc.DefaultMode)
+	}
+	tc.Timeout = 10 * time.Second
+	if tc.TimeoutStr != "" {
+		tc.Timeout, err = time.ParseDuration(tc.TimeoutStr)
+		if err != nil {
+			return fmt.Errorf("invalid translation timeout: %w", err)
+		}
+	}
+	return nil
+}
@@ -29,10 +29,56 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "bridge", "displayname_template")
 	helper.Copy(up.Str, "bridge", "bot_displayname_template")
 	helper.Copy(up.Str, "bridge", "channel_name_template")
+	helper.Copy(up.Str|up.Null, "bridge", "deactivated_displayname_suffix")
+	helper.Copy(up.Str|up.Null, "bridge", "guest_displayname_suffix")
+	helper.Copy(up.Bool, "bridge", "guest_channel_membership")
+	helper.Copy(up.Str, "bridge", "sender_local_time")
+	helper.Copy(up.Bool, "bridge", "status_emoji_in_displayname")
+	helper.Copy(up.Bool, "bridge", "team_icon_fallback")
+	helper.Copy(up.Bool, "bridge", "bookmarks")
+	helper.Copy(up.Bool, "bridge", "spaces", "enable")
+	helper.Copy(up.Bool, "bridge", "spaces", "sections")
+	helper.Copy(up.Bool, "bridge", "saved_items", "sync")
+	helper.Copy(up.Str|up.Null, "bridge", "saved_items", "reaction")
+	helper.Copy(up.Bool, "bridge", "sync_favourites")
+	helper.Copy(up.Bool, "bridge", "sync_mutes")
+	helper.Copy(up.Bool, "bridge", "dnd", "notices")
+	helper.Copy(up.Bool, "bridge", "dnd", "snooze_push_rules")
+	helper.Copy(up.Str, "bridge", "redactions", "matrix_to_slack")
+	helper.Copy(up.Str, "bridge", "redactions", "slack_to_matrix")
+	helper.Copy(up.Str, "bridge", "redactions", "placeholder")
+	helper.Copy(up.Int, "bridge", "redactions", "bulk_rate")
+	if legacyPortalMeta, ok := helper.Get(up.Bool, "bridge", "private_chat_portal_meta"); ok {
+		if legacyPortalMeta == "true" {
+			helper.Set(up.Str, "always", "bridge", "private_chat_portal_meta")
+		} else {
+			helper.Set(up.Str, "default", "bridge", "private_chat_portal_meta")
+		}
+	} else {
+		helper.Copy(up.Str, "bridge", "private_chat_portal_meta")
+	}
+	helper.Copy(up.Str, "bridge", "thread_mode")
+	helper.Copy(up.Str, "bridge", "edit_history")
+	helper.Copy(up.Str, "bridge", "unfurl")
+	helper.Copy(up.Str|up.Null, "bridge", "emote_template")
+	helper.Copy(up.Str, "bridge", "notice_policy")
+	helper.Copy(up.Str, "bridge", "notice_prefix")
+	helper.Copy(up.Bool, "bridge", "ephemeral_messages")
+	helper.Copy(up.Str, "bridge", "date_timezone")
 	helper.Copy(up.Int, "bridge", "portal_message_buffer")
+	helper.Copy(up.Int, "bridge", "portal_workers")
+	helper.Copy(up.Int, "bridge", "slack_event_workers")
 	helper.Copy(up.Bool, "bridge", "delivery_receipts")
 	helper.Copy(up.Bool, "bridge", "message_status_events")
 	helper.Copy(up.Bool, "bridge", "message_error_notices")
+	helper.Copy(up.Bool, "bridge", "usage_stats")
+	helper.Copy(up.Str, "bridge", "status_batching", "interval")
+	helper.Copy(up.Int, "bridge", "status_batching", "max_per_room")
+	helper.Copy(up.Int, "bridge", "api_concurrency", "max_calls")
+	helper.Copy(up.Int, "bridge", "api_concurrency", "reserved_interactive")
+	helper.Copy(up.List, "bridge", "loop_prevention", "gateway_bots")
+	helper.Copy(up.Str, "bridge", "loop_prevention", "echo_window")
+	helper.Copy(up.Bool, "bridge", "loop_prevention", "notice")
 	helper.Copy(up.Bool, "bridge", "sync_with_custom_puppets")
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "default_bridge_receipts")
@@ -40,7 +86,12 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
 	helper.Copy(up.Map, "bridge", "login_shared_secret_map")
-	helper.Copy(up.Map, "bridge", "message_handling_timeout")
+	helper.Copy(up.Str, "bridge", "message_handling_timeout", "error_after")
+	helper.Copy(up.Str, "bridge", "message_handling_timeout", "deadline")
+	helper.Copy(up.Str|up.Null, "bridge", "message_handling_timeout", "max_age")
+	helper.Copy(up.Bool, "bridge", "message_handling_timeout", "retry_after_restart")
+	helper.Copy(up.Bool, "bridge", "message_handling_timeout", "bridge_delayed")
+	helper.Copy(up.Str, "bridge", "message_handling_timeout", "delayed_marker")
 	helper.Copy(up.Str, "bridge", "command_prefix")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome")
 	helper.Copy(up.Str, "bridge", "management_room_text", "welcome_connected")
@@ -61,6 +112,78 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Int, "bridge", "backfill", "unread_hours_threshold")
 	helper.Copy(up.Int, "bridge", "backfill", "immediate_messages")
 	helper.Copy(up.Map, "bridge", "backfill", "incremental")
+	helper.Copy(up.Bool, "bridge", "event_archive", "enable")
+	helper.Copy(up.Int, "bridge", "event_archive", "max_events")
+	helper.Copy(up.Str, "bridge", "event_archive", "max_age")
+	helper.Copy(up.Bool, "bridge", "audit_log", "enable")
+	helper.Copy(up.Str|up.Null, "bridge", "audit_log", "notice_room")
+	helper.Copy(up.Str|up.Null, "bridge", "admin_notices", "room")
+	helper.Copy(up.Bool, "bridge", "admin_notices", "token_expiry")
+	helper.Copy(up.Int, "bridge", "admin_notices", "send_failure_threshold")
+	helper.Copy(up.Bool, "bridge", "admin_notices", "api_warnings")
+	helper.Copy(up.Bool, "bridge", "admin_notices", "backfill_complete")
+	helper.Copy(up.Bool, "bridge", "admin_notices", "start_stop")
+	helper.Copy(up.Str, "bridge", "filter", "channels", "mode")
+	helper.Copy(up.List, "bridge", "filter", "channels", "list")
+	helper.Copy(up.Str, "bridge", "filter", "users", "mode")
+	helper.Copy(up.List, "bridge", "filter", "users", "list")
+	helper.Copy(up.Bool, "bridge", "filter", "block_bots")
+	helper.Copy(up.List, "bridge", "filter", "read_only_channels")
+	helper.Copy(up.Str|up.Null, "bridge", "content_filter", "type")
+	helper.Copy(up.List, "bridge", "content_filter", "command")
+	helper.Copy(up.Str|up.Null, "bridge", "content_filter", "url")
+	helper.Copy(up.Str, "bridge", "content_filter", "timeout")
+	helper.Copy(up.Bool, "bridge", "content_filter", "fail_open")
+	helper.Copy(up.Str|up.Null, "bridge", "translation", "backend")
+	helper.Copy(up.Str|up.Null, "bridge", "translation", "url")
+	helper.Copy(up.Str|up.Null, "bridge", "translation", "api_key")
+	helper.Copy(up.Str, "bridge", "translation", "default_mode")
+	helper.Copy(up.Str, "bridge", "translation", "timeout")
+	helper.Copy(up.Bool, "bridge", "media", "strip_exif")
+	helper.Copy(up.Int, "bridge", "media", "max_image_dimension")
+	helper.Copy(up.Bool, "bridge", "media", "blurhash")
+	helper.Copy(up.Bool, "bridge", "media", "thumbnails")
+	helper.Copy(up.Bool, "bridge", "media", "convert_animations")
+	helper.Copy(up.Bool, "bridge", "media", "clip_transcripts")
+	helper.Copy(up.Int, "bridge", "media", "max_file_size")
+	helper.Copy(up.Int, "bridge", "media", "external_upload_threshold")
+	helper.Copy(up.Int, "bridge", "media", "upload_retries")
+	helper.Copy(up.Int, "bridge", "media", "link_threshold")
+	helper.Copy(up.Bool, "bridge", "media", "proxy_links")
+	helper.Copy(up.Str, "bridge", "media", "proxy_link_lifetime")
+	helper.Copy(up.Str|up.Null, "bridge", "media", "public_address")
+	helper.Copy(up.Str|up.Null, "bridge", "antivirus", "type")
+	helper.Copy(up.Str|up.Null, "bridge", "antivirus", "clamd_address")
+	helper.Copy(up.List, "bridge", "antivirus", "command")
+	helper.Copy(up.Str, "bridge", "antivirus", "timeout")
+	helper.Copy(up.Bool, "bridge", "antivirus", "fail_open")
+	helper.Copy(up.Str|up.Null, "bridge", "proxy")
+	helper.Copy(up.Map, "bridge", "team_proxies")
+	helper.Copy(up.Str, "bridge", "shutdown_timeout")
+	helper.Copy(up.Str|up.Null, "bridge", "sentry", "dsn")
+	helper.Copy(up.Str|up.Null, "bridge", "sentry", "environment")
+	helper.Copy(up.Float, "bridge", "sentry", "sample_rate")
+	helper.Copy(up.Str|up.Null, "bridge", "debug_listener")
+	helper.Copy(up.Bool, "bridge", "api_stats", "log_calls")
+	helper.Copy(up.Float, "bridge", "api_stats", "quota_warning")
+	helper.Copy(up.Str|up.Null, "bridge", "slack_app", "signing_secret")
+	helper.Copy(up.Int, "bridge", "circuit_breaker", "failure_threshold")
+	helper.Copy(up.Str, "bridge", "circuit_breaker", "probe_interval")
+	helper.Copy(up.Str|up.Null, "bridge", "reaction_resync", "interval")
+	helper.Copy(up.Int, "bridge", "reaction_resync", "messages")
+	helper.Copy(up.Str, "bridge", "retention", "interval")
+	helper.Copy(up.Int, "bridge", "retention", "days")
+	helper.Copy(up.Int, "bridge", "retention", "dm_days")
+	helper.Copy(up.Str, "bridge", "info_cache", "user_ttl")
+	helper.Copy(up.Str, "bridge", "info_cache", "channel_ttl")
+	helper.Copy(up.Int, "bridge", "info_cache", "max_entries")
+	helper.Copy(up.Str, "bridge", "sync_progress", "interval")
+	helper.Copy(up.Bool, "bridge", "sync_progress", "notices")
+	helper.Copy(up.Int, "bridge", "puppet_cache_size")
+	helper.Copy(up.Int, "bridge", "message_cache_size")
+	helper.Copy(up.Str|up.Null, "bridge", "sqlite", "journal_mode")
+	helper.Copy(up.Int, "bridge", "sqlite", "busy_timeout")
+	helper.Copy(up.Str|up.Null, "bridge", "sqlite", "synchronous")
 
 	helper.Copy(up.Str, "bridge", "provisioning", "prefix")
 	if secret, ok := helper.Get(up.Str, "bridge", "provisioning", "shared_secret"); !ok || secret == "generate" {
@@ -71,9 +194,15 @@ func DoUpgrade(helper *up.Helper) {
 	}
 
 	helper.Copy(up.Map, "bridge", "permissions")
-	//helper.Copy(up.Bool, "bridge", "relay", "enabled")
-	//helper.Copy(up.Bool, "bridge", "relay", "admin_only")
-	//helper.Copy(up.Map, "bridge", "relay", "message_formats")
+	helper.Copy(up.Str|up.Null, "bridge", "token_encryption_key")
+	helper.Copy(up.Map, "bridge", "command_permissions")
+	helper.Copy(up.Map, "bridge", "command_cooldowns")
+	helper.Copy(up.Map, "bridge", "team_overrides")
+	helper.Copy(up.Bool, "bridge", "relay", "enabled")
+	helper.Copy(up.Bool, "bridge", "relay", "admin_only")
+	helper.Copy(up.Str|up.Null, "bridge", "relay", "username_template")
+	helper.Copy(up.Str|up.Null, "bridge", "relay", "icon_url_template")
+	helper.Copy(up.Map, "bridge", "relay", "message_formats")
 }
 
 var SpacedBlocks = [][]string{
@@ -89,6 +218,8 @@ var SpacedBlocks = [][]string{
 	{"bridge", "encryption"},
 	{"bridge", "provisioning"},
 	{"bridge", "permissions"},
-	//{"bridge", "relay"},
+	{"bridge", "command_permissions"},
+	{"bridge", "relay"},
+	{"bridge", "team_overrides"},
 	{"logging"},
 }
@@ -0,0 +1,173 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/util/configupgrade"
+
+	"go.mau.fi/mautrix-slack/config"
+)
+
+var configReloadLock sync.Mutex
+
+// bridgeConfig returns the current bridge config. Reloading the config never
+// modifies a config that's in use, it stores a new copy instead, so the
+// returned config can be read without locking.
+func (br *SlackBridge) bridgeConfig() *config.BridgeConfig {
+	if live, ok := br.currentBridgeConfig.Load().(*config.BridgeConfig); ok {
+		return live
+	}
+	return &br.Config.Bridge
+}
+
+// reloadableBridgeConfig passes the config lookups of mautrix-go on to the current
+// bridge config, so that it sees reloaded settings too.
+type reloadableBridgeConfig struct {
+	br *SlackBridge
+}
+
+var _ bridgeconfig.BridgeConfig = reloadableBridgeConfig{}
+
+func (lc reloadableBridgeConfig) FormatUsername(username string) string {
+	return lc.br.bridgeConfig().FormatUsername(username)
+}
+
+func (lc reloadableBridgeConfig) GetEncryptionConfig() bridgeconfig.EncryptionConfig {
+	return lc.br.bridgeConfig().GetEncryptionConfig()
+}
+
+func (lc reloadableBridgeConfig) GetCommandPrefix() string {
+	return lc.br.bridgeConfig().GetCommandPrefix()
+}
+
+func (lc reloadableBridgeConfig) GetManagementRoomTexts() bridgeconfig.ManagementRoomTexts {
+	return lc.br.bridgeConfig().GetManagementRoomTexts()
+}
+
+func (lc reloadableBridgeConfig) GetResendBridgeInfo() bool {
+	return lc.br.bridgeConfig().GetResendBridgeInfo()
+}
+
+func (lc reloadableBridgeConfig) EnableMessageStatusEvents() bool {
+	return lc.br.bridgeConfig().EnableMessageStatusEvents()
+}
+
+func (lc reloadableBridgeConfig) EnableMessageErrorNotices() bool {
+	return lc.br.bridgeConfig().EnableMessageErrorNotices()
+}
+
+func (lc reloadableBridgeConfig) Validate() error {
+	return lc.br.bridgeConfig().Validate()
+}
+
+// loadConfigFromDisk reads and parses the config file the same way the bridge
+// does at startup, but without saving the upgraded config back to disk.
+func (br *SlackBridge) loadConfigFromDisk() (*config.Config, error) {
+	configData, upgraded, err := configupgrade.Do(br.ConfigPath, false, br.ConfigUpgrader)
+	if configData == nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	newConfig := &config.Config{BaseConfig: &bridgeconfig.BaseConfig{}}
+	newConfig.BaseConfig.Bridge = &newConfig.Bridge
+	if !upgraded {
+		err = yaml.Unmarshal([]byte(ExampleConfig), newConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse example config: %w", err)
+		}
+	}
+	err = yaml.Unmarshal(configData, newConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	return newConfig, nil
+}
+
+func configSectionsEqual(a, b interface{}) bool {
+	aData, errA := yaml.Marshal(a)
+	bData, errB := yaml.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aData, bData)
+}
+
+// ReloadConfig re-reads the config file and applies the settings that can
+// change at runtime. Slack connections and the appservice listener are left
+// alone, so changes to anything else are only reported as needing a restart.
+func (br *SlackBridge) ReloadConfig() (changed []string, needsRestart bool, err error) {
+	configReloadLock.Lock()
+	defer configReloadLock.Unlock()
+
+	newConfig, err := br.loadConfigFromDisk()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !reflect.DeepEqual(br.Config.Logging, newConfig.Logging) {
+		br.Config.Logging = newConfig.Logging
+		br.Config.Logging.Configure(br.Log)
+		changed = append(changed, "logging")
+	}
+	// Goroutines may be reading the current config, so the changes are applied to a copy that then replaces it
+	nextBridgeConfig := *br.bridgeConfig()
+	changed = append(changed, nextBridgeConfig.ApplyReloadable(&newConfig.Bridge)...)
+	br.currentBridgeConfig.Store(&nextBridgeConfig)
+
+	// The database URI is modified with SQLite parameters on startup, so it can't be compared directly
+	newConfig.AppService.Database = br.Config.AppService.Database
+	needsRestart = !configSectionsEqual(br.Config.Homeserver, newConfig.Homeserver) ||
+		!configSectionsEqual(br.Config.AppService, newConfig.AppService) ||
+		!configSectionsEqual(nextBridgeConfig, newConfig.Bridge)
+
+	// Users that aren't loaded yet will get the new permissions when they're loaded
+	br.usersLock.Lock()
+	for _, user := range br.usersByMXID {
+		user.PermissionLevel = nextBridgeConfig.Permissions.Get(user.MXID)
+	}
+	br.usersLock.Unlock()
+	return changed, needsRestart, nil
+}
+
+func (br *SlackBridge) logConfigReload(changed []string, needsRestart bool, err error) {
+	if err != nil {
+		br.Log.Errorln("Failed to reload config:", err)
+		return
+	} else if len(changed) == 0 {
+		br.Log.Infoln("Reloaded config, no runtime settings changed")
+	} else {
+		br.Log.Infofln("Reloaded config, changed settings: %v", changed)
+	}
+	if needsRestart {
+		br.Log.Warnln("Some changed settings can't be reloaded and will only apply after restarting the bridge")
+	}
+}
+
+func (br *SlackBridge) handleReloadSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		br.Log.Infoln("SIGHUP received, reloading config")
+		br.logConfigReload(br.ReloadConfig())
+	}
+}
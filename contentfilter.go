@@ -0,0 +1,210 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/config"
+)
+
+type ContentFilterDirection string
+
+const (
+	ContentFilterMatrixToSlack ContentFilterDirection = "matrix_to_slack"
+	ContentFilterSlackToMatrix ContentFilterDirection = "slack_to_matrix"
+)
+
+type ContentFilterAction string
+
+const (
+	ContentFilterAllow  ContentFilterAction = "allow"
+	ContentFilterModify ContentFilterAction = "modify"
+	ContentFilterReject ContentFilterAction = "reject"
+)
+
+// ContentFilterRequest is sent to the content filter for each message text
+// and media caption. Text is the final text that will be bridged: Slack's
+// mrkdwn format for messages to Slack, and the plain text body for messages to
+// Matrix.
+type ContentFilterRequest struct {
+	Direction ContentFilterDirection `json:"direction"`
+	TeamID    string                 `json:"team_id"`
+	ChannelID string                 `json:"channel_id"`
+	RoomID    id.RoomID              `json:"room_id,omitempty"`
+	Sender    string                 `json:"sender"`
+	Text      string                 `json:"text"`
+}
+
+type ContentFilterResult struct {
+	Action ContentFilterAction `json:"action"`
+	Text   string              `json:"text,omitempty"`
+	Reason string              `json:"reason,omitempty"`
+}
+
+// ContentFilter inspects messages before they're bridged, and can let them
+// through, replace their text or reject them.
+type ContentFilter interface {
+	Filter(ctx context.Context, req *ContentFilterRequest) (*ContentFilterResult, error)
+}
+
+var (
+	errContentRejected     = errors.New("the message was rejected by the content filter")
+	errContentFilterFailed = errors.New("the content filter failed to check the message")
+)
+
+func newContentFilter(br *SlackBridge) ContentFilter {
+	cfg := br.bridgeConfig().ContentFilter
+	switch cfg.Type {
+	case config.ContentFilterExec:
+		return &execContentFilter{command: cfg.Command}
+	case config.ContentFilterHTTP:
+		return &httpContentFilter{url: cfg.URL, client: &http.Client{}}
+	default:
+		return nil
+	}
+}
+
+type execContentFilter struct {
+	command []string
+}
+
+// Filter runs the command with the request as JSON on stdin and reads the
+// result as JSON from stdout.
+func (ecf *execContentFilter) Filter(ctx context.Context, req *ContentFilterRequest) (*ContentFilterResult, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, ecf.command[0], ecf.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w (stderr: %q)", err, stderr.String())
+	}
+	var result ContentFilterResult
+	err = json.Unmarshal(output, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output: %w", err)
+	}
+	return &result, nil
+}
+
+type httpContentFilter struct {
+	url    string
+	client *http.Client
+}
+
+// Filter POSTs the request as JSON to the endpoint and reads the result from
+// the response body.
+func (hcf *httpContentFilter) Filter(ctx context.Context, req *ContentFilterRequest) (*ContentFilterResult, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, hcf.url, bytes.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := hcf.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var result ContentFilterResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &result, nil
+}
+
+// filterContent passes the text of a message through the configured content
+// filter. It returns the text that should be bridged, or an error wrapping
+// errContentRejected or errContentFilterFailed if the message must be dropped.
+func (portal *Portal) filterContent(ctx context.Context, direction ContentFilterDirection, sender, text string) (string, error) {
+	filter := portal.bridge.ContentFilter
+	if filter == nil || text == "" {
+		return text, nil
+	}
+	cfg := portal.bridge.bridgeConfig().ContentFilter
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	result, err := filter.Filter(ctx, &ContentFilterRequest{
+		Direction: direction,
+		TeamID:    portal.Key.TeamID,
+		ChannelID: portal.Key.ChannelID,
+		RoomID:    portal.MXID,
+		Sender:    sender,
+		Text:      text,
+	})
+	if err != nil {
+		portal.log.Warnfln("Content filter failed to check %s message from %s: %v", direction, sender, err)
+		if cfg.FailOpen {
+			return text, nil
+		}
+		return "", errContentFilterFailed
+	}
+	switch result.Action {
+	case ContentFilterAllow:
+		return text, nil
+	case ContentFilterModify:
+		return result.Text, nil
+	case ContentFilterReject:
+		portal.log.Debugfln("Content filter rejected %s message from %s: %s", direction, sender, result.Reason)
+		if result.Reason != "" {
+			return "", fmt.Errorf("%w: %s", errContentRejected, result.Reason)
+		}
+		return "", errContentRejected
+	default:
+		portal.log.Warnfln("Content filter returned unknown action %q for %s message from %s", result.Action, direction, sender)
+		if cfg.FailOpen {
+			return text, nil
+		}
+		return "", errContentFilterFailed
+	}
+}
+
+// filterSlackContent passes the body of converted Slack content through the
+// content filter. Bodies that the filter modifies replace the formatted body,
+// as the filter only sees plain text.
+func (portal *Portal) filterSlackContent(sender string, content *event.MessageEventContent) error {
+	text, err := portal.filterContent(context.Background(), ContentFilterSlackToMatrix, sender, content.Body)
+	if err != nil {
+		return err
+	} else if text != content.Body {
+		content.Body = text
+		content.Format = ""
+		content.FormattedBody = ""
+	}
+	return nil
+}
@@ -28,6 +28,7 @@ import (
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
 )
 
 var (
@@ -44,11 +45,11 @@ func (br *SlackBridge) newDoublePuppetClient(mxid id.UserID, accessToken string)
 		return nil, err
 	}
 
-	homeserverURL, found := br.Config.Bridge.DoublePuppetServerMap[homeserver]
+	homeserverURL, found := br.bridgeConfig().DoublePuppetServerMap[homeserver]
 	if !found {
 		if homeserver == br.AS.HomeserverDomain {
 			homeserverURL = br.AS.HomeserverURL
-		} else if br.Config.Bridge.DoublePuppetAllowDiscovery {
+		} else if br.bridgeConfig().DoublePuppetAllowDiscovery {
 			resp, err := mautrix.DiscoverClientAPI(homeserver)
 			if err != nil {
 				return nil, fmt.Errorf("failed to find homeserver URL for %s: %v", homeserver, err)
@@ -78,16 +79,24 @@ func (br *SlackBridge) newDoublePuppetClient(mxid id.UserID, accessToken string)
 // /////////////////////////////////////////////////////////////////////////////
 func (puppet *Puppet) GetFilterJSON(_ id.UserID) *mautrix.Filter {
 	everything := []event.Type{{Type: "*"}}
+	roomAccountData := mautrix.FilterPart{NotTypes: everything}
+	if puppet.bridge.bridgeConfig().SyncFavourites {
+		roomAccountData = mautrix.FilterPart{Types: []event.Type{event.AccountDataRoomTags}}
+	}
+	accountData := mautrix.FilterPart{NotTypes: everything}
+	if puppet.bridge.bridgeConfig().SyncMutes {
+		accountData = mautrix.FilterPart{Types: []event.Type{event.AccountDataPushRules}}
+	}
 	return &mautrix.Filter{
 		Presence: mautrix.FilterPart{
 			Senders: []id.UserID{puppet.CustomMXID},
 			Types:   []event.Type{event.EphemeralEventPresence},
 		},
-		AccountData: mautrix.FilterPart{NotTypes: everything},
+		AccountData: accountData,
 		Room: mautrix.RoomFilter{
 			Ephemeral:    mautrix.FilterPart{Types: []event.Type{event.EphemeralEventTyping, event.EphemeralEventReceipt}},
 			IncludeLeave: false,
-			AccountData:  mautrix.FilterPart{NotTypes: everything},
+			AccountData:  roomAccountData,
 			State:        mautrix.FilterPart{NotTypes: everything},
 			Timeline:     mautrix.FilterPart{NotTypes: everything},
 		},
@@ -109,13 +118,43 @@ func (puppet *Puppet) OnFailedSync(_ *mautrix.RespSync, err error) (time.Duratio
 	return 10 * time.Second, nil
 }
 
-func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, _ string) error {
+func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, since string) error {
 	if !puppet.customUser.IsLoggedIn() {
 		puppet.log.Debugln("Skipping sync processing: custom user not connected to slack")
 
 		return nil
 	}
 
+	// The initial sync has the tags of every room, only changes after it are bridged
+	if since != "" && puppet.bridge.bridgeConfig().SyncFavourites {
+		for roomID, room := range resp.Rooms.Join {
+			for _, evt := range room.AccountData.Events {
+				if evt.Type.Type != event.AccountDataRoomTags.Type {
+					continue
+				}
+				err := evt.Content.ParseRaw(event.AccountDataRoomTags)
+				if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+					continue
+				}
+				go puppet.customUser.handleMatrixTags(roomID, evt.Content.AsTag())
+			}
+		}
+	}
+
+	if since != "" && puppet.bridge.bridgeConfig().SyncMutes {
+		for _, evt := range resp.AccountData.Events {
+			if evt.Type.Type != event.AccountDataPushRules.Type {
+				continue
+			}
+			rules, err := pushrules.EventToPushRules(evt)
+			if err != nil {
+				puppet.log.Warnfln("Failed to parse push rules: %v", err)
+				continue
+			}
+			go puppet.customUser.handleMatrixPushRules(rules)
+		}
+	}
+
 	// for roomID, events := range resp.Rooms.Join {
 	// 	for _, evt := range events.Ephemeral.Events {
 	// 		evt.RoomID = roomID
@@ -161,7 +200,7 @@ func (puppet *Puppet) SaveFilterID(_ id.UserID, _ string) {
 
 func (puppet *Puppet) SaveNextBatch(_ id.UserID, nbt string) {
 	puppet.NextBatch = nbt
-	puppet.Update()
+	puppet.Update(nil)
 }
 
 func (puppet *Puppet) SaveRoom(_ *mautrix.Room) {
@@ -268,7 +307,7 @@ func (puppet *Puppet) tryRelogin(cause error, action string) bool {
 }
 
 func (puppet *Puppet) startSyncing() {
-	if !puppet.bridge.Config.Bridge.SyncWithCustomPuppets {
+	if !puppet.bridge.bridgeConfig().SyncWithCustomPuppets {
 		return
 	}
 
@@ -284,7 +323,7 @@ func (puppet *Puppet) startSyncing() {
 }
 
 func (puppet *Puppet) stopSyncing() {
-	if !puppet.bridge.Config.Bridge.SyncWithCustomPuppets {
+	if !puppet.bridge.bridgeConfig().SyncWithCustomPuppets {
 		return
 	}
 
@@ -296,7 +335,7 @@ func (puppet *Puppet) loginWithSharedSecret(mxid id.UserID, teamID string) (stri
 
 	puppet.log.Debugfln("Logging into %s with shared secret", mxid)
 
-	loginSecret := puppet.bridge.Config.Bridge.LoginSharedSecretMap[homeserver]
+	loginSecret := puppet.bridge.bridgeConfig().LoginSharedSecretMap[homeserver]
 
 	client, err := puppet.bridge.newDoublePuppetClient(mxid, "")
 	if err != nil {
@@ -347,12 +386,12 @@ func (puppet *Puppet) SwitchCustomMXID(accessToken string, mxid id.UserID) error
 		puppet.bridge.puppetsByCustomMXID[puppet.CustomMXID] = puppet
 	}
 
-	puppet.EnablePresence = puppet.bridge.Config.Bridge.DefaultBridgePresence
-	puppet.EnableReceipts = puppet.bridge.Config.Bridge.DefaultBridgeReceipts
+	puppet.EnablePresence = puppet.bridge.bridgeConfig().DefaultBridgePresence
+	puppet.EnableReceipts = puppet.bridge.bridgeConfig().DefaultBridgeReceipts
 
 	puppet.bridge.AS.StateStore.MarkRegistered(puppet.CustomMXID)
 
-	puppet.Update()
+	puppet.Update(nil)
 
 	// TODO leave rooms with default puppet
 
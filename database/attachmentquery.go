@@ -46,6 +46,15 @@ func (aq *AttachmentQuery) GetAllBySlackMessageID(key PortalKey, slackMessageID
 	return aq.getAll(query, key.TeamID, key.ChannelID, slackMessageID)
 }
 
+// GetOlderThan returns up to limit attachments in the portal whose messages
+// were sent before the given Slack timestamp.
+func (aq *AttachmentQuery) GetOlderThan(key PortalKey, beforeTs string, limit int) []*Attachment {
+	query := attachmentSelect + " WHERE team_id=$1 AND channel_id=$2" +
+		" AND slack_message_id<$3 ORDER BY slack_message_id ASC LIMIT $4"
+
+	return aq.getAll(query, key.TeamID, key.ChannelID, beforeTs, limit)
+}
+
 func (aq *AttachmentQuery) getAll(query string, args ...interface{}) []*Attachment {
 	rows, err := aq.db.Query(query, args...)
 	if err != nil {
@@ -0,0 +1,95 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type AuditLogQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+const (
+	auditEntrySelect = "SELECT audit_id, actor, action, target, params, timestamp FROM audit_log"
+)
+
+func (alq *AuditLogQuery) New() *AuditEntry {
+	return &AuditEntry{
+		db:  alq.db,
+		log: alq.log,
+	}
+}
+
+func (alq *AuditLogQuery) GetLatest(limit int) []*AuditEntry {
+	rows, err := alq.db.Query(auditEntrySelect+" ORDER BY audit_id DESC LIMIT $1", limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		if entry := alq.New().Scan(rows); entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+type AuditEntry struct {
+	db  *Database
+	log log.Logger
+
+	AuditID   int
+	Actor     id.UserID
+	Action    string
+	Target    string
+	Params    string
+	Timestamp time.Time
+}
+
+func (ae *AuditEntry) Scan(row dbutil.Scannable) *AuditEntry {
+	var timestamp int64
+	err := row.Scan(&ae.AuditID, &ae.Actor, &ae.Action, &ae.Target, &ae.Params, &timestamp)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			ae.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	ae.Timestamp = time.UnixMilli(timestamp)
+	return ae
+}
+
+func (ae *AuditEntry) Insert() {
+	query := "INSERT INTO audit_log (actor, action, target, params, timestamp)" +
+		" VALUES ($1, $2, $3, $4, $5)"
+	_, err := ae.db.Exec(query, ae.Actor, ae.Action, ae.Target, ae.Params, ae.Timestamp.UnixMilli())
+	if err != nil {
+		ae.log.Warnfln("Failed to record %s by %s in audit log: %v", ae.Action, ae.Actor, err)
+	}
+}
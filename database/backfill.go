@@ -40,14 +40,16 @@ func (bq *BackfillQuery) NewBackfillState(portalKey *PortalKey) *BackfillState {
 
 const (
 	getBackfillState = `
-		SELECT team_id, channel_id, dispatched, backfill_complete, message_count, immediate_complete
+		SELECT team_id, channel_id, dispatched, backfill_complete, message_count, immediate_complete,
+			oldest_slack_ts, newest_slack_ts
 		FROM backfill_state
 		WHERE team_id=$1
 			AND channel_id=$2
 	`
 
 	getNextUnfinishedBackfillState = `
-		SELECT team_id, channel_id, dispatched, backfill_complete, message_count, immediate_complete
+		SELECT team_id, channel_id, dispatched, backfill_complete, message_count, immediate_complete,
+			oldest_slack_ts, newest_slack_ts
 		FROM backfill_state
 		WHERE dispatched IS FALSE
 		AND backfill_complete IS FALSE
@@ -67,16 +69,24 @@ type BackfillState struct {
 	BackfillComplete  bool
 	MessageCount      int
 	ImmediateComplete bool
+
+	// The oldest and newest Slack message bridged into the portal. These are
+	// only updated through MarkBridged, never by Upsert.
+	OldestSlackTs string
+	NewestSlackTs string
 }
 
 func (b *BackfillState) Scan(row dbutil.Scannable) *BackfillState {
-	err := row.Scan(&b.Portal.TeamID, &b.Portal.ChannelID, &b.Dispatched, &b.BackfillComplete, &b.MessageCount, &b.ImmediateComplete)
+	var oldest, newest sql.NullString
+	err := row.Scan(&b.Portal.TeamID, &b.Portal.ChannelID, &b.Dispatched, &b.BackfillComplete, &b.MessageCount, &b.ImmediateComplete, &oldest, &newest)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			b.log.Errorln("Database scan failed:", err)
 		}
 		return nil
 	}
+	b.OldestSlackTs = oldest.String
+	b.NewestSlackTs = newest.String
 	return b
 }
 
@@ -102,6 +112,26 @@ func (b *BackfillState) SetDispatched(d bool) {
 	b.Upsert()
 }
 
+// MarkBridged extends the range of bridged Slack messages of the portal to
+// include the given message timestamp.
+func (bq *BackfillQuery) MarkBridged(txn dbutil.Transaction, portalKey PortalKey, slackTs string) {
+	query := `
+		UPDATE backfill_state SET
+			oldest_slack_ts=CASE WHEN oldest_slack_ts IS NULL OR oldest_slack_ts > $3 THEN $3 ELSE oldest_slack_ts END,
+			newest_slack_ts=CASE WHEN newest_slack_ts IS NULL OR newest_slack_ts < $3 THEN $3 ELSE newest_slack_ts END
+		WHERE team_id=$1 AND channel_id=$2`
+
+	var err error
+	if txn != nil {
+		_, err = txn.Exec(query, portalKey.TeamID, portalKey.ChannelID, slackTs)
+	} else {
+		_, err = bq.db.Exec(query, portalKey.TeamID, portalKey.ChannelID, slackTs)
+	}
+	if err != nil {
+		bq.log.Warnfln("Failed to update bridged message range of %s: %v", portalKey, err)
+	}
+}
+
 // Undispatch backfills so they can be retried in case the bridge crashed/was stopped during backfill
 // Sent messages are tracked in the message and portal tables so this shouldn't lead to duplicate backfills
 func (b *BackfillQuery) UndispatchAll() {
@@ -111,6 +141,19 @@ func (b *BackfillQuery) UndispatchAll() {
 	}
 }
 
+// CountPendingImmediate returns how many portals in the team haven't had
+// their first batch of messages backfilled yet.
+func (bq *BackfillQuery) CountPendingImmediate(teamID string) (count int) {
+	err := bq.db.QueryRow(`
+		SELECT COUNT(*) FROM backfill_state
+		WHERE team_id=$1 AND immediate_complete IS FALSE AND backfill_complete IS FALSE
+	`, teamID).Scan(&count)
+	if err != nil {
+		bq.log.Warnfln("Failed to count pending backfills of %s: %v", teamID, err)
+	}
+	return
+}
+
 func (bq *BackfillQuery) GetBackfillState(portalKey *PortalKey) (backfillState *BackfillState) {
 	rows, err := bq.db.Query(getBackfillState, portalKey.TeamID, portalKey.ChannelID)
 	if err != nil || rows == nil {
@@ -0,0 +1,60 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// BookmarksQuery stores the Matrix message that lists the bookmarks of a
+// channel, so it can be edited when the bookmarks change.
+type BookmarksQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (bq *BookmarksQuery) Get(key PortalKey) (id.EventID, string) {
+	var eventID, body string
+	err := bq.db.QueryRow("SELECT event_id, body FROM portal_bookmarks WHERE team_id=$1 AND channel_id=$2",
+		key.TeamID, key.ChannelID).Scan(&eventID, &body)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		bq.log.Warnfln("Failed to get bookmarks message of %s: %v", key, err)
+	}
+	return id.EventID(eventID), body
+}
+
+func (bq *BookmarksQuery) Set(key PortalKey, eventID id.EventID, body string) {
+	_, err := bq.db.Exec(`
+		INSERT INTO portal_bookmarks (team_id, channel_id, event_id, body) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (team_id, channel_id) DO UPDATE SET event_id=excluded.event_id, body=excluded.body
+	`, key.TeamID, key.ChannelID, eventID, body)
+	if err != nil {
+		bq.log.Warnfln("Failed to save bookmarks message of %s: %v", key, err)
+	}
+}
+
+func (bq *BookmarksQuery) Delete(key PortalKey) {
+	_, err := bq.db.Exec("DELETE FROM portal_bookmarks WHERE team_id=$1 AND channel_id=$2", key.TeamID, key.ChannelID)
+	if err != nil {
+		bq.log.Warnfln("Failed to delete bookmarks message of %s: %v", key, err)
+	}
+}
@@ -0,0 +1,125 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// BroadcastQuery stores the extra Slack channels that a portal's Matrix
+// messages are cross-posted to, and the timestamps of the cross-posted copies
+// so that edits and deletions can be relayed to them too.
+type BroadcastQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// BroadcastTarget is a channel that the Matrix messages of the user who added
+// it are cross-posted to.
+type BroadcastTarget struct {
+	ChannelID string
+	AddedBy   id.UserID
+}
+
+type BroadcastCopy struct {
+	ChannelID string
+	Ts        string
+}
+
+func (bq *BroadcastQuery) GetTargets(key PortalKey) []BroadcastTarget {
+	rows, err := bq.db.Query("SELECT target_channel_id, added_by FROM broadcast_target WHERE team_id=$1 AND channel_id=$2 ORDER BY target_channel_id",
+		key.TeamID, key.ChannelID)
+	if err != nil {
+		bq.log.Warnfln("Failed to get broadcast targets of %s: %v", key, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var targets []BroadcastTarget
+	for rows.Next() {
+		var target BroadcastTarget
+		err = rows.Scan(&target.ChannelID, &target.AddedBy)
+		if err != nil {
+			bq.log.Warnfln("Failed to scan broadcast target of %s: %v", key, err)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// AddTarget adds a broadcast target for the given user. If someone else had
+// already added the same target, it's moved to the given user.
+func (bq *BroadcastQuery) AddTarget(key PortalKey, targetChannelID string, addedBy id.UserID) {
+	_, err := bq.db.Exec(`
+		INSERT INTO broadcast_target (team_id, channel_id, target_channel_id, added_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (team_id, channel_id, target_channel_id) DO UPDATE SET added_by=excluded.added_by
+	`, key.TeamID, key.ChannelID, targetChannelID, addedBy)
+	if err != nil {
+		bq.log.Warnfln("Failed to add broadcast target %s to %s: %v", targetChannelID, key, err)
+	}
+}
+
+func (bq *BroadcastQuery) RemoveTarget(key PortalKey, targetChannelID string) {
+	_, err := bq.db.Exec("DELETE FROM broadcast_target WHERE team_id=$1 AND channel_id=$2 AND target_channel_id=$3",
+		key.TeamID, key.ChannelID, targetChannelID)
+	if err != nil {
+		bq.log.Warnfln("Failed to remove broadcast target %s from %s: %v", targetChannelID, key, err)
+	}
+}
+
+func (bq *BroadcastQuery) GetCopies(key PortalKey, slackID string) []BroadcastCopy {
+	rows, err := bq.db.Query("SELECT target_channel_id, target_ts FROM broadcast_message WHERE team_id=$1 AND channel_id=$2 AND slack_id=$3",
+		key.TeamID, key.ChannelID, slackID)
+	if err != nil {
+		bq.log.Warnfln("Failed to get broadcast copies of %s in %s: %v", slackID, key, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var copies []BroadcastCopy
+	for rows.Next() {
+		var cp BroadcastCopy
+		err = rows.Scan(&cp.ChannelID, &cp.Ts)
+		if err != nil {
+			bq.log.Warnfln("Failed to scan broadcast copy of %s in %s: %v", slackID, key, err)
+			continue
+		}
+		copies = append(copies, cp)
+	}
+	return copies
+}
+
+func (bq *BroadcastQuery) AddCopy(key PortalKey, slackID, targetChannelID, targetTs string) {
+	_, err := bq.db.Exec(`
+		INSERT INTO broadcast_message (team_id, channel_id, slack_id, target_channel_id, target_ts) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (team_id, channel_id, slack_id, target_channel_id) DO UPDATE SET target_ts=excluded.target_ts
+	`, key.TeamID, key.ChannelID, slackID, targetChannelID, targetTs)
+	if err != nil {
+		bq.log.Warnfln("Failed to store broadcast copy of %s in %s: %v", slackID, targetChannelID, err)
+	}
+}
+
+func (bq *BroadcastQuery) DeleteCopy(key PortalKey, slackID, targetChannelID string) {
+	_, err := bq.db.Exec("DELETE FROM broadcast_message WHERE team_id=$1 AND channel_id=$2 AND slack_id=$3 AND target_channel_id=$4",
+		key.TeamID, key.ChannelID, slackID, targetChannelID)
+	if err != nil {
+		bq.log.Warnfln("Failed to delete broadcast copy of %s in %s: %v", slackID, targetChannelID, err)
+	}
+}
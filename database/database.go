@@ -19,6 +19,7 @@ package database
 import (
 	"database/sql"
 	_ "embed"
+	"errors"
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -41,6 +42,21 @@ type Database struct {
 	Attachment *AttachmentQuery
 	TeamInfo   *TeamInfoQuery
 	Backfill   *BackfillQuery
+
+	EventArchive *EventArchiveQuery
+	InfoCache    *InfoCacheQuery
+	AuditLog     *AuditLogQuery
+	KV           *KVQuery
+	Bookmarks    *BookmarksQuery
+	SectionSpace *SectionSpaceQuery
+	RetryQueue   *RetryQueueQuery
+	Broadcast    *BroadcastQuery
+	UserStats    *UserStatsQuery
+
+	RelayedReaction *RelayedReactionQuery
+	HandledEvent    *HandledEventQuery
+
+	TokenCipher TokenCipher
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -83,10 +99,80 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Backfill"),
 	}
+	db.EventArchive = &EventArchiveQuery{
+		db:  db,
+		log: log.Sub("EventArchive"),
+	}
+	db.InfoCache = &InfoCacheQuery{
+		db:  db,
+		log: log.Sub("InfoCache"),
+	}
+	db.AuditLog = &AuditLogQuery{
+		db:  db,
+		log: log.Sub("AuditLog"),
+	}
+	db.KV = &KVQuery{
+		db:  db,
+		log: log.Sub("KV"),
+	}
+	db.Bookmarks = &BookmarksQuery{
+		db:  db,
+		log: log.Sub("Bookmarks"),
+	}
+	db.SectionSpace = &SectionSpaceQuery{
+		db:  db,
+		log: log.Sub("SectionSpace"),
+	}
+	db.RetryQueue = &RetryQueueQuery{
+		db:  db,
+		log: log.Sub("RetryQueue"),
+	}
+	db.Broadcast = &BroadcastQuery{
+		db:  db,
+		log: log.Sub("Broadcast"),
+	}
+	db.UserStats = &UserStatsQuery{
+		db:  db,
+		log: log.Sub("UserStats"),
+	}
+	db.RelayedReaction = &RelayedReactionQuery{
+		db:  db,
+		log: log.Sub("RelayedReaction"),
+	}
+	db.HandledEvent = &HandledEventQuery{
+		db:  db,
+		log: log.Sub("HandledEvent"),
+	}
 
 	return db
 }
 
+// PendingUpgrades returns the current schema version and the upgrades that
+// would be applied to reach the latest version, without changing anything.
+func (db *Database) PendingUpgrades() (int, []string, error) {
+	var exists bool
+	var err error
+	switch db.Dialect {
+	case dbutil.SQLite:
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type='table' AND name=$1)", db.VersionTable).Scan(&exists)
+	default:
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name=$1)", db.VersionTable).Scan(&exists)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var version int
+	if exists {
+		err = db.QueryRow("SELECT version FROM " + db.VersionTable + " LIMIT 1").Scan(&version)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, err
+		}
+	}
+	pending, err := upgrades.Pending(version)
+	return version, pending, err
+}
+
 func strPtr(val string) *string {
 	if val == "" {
 		return nil
@@ -0,0 +1,125 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type EventArchiveQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+const (
+	archivedEventSelect = "SELECT archive_id, user_mxid, team_id, slack_user_id, event_type, data, received_at FROM event_archive"
+)
+
+func (eaq *EventArchiveQuery) New() *ArchivedEvent {
+	return &ArchivedEvent{
+		db:  eaq.db,
+		log: eaq.log,
+	}
+}
+
+func (eaq *EventArchiveQuery) GetByID(archiveID int) *ArchivedEvent {
+	row := eaq.db.QueryRow(archivedEventSelect+" WHERE archive_id=$1", archiveID)
+	if row == nil {
+		return nil
+	}
+
+	return eaq.New().Scan(row)
+}
+
+func (eaq *EventArchiveQuery) GetLatest(limit int) []*ArchivedEvent {
+	rows, err := eaq.db.Query(archivedEventSelect+" ORDER BY archive_id DESC LIMIT $1", limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	events := []*ArchivedEvent{}
+	for rows.Next() {
+		if evt := eaq.New().Scan(rows); evt != nil {
+			events = append(events, evt)
+		}
+	}
+
+	return events
+}
+
+// Prune deletes archived events that are older than maxAge or that don't fit
+// in the newest maxEvents. Zero values disable the respective limit.
+func (eaq *EventArchiveQuery) Prune(maxEvents int, maxAge time.Duration) {
+	if maxAge > 0 {
+		_, err := eaq.db.Exec("DELETE FROM event_archive WHERE received_at<$1", time.Now().Add(-maxAge).UnixMilli())
+		if err != nil {
+			eaq.log.Warnln("Failed to prune old archived events:", err)
+		}
+	}
+	if maxEvents > 0 {
+		_, err := eaq.db.Exec("DELETE FROM event_archive WHERE archive_id<=(SELECT MAX(archive_id) FROM event_archive)-$1", maxEvents)
+		if err != nil {
+			eaq.log.Warnln("Failed to prune excess archived events:", err)
+		}
+	}
+}
+
+type ArchivedEvent struct {
+	db  *Database
+	log log.Logger
+
+	ArchiveID int
+	UserMXID  id.UserID
+	TeamID    string
+	// The Slack user the event is about, if any
+	SlackUserID string
+	EventType   string
+	Data        string
+	ReceivedAt  time.Time
+}
+
+func (ae *ArchivedEvent) Scan(row dbutil.Scannable) *ArchivedEvent {
+	var receivedAt int64
+	var slackUserID sql.NullString
+	err := row.Scan(&ae.ArchiveID, &ae.UserMXID, &ae.TeamID, &slackUserID, &ae.EventType, &ae.Data, &receivedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			ae.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	ae.SlackUserID = slackUserID.String
+	ae.ReceivedAt = time.UnixMilli(receivedAt)
+	return ae
+}
+
+func (ae *ArchivedEvent) Insert() {
+	query := "INSERT INTO event_archive (user_mxid, team_id, slack_user_id, event_type, data, received_at)" +
+		" VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := ae.db.Exec(query, ae.UserMXID, ae.TeamID, strPtr(ae.SlackUserID), ae.EventType, ae.Data, ae.ReceivedAt.UnixMilli())
+	if err != nil {
+		ae.log.Warnfln("Failed to archive %s event: %v", ae.EventType, err)
+	}
+}
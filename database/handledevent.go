@@ -0,0 +1,74 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// HandledEventQuery remembers which Matrix events the bridge has started
+// handling, so that events redelivered by the homeserver, e.g. when an
+// appservice transaction is retried after a restart, aren't sent twice.
+type HandledEventQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// Claim marks the event as being handled and returns false if it already
+// was handled, or is still being handled since staleBefore. Claims that were
+// never marked done with MarkDone and are older than that can be taken over,
+// so that an event isn't lost if sending it failed or the bridge stopped in
+// the middle. If the database fails, the event is treated as new, as
+// dropping a message is worse than sending it twice.
+func (heq *HandledEventQuery) Claim(eventID id.EventID, roomID id.RoomID, staleBefore time.Time) bool {
+	res, err := heq.db.Exec(`
+		INSERT INTO matrix_handled_event (event_id, room_id, handled_at, done) VALUES ($1, $2, $3, false)
+		ON CONFLICT (event_id) DO UPDATE SET handled_at=excluded.handled_at
+		WHERE matrix_handled_event.done=false AND matrix_handled_event.handled_at<$4
+	`, eventID, roomID, time.Now().UnixMilli(), staleBefore.UnixMilli())
+	if err != nil {
+		heq.log.Warnfln("Failed to mark %s as handled: %v", eventID, err)
+		return true
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		heq.log.Warnfln("Failed to check if %s was already handled: %v", eventID, err)
+		return true
+	}
+	return affected > 0
+}
+
+// MarkDone marks a claimed event as successfully handled, so that it's never
+// handled again.
+func (heq *HandledEventQuery) MarkDone(eventID id.EventID) {
+	_, err := heq.db.Exec("UPDATE matrix_handled_event SET done=true WHERE event_id=$1", eventID)
+	if err != nil {
+		heq.log.Warnfln("Failed to mark %s as done: %v", eventID, err)
+	}
+}
+
+// DeleteOlderThan forgets events that were handled before the given time.
+func (heq *HandledEventQuery) DeleteOlderThan(before time.Time) {
+	_, err := heq.db.Exec("DELETE FROM matrix_handled_event WHERE handled_at<$1", before.UnixMilli())
+	if err != nil {
+		heq.log.Warnfln("Failed to prune handled events: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+type InfoCacheQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// Get returns the cached JSON data of a Slack object and the time it was
+// fetched, or nil if the object isn't cached.
+func (icq *InfoCacheQuery) Get(teamID, objectID string) ([]byte, time.Time) {
+	var data string
+	var fetchedAt int64
+	err := icq.db.QueryRow("SELECT data, fetched_at FROM slack_info_cache WHERE team_id=$1 AND object_id=$2", teamID, objectID).Scan(&data, &fetchedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			icq.log.Warnfln("Failed to get cached info of %s/%s: %v", teamID, objectID, err)
+		}
+		return nil, time.Time{}
+	}
+	return []byte(data), time.UnixMilli(fetchedAt)
+}
+
+func (icq *InfoCacheQuery) Put(teamID, objectID, objectType string, data []byte, fetchedAt time.Time) {
+	query := `
+		INSERT INTO slack_info_cache (team_id, object_id, object_type, data, fetched_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (team_id, object_id) DO UPDATE
+			SET object_type=excluded.object_type, data=excluded.data, fetched_at=excluded.fetched_at
+	`
+	_, err := icq.db.Exec(query, teamID, objectID, objectType, string(data), fetchedAt.UnixMilli())
+	if err != nil {
+		icq.log.Warnfln("Failed to cache info of %s/%s: %v", teamID, objectID, err)
+	}
+}
+
+// PutMany caches many objects of the same team in one transaction.
+func (icq *InfoCacheQuery) PutMany(teamID, objectType string, data map[string][]byte, fetchedAt time.Time) {
+	query := `
+		INSERT INTO slack_info_cache (team_id, object_id, object_type, data, fetched_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (team_id, object_id) DO UPDATE
+			SET object_type=excluded.object_type, data=excluded.data, fetched_at=excluded.fetched_at
+	`
+	txn, err := icq.db.Begin()
+	if err != nil {
+		icq.log.Warnfln("Failed to start transaction to cache %d objects of %s: %v", len(data), teamID, err)
+		return
+	}
+	for objectID, objectData := range data {
+		_, err = txn.Exec(query, teamID, objectID, objectType, string(objectData), fetchedAt.UnixMilli())
+		if err != nil {
+			icq.log.Warnfln("Failed to cache info of %s/%s: %v", teamID, objectID, err)
+			_ = txn.Rollback()
+			return
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		icq.log.Warnfln("Failed to commit cached info of %d objects of %s: %v", len(data), teamID, err)
+	}
+}
+
+func (icq *InfoCacheQuery) Delete(teamID, objectID string) {
+	_, err := icq.db.Exec("DELETE FROM slack_info_cache WHERE team_id=$1 AND object_id=$2", teamID, objectID)
+	if err != nil {
+		icq.log.Warnfln("Failed to delete cached info of %s/%s: %v", teamID, objectID, err)
+	}
+}
+
+// DeleteOlderThan removes cached objects of the given type that were fetched
+// before the given time.
+func (icq *InfoCacheQuery) DeleteOlderThan(objectType string, before time.Time) {
+	_, err := icq.db.Exec("DELETE FROM slack_info_cache WHERE object_type=$1 AND fetched_at<$2", objectType, before.UnixMilli())
+	if err != nil {
+		icq.log.Warnfln("Failed to prune cached %s info: %v", objectType, err)
+	}
+}
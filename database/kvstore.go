@@ -0,0 +1,62 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const (
+	KVGhostUsernameTemplate = "ghost_username_template"
+	KVGhostDomain           = "ghost_domain"
+	// Followed by the user ID, stores whether the master push rule was
+	// enabled before the bridge snoozed the user's notifications.
+	KVDNDMasterRulePrefix = "dnd_master_rule:"
+	// Followed by the room ID, stores the power levels a DM had before it was
+	// made read-only because the other user was deactivated.
+	KVDMReadOnlyLevelsPrefix = "dm_read_only_levels:"
+	// The hex-encoded key used to sign links to the media proxy.
+	KVMediaLinkKey = "media_link_key"
+)
+
+// KVQuery stores bridge-wide state that doesn't belong to any other table.
+type KVQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (kvq *KVQuery) Get(key string) string {
+	var value string
+	err := kvq.db.QueryRow("SELECT value FROM kv_store WHERE key=$1", key).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		kvq.log.Warnfln("Failed to get %s: %v", key, err)
+	}
+	return value
+}
+
+func (kvq *KVQuery) Set(key, value string) {
+	_, err := kvq.db.Exec(`
+		INSERT INTO kv_store (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value=excluded.value
+	`, key, value)
+	if err != nil {
+		kvq.log.Warnfln("Failed to set %s: %v", key, err)
+	}
+}
@@ -0,0 +1,150 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type orphanQuery struct {
+	table string
+	name  string
+	where string
+}
+
+// orphanQueries describe rows that no longer belong to anything. Foreign keys
+// should prevent most of these, but SQLite doesn't enforce them unless asked to.
+var orphanQueries = []orphanQuery{{
+	table: "message",
+	name:  "messages of deleted portals",
+	where: "NOT EXISTS (SELECT 1 FROM portal WHERE portal.team_id=message.team_id AND portal.channel_id=message.channel_id)",
+}, {
+	table: "attachment",
+	name:  "attachments of deleted portals",
+	where: "NOT EXISTS (SELECT 1 FROM portal WHERE portal.team_id=attachment.team_id AND portal.channel_id=attachment.channel_id)",
+}, {
+	table: "reaction",
+	name:  "reactions without messages",
+	where: "NOT EXISTS (SELECT 1 FROM message WHERE message.team_id=reaction.team_id AND message.channel_id=reaction.channel_id" +
+		" AND message.slack_message_id=reaction.slack_message_id)",
+}, {
+	table: "user_team_portal",
+	name:  "portal memberships of deleted portals",
+	where: "NOT EXISTS (SELECT 1 FROM portal WHERE portal.team_id=user_team_portal.slack_team_id" +
+		" AND portal.channel_id=user_team_portal.portal_channel_id)",
+}}
+
+var orphanPuppetQuery = orphanQuery{
+	table: "puppet",
+	name:  "puppets without messages",
+	where: "custom_mxid IS NULL" +
+		" AND NOT EXISTS (SELECT 1 FROM message WHERE message.team_id=puppet.team_id AND message.author_id=puppet.user_id)" +
+		" AND NOT EXISTS (SELECT 1 FROM reaction WHERE reaction.team_id=puppet.team_id AND reaction.author_id=puppet.user_id)" +
+		" AND NOT EXISTS (SELECT 1 FROM portal WHERE portal.team_id=puppet.team_id AND portal.dm_user_id=puppet.user_id)" +
+		" AND NOT EXISTS (SELECT 1 FROM user_team WHERE user_team.team_id=puppet.team_id AND user_team.slack_id=puppet.user_id)",
+}
+
+type OrphanCount struct {
+	Description string
+	Count       int64
+}
+
+// CleanOrphans counts orphaned rows, and deletes them unless dryRun is set.
+// Puppets are only included if includePuppets is set, as deleting them loses
+// their cached profile info.
+func (db *Database) CleanOrphans(dryRun, includePuppets bool) ([]OrphanCount, error) {
+	queries := orphanQueries
+	if includePuppets {
+		queries = append(queries[:len(queries):len(queries)], orphanPuppetQuery)
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	counts := make([]OrphanCount, len(queries))
+	for i, query := range queries {
+		counts[i].Description = query.name
+		if dryRun {
+			err = txn.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", query.table, query.where)).Scan(&counts[i].Count)
+		} else {
+			var res sql.Result
+			res, err = txn.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", query.table, query.where))
+			if err == nil {
+				counts[i].Count, err = res.RowsAffected()
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", query.name, err)
+		}
+	}
+	if !dryRun {
+		err = txn.Commit()
+	}
+	return counts, err
+}
+
+type TableStats struct {
+	Name string
+	Rows int64
+	// Size is the size of the table including indexes in bytes, or -1 if the
+	// database doesn't support measuring it.
+	Size int64
+}
+
+var maintainedTables = []string{
+	"portal", "puppet", `"user"`, "user_team", "user_team_portal", "message", "reaction",
+	"attachment", "team_info", "backfill_state", "event_archive", "slack_info_cache",
+	"audit_log",
+}
+
+func (db *Database) GetTableStats() ([]TableStats, error) {
+	stats := make([]TableStats, len(maintainedTables))
+	for i, table := range maintainedTables {
+		stats[i].Name = table
+		stats[i].Size = -1
+		err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&stats[i].Rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count rows in %s: %w", table, err)
+		}
+		if db.Dialect == dbutil.Postgres {
+			err = db.QueryRow("SELECT pg_total_relation_size($1)", table).Scan(&stats[i].Size)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get size of %s: %w", table, err)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// Optimize reclaims free space and updates the query planner statistics.
+func (db *Database) Optimize() error {
+	_, err := db.Exec("VACUUM")
+	if err != nil {
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	_, err = db.Exec("ANALYZE")
+	if err != nil {
+		return fmt.Errorf("failed to analyze: %w", err)
+	}
+	return nil
+}
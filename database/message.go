@@ -36,14 +36,20 @@ type Message struct {
 	MatrixID id.EventID
 
 	SlackThreadID string
+	// PartIndex is the position of the Matrix event among all the events a
+	// Slack message was bridged as. Files are sent before the text and stored
+	// in the attachment table, so the text of a message with files doesn't
+	// have index 0.
+	PartIndex int
+	Subtype   string
 
 	AuthorID string
 }
 
 func (m *Message) Scan(row dbutil.Scannable) *Message {
-	var threadID sql.NullString
+	var threadID, subtype sql.NullString
 
-	err := row.Scan(&m.Channel.TeamID, &m.Channel.ChannelID, &m.SlackID, &m.MatrixID, &m.AuthorID, &threadID)
+	err := row.Scan(&m.Channel.TeamID, &m.Channel.ChannelID, &m.SlackID, &m.MatrixID, &m.AuthorID, &threadID, &m.PartIndex, &subtype)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			m.log.Errorln("Database scan failed:", err)
@@ -53,6 +59,7 @@ func (m *Message) Scan(row dbutil.Scannable) *Message {
 	}
 
 	m.SlackThreadID = threadID.String
+	m.Subtype = subtype.String
 
 	return m
 }
@@ -60,10 +67,11 @@ func (m *Message) Scan(row dbutil.Scannable) *Message {
 func (m *Message) Insert(txn dbutil.Transaction) {
 	query := "INSERT INTO message" +
 		" (team_id, channel_id, slack_message_id, matrix_message_id," +
-		" author_id, slack_thread_id) VALUES ($1, $2, $3, $4, $5, $6)"
+		" author_id, slack_thread_id, part_index, subtype) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
 
 	args := []interface{}{m.Channel.TeamID,
-		m.Channel.ChannelID, m.SlackID, m.MatrixID, m.AuthorID, strPtr(m.SlackThreadID)}
+		m.Channel.ChannelID, m.SlackID, m.MatrixID, m.AuthorID, strPtr(m.SlackThreadID),
+		m.PartIndex, strPtr(m.Subtype)}
 
 	var err error
 	if txn != nil {
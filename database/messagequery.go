@@ -28,7 +28,12 @@ type MessageQuery struct {
 
 const (
 	messageSelect = "SELECT team_id, channel_id, slack_message_id," +
-		" matrix_message_id, author_id, slack_thread_id FROM message"
+		" matrix_message_id, author_id, slack_thread_id, part_index, subtype FROM message"
+	// Matches only the lowest part of each Slack message in this table, which
+	// isn't part 0 if the message had files.
+	messageFirstPart = " AND NOT EXISTS (SELECT 1 FROM message earlier WHERE earlier.team_id=message.team_id" +
+		" AND earlier.channel_id=message.channel_id AND earlier.slack_message_id=message.slack_message_id" +
+		" AND earlier.part_index<message.part_index)"
 )
 
 func (mq *MessageQuery) New() *Message {
@@ -54,9 +59,74 @@ func (mq *MessageQuery) GetAll(key PortalKey) []*Message {
 	return messages
 }
 
+// GetRecent returns the first part of the latest messages in the portal,
+// newest first.
+func (mq *MessageQuery) GetRecent(key PortalKey, limit int) []*Message {
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2" + messageFirstPart + " ORDER BY slack_message_id DESC LIMIT $3"
+
+	rows, err := mq.db.Query(query, key.TeamID, key.ChannelID, limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		if msg := mq.New().Scan(rows); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// GetSince returns the first part of every message in the portal sent at or
+// after the given Slack timestamp.
+func (mq *MessageQuery) GetSince(key PortalKey, sinceTs string) []*Message {
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 AND slack_message_id>=$3" + messageFirstPart
+
+	rows, err := mq.db.Query(query, key.TeamID, key.ChannelID, sinceTs)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		if msg := mq.New().Scan(rows); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// GetOlderThan returns up to limit messages in the portal, including all
+// parts, that were sent before the given Slack timestamp.
+func (mq *MessageQuery) GetOlderThan(key PortalKey, beforeTs string, limit int) []*Message {
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 AND slack_message_id<$3" +
+		" ORDER BY slack_message_id ASC, part_index ASC LIMIT $4"
+
+	rows, err := mq.db.Query(query, key.TeamID, key.ChannelID, beforeTs, limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		if msg := mq.New().Scan(rows); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// GetBySlackID returns the first part of the given Slack message.
 func (mq *MessageQuery) GetBySlackID(key PortalKey, slackID string) *Message {
 	query := messageSelect + " WHERE team_id=$1" +
-		" AND channel_id=$2 AND slack_message_id=$3"
+		" AND channel_id=$2 AND slack_message_id=$3 ORDER BY part_index ASC LIMIT 1"
 
 	row := mq.db.QueryRow(query, key.TeamID, key.ChannelID, slackID)
 	if row == nil {
@@ -67,6 +137,23 @@ func (mq *MessageQuery) GetBySlackID(key PortalKey, slackID string) *Message {
 	return mq.New().Scan(row)
 }
 
+// GetAllBySlackID returns all parts of the given Slack message.
+func (mq *MessageQuery) GetAllBySlackID(key PortalKey, slackID string) []*Message {
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 AND slack_message_id=$3 ORDER BY part_index ASC"
+
+	rows, err := mq.db.Query(query, key.TeamID, key.ChannelID, slackID)
+	if err != nil || rows == nil {
+		return nil
+	}
+
+	messages := []*Message{}
+	for rows.Next() {
+		messages = append(messages, mq.New().Scan(rows))
+	}
+
+	return messages
+}
+
 func (mq *MessageQuery) GetByMatrixID(key PortalKey, matrixID id.EventID) *Message {
 	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 AND matrix_message_id=$3"
 
@@ -79,7 +166,7 @@ func (mq *MessageQuery) GetByMatrixID(key PortalKey, matrixID id.EventID) *Messa
 }
 
 func (mq *MessageQuery) GetLastInThread(key PortalKey, slackThreadId string) *Message {
-	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 AND slack_thread_id=$3 ORDER BY slack_message_id DESC LIMIT 1"
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 AND slack_thread_id=$3 ORDER BY slack_message_id DESC, part_index DESC LIMIT 1"
 
 	row := mq.db.QueryRow(query, key.TeamID, key.ChannelID, slackThreadId)
 	if row == nil {
@@ -95,7 +182,7 @@ func (mq *MessageQuery) GetLastInThread(key PortalKey, slackThreadId string) *Me
 }
 
 func (mq *MessageQuery) GetFirst(key PortalKey) *Message {
-	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 ORDER BY slack_message_id ASC LIMIT 1"
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 ORDER BY slack_message_id ASC, part_index ASC LIMIT 1"
 
 	row := mq.db.QueryRow(query, key.TeamID, key.ChannelID)
 	if row == nil {
@@ -107,7 +194,7 @@ func (mq *MessageQuery) GetFirst(key PortalKey) *Message {
 }
 
 func (mq *MessageQuery) GetLast(key PortalKey) *Message {
-	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 ORDER BY slack_message_id DESC LIMIT 1"
+	query := messageSelect + " WHERE team_id=$1 AND channel_id=$2 ORDER BY slack_message_id DESC, part_index DESC LIMIT 1"
 
 	row := mq.db.QueryRow(query, key.TeamID, key.ChannelID)
 	if row == nil {
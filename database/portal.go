@@ -18,6 +18,7 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -47,6 +48,137 @@ func (ct ChannelType) String() string {
 	}
 }
 
+// MediaPolicy decides how files are bridged in a portal. The default policy
+// follows the media section of the bridge config.
+type MediaPolicy string
+
+const (
+	MediaPolicyDefault MediaPolicy = ""
+	MediaPolicyBridge  MediaPolicy = "bridge"
+	MediaPolicyLink    MediaPolicy = "link"
+	MediaPolicyProxy   MediaPolicy = "proxy"
+	MediaPolicyBlock   MediaPolicy = "block"
+)
+
+func (mp MediaPolicy) IsValid() bool {
+	switch mp {
+	case MediaPolicyDefault, MediaPolicyBridge, MediaPolicyLink, MediaPolicyProxy, MediaPolicyBlock:
+		return true
+	default:
+		return false
+	}
+}
+
+// ThreadMode decides how Slack threads are shown in Matrix. The default mode
+// follows the bridge config.
+type ThreadMode string
+
+const (
+	ThreadModeDefault ThreadMode = ""
+	ThreadModeThread  ThreadMode = "thread"
+	ThreadModeReply   ThreadMode = "reply"
+	ThreadModeFlatten ThreadMode = "flatten"
+)
+
+func (tm ThreadMode) IsValid() bool {
+	switch tm {
+	case ThreadModeDefault, ThreadModeThread, ThreadModeReply, ThreadModeFlatten:
+		return true
+	default:
+		return false
+	}
+}
+
+// EditHistoryMode decides whether the previous version of messages edited in
+// Slack is kept visible in Matrix. The default mode follows the bridge config.
+type EditHistoryMode string
+
+const (
+	EditHistoryDefault EditHistoryMode = ""
+	EditHistoryOff     EditHistoryMode = "off"
+	EditHistoryField   EditHistoryMode = "field"
+	EditHistoryThread  EditHistoryMode = "thread"
+)
+
+func (ehm EditHistoryMode) IsValid() bool {
+	switch ehm {
+	case EditHistoryDefault, EditHistoryOff, EditHistoryField, EditHistoryThread:
+		return true
+	default:
+		return false
+	}
+}
+
+// UnfurlMode decides which previews Slack generates for links in messages
+// sent from Matrix. The default mode follows the bridge config.
+type UnfurlMode string
+
+const (
+	UnfurlDefault UnfurlMode = ""
+	UnfurlAll     UnfurlMode = "all"
+	UnfurlLinks   UnfurlMode = "links"
+	UnfurlMedia   UnfurlMode = "media"
+	UnfurlNone    UnfurlMode = "none"
+)
+
+func (um UnfurlMode) IsValid() bool {
+	switch um {
+	case UnfurlDefault, UnfurlAll, UnfurlLinks, UnfurlMedia, UnfurlNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// NoticePolicy decides how m.notice messages from Matrix are bridged to
+// Slack. The default policy follows the bridge config.
+type NoticePolicy string
+
+const (
+	NoticePolicyDefault NoticePolicy = ""
+	NoticePolicyDrop    NoticePolicy = "drop"
+	NoticePolicyPlain   NoticePolicy = "plain"
+	NoticePolicyPrefix  NoticePolicy = "prefix"
+)
+
+func (np NoticePolicy) IsValid() bool {
+	switch np {
+	case NoticePolicyDefault, NoticePolicyDrop, NoticePolicyPlain, NoticePolicyPrefix:
+		return true
+	default:
+		return false
+	}
+}
+
+type TranslationDirection string
+
+const (
+	TranslationSlackToMatrix TranslationDirection = "slack_to_matrix"
+	TranslationMatrixToSlack TranslationDirection = "matrix_to_slack"
+)
+
+func (td TranslationDirection) IsValid() bool {
+	return td == TranslationSlackToMatrix || td == TranslationMatrixToSlack
+}
+
+type TranslationMode string
+
+const (
+	// TranslationAppend adds the translation below the original text
+	TranslationAppend TranslationMode = "append"
+	// TranslationReplace bridges only the translation
+	TranslationReplace TranslationMode = "replace"
+)
+
+func (tm TranslationMode) IsValid() bool {
+	return tm == TranslationAppend || tm == TranslationReplace
+}
+
+type TranslationSetting struct {
+	TargetLang string          `json:"target_lang"`
+	Mode       TranslationMode `json:"mode"`
+}
+
 type Portal struct {
 	db  *Database
 	log log.Logger
@@ -54,8 +186,12 @@ type Portal struct {
 	Key  PortalKey
 	MXID id.RoomID
 
-	Type     ChannelType
+	Type ChannelType
+	// The other Slack user of a DM. Together with DMReceiverID, this identifies
+	// the user pair of the DM, but the portal is still keyed by channel ID.
 	DMUserID string
+	// The Slack user on the bridge side of a DM, DMUserID is the other one
+	DMReceiverID string
 
 	PlainName string
 	Name      string
@@ -70,15 +206,79 @@ type Portal struct {
 	FirstEventID id.EventID
 	NextBatchID  id.BatchID
 	FirstSlackID string
+
+	PortalSettings
+}
+
+// PortalSettings are the settings of a portal that can be changed with
+// commands. They belong to the Matrix room, so they move along with it if the
+// room is re-linked to another Slack conversation.
+type PortalSettings struct {
+	RelayUserID       id.UserID
+	ErrorNotices      bool
+	BridgeBotMessages bool
+	BridgeJoinLeave   bool
+	ReadOnly          bool
+
+	// Megolm session rotation overrides, zero means the bridge config is used
+	RotationPeriodMillis   int64
+	RotationPeriodMessages int
+	RequireVerification    bool
+
+	// Message handling timeout overrides, zero means the bridge config is used
+	// and a negative value disables the timeout
+	TimeoutErrorAfterMillis int64
+	TimeoutDeadlineMillis   int64
+
+	MediaPolicy MediaPolicy
+	ThreadMode  ThreadMode
+	EditHistory EditHistoryMode
+	Unfurl      UnfurlMode
+	Notices     NoticePolicy
+
+	// Relay templates that override the bridge config, keyed like the relay config
+	RelayTemplates map[string]string
+	// Languages that messages are translated to, keyed by the direction they're bridged in
+	Translation map[TranslationDirection]TranslationSetting
+
+	// How many days to keep bridged messages, zero means the bridge config
+	// is used and a negative value keeps them forever
+	RetentionDays int
+}
+
+// Clone returns a copy of the settings that doesn't share any maps with the
+// original.
+func (ps PortalSettings) Clone() PortalSettings {
+	if ps.RelayTemplates != nil {
+		templates := make(map[string]string, len(ps.RelayTemplates))
+		for key, value := range ps.RelayTemplates {
+			templates[key] = value
+		}
+		ps.RelayTemplates = templates
+	}
+	if ps.Translation != nil {
+		translation := make(map[TranslationDirection]TranslationSetting, len(ps.Translation))
+		for key, value := range ps.Translation {
+			translation[key] = value
+		}
+		ps.Translation = translation
+	}
+	return ps
 }
 
 func (p *Portal) Scan(row dbutil.Scannable) *Portal {
-	var mxid, dmUserID, avatarURL, firstEventID, nextBatchID, firstSlackID sql.NullString
+	var mxid, dmUserID, dmReceiverID, avatarURL, firstEventID, nextBatchID, firstSlackID, relayUserID sql.NullString
+	var relayTemplates, translation string
 
 	err := row.Scan(&p.Key.TeamID, &p.Key.ChannelID, &mxid,
 		&p.Type, &dmUserID, &p.PlainName, &p.Name, &p.NameSet, &p.Topic,
 		&p.TopicSet, &p.Avatar, &avatarURL, &p.AvatarSet, &firstEventID,
-		&p.Encrypted, &nextBatchID, &firstSlackID)
+		&p.Encrypted, &nextBatchID, &firstSlackID, &relayUserID,
+		&p.ErrorNotices, &p.BridgeBotMessages, &p.BridgeJoinLeave,
+		&p.RotationPeriodMillis, &p.RotationPeriodMessages, &p.RequireVerification,
+		&p.MediaPolicy, &relayTemplates, &p.ThreadMode, &dmReceiverID, &p.EditHistory,
+		&p.TimeoutErrorAfterMillis, &p.TimeoutDeadlineMillis, &p.ReadOnly, &p.Unfurl, &p.Notices,
+		&translation, &p.RetentionDays)
 
 	if err != nil {
 		if err != sql.ErrNoRows {
@@ -90,14 +290,38 @@ func (p *Portal) Scan(row dbutil.Scannable) *Portal {
 
 	p.MXID = id.RoomID(mxid.String)
 	p.DMUserID = dmUserID.String
+	p.DMReceiverID = dmReceiverID.String
 	p.AvatarURL, _ = id.ParseContentURI(avatarURL.String)
 	p.FirstEventID = id.EventID(firstEventID.String)
 	p.NextBatchID = id.BatchID(nextBatchID.String)
 	p.FirstSlackID = firstSlackID.String
+	p.RelayUserID = id.UserID(relayUserID.String)
+	if err = json.Unmarshal([]byte(relayTemplates), &p.RelayTemplates); err != nil {
+		p.log.Warnfln("Failed to parse relay templates of %s: %v", p.Key, err)
+	}
+	if err = json.Unmarshal([]byte(translation), &p.Translation); err != nil {
+		p.log.Warnfln("Failed to parse translation settings of %s: %v", p.Key, err)
+	}
 
 	return p
 }
 
+func (p *Portal) relayTemplatesJSON() string {
+	if len(p.RelayTemplates) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(p.RelayTemplates)
+	return string(data)
+}
+
+func (p *Portal) translationJSON() string {
+	if len(p.Translation) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(p.Translation)
+	return string(data)
+}
+
 func (p *Portal) mxidPtr() *id.RoomID {
 	if p.MXID != "" {
 		return &p.MXID
@@ -110,13 +334,21 @@ func (p *Portal) Insert() {
 	query := "INSERT INTO portal" +
 		" (team_id, channel_id, mxid, type, dm_user_id, plain_name," +
 		" name, name_set, topic, topic_set, avatar, avatar_url, avatar_set," +
-		" first_event_id, encrypted, next_batch_id, first_slack_id)" +
-		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)"
+		" first_event_id, encrypted, next_batch_id, first_slack_id, relay_user_id," +
+		" error_notices, bridge_bot_messages, bridge_join_leave," +
+		" encryption_rotation_ms, encryption_rotation_messages, require_verification, media_policy, relay_templates," +
+		" thread_mode, dm_receiver_id, edit_history, timeout_error_after_ms, timeout_deadline_ms, read_only, unfurl, notice_policy," +
+		" translation, retention_days)" +
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36)"
 
 	_, err := p.db.Exec(query, p.Key.TeamID, p.Key.ChannelID,
 		p.mxidPtr(), p.Type, p.DMUserID, p.PlainName, p.Name, p.NameSet,
 		p.Topic, p.TopicSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
-		p.FirstEventID.String(), p.Encrypted, p.NextBatchID.String(), p.FirstSlackID)
+		p.FirstEventID.String(), p.Encrypted, p.NextBatchID.String(), p.FirstSlackID,
+		strPtr(p.RelayUserID.String()), p.ErrorNotices, p.BridgeBotMessages, p.BridgeJoinLeave,
+		p.RotationPeriodMillis, p.RotationPeriodMessages, p.RequireVerification, p.MediaPolicy, p.relayTemplatesJSON(),
+		p.ThreadMode, strPtr(p.DMReceiverID), p.EditHistory, p.TimeoutErrorAfterMillis, p.TimeoutDeadlineMillis, p.ReadOnly, p.Unfurl, p.Notices,
+		p.translationJSON(), p.RetentionDays)
 
 	if err != nil {
 		p.log.Warnfln("Failed to insert %s: %v", p.Key, err)
@@ -127,13 +359,22 @@ func (p *Portal) Update(txn dbutil.Transaction) {
 	query := "UPDATE portal SET" +
 		" mxid=$1, type=$2, dm_user_id=$3, plain_name=$4, name=$5, name_set=$6," +
 		" topic=$7, topic_set=$8, avatar=$9, avatar_url=$10, avatar_set=$11," +
-		" first_event_id=$12, encrypted=$13, next_batch_id=$14, first_slack_id=$15" +
-		" WHERE team_id=$16 AND channel_id=$17"
+		" first_event_id=$12, encrypted=$13, next_batch_id=$14, first_slack_id=$15," +
+		" relay_user_id=$16, error_notices=$17, bridge_bot_messages=$18, bridge_join_leave=$19," +
+		" encryption_rotation_ms=$20, encryption_rotation_messages=$21, require_verification=$22," +
+		" media_policy=$23, relay_templates=$24, thread_mode=$25, dm_receiver_id=$26, edit_history=$27," +
+		" timeout_error_after_ms=$28, timeout_deadline_ms=$29, read_only=$30, unfurl=$31, notice_policy=$32," +
+		" translation=$33, retention_days=$34" +
+		" WHERE team_id=$35 AND channel_id=$36"
 
 	args := []interface{}{p.mxidPtr(), p.Type, p.DMUserID, p.PlainName,
 		p.Name, p.NameSet, p.Topic, p.TopicSet, p.Avatar, p.AvatarURL.String(),
 		p.AvatarSet, p.FirstEventID.String(), p.Encrypted, p.NextBatchID.String(), p.FirstSlackID,
-		p.Key.TeamID, p.Key.ChannelID}
+		strPtr(p.RelayUserID.String()), p.ErrorNotices, p.BridgeBotMessages, p.BridgeJoinLeave,
+		p.RotationPeriodMillis, p.RotationPeriodMessages, p.RequireVerification,
+		p.MediaPolicy, p.relayTemplatesJSON(), p.ThreadMode, strPtr(p.DMReceiverID), p.EditHistory,
+		p.TimeoutErrorAfterMillis, p.TimeoutDeadlineMillis, p.ReadOnly, p.Unfurl, p.Notices,
+		p.translationJSON(), p.RetentionDays, p.Key.TeamID, p.Key.ChannelID}
 
 	var err error
 	if txn != nil {
@@ -17,6 +17,9 @@
 package database
 
 import (
+	"fmt"
+	"strings"
+
 	log "maunium.net/go/maulogger/v2"
 	"maunium.net/go/mautrix/id"
 )
@@ -25,7 +28,12 @@ const (
 	portalSelect = "SELECT team_id, channel_id, mxid, type, " +
 		" dm_user_id, plain_name, name, name_set, topic, topic_set," +
 		" avatar, avatar_url, avatar_set, first_event_id," +
-		" encrypted, next_batch_id, first_slack_id FROM portal"
+		" encrypted, next_batch_id, first_slack_id, relay_user_id," +
+		" error_notices, bridge_bot_messages, bridge_join_leave," +
+		" encryption_rotation_ms, encryption_rotation_messages, require_verification," +
+		" media_policy, relay_templates, thread_mode, dm_receiver_id, edit_history," +
+		" timeout_error_after_ms, timeout_deadline_ms, read_only, unfurl, notice_policy," +
+		" translation, retention_days FROM portal"
 )
 
 type PortalQuery struct {
@@ -37,6 +45,11 @@ func (pq *PortalQuery) New() *Portal {
 	return &Portal{
 		db:  pq.db,
 		log: pq.log,
+
+		PortalSettings: PortalSettings{
+			ErrorNotices:      true,
+			BridgeBotMessages: true,
+		},
 	}
 }
 
@@ -63,8 +76,59 @@ func (pq *PortalQuery) GetAllForUserTeam(utk UserTeamKey) []*Portal {
 		utk.MXID, utk.SlackID, utk.TeamID)
 }
 
-func (pq *PortalQuery) FindPrivateChatsWith(id string) []*Portal {
-	return pq.getAll(portalSelect+" WHERE dm_user_id=$1 AND type=$2", id, ChannelTypeDM)
+func (pq *PortalQuery) FindPrivateChatsWith(teamID, userID string) []*Portal {
+	return pq.getAll(portalSelect+" WHERE team_id=$1 AND dm_user_id=$2 AND type=$3", teamID, userID, ChannelTypeDM)
+}
+
+// FindPrivateChatBetween finds the DM portals of the given pair of Slack
+// users, regardless of which one of them is logged into the bridge.
+func (pq *PortalQuery) FindPrivateChatBetween(teamID, userA, userB string) []*Portal {
+	return pq.getAll(portalSelect+" WHERE team_id=$1 AND type=$2 AND"+
+		" ((dm_user_id=$3 AND dm_receiver_id=$4) OR (dm_user_id=$4 AND dm_receiver_id=$3))",
+		teamID, ChannelTypeDM, userA, userB)
+}
+
+const userPortalBatchSize = 100
+
+// InsertUserPortals records that the given userteam is in all the given
+// channels. The rows are inserted in batches within a single transaction, so
+// syncing large workspaces doesn't need a separate query for every channel.
+func (pq *PortalQuery) InsertUserPortals(utk UserTeamKey, channelIDs []string) {
+	if len(channelIDs) == 0 {
+		return
+	}
+	txn, err := pq.db.Begin()
+	if err != nil {
+		pq.log.Warnfln("Failed to start transaction to insert portals of %s: %v", utk, err)
+		return
+	}
+	for start := 0; start < len(channelIDs); start += userPortalBatchSize {
+		end := start + userPortalBatchSize
+		if end > len(channelIDs) {
+			end = len(channelIDs)
+		}
+		batch := channelIDs[start:end]
+		placeholders := make([]string, len(batch))
+		args := []interface{}{utk.MXID, utk.SlackID, utk.TeamID}
+		for i, channelID := range batch {
+			placeholders[i] = fmt.Sprintf("($1, $2, $3, $%d)", i+4)
+			args = append(args, channelID)
+		}
+		query := "INSERT INTO user_team_portal" +
+			" (matrix_user_id, slack_user_id, slack_team_id, portal_channel_id)" +
+			" VALUES " + strings.Join(placeholders, ", ") +
+			" ON CONFLICT DO NOTHING"
+		_, err = txn.Exec(query, args...)
+		if err != nil {
+			pq.log.Warnfln("Failed to insert portals of %s: %v", utk, err)
+			_ = txn.Rollback()
+			return
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		pq.log.Warnfln("Failed to commit portals of %s: %v", utk, err)
+	}
 }
 
 func (pq *PortalQuery) getAll(query string, args ...interface{}) []*Portal {
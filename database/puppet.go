@@ -28,7 +28,7 @@ import (
 const (
 	puppetSelect = "SELECT team_id, user_id, name, name_set, avatar," +
 		" avatar_url, avatar_set, enable_presence, custom_mxid, access_token," +
-		" next_batch, enable_receipts" +
+		" next_batch, enable_receipts, deactivated, guest, avatar_hash" +
 		" FROM puppet "
 )
 
@@ -45,6 +45,8 @@ type Puppet struct {
 	Avatar    string
 	AvatarURL id.ContentURI
 	AvatarSet bool
+	// The Slack hash of the avatar image, which stays the same when the URL changes
+	AvatarHash string
 
 	EnablePresence bool
 
@@ -54,6 +56,11 @@ type Puppet struct {
 	NextBatch string
 
 	EnableReceipts bool
+
+	// Whether the Slack account has been deactivated
+	Deactivated bool
+	// Whether the Slack user is a single- or multi-channel guest
+	Guest bool
 }
 
 func (p *Puppet) Scan(row dbutil.Scannable) *Puppet {
@@ -63,7 +70,7 @@ func (p *Puppet) Scan(row dbutil.Scannable) *Puppet {
 
 	err := row.Scan(&teamID, &userID, &p.Name, &p.NameSet, &avatar, &avatarURL,
 		&p.AvatarSet, &enablePresence, &customMXID, &accessToken, &nextBatch,
-		&p.EnableReceipts)
+		&p.EnableReceipts, &p.Deactivated, &p.Guest, &p.AvatarHash)
 
 	if err != nil {
 		if err != sql.ErrNoRows {
@@ -89,28 +96,39 @@ func (p *Puppet) Insert() {
 	query := "INSERT INTO puppet" +
 		" (team_id, user_id, name, name_set, avatar, avatar_url, avatar_set," +
 		" enable_presence, custom_mxid, access_token, next_batch," +
-		" enable_receipts)" +
-		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
+		" enable_receipts, deactivated, guest, avatar_hash)" +
+		" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)" +
+		" ON CONFLICT (team_id, user_id) DO NOTHING"
 
 	_, err := p.db.Exec(query, p.TeamID, p.UserID, p.Name, p.NameSet, p.Avatar,
 		p.AvatarURL.String(), p.AvatarSet, p.EnablePresence, p.CustomMXID,
-		p.AccessToken, p.NextBatch, p.EnableReceipts)
+		p.AccessToken, p.NextBatch, p.EnableReceipts, p.Deactivated, p.Guest,
+		p.AvatarHash)
 
 	if err != nil {
 		p.log.Warnfln("Failed to insert %s-%s: %v", p.TeamID, p.UserID, err)
 	}
 }
 
-func (p *Puppet) Update() {
+func (p *Puppet) Update(txn dbutil.Transaction) {
 	query := "UPDATE puppet" +
 		" SET name=$1, name_set=$2, avatar=$3, avatar_url=$4, avatar_set=$5," +
 		"     enable_presence=$6, custom_mxid=$7, access_token=$8," +
-		"     next_batch=$9, enable_receipts=$10" +
-		" WHERE team_id=$11 AND user_id=$12"
+		"     next_batch=$9, enable_receipts=$10, deactivated=$11, guest=$12," +
+		"     avatar_hash=$13" +
+		" WHERE team_id=$14 AND user_id=$15"
 
-	_, err := p.db.Exec(query, p.Name, p.NameSet, p.Avatar,
+	args := []interface{}{p.Name, p.NameSet, p.Avatar,
 		p.AvatarURL.String(), p.AvatarSet, p.EnablePresence, p.CustomMXID,
-		p.AccessToken, p.NextBatch, p.EnableReceipts, p.TeamID, p.UserID)
+		p.AccessToken, p.NextBatch, p.EnableReceipts, p.Deactivated, p.Guest, p.AvatarHash,
+		p.TeamID, p.UserID}
+
+	var err error
+	if txn != nil {
+		_, err = txn.Exec(query, args...)
+	} else {
+		_, err = p.db.Exec(query, args...)
+	}
 
 	if err != nil {
 		p.log.Warnfln("Failed to update %s-%s: %v", p.TeamID, p.UserID, err)
@@ -17,6 +17,8 @@
 package database
 
 import (
+	"database/sql"
+
 	log "maunium.net/go/maulogger/v2"
 	"maunium.net/go/mautrix/id"
 )
@@ -43,6 +45,21 @@ func (pq *PuppetQuery) GetByCustomMXID(mxid id.UserID) *Puppet {
 	return pq.get(puppetSelect+" WHERE custom_mxid=$1", mxid)
 }
 
+// GetAvatarURLByHash finds an already uploaded avatar with the given Slack
+// avatar hash, so that identical avatars don't have to be reuploaded.
+func (pq *PuppetQuery) GetAvatarURLByHash(hash string) id.ContentURI {
+	var avatarURL string
+	err := pq.db.QueryRow("SELECT avatar_url FROM puppet WHERE avatar_hash=$1 AND avatar_url<>'' LIMIT 1", hash).Scan(&avatarURL)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			pq.log.Warnfln("Failed to get avatar with hash %s: %v", hash, err)
+		}
+		return id.ContentURI{}
+	}
+	parsed, _ := id.ParseContentURI(avatarURL)
+	return parsed
+}
+
 func (pq *PuppetQuery) get(query string, args ...interface{}) *Puppet {
 	row := pq.db.QueryRow(query, args...)
 	if row == nil {
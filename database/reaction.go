@@ -104,6 +104,18 @@ func (r *Reaction) Update() {
 	// the homeserver?
 }
 
+// SetMatrixEventID changes which Matrix reaction the Slack reaction belongs
+// to, for Slack reactions shared by several relayed Matrix reactions.
+func (r *Reaction) SetMatrixEventID(evtID id.EventID) {
+	query := "UPDATE reaction SET matrix_event_id=$1 WHERE team_id=$2 AND channel_id=$3 AND matrix_event_id=$4"
+	_, err := r.db.Exec(query, evtID, r.Channel.TeamID, r.Channel.ChannelID, r.MatrixEventID)
+	if err != nil {
+		r.log.Warnfln("Failed to move reaction %s to %s: %v", r.MatrixEventID, evtID, err)
+		return
+	}
+	r.MatrixEventID = evtID
+}
+
 func (r *Reaction) Delete() {
 	query := "DELETE FROM reaction WHERE" +
 		" team_id=$1 AND channel_id=$2 AND slack_message_id=$3 AND author_id=$4 AND slack_name=$5"
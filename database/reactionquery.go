@@ -45,11 +45,27 @@ func (rq *ReactionQuery) GetAllByMatrixID(key PortalKey, matrixEventID id.EventI
 	return rq.getAll(query, key.TeamID, key.ChannelID, matrixEventID)
 }
 
+func (rq *ReactionQuery) GetAllBySlackMessageID(key PortalKey, slackMessageID string) []*Reaction {
+	query := reactionSelect + " WHERE team_id=$1 AND channel_id=$2 AND slack_message_id=$3"
+
+	return rq.getAll(query, key.TeamID, key.ChannelID, slackMessageID)
+}
+
+// DeleteOlderThan forgets the reactions to messages in the portal that were
+// sent before the given Slack timestamp.
+func (rq *ReactionQuery) DeleteOlderThan(key PortalKey, beforeTs string) {
+	_, err := rq.db.Exec("DELETE FROM reaction WHERE team_id=$1 AND channel_id=$2 AND slack_message_id<$3", key.TeamID, key.ChannelID, beforeTs)
+	if err != nil {
+		rq.log.Warnfln("Failed to delete reactions in %s older than %s: %v", key, beforeTs, err)
+	}
+}
+
 func (rq *ReactionQuery) getAll(query string, args ...interface{}) []*Reaction {
-	rows, err := rq.db.Query(query)
+	rows, err := rq.db.Query(query, args...)
 	if err != nil || rows == nil {
 		return nil
 	}
+	defer rows.Close()
 
 	reactions := []*Reaction{}
 	for rows.Next() {
@@ -0,0 +1,166 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RelayedReactionQuery stores the reactions that Matrix users without a Slack
+// login sent through the relay user. Slack only allows one reaction per emoji
+// per user, so several Matrix users reacting with the same emoji share one
+// Slack reaction, and the count is shown in a separate message instead.
+type RelayedReactionQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (rrq *RelayedReactionQuery) Add(key PortalKey, slackMessageID, slackName string, evtID id.EventID, sender id.UserID) {
+	_, err := rrq.db.Exec(`
+		INSERT INTO relayed_reaction (team_id, channel_id, slack_message_id, slack_name, matrix_event_id, matrix_sender)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (team_id, channel_id, matrix_event_id) DO NOTHING
+	`, key.TeamID, key.ChannelID, slackMessageID, slackName, evtID, sender)
+	if err != nil {
+		rrq.log.Warnfln("Failed to store relayed reaction %s in %s: %v", evtID, key, err)
+	}
+}
+
+func (rrq *RelayedReactionQuery) IsRelayed(key PortalKey, evtID id.EventID) bool {
+	var exists int
+	err := rrq.db.QueryRow("SELECT 1 FROM relayed_reaction WHERE team_id=$1 AND channel_id=$2 AND matrix_event_id=$3",
+		key.TeamID, key.ChannelID, evtID).Scan(&exists)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		rrq.log.Warnfln("Failed to check if %s in %s is a relayed reaction: %v", evtID, key, err)
+	}
+	return exists == 1
+}
+
+// GetCounts returns the number of relayed reactions on a Slack message per emoji.
+func (rrq *RelayedReactionQuery) GetCounts(key PortalKey, slackMessageID string) map[string]int {
+	rows, err := rrq.db.Query(`
+		SELECT slack_name, COUNT(*) FROM relayed_reaction
+		WHERE team_id=$1 AND channel_id=$2 AND slack_message_id=$3
+		GROUP BY slack_name
+	`, key.TeamID, key.ChannelID, slackMessageID)
+	if err != nil {
+		rrq.log.Warnfln("Failed to count relayed reactions on %s in %s: %v", slackMessageID, key, err)
+		return nil
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var count int
+		err = rows.Scan(&name, &count)
+		if err != nil {
+			rrq.log.Warnfln("Failed to scan relayed reaction count on %s in %s: %v", slackMessageID, key, err)
+			continue
+		}
+		counts[name] = count
+	}
+	return counts
+}
+
+func (rrq *RelayedReactionQuery) GetCountMessage(key PortalKey, slackMessageID string) string {
+	var ts string
+	err := rrq.db.QueryRow("SELECT count_message_id FROM reaction_count_message WHERE team_id=$1 AND channel_id=$2 AND slack_message_id=$3",
+		key.TeamID, key.ChannelID, slackMessageID).Scan(&ts)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		rrq.log.Warnfln("Failed to get reaction count message of %s in %s: %v", slackMessageID, key, err)
+	}
+	return ts
+}
+
+func (rrq *RelayedReactionQuery) SetCountMessage(key PortalKey, slackMessageID, countMessageID string) {
+	_, err := rrq.db.Exec(`
+		INSERT INTO reaction_count_message (team_id, channel_id, slack_message_id, count_message_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (team_id, channel_id, slack_message_id) DO UPDATE SET count_message_id=excluded.count_message_id
+	`, key.TeamID, key.ChannelID, slackMessageID, countMessageID)
+	if err != nil {
+		rrq.log.Warnfln("Failed to store reaction count message of %s in %s: %v", slackMessageID, key, err)
+	}
+}
+
+func (rrq *RelayedReactionQuery) DeleteCountMessage(key PortalKey, slackMessageID string) {
+	_, err := rrq.db.Exec("DELETE FROM reaction_count_message WHERE team_id=$1 AND channel_id=$2 AND slack_message_id=$3",
+		key.TeamID, key.ChannelID, slackMessageID)
+	if err != nil {
+		rrq.log.Warnfln("Failed to delete reaction count message of %s in %s: %v", slackMessageID, key, err)
+	}
+}
+
+// IsCountMessage checks whether a Slack message is a reaction count message
+// posted by the bridge, so that it isn't bridged back to Matrix.
+func (rrq *RelayedReactionQuery) IsCountMessage(key PortalKey, slackID string) bool {
+	var exists int
+	err := rrq.db.QueryRow("SELECT 1 FROM reaction_count_message WHERE team_id=$1 AND channel_id=$2 AND count_message_id=$3",
+		key.TeamID, key.ChannelID, slackID).Scan(&exists)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		rrq.log.Warnfln("Failed to check if %s in %s is a reaction count message: %v", slackID, key, err)
+	}
+	return exists == 1
+}
+
+type RelayedReaction struct {
+	SlackMessageID string
+	SlackName      string
+	MatrixEventID  id.EventID
+	MatrixSender   id.UserID
+}
+
+func (rrq *RelayedReactionQuery) GetByMatrixID(key PortalKey, evtID id.EventID) *RelayedReaction {
+	reaction := RelayedReaction{MatrixEventID: evtID}
+	err := rrq.db.QueryRow("SELECT slack_message_id, slack_name, matrix_sender FROM relayed_reaction WHERE team_id=$1 AND channel_id=$2 AND matrix_event_id=$3",
+		key.TeamID, key.ChannelID, evtID).Scan(&reaction.SlackMessageID, &reaction.SlackName, &reaction.MatrixSender)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		rrq.log.Warnfln("Failed to get relayed reaction %s in %s: %v", evtID, key, err)
+		return nil
+	}
+	return &reaction
+}
+
+// GetAnother returns a relayed reaction with the same emoji on the same
+// message as the given one, or an empty string if there are no others.
+func (rrq *RelayedReactionQuery) GetAnother(key PortalKey, reaction *RelayedReaction) id.EventID {
+	var evtID id.EventID
+	err := rrq.db.QueryRow(`
+		SELECT matrix_event_id FROM relayed_reaction
+		WHERE team_id=$1 AND channel_id=$2 AND slack_message_id=$3 AND slack_name=$4 AND matrix_event_id<>$5
+		LIMIT 1
+	`, key.TeamID, key.ChannelID, reaction.SlackMessageID, reaction.SlackName, reaction.MatrixEventID).Scan(&evtID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		rrq.log.Warnfln("Failed to find other relayed reactions like %s in %s: %v", reaction.MatrixEventID, key, err)
+	}
+	return evtID
+}
+
+func (rrq *RelayedReactionQuery) Delete(key PortalKey, evtID id.EventID) {
+	_, err := rrq.db.Exec("DELETE FROM relayed_reaction WHERE team_id=$1 AND channel_id=$2 AND matrix_event_id=$3",
+		key.TeamID, key.ChannelID, evtID)
+	if err != nil {
+		rrq.log.Warnfln("Failed to delete relayed reaction %s in %s: %v", evtID, key, err)
+	}
+}
@@ -0,0 +1,93 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RetryQueueQuery stores Matrix messages that arrived while the bridge was
+// restarting, so they can be sent once the Slack connection is up.
+type RetryQueueQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+type QueuedRetry struct {
+	EventID  id.EventID
+	RoomID   id.RoomID
+	QueuedAt time.Time
+}
+
+func (rqq *RetryQueueQuery) Add(eventID id.EventID, roomID id.RoomID, sender id.UserID, teamID string) {
+	_, err := rqq.db.Exec(`
+		INSERT INTO matrix_retry_queue (event_id, room_id, sender, team_id, queued_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (event_id) DO NOTHING
+	`, eventID, roomID, sender, teamID, time.Now().UnixMilli())
+	if err != nil {
+		rqq.log.Warnfln("Failed to queue %s for retrying: %v", eventID, err)
+	}
+}
+
+// TakeAll removes the queued retries of the user in the team and returns
+// them in the order they were queued. The rows are deleted in the same
+// transaction they're read in, so each retry is only ever taken once.
+func (rqq *RetryQueueQuery) TakeAll(sender id.UserID, teamID string) []*QueuedRetry {
+	txn, err := rqq.db.Begin()
+	if err != nil {
+		rqq.log.Warnfln("Failed to start transaction to take queued retries of %s in %s: %v", sender, teamID, err)
+		return nil
+	}
+	rows, err := txn.Query("SELECT event_id, room_id, queued_at FROM matrix_retry_queue WHERE sender=$1 AND team_id=$2 ORDER BY queued_at",
+		sender, teamID)
+	if err != nil {
+		rqq.log.Warnfln("Failed to get queued retries of %s in %s: %v", sender, teamID, err)
+		_ = txn.Rollback()
+		return nil
+	}
+	var retries []*QueuedRetry
+	for rows.Next() {
+		var retry QueuedRetry
+		var queuedAt int64
+		err = rows.Scan(&retry.EventID, &retry.RoomID, &queuedAt)
+		if err != nil {
+			rqq.log.Warnfln("Failed to scan queued retry of %s: %v", sender, err)
+			continue
+		}
+		retry.QueuedAt = time.UnixMilli(queuedAt)
+		retries = append(retries, &retry)
+	}
+	_ = rows.Close()
+	for _, retry := range retries {
+		_, err = txn.Exec("DELETE FROM matrix_retry_queue WHERE event_id=$1", retry.EventID)
+		if err != nil {
+			rqq.log.Warnfln("Failed to delete queued retry %s: %v", retry.EventID, err)
+			_ = txn.Rollback()
+			return nil
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		rqq.log.Warnfln("Failed to commit taking queued retries of %s in %s: %v", sender, teamID, err)
+		return nil
+	}
+	return retries
+}
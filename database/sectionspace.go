@@ -0,0 +1,76 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SectionSpaceQuery stores the spaces created for the Slack sidebar sections
+// of a user.
+type SectionSpaceQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+type SectionSpace struct {
+	SectionID string
+	Name      string
+	SpaceRoom id.RoomID
+}
+
+func (ssq *SectionSpaceQuery) GetAll(utk UserTeamKey) map[string]*SectionSpace {
+	rows, err := ssq.db.Query("SELECT section_id, name, space_room FROM user_team_section WHERE mxid=$1 AND slack_id=$2 AND team_id=$3",
+		utk.MXID, utk.SlackID, utk.TeamID)
+	if err != nil {
+		ssq.log.Warnfln("Failed to get section spaces of %s: %v", utk, err)
+		return nil
+	}
+	defer rows.Close()
+
+	sections := make(map[string]*SectionSpace)
+	for rows.Next() {
+		var section SectionSpace
+		err = rows.Scan(&section.SectionID, &section.Name, &section.SpaceRoom)
+		if err != nil {
+			ssq.log.Warnfln("Failed to scan section space of %s: %v", utk, err)
+			continue
+		}
+		sections[section.SectionID] = &section
+	}
+	return sections
+}
+
+func (ssq *SectionSpaceQuery) Upsert(utk UserTeamKey, section *SectionSpace) {
+	_, err := ssq.db.Exec(`
+		INSERT INTO user_team_section (mxid, slack_id, team_id, section_id, name, space_room) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (mxid, slack_id, team_id, section_id) DO UPDATE SET name=excluded.name, space_room=excluded.space_room
+	`, utk.MXID, utk.SlackID, utk.TeamID, section.SectionID, section.Name, section.SpaceRoom)
+	if err != nil {
+		ssq.log.Warnfln("Failed to save section space %s of %s: %v", section.SectionID, utk, err)
+	}
+}
+
+func (ssq *SectionSpaceQuery) Delete(utk UserTeamKey, sectionID string) {
+	_, err := ssq.db.Exec("DELETE FROM user_team_section WHERE mxid=$1 AND slack_id=$2 AND team_id=$3 AND section_id=$4",
+		utk.MXID, utk.SlackID, utk.TeamID, sectionID)
+	if err != nil {
+		ssq.log.Warnfln("Failed to delete section space %s of %s: %v", sectionID, utk, err)
+	}
+}
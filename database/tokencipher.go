@@ -0,0 +1,110 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TokenCipher encrypts Slack tokens and cookies before they're stored in the
+// database. The default implementation uses a key from the config, but any
+// other secret store can be plugged in by setting Database.TokenCipher.
+type TokenCipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+}
+
+const encryptedTokenPrefix = "enc:v1:"
+
+var ErrTokenKeyMissing = errors.New("token is encrypted, but no token encryption key is configured")
+
+type aesTokenCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESTokenCipher creates a TokenCipher using AES-GCM with a key derived
+// from the given passphrase.
+func NewAESTokenCipher(passphrase string) (TokenCipher, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesTokenCipher{aead: aead}, nil
+}
+
+func (atc *aesTokenCipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, atc.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := atc.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (atc *aesTokenCipher) Decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	} else if len(sealed) < atc.aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonceSize := atc.aead.NonceSize()
+	plaintext, err := atc.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func (db *Database) encryptToken(token string) (string, error) {
+	if db.TokenCipher == nil || token == "" {
+		return token, nil
+	}
+	encrypted, err := db.TokenCipher.Encrypt(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt token: %w", err)
+	}
+	return encryptedTokenPrefix + encrypted, nil
+}
+
+// decryptToken decrypts a stored token. Tokens stored before encryption was
+// enabled are returned as-is.
+func (db *Database) decryptToken(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		return stored, nil
+	} else if db.TokenCipher == nil {
+		return "", ErrTokenKeyMissing
+	}
+	token, err := db.TokenCipher.Decrypt(strings.TrimPrefix(stored, encryptedTokenPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token: %w", err)
+	}
+	return token, nil
+}
@@ -1,4 +1,4 @@
--- v1 -> v7: Latest revision
+-- v1 -> v47: Latest revision
 
 CREATE TABLE portal (
 	team_id    TEXT,
@@ -7,6 +7,7 @@ CREATE TABLE portal (
 
 	type INT DEFAULT 0,
 	dm_user_id TEXT,
+	dm_receiver_id TEXT,
 
 	plain_name TEXT NOT NULL,
 	name       TEXT NOT NULL,
@@ -20,10 +21,35 @@ CREATE TABLE portal (
 	encrypted BOOLEAN NOT NULL DEFAULT false,
 
 	first_event_id TEXT,
+	next_batch_id  TEXT,
+	first_slack_id TEXT,
+
+	relay_user_id       TEXT,
+	error_notices       BOOLEAN NOT NULL DEFAULT true,
+	bridge_bot_messages BOOLEAN NOT NULL DEFAULT true,
+	bridge_join_leave   BOOLEAN NOT NULL DEFAULT false,
+
+	encryption_rotation_ms       BIGINT  NOT NULL DEFAULT 0,
+	encryption_rotation_messages INTEGER NOT NULL DEFAULT 0,
+	require_verification         BOOLEAN NOT NULL DEFAULT false,
+
+	media_policy           TEXT    NOT NULL DEFAULT '',
+	relay_templates        TEXT    NOT NULL DEFAULT '{}',
+	thread_mode            TEXT    NOT NULL DEFAULT '',
+	edit_history           TEXT    NOT NULL DEFAULT '',
+	timeout_error_after_ms BIGINT  NOT NULL DEFAULT 0,
+	timeout_deadline_ms    BIGINT  NOT NULL DEFAULT 0,
+	read_only              BOOLEAN NOT NULL DEFAULT false,
+	unfurl                 TEXT    NOT NULL DEFAULT '',
+	notice_policy          TEXT    NOT NULL DEFAULT '',
+	translation            TEXT    NOT NULL DEFAULT '{}',
+	retention_days         INTEGER NOT NULL DEFAULT 0,
 
 	PRIMARY KEY (team_id, channel_id)
 );
 
+CREATE INDEX portal_dm_users_idx ON portal (team_id, dm_user_id, dm_receiver_id);
+
 CREATE TABLE puppet (
 	team_id TEXT NOT NULL,
 	user_id TEXT NOT NULL,
@@ -31,9 +57,10 @@ CREATE TABLE puppet (
 	name TEXT NOT NULL,
 	name_set BOOLEAN DEFAULT false,
 
-	avatar     TEXT,
-	avatar_url TEXT,
-	avatar_set BOOLEAN DEFAULT false,
+	avatar      TEXT,
+	avatar_url  TEXT,
+	avatar_set  BOOLEAN DEFAULT false,
+	avatar_hash TEXT NOT NULL DEFAULT '',
 
 	enable_presence BOOLEAN NOT NULL DEFAULT true,
 	enable_receipts BOOLEAN NOT NULL DEFAULT true,
@@ -42,13 +69,23 @@ CREATE TABLE puppet (
 	access_token TEXT,
 	next_batch   TEXT,
 
+	deactivated BOOLEAN NOT NULL DEFAULT false,
+	guest       BOOLEAN NOT NULL DEFAULT false,
+
 	PRIMARY KEY(team_id, user_id)
 );
 
+CREATE INDEX puppet_avatar_hash_idx ON puppet (avatar_hash);
+CREATE INDEX puppet_custom_mxid_idx ON puppet (custom_mxid);
+
 CREATE TABLE "user" (
 	mxid TEXT PRIMARY KEY,
 
-	management_room TEXT
+	management_room TEXT,
+
+	auto_status_text  TEXT,
+	auto_status_emoji TEXT,
+	api_concurrency   INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE "user_team" (
@@ -63,9 +100,24 @@ CREATE TABLE "user_team" (
 	token TEXT,
     cookie_token TEXT,
 
+	space_room TEXT,
+
 	PRIMARY KEY(mxid, slack_id, team_id)
 );
 
+CREATE TABLE user_team_section (
+	mxid     TEXT NOT NULL,
+	slack_id TEXT NOT NULL,
+	team_id  TEXT NOT NULL,
+
+	section_id TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	space_room TEXT NOT NULL,
+
+	PRIMARY KEY(mxid, slack_id, team_id, section_id),
+	FOREIGN KEY(mxid, slack_id, team_id) REFERENCES user_team(mxid, slack_id, team_id) ON DELETE CASCADE
+);
+
 CREATE TABLE user_team_portal (
     matrix_user_id TEXT NOT NULL,
     slack_user_id TEXT NOT NULL,
@@ -79,13 +131,15 @@ CREATE TABLE message (
 	team_id    TEXT NOT NULL,
 	channel_id TEXT NOT NULL,
 
-	slack_message_id TEXT NOT NULL,
-    slack_thread_id TEXT,
-	matrix_message_id  TEXT NOT NULL UNIQUE,
+	slack_message_id  TEXT NOT NULL,
+	slack_thread_id   TEXT,
+	part_index        INTEGER NOT NULL DEFAULT 0,
+	subtype           TEXT,
+	matrix_message_id TEXT NOT NULL UNIQUE,
 
-	author_id TEXT   NOT NULL,
+	author_id TEXT NOT NULL,
 
-	PRIMARY KEY(slack_message_id, team_id, channel_id),
+	PRIMARY KEY(slack_message_id, part_index, team_id, channel_id),
 	FOREIGN KEY(team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
 );
 
@@ -114,6 +168,7 @@ CREATE TABLE attachment (
 	slack_message_id TEXT NOT NULL,
     slack_file_id TEXT NOT NULL,
 	matrix_event_id TEXT NOT NULL UNIQUE,
+	slack_thread_id TEXT,
 
 	PRIMARY KEY(slack_message_id, slack_file_id, matrix_event_id),
 	FOREIGN KEY(team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
@@ -127,3 +182,144 @@ CREATE TABLE "team_info" (
     avatar TEXT,
     avatar_url TEXT
 );
+
+CREATE TABLE backfill_state (
+    team_id            TEXT,
+    channel_id         TEXT,
+    backfill_complete  BOOLEAN,
+    dispatched         BOOLEAN,
+    message_count      INTEGER,
+    immediate_complete BOOLEAN,
+    oldest_slack_ts    TEXT,
+    newest_slack_ts    TEXT,
+    PRIMARY KEY (team_id, channel_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal (team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE event_archive (
+	archive_id INTEGER PRIMARY KEY
+		-- only: postgres
+		GENERATED ALWAYS AS IDENTITY
+	,
+	user_mxid     TEXT NOT NULL,
+	team_id       TEXT NOT NULL,
+	event_type    TEXT NOT NULL,
+	data          TEXT NOT NULL,
+	received_at   BIGINT NOT NULL,
+	slack_user_id TEXT
+);
+
+CREATE INDEX event_archive_received_at_idx ON event_archive (received_at);
+CREATE INDEX event_archive_slack_user_idx ON event_archive (team_id, slack_user_id);
+
+CREATE TABLE slack_info_cache (
+	team_id     TEXT   NOT NULL,
+	object_id   TEXT   NOT NULL,
+	object_type TEXT   NOT NULL,
+	data        TEXT   NOT NULL,
+	fetched_at  BIGINT NOT NULL,
+
+	PRIMARY KEY (team_id, object_id)
+);
+
+CREATE TABLE audit_log (
+	audit_id INTEGER PRIMARY KEY
+		-- only: postgres
+		GENERATED ALWAYS AS IDENTITY
+	,
+	actor     TEXT   NOT NULL,
+	action    TEXT   NOT NULL,
+	target    TEXT   NOT NULL,
+	params    TEXT   NOT NULL,
+	timestamp BIGINT NOT NULL
+);
+
+CREATE INDEX audit_log_timestamp_idx ON audit_log (timestamp);
+
+CREATE TABLE kv_store (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE portal_bookmarks (
+	team_id    TEXT NOT NULL,
+	channel_id TEXT NOT NULL,
+
+	event_id TEXT NOT NULL,
+	body     TEXT NOT NULL,
+
+	PRIMARY KEY(team_id, channel_id),
+	FOREIGN KEY(team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE matrix_retry_queue (
+    event_id  TEXT PRIMARY KEY,
+    room_id   TEXT NOT NULL,
+    sender    TEXT NOT NULL,
+    team_id   TEXT NOT NULL,
+    queued_at BIGINT NOT NULL
+);
+CREATE INDEX matrix_retry_queue_sender_idx ON matrix_retry_queue (sender, team_id);
+
+CREATE TABLE broadcast_target (
+    team_id           TEXT NOT NULL,
+    channel_id        TEXT NOT NULL,
+    target_channel_id TEXT NOT NULL,
+    added_by          TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY (team_id, channel_id, target_channel_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE broadcast_message (
+    team_id           TEXT NOT NULL,
+    channel_id        TEXT NOT NULL,
+    slack_id          TEXT NOT NULL,
+    target_channel_id TEXT NOT NULL,
+    target_ts         TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, slack_id, target_channel_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE user_stats (
+    mxid                  TEXT PRIMARY KEY,
+    messages_to_slack     BIGINT NOT NULL DEFAULT 0,
+    messages_to_matrix    BIGINT NOT NULL DEFAULT 0,
+    media_bytes_to_slack  BIGINT NOT NULL DEFAULT 0,
+    media_bytes_to_matrix BIGINT NOT NULL DEFAULT 0,
+    reactions_to_slack    BIGINT NOT NULL DEFAULT 0,
+    reactions_to_matrix   BIGINT NOT NULL DEFAULT 0,
+    errors                BIGINT NOT NULL DEFAULT 0,
+    since                 BIGINT NOT NULL
+);
+
+CREATE TABLE relayed_reaction (
+    team_id          TEXT NOT NULL,
+    channel_id       TEXT NOT NULL,
+    slack_message_id TEXT NOT NULL,
+    slack_name       TEXT NOT NULL,
+    matrix_event_id  TEXT NOT NULL,
+    matrix_sender    TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, matrix_event_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE reaction_count_message (
+    team_id          TEXT NOT NULL,
+    channel_id       TEXT NOT NULL,
+    slack_message_id TEXT NOT NULL,
+    count_message_id TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, slack_message_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE matrix_handled_event (
+    event_id   TEXT PRIMARY KEY,
+    room_id    TEXT NOT NULL,
+    handled_at BIGINT NOT NULL,
+    done       BOOLEAN NOT NULL DEFAULT true
+);
+CREATE INDEX matrix_handled_event_handled_at_idx ON matrix_handled_event (handled_at);
@@ -0,0 +1,4 @@
+-- v12: Add automatic Slack status to users
+
+ALTER TABLE "user" ADD auto_status_text TEXT;
+ALTER TABLE "user" ADD auto_status_emoji TEXT;
@@ -0,0 +1,6 @@
+-- v13: Add per-portal settings
+
+ALTER TABLE portal ADD relay_user_id TEXT;
+ALTER TABLE portal ADD error_notices BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE portal ADD bridge_bot_messages BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE portal ADD bridge_join_leave BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,23 @@
+-- v14: Store subtype and part index of messages
+
+CREATE TABLE message_new (
+	team_id    TEXT NOT NULL,
+	channel_id TEXT NOT NULL,
+
+	slack_message_id  TEXT NOT NULL,
+	slack_thread_id   TEXT,
+	part_index        INTEGER NOT NULL DEFAULT 0,
+	subtype           TEXT,
+	matrix_message_id TEXT NOT NULL UNIQUE,
+
+	author_id TEXT NOT NULL,
+
+	PRIMARY KEY(slack_message_id, part_index, team_id, channel_id),
+	FOREIGN KEY(team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+INSERT INTO message_new (team_id, channel_id, slack_message_id, slack_thread_id, matrix_message_id, author_id)
+SELECT team_id, channel_id, slack_message_id, slack_thread_id, matrix_message_id, author_id FROM message;
+
+DROP TABLE message;
+ALTER TABLE message_new RENAME TO message;
@@ -0,0 +1,8 @@
+-- v15: Track oldest and newest bridged Slack message in backfill state
+
+ALTER TABLE backfill_state ADD oldest_slack_ts TEXT;
+ALTER TABLE backfill_state ADD newest_slack_ts TEXT;
+
+UPDATE backfill_state SET
+	oldest_slack_ts=(SELECT MIN(slack_message_id) FROM message WHERE message.team_id=backfill_state.team_id AND message.channel_id=backfill_state.channel_id),
+	newest_slack_ts=(SELECT MAX(slack_message_id) FROM message WHERE message.team_id=backfill_state.team_id AND message.channel_id=backfill_state.channel_id);
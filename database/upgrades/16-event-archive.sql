@@ -0,0 +1,15 @@
+-- v16: Add archive of raw Slack events
+
+CREATE TABLE event_archive (
+	archive_id INTEGER PRIMARY KEY
+		-- only: postgres
+		GENERATED ALWAYS AS IDENTITY
+	,
+	user_mxid   TEXT NOT NULL,
+	team_id     TEXT NOT NULL,
+	event_type  TEXT NOT NULL,
+	data        TEXT NOT NULL,
+	received_at BIGINT NOT NULL
+);
+
+CREATE INDEX event_archive_received_at_idx ON event_archive (received_at);
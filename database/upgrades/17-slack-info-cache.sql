@@ -0,0 +1,11 @@
+-- v17: Add cache of Slack user and channel info
+
+CREATE TABLE slack_info_cache (
+	team_id     TEXT   NOT NULL,
+	object_id   TEXT   NOT NULL,
+	object_type TEXT   NOT NULL,
+	data        TEXT   NOT NULL,
+	fetched_at  BIGINT NOT NULL,
+
+	PRIMARY KEY (team_id, object_id)
+);
@@ -0,0 +1,5 @@
+-- v18: Add per-portal encryption settings
+
+ALTER TABLE portal ADD encryption_rotation_ms BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE portal ADD encryption_rotation_messages INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE portal ADD require_verification BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,15 @@
+-- v19: Add audit log of admin and destructive actions
+
+CREATE TABLE audit_log (
+	audit_id INTEGER PRIMARY KEY
+		-- only: postgres
+		GENERATED ALWAYS AS IDENTITY
+	,
+	actor     TEXT   NOT NULL,
+	action    TEXT   NOT NULL,
+	target    TEXT   NOT NULL,
+	params    TEXT   NOT NULL,
+	timestamp BIGINT NOT NULL
+);
+
+CREATE INDEX audit_log_timestamp_idx ON audit_log (timestamp);
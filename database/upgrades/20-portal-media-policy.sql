@@ -0,0 +1,3 @@
+-- v20: Add per-portal media policy
+
+ALTER TABLE portal ADD media_policy TEXT NOT NULL DEFAULT '';
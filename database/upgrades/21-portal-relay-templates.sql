@@ -0,0 +1,3 @@
+-- v21: Add per-portal relay message templates
+
+ALTER TABLE portal ADD relay_templates TEXT NOT NULL DEFAULT '{}';
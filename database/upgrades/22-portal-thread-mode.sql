@@ -0,0 +1,3 @@
+-- v22: Add per-portal thread mode
+
+ALTER TABLE portal ADD thread_mode TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- v23: Add key-value store for bridge state
+
+CREATE TABLE kv_store (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
@@ -0,0 +1,4 @@
+-- v24: Store both users of DM portals
+
+ALTER TABLE portal ADD dm_receiver_id TEXT;
+CREATE INDEX portal_dm_users_idx ON portal (team_id, dm_user_id, dm_receiver_id);
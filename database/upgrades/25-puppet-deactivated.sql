@@ -0,0 +1,3 @@
+-- v25: Remember deactivated Slack users
+
+ALTER TABLE puppet ADD deactivated BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,12 @@
+-- v26: Track bridged channel bookmarks
+
+CREATE TABLE portal_bookmarks (
+	team_id    TEXT NOT NULL,
+	channel_id TEXT NOT NULL,
+
+	event_id TEXT NOT NULL,
+	body     TEXT NOT NULL,
+
+	PRIMARY KEY(team_id, channel_id),
+	FOREIGN KEY(team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
@@ -0,0 +1,16 @@
+-- v27: Add workspace and sidebar section spaces
+
+ALTER TABLE user_team ADD space_room TEXT;
+
+CREATE TABLE user_team_section (
+	mxid     TEXT NOT NULL,
+	slack_id TEXT NOT NULL,
+	team_id  TEXT NOT NULL,
+
+	section_id TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	space_room TEXT NOT NULL,
+
+	PRIMARY KEY(mxid, slack_id, team_id, section_id),
+	FOREIGN KEY(mxid, slack_id, team_id) REFERENCES user_team(mxid, slack_id, team_id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- v28: Add per-portal edit history mode
+
+ALTER TABLE portal ADD edit_history TEXT NOT NULL DEFAULT '';
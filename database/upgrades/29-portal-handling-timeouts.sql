@@ -0,0 +1,4 @@
+-- v29: Add per-portal message handling timeouts
+
+ALTER TABLE portal ADD timeout_error_after_ms BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE portal ADD timeout_deadline_ms BIGINT NOT NULL DEFAULT 0;
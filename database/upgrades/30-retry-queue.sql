@@ -0,0 +1,10 @@
+-- v30: Store Matrix messages to retry after the bridge restarts
+
+CREATE TABLE matrix_retry_queue (
+    event_id  TEXT PRIMARY KEY,
+    room_id   TEXT NOT NULL,
+    sender    TEXT NOT NULL,
+    team_id   TEXT NOT NULL,
+    queued_at BIGINT NOT NULL
+);
+CREATE INDEX matrix_retry_queue_sender_idx ON matrix_retry_queue (sender, team_id);
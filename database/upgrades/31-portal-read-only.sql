@@ -0,0 +1,3 @@
+-- v31: Add per-portal read-only flag
+
+ALTER TABLE portal ADD read_only BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,21 @@
+-- v32: Store extra Slack channels that Matrix messages are broadcast to
+
+CREATE TABLE broadcast_target (
+    team_id           TEXT NOT NULL,
+    channel_id        TEXT NOT NULL,
+    target_channel_id TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, target_channel_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE broadcast_message (
+    team_id           TEXT NOT NULL,
+    channel_id        TEXT NOT NULL,
+    slack_id          TEXT NOT NULL,
+    target_channel_id TEXT NOT NULL,
+    target_ts         TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, slack_id, target_channel_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
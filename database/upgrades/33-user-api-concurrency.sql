@@ -0,0 +1,3 @@
+-- v33: Add per-user Slack API concurrency limits
+
+ALTER TABLE "user" ADD api_concurrency INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+-- v34: Add per-user usage counters
+
+CREATE TABLE user_stats (
+    mxid                  TEXT PRIMARY KEY,
+    messages_to_slack     BIGINT NOT NULL DEFAULT 0,
+    messages_to_matrix    BIGINT NOT NULL DEFAULT 0,
+    media_bytes_to_slack  BIGINT NOT NULL DEFAULT 0,
+    media_bytes_to_matrix BIGINT NOT NULL DEFAULT 0,
+    reactions_to_slack    BIGINT NOT NULL DEFAULT 0,
+    reactions_to_matrix   BIGINT NOT NULL DEFAULT 0,
+    errors                BIGINT NOT NULL DEFAULT 0,
+    since                 BIGINT NOT NULL
+);
@@ -0,0 +1,3 @@
+-- v35: Add per-portal link unfurling mode
+
+ALTER TABLE portal ADD unfurl TEXT NOT NULL DEFAULT '';
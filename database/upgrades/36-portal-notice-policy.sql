@@ -0,0 +1,3 @@
+-- v36: Add per-portal m.notice bridging policy
+
+ALTER TABLE portal ADD notice_policy TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,23 @@
+-- v37: Store reactions sent through the relay user
+
+CREATE TABLE relayed_reaction (
+    team_id          TEXT NOT NULL,
+    channel_id       TEXT NOT NULL,
+    slack_message_id TEXT NOT NULL,
+    slack_name       TEXT NOT NULL,
+    matrix_event_id  TEXT NOT NULL,
+    matrix_sender    TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, matrix_event_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
+
+CREATE TABLE reaction_count_message (
+    team_id          TEXT NOT NULL,
+    channel_id       TEXT NOT NULL,
+    slack_message_id TEXT NOT NULL,
+    count_message_id TEXT NOT NULL,
+
+    PRIMARY KEY (team_id, channel_id, slack_message_id),
+    FOREIGN KEY (team_id, channel_id) REFERENCES portal(team_id, channel_id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- v38: Add per-portal translation settings
+
+ALTER TABLE portal ADD translation TEXT NOT NULL DEFAULT '{}';
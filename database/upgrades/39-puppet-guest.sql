@@ -0,0 +1,3 @@
+-- v39: Store whether Slack users are guests
+
+ALTER TABLE puppet ADD guest BOOLEAN NOT NULL DEFAULT false;
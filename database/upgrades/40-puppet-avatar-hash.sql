@@ -0,0 +1,4 @@
+-- v40: Store the Slack avatar hash of puppets
+
+ALTER TABLE puppet ADD avatar_hash TEXT NOT NULL DEFAULT '';
+CREATE INDEX puppet_avatar_hash_idx ON puppet (avatar_hash);
@@ -0,0 +1,3 @@
+-- v41: Add index for finding puppets by custom MXID
+
+CREATE INDEX puppet_custom_mxid_idx ON puppet (custom_mxid);
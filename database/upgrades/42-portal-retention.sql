@@ -0,0 +1,3 @@
+-- v42: Add per-portal message retention
+
+ALTER TABLE portal ADD retention_days INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- v43: Track handled Matrix events to ignore redelivered transactions
+
+CREATE TABLE matrix_handled_event (
+    event_id   TEXT PRIMARY KEY,
+    room_id    TEXT NOT NULL,
+    handled_at BIGINT NOT NULL
+);
+CREATE INDEX matrix_handled_event_handled_at_idx ON matrix_handled_event (handled_at);
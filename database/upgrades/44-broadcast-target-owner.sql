@@ -0,0 +1,3 @@
+-- v44: Store who added broadcast targets, as messages are only broadcast for them
+
+ALTER TABLE broadcast_target ADD COLUMN added_by TEXT NOT NULL DEFAULT '';
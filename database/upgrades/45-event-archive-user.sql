@@ -0,0 +1,12 @@
+-- v45: Store the Slack user of archived events, so they can be found without searching the data
+
+ALTER TABLE event_archive ADD COLUMN slack_user_id TEXT;
+-- only: postgres for next 3 lines
+UPDATE event_archive SET slack_user_id=data::jsonb->>'user' WHERE jsonb_typeof(data::jsonb->'user')='string';
+UPDATE event_archive SET slack_user_id=data::jsonb->'user'->>'id'
+	WHERE slack_user_id IS NULL AND jsonb_typeof(data::jsonb->'user')='object';
+-- only: sqlite for next 3 lines
+UPDATE event_archive SET slack_user_id=json_extract(data, '$.user') WHERE json_type(data, '$.user')='text';
+UPDATE event_archive SET slack_user_id=json_extract(data, '$.user.id')
+	WHERE slack_user_id IS NULL AND json_type(data, '$.user.id')='text';
+CREATE INDEX event_archive_slack_user_idx ON event_archive (team_id, slack_user_id);
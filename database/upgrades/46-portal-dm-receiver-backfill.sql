@@ -0,0 +1,8 @@
+-- v46: Fill in the receiver of existing DM portals from the users in them
+
+UPDATE portal SET dm_receiver_id=(
+	SELECT MIN(utp.slack_user_id) FROM user_team_portal utp
+	WHERE utp.slack_team_id=portal.team_id AND utp.portal_channel_id=portal.channel_id
+		AND utp.slack_user_id<>COALESCE(portal.dm_user_id, '')
+)
+WHERE type=2 AND dm_receiver_id IS NULL;
@@ -0,0 +1,3 @@
+-- v47: Track whether handled Matrix events were actually sent
+
+ALTER TABLE matrix_handled_event ADD COLUMN done BOOLEAN NOT NULL DEFAULT true;
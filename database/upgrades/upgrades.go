@@ -17,8 +17,12 @@
 package upgrades
 
 import (
+	"bytes"
 	"embed"
 	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
 
 	"maunium.net/go/mautrix/util/dbutil"
 )
@@ -34,3 +38,58 @@ func init() {
 	})
 	Table.RegisterFS(rawUpgrades)
 }
+
+var upgradeHeaderRegex = regexp.MustCompile(`^-- (?:v(\d+) -> )?v(\d+): (.+)`)
+
+type upgradeInfo struct {
+	from, to int
+	message  string
+}
+
+// Pending lists the upgrades that would be applied to a database currently on
+// the given version, in the order they would be applied.
+func Pending(version int) ([]string, error) {
+	files, err := rawUpgrades.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	byFrom := make(map[int]upgradeInfo)
+	latest := 0
+	for _, file := range files {
+		data, err := rawUpgrades.ReadFile(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+		match := upgradeHeaderRegex.FindSubmatch(firstLine)
+		if match == nil {
+			return nil, fmt.Errorf("upgrade header not found in %s", file.Name())
+		}
+		info := upgradeInfo{message: string(match[3])}
+		info.to, _ = strconv.Atoi(string(match[2]))
+		info.from = info.to - 1
+		if len(match[1]) > 0 {
+			info.from, _ = strconv.Atoi(string(match[1]))
+		}
+		byFrom[info.from] = info
+		if info.to > latest {
+			latest = info.to
+		}
+	}
+
+	var pending []upgradeInfo
+	for version < latest {
+		info, ok := byFrom[version]
+		if !ok {
+			version++
+			continue
+		}
+		pending = append(pending, info)
+		version = info.to
+	}
+	descriptions := make([]string, len(pending))
+	for i, info := range pending {
+		descriptions[i] = fmt.Sprintf("v%d -> v%d: %s", info.from, info.to, info.message)
+	}
+	return descriptions, nil
+}
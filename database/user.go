@@ -33,6 +33,12 @@ type User struct {
 	MXID           id.UserID
 	ManagementRoom id.RoomID
 
+	AutoStatusText  string
+	AutoStatusEmoji string
+
+	// Maximum number of concurrent Slack API calls, zero means the bridge config is used
+	APIConcurrency int
+
 	TeamsLock sync.Mutex
 	Teams     map[string]*UserTeam
 }
@@ -47,7 +53,9 @@ func (user *User) loadTeams() {
 }
 
 func (u *User) Scan(row dbutil.Scannable) *User {
-	err := row.Scan(&u.MXID, &u.ManagementRoom)
+	var autoStatusText, autoStatusEmoji sql.NullString
+
+	err := row.Scan(&u.MXID, &u.ManagementRoom, &autoStatusText, &autoStatusEmoji, &u.APIConcurrency)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			u.log.Errorln("Database scan failed:", err)
@@ -56,6 +64,9 @@ func (u *User) Scan(row dbutil.Scannable) *User {
 		return nil
 	}
 
+	u.AutoStatusText = autoStatusText.String
+	u.AutoStatusEmoji = autoStatusEmoji.String
+
 	u.loadTeams()
 
 	return u
@@ -91,9 +102,9 @@ func (u *User) Insert() {
 }
 
 func (u *User) Update() {
-	query := "UPDATE \"user\" SET management_room=$1 WHERE mxid=$2;"
+	query := "UPDATE \"user\" SET management_room=$1, auto_status_text=$2, auto_status_emoji=$3, api_concurrency=$4 WHERE mxid=$5;"
 
-	_, err := u.db.Exec(query, u.ManagementRoom, u.MXID)
+	_, err := u.db.Exec(query, u.ManagementRoom, strPtr(u.AutoStatusText), strPtr(u.AutoStatusEmoji), u.APIConcurrency, u.MXID)
 
 	if err != nil {
 		u.log.Warnfln("Failed to update %q: %v", u.MXID, err)
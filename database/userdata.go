@@ -0,0 +1,169 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+type userDataQuery struct {
+	table string
+	where string
+	// Columns that hold credentials, which aren't included in exports
+	secrets []string
+	// Whether the rows are kept when purging, e.g. because they're a record
+	// of admin actions
+	keep bool
+	// A column that's cleared when purging instead of deleting the rows, as
+	// the rest of the row isn't about the user
+	clear string
+}
+
+// matrixUserDataQueries find the rows about a Matrix user, with the MXID as $1.
+var matrixUserDataQueries = []userDataQuery{
+	{table: `"user"`, where: "mxid=$1"},
+	{table: "user_team_portal", where: "matrix_user_id=$1"},
+	{table: "user_team_section", where: "mxid=$1"},
+	{table: "user_team", where: "mxid=$1", secrets: []string{"token", "cookie_token"}},
+	{table: "user_stats", where: "mxid=$1"},
+	{table: "event_archive", where: "user_mxid=$1"},
+	{table: "matrix_retry_queue", where: "sender=$1"},
+	{table: "relayed_reaction", where: "matrix_sender=$1"},
+	{table: "broadcast_target", where: "added_by=$1"},
+	{table: "portal", where: "relay_user_id=$1", clear: "relay_user_id"},
+	{table: "puppet", where: "custom_mxid=$1", secrets: []string{"access_token"}},
+	{table: "audit_log", where: "actor=$1 OR target=$1", keep: true},
+}
+
+// slackUserDataQueries find the rows about a Slack user, with the team ID as
+// $1 and the user ID as $2.
+var slackUserDataQueries = []userDataQuery{
+	{table: "attachment", where: "team_id=$1 AND EXISTS (SELECT 1 FROM message WHERE message.team_id=attachment.team_id" +
+		" AND message.channel_id=attachment.channel_id AND message.slack_message_id=attachment.slack_message_id AND message.author_id=$2)"},
+	{table: "message", where: "team_id=$1 AND author_id=$2"},
+	{table: "reaction", where: "team_id=$1 AND author_id=$2"},
+	{table: "portal", where: "team_id=$1 AND dm_user_id=$2"},
+	{table: "puppet", where: "team_id=$1 AND user_id=$2", secrets: []string{"access_token"}},
+	{table: "slack_info_cache", where: "team_id=$1 AND object_id=$2"},
+	{table: "event_archive", where: "team_id=$1 AND slack_user_id=$2"},
+	{table: "user_team", where: "team_id=$1 AND slack_id=$2", secrets: []string{"token", "cookie_token"}},
+}
+
+// UserData contains the rows stored about a user, keyed by table name.
+type UserData map[string][]map[string]interface{}
+
+// ExportMatrixUserData returns everything stored about the given Matrix user.
+func (db *Database) ExportMatrixUserData(mxid string) (UserData, error) {
+	return db.exportUserData(matrixUserDataQueries, mxid)
+}
+
+// ExportSlackUserData returns everything stored about the given Slack user.
+func (db *Database) ExportSlackUserData(teamID, userID string) (UserData, error) {
+	return db.exportUserData(slackUserDataQueries, teamID, userID)
+}
+
+// PurgeMatrixUserData deletes everything stored about the given Matrix user
+// and returns the number of deleted rows per table.
+func (db *Database) PurgeMatrixUserData(mxid string) (map[string]int64, error) {
+	return db.purgeUserData(matrixUserDataQueries, mxid)
+}
+
+// PurgeSlackUserData deletes everything stored about the given Slack user
+// and returns the number of deleted rows per table.
+func (db *Database) PurgeSlackUserData(teamID, userID string) (map[string]int64, error) {
+	return db.purgeUserData(slackUserDataQueries, teamID, userID)
+}
+
+func (db *Database) exportUserData(queries []userDataQuery, args ...interface{}) (UserData, error) {
+	data := make(UserData)
+	for _, query := range queries {
+		rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s", query.table, query.where), args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s: %w", query.table, err)
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to get columns of %s: %w", query.table, err)
+		}
+		var tableRows []map[string]interface{}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err = rows.Scan(pointers...); err != nil {
+				_ = rows.Close()
+				return nil, fmt.Errorf("failed to scan %s: %w", query.table, err)
+			}
+			row := make(map[string]interface{}, len(columns))
+			for i, column := range columns {
+				if bytes, ok := values[i].([]byte); ok {
+					values[i] = string(bytes)
+				}
+				row[column] = values[i]
+			}
+			for _, secret := range query.secrets {
+				if value, ok := row[secret]; ok && value != nil && value != "" {
+					row[secret] = "[redacted]"
+				}
+			}
+			tableRows = append(tableRows, row)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", query.table, err)
+		}
+		if len(tableRows) > 0 {
+			table := strings.Trim(query.table, `"`)
+			data[table] = append(data[table], tableRows...)
+		}
+	}
+	return data, nil
+}
+
+func (db *Database) purgeUserData(queries []userDataQuery, args ...interface{}) (map[string]int64, error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	counts := make(map[string]int64)
+	for _, query := range queries {
+		if query.keep {
+			continue
+		}
+		sqlQuery := fmt.Sprintf("DELETE FROM %s WHERE %s", query.table, query.where)
+		if query.clear != "" {
+			sqlQuery = fmt.Sprintf("UPDATE %s SET %s=NULL WHERE %s", query.table, query.clear, query.where)
+		}
+		res, err := txn.Exec(sqlQuery, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete from %s: %w", query.table, err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("failed to count deleted rows in %s: %w", query.table, err)
+		}
+		counts[strings.Trim(query.table, `"`)] += affected
+	}
+	return counts, txn.Commit()
+}
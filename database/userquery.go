@@ -21,6 +21,8 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+const userSelect = `SELECT mxid, management_room, auto_status_text, auto_status_emoji, api_concurrency FROM "user"`
+
 type UserQuery struct {
 	db  *Database
 	log log.Logger
@@ -35,7 +37,7 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	query := `SELECT mxid, management_room FROM "user" WHERE mxid=$1`
+	query := userSelect + ` WHERE mxid=$1`
 	row := uq.db.QueryRow(query, userID)
 	if row == nil {
 		return nil
@@ -45,7 +47,7 @@ func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
 }
 
 func (uq *UserQuery) GetBySlackID(teamID, userID string) *User {
-	query := `SELECT u.mxid, u.management_room FROM "user" u` +
+	query := `SELECT u.mxid, u.management_room, u.auto_status_text, u.auto_status_emoji, u.api_concurrency FROM "user" u` +
 		` INNER JOIN user_team ut ON u.mxid = ut.mxid` +
 		` WHERE ut.team_id=$1 AND ut.slack_id=$2`
 	row := uq.db.QueryRow(query, teamID, userID)
@@ -57,7 +59,7 @@ func (uq *UserQuery) GetBySlackID(teamID, userID string) *User {
 }
 
 func (uq *UserQuery) GetAll() []*User {
-	rows, err := uq.db.Query(`SELECT mxid, management_room FROM "user"`)
+	rows, err := uq.db.Query(userSelect)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -0,0 +1,96 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// UserStatsCounter is the name of a usage counter column in the user_stats table.
+type UserStatsCounter string
+
+const (
+	StatMessagesToSlack    UserStatsCounter = "messages_to_slack"
+	StatMessagesToMatrix   UserStatsCounter = "messages_to_matrix"
+	StatMediaBytesToSlack  UserStatsCounter = "media_bytes_to_slack"
+	StatMediaBytesToMatrix UserStatsCounter = "media_bytes_to_matrix"
+	StatReactionsToSlack   UserStatsCounter = "reactions_to_slack"
+	StatReactionsToMatrix  UserStatsCounter = "reactions_to_matrix"
+	StatErrors             UserStatsCounter = "errors"
+)
+
+// UserStatsQuery stores per-user counters of what the bridge has done for
+// each user, for deployments that need to enforce fair use.
+type UserStatsQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+type UserStats struct {
+	MessagesToSlack    int64     `json:"messages_to_slack"`
+	MessagesToMatrix   int64     `json:"messages_to_matrix"`
+	MediaBytesToSlack  int64     `json:"media_bytes_to_slack"`
+	MediaBytesToMatrix int64     `json:"media_bytes_to_matrix"`
+	ReactionsToSlack   int64     `json:"reactions_to_slack"`
+	ReactionsToMatrix  int64     `json:"reactions_to_matrix"`
+	Errors             int64     `json:"errors"`
+	Since              time.Time `json:"since"`
+}
+
+func (usq *UserStatsQuery) Increment(userID id.UserID, counter UserStatsCounter, amount int64) {
+	query := fmt.Sprintf(`
+		INSERT INTO user_stats (mxid, %[1]s, since) VALUES ($1, $2, $3)
+		ON CONFLICT (mxid) DO UPDATE SET %[1]s=user_stats.%[1]s+excluded.%[1]s
+	`, counter)
+	_, err := usq.db.Exec(query, userID, amount, time.Now().UnixMilli())
+	if err != nil {
+		usq.log.Warnfln("Failed to increment %s of %s: %v", counter, userID, err)
+	}
+}
+
+func (usq *UserStatsQuery) Get(userID id.UserID) *UserStats {
+	var stats UserStats
+	var since int64
+	err := usq.db.QueryRow(`
+		SELECT messages_to_slack, messages_to_matrix, media_bytes_to_slack, media_bytes_to_matrix,
+		       reactions_to_slack, reactions_to_matrix, errors, since
+		FROM user_stats WHERE mxid=$1
+	`, userID).Scan(&stats.MessagesToSlack, &stats.MessagesToMatrix, &stats.MediaBytesToSlack, &stats.MediaBytesToMatrix,
+		&stats.ReactionsToSlack, &stats.ReactionsToMatrix, &stats.Errors, &since)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &UserStats{Since: time.Now()}
+	} else if err != nil {
+		usq.log.Warnfln("Failed to get stats of %s: %v", userID, err)
+		return nil
+	}
+	stats.Since = time.UnixMilli(since)
+	return &stats
+}
+
+func (usq *UserStatsQuery) Reset(userID id.UserID) {
+	_, err := usq.db.Exec("DELETE FROM user_stats WHERE mxid=$1", userID)
+	if err != nil {
+		usq.log.Warnfln("Failed to reset stats of %s: %v", userID, err)
+	}
+}
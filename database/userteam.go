@@ -40,7 +40,7 @@ func (utq *UserTeamQuery) New() *UserTeam {
 	}
 }
 
-const userTeamSelect = "SELECT ut.mxid, ut.slack_email, ut.slack_id, ut.team_name, ut.team_id, ut.token, ut.cookie_token FROM user_team ut "
+const userTeamSelect = "SELECT ut.mxid, ut.slack_email, ut.slack_id, ut.team_name, ut.team_id, ut.token, ut.cookie_token, ut.space_room FROM user_team ut "
 
 func (utq *UserTeamQuery) GetBySlackDomain(userID id.UserID, email, domain string) *UserTeam {
 	query := userTeamSelect + "WHERE ut.mxid=$1 AND ut.slack_email=$2 AND ut.team_id=(SELECT team_id FROM team_info WHERE team_domain=$3)"
@@ -71,6 +71,24 @@ func (utq *UserTeamQuery) GetAllByMXIDWithToken(userID id.UserID) []*UserTeam {
 	return tokens
 }
 
+func (utq *UserTeamQuery) GetAllWithToken() []*UserTeam {
+	query := userTeamSelect + "WHERE ut.token IS NOT NULL"
+
+	rows, err := utq.db.Query(query)
+	if err != nil || rows == nil {
+		return nil
+	}
+
+	defer rows.Close()
+
+	tokens := []*UserTeam{}
+	for rows.Next() {
+		tokens = append(tokens, utq.New().Scan(rows))
+	}
+
+	return tokens
+}
+
 func (utq *UserTeamQuery) GetAllBySlackTeamID(teamID string) []*UserTeam {
 	query := userTeamSelect + "WHERE ut.team_id=$1"
 
@@ -107,6 +125,36 @@ func (utq *UserTeamQuery) GetFirstUserTeamForPortal(portal *PortalKey) *UserTeam
 	return utq.New().Scan(row)
 }
 
+// EncryptExistingTokens encrypts tokens that were stored in plaintext before
+// token encryption was enabled.
+func (utq *UserTeamQuery) EncryptExistingTokens() {
+	if utq.db.TokenCipher == nil {
+		return
+	}
+	query := userTeamSelect + "WHERE ut.token NOT LIKE $1 OR ut.cookie_token NOT LIKE $1"
+
+	rows, err := utq.db.Query(query, encryptedTokenPrefix+"%")
+	if err != nil || rows == nil {
+		utq.log.Warnln("Failed to find plaintext tokens:", err)
+		return
+	}
+
+	var userTeams []*UserTeam
+	for rows.Next() {
+		if userTeam := utq.New().Scan(rows); userTeam != nil && !userTeam.tokensUnreadable {
+			userTeams = append(userTeams, userTeam)
+		}
+	}
+	_ = rows.Close()
+
+	for _, userTeam := range userTeams {
+		userTeam.Upsert()
+	}
+	if len(userTeams) > 0 {
+		utq.log.Infofln("Encrypted tokens of %d Slack logins", len(userTeams))
+	}
+}
+
 type UserTeamKey struct {
 	MXID    id.UserID
 	SlackID string
@@ -129,6 +177,13 @@ type UserTeam struct {
 	Token       string
 	CookieToken string
 
+	// The personal space of the user for this workspace
+	SpaceRoom id.RoomID
+
+	// Set if the stored tokens couldn't be decrypted, to avoid overwriting them with empty values
+	tokensUnreadable bool
+	cookieUnreadable bool
+
 	Client *slack.Client
 	RTM    *slack.RTM
 }
@@ -156,8 +211,9 @@ func (ut *UserTeam) IsConnected() bool {
 func (ut *UserTeam) Scan(row dbutil.Scannable) *UserTeam {
 	var token sql.NullString
 	var cookieToken sql.NullString
+	var spaceRoom sql.NullString
 
-	err := row.Scan(&ut.Key.MXID, &ut.SlackEmail, &ut.Key.SlackID, &ut.TeamName, &ut.Key.TeamID, &token, &cookieToken)
+	err := row.Scan(&ut.Key.MXID, &ut.SlackEmail, &ut.Key.SlackID, &ut.TeamName, &ut.Key.TeamID, &token, &cookieToken, &spaceRoom)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			ut.log.Errorln("Database scan failed:", err)
@@ -166,28 +222,83 @@ func (ut *UserTeam) Scan(row dbutil.Scannable) *UserTeam {
 		return nil
 	}
 
+	ut.SpaceRoom = id.RoomID(spaceRoom.String)
 	if token.Valid {
-		ut.Token = token.String
+		ut.Token, err = ut.db.decryptToken(token.String)
+		if err != nil {
+			ut.tokensUnreadable = true
+			ut.log.Errorfln("Failed to read token of %s/%s: %v", ut.Key.MXID, ut.Key.TeamID, err)
+		}
 	}
 	if cookieToken.Valid {
-		ut.CookieToken = cookieToken.String
+		ut.CookieToken, err = ut.db.decryptToken(cookieToken.String)
+		if err != nil {
+			ut.tokensUnreadable = true
+			ut.cookieUnreadable = true
+			ut.log.Errorfln("Failed to read cookie token of %s/%s: %v", ut.Key.MXID, ut.Key.TeamID, err)
+		}
 	}
 
 	return ut
 }
 
+// TokensUnreadable checks whether the stored tokens couldn't be decrypted,
+// usually because the token encryption key was changed or removed.
+func (ut *UserTeam) TokensUnreadable() bool {
+	return ut.tokensUnreadable
+}
+
+// ClearTokens removes the stored tokens of the login, even if they couldn't be
+// decrypted, so that it can't be used again after logging out.
+func (ut *UserTeam) ClearTokens() {
+	ut.Token = ""
+	ut.CookieToken = ""
+	ut.tokensUnreadable = false
+	ut.cookieUnreadable = false
+	_, err := ut.db.Exec("UPDATE user_team SET token=NULL, cookie_token=NULL WHERE mxid=$1 AND slack_id=$2 AND team_id=$3",
+		ut.Key.MXID, ut.Key.SlackID, ut.Key.TeamID)
+	if err != nil {
+		ut.log.Warnfln("Failed to clear tokens of %s/%s/%s: %v", ut.Key.MXID, ut.Key.SlackID, ut.Key.TeamID, err)
+	}
+}
+
 func (ut *UserTeam) Upsert() {
 	query := `
-		INSERT INTO user_team (mxid, slack_email, slack_id, team_name, team_id, token, cookie_token)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO user_team (mxid, slack_email, slack_id, team_name, team_id, token, cookie_token, space_room)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		ON CONFLICT (mxid, slack_id, team_id) DO UPDATE
-			SET slack_email=excluded.slack_email, team_name=excluded.team_name, token=excluded.token, cookie_token=excluded.cookie_token
+			SET slack_email=excluded.slack_email, team_name=excluded.team_name, token=excluded.token,
+				cookie_token=excluded.cookie_token, space_room=excluded.space_room
 	`
+	if ut.cookieUnreadable && ut.CookieToken == "" {
+		// Keep the stored cookie token, it may still be readable with the right key
+		query = `
+			INSERT INTO user_team (mxid, slack_email, slack_id, team_name, team_id, token, cookie_token, space_room)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (mxid, slack_id, team_id) DO UPDATE
+				SET slack_email=excluded.slack_email, team_name=excluded.team_name, token=excluded.token,
+					space_room=excluded.space_room
+		`
+	}
 
-	token := sqlNullString(ut.Token)
-	cookieToken := sqlNullString(ut.CookieToken)
+	if ut.tokensUnreadable && ut.Token == "" {
+		ut.log.Warnfln("Not saving %s/%s/%s: stored tokens couldn't be decrypted", ut.Key.MXID, ut.Key.SlackID, ut.Key.TeamID)
+		return
+	}
+	encryptedToken, err := ut.db.encryptToken(ut.Token)
+	if err != nil {
+		ut.log.Errorfln("Not saving %s/%s/%s: %v", ut.Key.MXID, ut.Key.SlackID, ut.Key.TeamID, err)
+		return
+	}
+	encryptedCookieToken, err := ut.db.encryptToken(ut.CookieToken)
+	if err != nil {
+		ut.log.Errorfln("Not saving %s/%s/%s: %v", ut.Key.MXID, ut.Key.SlackID, ut.Key.TeamID, err)
+		return
+	}
+	token := sqlNullString(encryptedToken)
+	cookieToken := sqlNullString(encryptedCookieToken)
 
-	_, err := ut.db.Exec(query, ut.Key.MXID, ut.SlackEmail, ut.Key.SlackID, ut.TeamName, ut.Key.TeamID, token, cookieToken)
+	_, err = ut.db.Exec(query, ut.Key.MXID, ut.SlackEmail, ut.Key.SlackID, ut.TeamName, ut.Key.TeamID, token, cookieToken, strPtr(string(ut.SpaceRoom)))
 
 	if err != nil {
 		ut.log.Warnfln("Failed to upsert %s/%s/%s: %v", ut.Key.MXID, ut.Key.SlackID, ut.Key.TeamID, err)
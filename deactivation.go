@@ -0,0 +1,147 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// updateDeactivated records whether the Slack account of the puppet has been
+// deactivated and updates the rooms it's in accordingly. The name is the
+// displayname built from the same user info, which DM rooms are renamed to.
+// The caller must save the puppet if this returns true.
+func (puppet *Puppet) updateDeactivated(deactivated bool, name string) bool {
+	if puppet.Deactivated == deactivated {
+		return false
+	}
+	puppet.Deactivated = deactivated
+	if deactivated {
+		puppet.log.Infoln("Slack account was deactivated")
+	} else {
+		puppet.log.Infoln("Slack account was reactivated")
+	}
+	go puppet.applyDeactivation(deactivated, name)
+	return true
+}
+
+func (puppet *Puppet) applyDeactivation(deactivated bool, name string) {
+	for _, portal := range puppet.bridge.GetDMPortalsWith(puppet.TeamID, puppet.UserID) {
+		if portal.MXID != "" {
+			portal.setDMReadOnly(deactivated, name)
+		}
+	}
+	if !deactivated {
+		// The ghost will be joined back to channels when it's seen there again.
+		return
+	}
+	for _, portal := range puppet.bridge.GetAllPortals() {
+		if portal.Key.TeamID != puppet.TeamID || portal.Type == database.ChannelTypeDM || portal.MXID == "" ||
+			!puppet.bridge.StateStore.IsInRoom(portal.MXID, puppet.MXID) {
+			continue
+		}
+		_, err := portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{
+			UserID: puppet.MXID,
+			Reason: "Slack account deactivated",
+		})
+		if err != nil {
+			portal.log.Warnfln("Failed to remove deactivated user %s: %v", puppet.MXID, err)
+		}
+	}
+}
+
+// dmLevels are the parts of the power levels that setDMReadOnly changes.
+type dmLevels struct {
+	EventsDefault int            `json:"events_default"`
+	Events        map[string]int `json:"events,omitempty"`
+}
+
+// setDMReadOnly prevents sending messages in a DM with a deactivated user, as
+// Slack would reject them anyway, and posts a notice explaining why. The
+// original power levels are saved and restored when the user is reactivated,
+// and the room name is updated to the current displayname of the user.
+func (portal *Portal) setDMReadOnly(readOnly bool, name string) {
+	intent := portal.MainIntent()
+	levels, err := intent.PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Warnln("Failed to get power levels:", err)
+	} else if portal.setDMReadOnlyLevels(levels, readOnly) {
+		_, err = intent.SetPowerLevels(portal.MXID, levels)
+		if err != nil {
+			portal.log.Warnln("Failed to update power levels:", err)
+		} else if !readOnly {
+			portal.bridge.DB.KV.Set(database.KVDMReadOnlyLevelsPrefix+portal.MXID.String(), "")
+		}
+	}
+	if portal.UpdateNameDirect(name) {
+		portal.Update(nil)
+		portal.UpdateBridgeInfo()
+	}
+	notice := "This Slack account has been deactivated, messages can no longer be sent in this chat."
+	if !readOnly {
+		notice = "This Slack account has been reactivated."
+	}
+	_, err = portal.sendMatrixMessage(intent, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    notice,
+	}, nil, 0)
+	if err != nil {
+		portal.log.Warnln("Failed to send deactivation notice:", err)
+	}
+}
+
+// setDMReadOnlyLevels changes the power levels to make the room read-only or
+// restores the saved ones, and returns whether they have to be sent.
+func (portal *Portal) setDMReadOnlyLevels(levels *event.PowerLevelsEventContent, readOnly bool) bool {
+	key := database.KVDMReadOnlyLevelsPrefix + portal.MXID.String()
+	saved := portal.bridge.DB.KV.Get(key)
+	if readOnly {
+		if saved == "" {
+			data, err := json.Marshal(&dmLevels{EventsDefault: levels.EventsDefault, Events: levels.Events})
+			if err != nil {
+				portal.log.Warnln("Failed to save power levels:", err)
+				return false
+			}
+			portal.bridge.DB.KV.Set(key, string(data))
+		}
+		if levels.EventsDefault == 100 {
+			return false
+		}
+		levels.EventsDefault = 100
+		return true
+	}
+	var original dmLevels
+	if saved == "" {
+		// The room was made read-only before the levels were saved
+		original.Events = levels.Events
+	} else if err := json.Unmarshal([]byte(saved), &original); err != nil {
+		portal.log.Warnln("Failed to parse saved power levels:", err)
+		return false
+	}
+	levels.EventsDefault = original.EventsDefault
+	levels.Events = original.Events
+	return true
+}
+
+func (portal *Portal) isDMUserDeactivated() bool {
+	return portal.IsPrivateChat() && portal.DMUserID != "" &&
+		portal.bridge.GetPuppetByID(portal.Key.TeamID, portal.DMUserID).Deactivated
+}
@@ -0,0 +1,76 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// publishAPIStatsOnce guards the slack_api expvar, as expvar panics when a
+// name is published twice.
+var publishAPIStatsOnce sync.Once
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// startDebugListener serves the profiling and expvar endpoints on their own
+// listener, so that they're never exposed through the appservice port.
+func (br *SlackBridge) startDebugListener() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	publishAPIStatsOnce.Do(func() {
+		expvar.Publish("slack_api", expvar.Func(func() interface{} {
+			return br.apiStats.snapshot()
+		}))
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	br.debugServer = &http.Server{
+		Addr:              br.bridgeConfig().DebugListener,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	br.Log.Infoln("Starting debug listener on", br.debugServer.Addr)
+	go func() {
+		err := br.debugServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			br.Log.Errorln("Debug listener failed:", err)
+		}
+	}()
+}
+
+func (br *SlackBridge) stopDebugListener() {
+	if br.debugServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = br.debugServer.Shutdown(ctx)
+}
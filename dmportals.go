@@ -0,0 +1,86 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// DM portals are keyed by team and conversation ID like all other portals,
+// because messages, reactions, threads and backfill state all refer to the
+// Slack conversation. The pair of users (DMUserID and DMReceiverID) is only a
+// secondary identity: it's used to find the Matrix room of a previous
+// conversation between the same users, so that each pair keeps one room even
+// if Slack opens a new conversation for them.
+
+// relinkDMPortal looks for an existing DM room between the same pair of
+// Slack users under a different conversation ID. Slack occasionally opens a
+// new conversation for the same pair, e.g. when an account is deactivated
+// and later restored, and without this the user would end up with a second
+// DM room. If one is found, its room is moved to this portal and true is
+// returned. The caller must hold portal.roomCreateLock.
+func (portal *Portal) relinkDMPortal(userTeam *database.UserTeam) bool {
+	if !portal.IsPrivateChat() || portal.DMUserID == "" || portal.DMReceiverID == "" {
+		return false
+	}
+	for _, old := range portal.bridge.GetDMPortalsBetween(portal.Key.TeamID, portal.DMUserID, portal.DMReceiverID) {
+		if old.Key == portal.Key || old.MXID == "" {
+			continue
+		}
+		portal.moveRoomFrom(old)
+		portal.InsertUser(userTeam.Key)
+		portal.log.Infofln("Re-linked %s from %s, as Slack opened a new conversation between %s and %s",
+			portal.MXID, old.Key.ChannelID, portal.DMUserID, portal.DMReceiverID)
+		_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    "Slack started a new conversation for this chat. Older messages can no longer be edited, replied to or reacted to from here.",
+		}, nil, 0)
+		if err != nil {
+			portal.log.Warnln("Failed to send re-link notice:", err)
+		}
+		return true
+	}
+	return false
+}
+
+func (portal *Portal) moveRoomFrom(old *Portal) {
+	old.roomCreateLock.Lock()
+	defer old.roomCreateLock.Unlock()
+
+	portal.MXID = old.MXID
+	portal.NameSet = old.NameSet
+	portal.TopicSet = old.TopicSet
+	portal.Encrypted = old.Encrypted
+	portal.AvatarSet = old.AvatarSet
+	portal.PortalSettings = old.PortalSettings.Clone()
+	// The history of the new conversation starts now, so there's nothing
+	// to backfill from the old one.
+	portal.FirstEventID = ""
+	portal.NextBatchID = ""
+	portal.FirstSlackID = ""
+
+	old.MXID = ""
+	old.Update(nil)
+	portal.Update(nil)
+
+	portal.bridge.portalsLock.Lock()
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
+	portal.UpdateBridgeInfo()
+}
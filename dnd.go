@@ -0,0 +1,159 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const masterPushRuleID = ".m.rule.master"
+
+func formatSnoozeEnd(status *slack.DNDStatus) string {
+	return time.Unix(int64(status.SnoozeEndTime), 0).UTC().Format("2006-01-02 15:04 MST")
+}
+
+// handleSlackDNDUpdate tells the user when they snooze notifications in Slack
+// or the snooze ends, and optionally snoozes Matrix notifications too.
+func (user *User) handleSlackDNDUpdate(userTeam *database.UserTeam, evt *slack.DNDUpdatedEvent) {
+	if evt.User != userTeam.Key.SlackID {
+		return
+	}
+	user.setDNDStatus(userTeam, &evt.Status, true)
+}
+
+// setDNDStatus remembers whether notifications are snoozed in the team and
+// schedules the end of the snooze, as Slack doesn't always send an event when
+// a snooze runs out.
+func (user *User) setDNDStatus(userTeam *database.UserTeam, status *slack.DNDStatus, notify bool) {
+	snoozed := status.SnoozeEnabled
+	endTime := time.Unix(int64(status.SnoozeEndTime), 0)
+	if snoozed && status.SnoozeEndTime != 0 && !endTime.After(time.Now()) {
+		snoozed = false
+	}
+	teamID := userTeam.Key.TeamID
+	user.dndLock.Lock()
+	wasSnoozed := user.dndSnoozed[teamID]
+	user.dndSnoozed[teamID] = snoozed
+	if timer, ok := user.dndTimers[teamID]; ok {
+		timer.Stop()
+		delete(user.dndTimers, teamID)
+	}
+	if snoozed && status.SnoozeEndTime != 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(time.Until(endTime), func() {
+			user.dndLock.Lock()
+			current := user.dndTimers[teamID] == timer
+			user.dndLock.Unlock()
+			if current {
+				user.setDNDStatus(userTeam, &slack.DNDStatus{}, true)
+			}
+		})
+		user.dndTimers[teamID] = timer
+	}
+	anySnoozed := false
+	for _, teamSnoozed := range user.dndSnoozed {
+		anySnoozed = anySnoozed || teamSnoozed
+	}
+	user.dndLock.Unlock()
+
+	cfg := user.bridge.bridgeConfig().DND
+	if notify && (wasSnoozed != snoozed || snoozed) && cfg.Notices && user.ManagementRoom != "" {
+		var text string
+		if snoozed {
+			text = fmt.Sprintf("Notifications are snoozed in %s until %s", userTeam.TeamName, formatSnoozeEnd(status))
+		} else {
+			text = fmt.Sprintf("Notifications are no longer snoozed in %s", userTeam.TeamName)
+		}
+		_, err := user.bridge.Bot.SendNotice(user.ManagementRoom, text)
+		if err != nil {
+			user.log.Warnfln("Failed to send DND notice to %s: %v", user.ManagementRoom, err)
+		}
+	}
+	if cfg.SnoozePushRules {
+		user.setMatrixSnooze(anySnoozed)
+	}
+}
+
+type pushRuleEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+// setMatrixSnooze enables the master push rule of the double puppet, which
+// turns off all notifications, and restores its previous state when the
+// snooze ends. The previous state is stored in the database so that it
+// survives restarts during a snooze.
+func (user *User) setMatrixSnooze(snoozed bool) {
+	intent := user.doublePuppetIntent()
+	if intent == nil {
+		return
+	}
+	user.dndRuleLock.Lock()
+	defer user.dndRuleLock.Unlock()
+	key := database.KVDNDMasterRulePrefix + user.MXID.String()
+	saved := user.bridge.DB.KV.Get(key)
+	url := intent.BuildClientURL("v3", "pushrules", "global", "override", masterPushRuleID, "enabled")
+	if snoozed {
+		if saved != "" {
+			return
+		}
+		var previous pushRuleEnabled
+		_, err := intent.MakeRequest(http.MethodGet, url, nil, &previous)
+		if err != nil {
+			user.log.Warnfln("Failed to get master push rule through double puppet: %v", err)
+			return
+		}
+		user.bridge.DB.KV.Set(key, strconv.FormatBool(previous.Enabled))
+		if previous.Enabled {
+			// Notifications are already off, so there's nothing to change
+			return
+		}
+	} else if saved == "" || saved == "true" {
+		user.bridge.DB.KV.Set(key, "")
+		return
+	}
+	_, err := intent.MakeRequest(http.MethodPut, url, &pushRuleEnabled{Enabled: snoozed}, nil)
+	if err != nil {
+		user.log.Warnfln("Failed to update master push rule through double puppet: %v", err)
+		return
+	}
+	if !snoozed {
+		user.bridge.DB.KV.Set(key, "")
+	}
+}
+
+// initDNDState remembers whether notifications are snoozed when connecting,
+// so that the next dnd_updated event can be compared against it and a snooze
+// that ended while the bridge was offline is undone.
+func (user *User) initDNDState(userTeam *database.UserTeam) {
+	if !user.bridge.bridgeConfig().DND.Notices && !user.bridge.bridgeConfig().DND.SnoozePushRules {
+		return
+	}
+	status, err := userTeam.Client.GetDNDInfoContext(withBackgroundPriority(context.Background()), nil)
+	if err != nil {
+		user.log.Warnfln("Failed to get DND status of %s: %v", userTeam.Key, err)
+		return
+	}
+	user.setDNDStatus(userTeam, status, false)
+}
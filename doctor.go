@@ -0,0 +1,281 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+)
+
+const doctorCheckTimeout = 15 * time.Second
+
+type doctorSeverity int
+
+const (
+	doctorOK doctorSeverity = iota
+	doctorWarning
+	doctorError
+)
+
+func (sev doctorSeverity) Icon() string {
+	switch sev {
+	case doctorWarning:
+		return "⚠️"
+	case doctorError:
+		return "❌"
+	default:
+		return "✅"
+	}
+}
+
+type doctorFinding struct {
+	Check    string
+	Severity doctorSeverity
+	Message  string
+}
+
+type doctorReport struct {
+	Findings []doctorFinding
+}
+
+func (report *doctorReport) add(check string, severity doctorSeverity, message string, args ...interface{}) {
+	report.Findings = append(report.Findings, doctorFinding{
+		Check:    check,
+		Severity: severity,
+		Message:  fmt.Sprintf(message, args...),
+	})
+}
+
+func (report *doctorReport) HasErrors() bool {
+	for _, finding := range report.Findings {
+		if finding.Severity == doctorError {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *doctorReport) String() string {
+	var text strings.Builder
+	for _, finding := range report.Findings {
+		_, _ = fmt.Fprintf(&text, "%s %s: %s\n", finding.Severity.Icon(), finding.Check, finding.Message)
+	}
+	return text.String()
+}
+
+// runDoctor checks that the bridge can talk to everything it depends on.
+// The media proxy can only be checked while the bridge is running, as it's
+// served by the appservice HTTP server.
+func (br *SlackBridge) runDoctor(ctx context.Context, running bool) *doctorReport {
+	report := &doctorReport{}
+	br.checkHomeserverConnection(report)
+	br.checkRegistration(report)
+	br.checkDatabaseSchema(report)
+	br.checkSlackTokens(ctx, report)
+	br.checkMediaProxy(ctx, report, running)
+	return report
+}
+
+// validateConfigAndExit runs the doctor checks for --validate-config and
+// exits with a non-zero status if any of them failed.
+func (br *SlackBridge) validateConfigAndExit() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*doctorCheckTimeout)
+	defer cancel()
+	report := br.runDoctor(ctx, false)
+	fmt.Print(report.String())
+	if report.HasErrors() {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func (br *SlackBridge) checkHomeserverConnection(report *doctorReport) {
+	const check = "Homeserver"
+	versions, err := br.Bot.Versions()
+	if err != nil {
+		report.add(check, doctorError, "Failed to connect to %s: %v. Check homeserver.address in the config.", br.Config.Homeserver.Address, err)
+		return
+	} else if !versions.ContainsGreaterOrEqual(bridge.MinSpecVersion) {
+		report.add(check, doctorError, "The homeserver only supports %s, but the bridge requires at least %s", versions.GetLatest(), bridge.MinSpecVersion)
+		return
+	}
+	resp, err := br.Bot.Whoami()
+	switch {
+	case errors.Is(err, mautrix.MUnknownToken):
+		report.add(check, doctorError, "The as_token was not accepted. Make sure the registration file is installed in the homeserver and the homeserver was restarted.")
+	case errors.Is(err, mautrix.MExclusive):
+		report.add(check, doctorError, "The as_token was accepted, but the bot user isn't in the registration's namespace. Check homeserver.domain and appservice.bot.username.")
+	case err != nil:
+		report.add(check, doctorError, "Failed to check the bot user: %v", err)
+	case resp.UserID != br.Bot.UserID:
+		report.add(check, doctorError, "The homeserver thinks the bot is %s, but the config says %s", resp.UserID, br.Bot.UserID)
+	default:
+		report.add(check, doctorOK, "Connected to %s as %s (latest supported spec version: %s)", br.Config.Homeserver.Address, resp.UserID, versions.GetLatest())
+	}
+}
+
+func (br *SlackBridge) checkRegistration(report *doctorReport) {
+	const check = "Registration"
+	if br.RegistrationPath == "" {
+		report.add(check, doctorWarning, "No registration file path given, skipping registration check")
+		return
+	}
+	reg, err := appservice.LoadRegistration(br.RegistrationPath)
+	if err != nil {
+		report.add(check, doctorError, "Failed to read %s: %v. Generate it again with -g.", br.RegistrationPath, err)
+		return
+	}
+	asConfig := br.Config.AppService
+	var problems []string
+	if reg.AppToken != asConfig.ASToken {
+		problems = append(problems, "as_token doesn't match appservice.as_token")
+	}
+	if reg.ServerToken != asConfig.HSToken {
+		problems = append(problems, "hs_token doesn't match appservice.hs_token")
+	}
+	if reg.ID != asConfig.ID {
+		problems = append(problems, fmt.Sprintf("id is %q, but appservice.id is %q", reg.ID, asConfig.ID))
+	}
+	if reg.URL != asConfig.Address {
+		problems = append(problems, fmt.Sprintf("url is %q, but appservice.address is %q", reg.URL, asConfig.Address))
+	}
+	if !registrationCovers(reg, br.Bot.UserID) {
+		problems = append(problems, fmt.Sprintf("the bot user %s isn't in the user namespaces", br.Bot.UserID))
+	}
+	if sampleGhost := br.FormatPuppetMXID("t0123abc-u0123abc"); !registrationCovers(reg, sampleGhost) {
+		problems = append(problems, fmt.Sprintf("ghost users like %s aren't in the user namespaces, check bridge.username_template", sampleGhost))
+	}
+	if len(problems) > 0 {
+		report.add(check, doctorError, "%s doesn't match the config: %s. Regenerate the registration with -g and restart the homeserver.",
+			br.RegistrationPath, strings.Join(problems, "; "))
+	} else {
+		report.add(check, doctorOK, "%s matches the config", br.RegistrationPath)
+	}
+}
+
+func registrationCovers(reg *appservice.Registration, userID id.UserID) bool {
+	for _, ns := range reg.Namespaces.UserIDs {
+		if regex, err := regexp.Compile(ns.Regex); err == nil && regex.MatchString(string(userID)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (br *SlackBridge) checkDatabaseSchema(report *doctorReport) {
+	const check = "Database"
+	version, pending, err := br.DB.PendingUpgrades()
+	if err != nil {
+		report.add(check, doctorError, "Failed to check the schema version: %v. Check appservice.database.", err)
+		return
+	} else if len(pending) > 0 {
+		report.add(check, doctorWarning, "Schema is on v%d with %d pending migrations, they'll be applied when the bridge starts", version, len(pending))
+		return
+	}
+	report.add(check, doctorOK, "Schema is up to date (v%d)", version)
+	if oldTemplate, oldDomain := br.getStoredGhostFormat(); oldTemplate != "" && br.ghostFormatChanged(oldTemplate, oldDomain) {
+		report.add("Ghost users", doctorWarning, "The username template or homeserver domain changed since ghosts were created. Run the migrate-ghosts command to move them.")
+	}
+}
+
+func (br *SlackBridge) checkSlackTokens(ctx context.Context, report *doctorReport) {
+	const check = "Slack login"
+	userTeams := br.DB.UserTeam.GetAllWithToken()
+	if len(userTeams) == 0 {
+		report.add(check, doctorOK, "No users are logged in")
+		return
+	}
+	for _, userTeam := range userTeams {
+		if userTeam == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s in %s (%s)", userTeam.Key.MXID, userTeam.TeamName, userTeam.Key.TeamID)
+		if userTeam.TokensUnreadable() {
+			report.add(check, doctorError, "The token of %s can't be decrypted. Check bridge.token_encryption_key.", name)
+			continue
+		}
+		client := userTeam.Client
+		if client == nil {
+			slackOptions := br.getSlackClientOptions(userTeam.Key.TeamID)
+			if userTeam.CookieToken != "" {
+				slackOptions = append(slackOptions, slack.OptionCookie("d", userTeam.CookieToken))
+			}
+			client = slack.New(userTeam.Token, slackOptions...)
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+		_, err := client.AuthTestContext(checkCtx)
+		cancel()
+		if err != nil {
+			switch err.Error() {
+			case "invalid_auth", "not_authed", "token_revoked", "token_expired", "account_inactive":
+				report.add(check, doctorError, "The token of %s is no longer valid (%v), they need to log in again", name, err)
+			default:
+				report.add(check, doctorWarning, "Failed to check the token of %s: %v", name, err)
+			}
+		} else {
+			report.add(check, doctorOK, "%s is logged in", name)
+		}
+	}
+}
+
+func (br *SlackBridge) checkMediaProxy(ctx context.Context, report *doctorReport, running bool) {
+	const check = "Media proxy"
+	cfg := br.bridgeConfig().Media
+	if cfg.PublicAddress == "" {
+		if cfg.ProxyLinks {
+			report.add(check, doctorError, "bridge.media.proxy_links is enabled, but bridge.media.public_address isn't set")
+		}
+		return
+	} else if !running {
+		report.add(check, doctorWarning, "Skipped, the media proxy can only be checked with the doctor command while the bridge is running")
+		return
+	}
+	// Requests without a valid signature are rejected with 403, which is
+	// enough to know the request reached the bridge.
+	proxyURL := strings.TrimSuffix(cfg.PublicAddress, "/") + slackMediaProxyPath + "/doctor/doctor/doctor"
+	checkCtx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(checkCtx, http.MethodGet, proxyURL, nil)
+	if err != nil {
+		report.add(check, doctorError, "Invalid bridge.media.public_address: %v", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		report.add(check, doctorError, "%s isn't reachable: %v. Check bridge.media.public_address and your reverse proxy.", cfg.PublicAddress, err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		report.add(check, doctorError, "Expected HTTP 403 from %s, got %d. Make sure %s is forwarded to the bridge.", proxyURL, resp.StatusCode, slackMediaProxyPath)
+	} else {
+		report.add(check, doctorOK, "%s is reachable", cfg.PublicAddress)
+	}
+}
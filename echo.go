@@ -0,0 +1,177 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const pendingEchoTimeout = 2 * time.Minute
+
+// pendingEcho is a message or edit that the bridge sent to Slack. Slack
+// echoes it back over the websocket, and the echo must not be bridged to
+// Matrix again.
+type pendingEcho struct {
+	matrixID id.EventID
+	author   string
+	text     string
+	// The timestamp of the edited message, empty for new messages
+	editOf  string
+	expires time.Time
+}
+
+// echoTracker deduplicates Slack messages in a portal that the stored
+// timestamp mapping alone can't catch: messages that were posted even though
+// sending them failed or timed out, echoes of edits made from Matrix, and
+// edits that arrive once for every logged-in user's connection.
+type echoTracker struct {
+	pending   []*pendingEcho
+	seenEdits map[string]time.Time
+	lock      sync.Mutex
+}
+
+func normalizeEchoText(text string) string {
+	return strings.TrimSpace(html.UnescapeString(text))
+}
+
+func (et *echoTracker) pruneLocked(now time.Time) {
+	kept := et.pending[:0]
+	for _, echo := range et.pending {
+		if now.Before(echo.expires) {
+			kept = append(kept, echo)
+		}
+	}
+	for i := len(kept); i < len(et.pending); i++ {
+		et.pending[i] = nil
+	}
+	et.pending = kept
+	for key, expires := range et.seenEdits {
+		if now.After(expires) {
+			delete(et.seenEdits, key)
+		}
+	}
+}
+
+// Expect registers a message that is about to be sent with the given options.
+func (et *echoTracker) Expect(evtID id.EventID, author string, options []slack.MsgOption) *pendingEcho {
+	endpoint, values, err := slack.UnsafeApplyMsgOptions("", "", "", nil, options...)
+	if err != nil {
+		return nil
+	}
+	echo := &pendingEcho{
+		matrixID: evtID,
+		author:   author,
+		text:     normalizeEchoText(values.Get("text")),
+		expires:  time.Now().Add(pendingEchoTimeout),
+	}
+	if strings.HasSuffix(endpoint, "chat.update") {
+		echo.editOf = values.Get("ts")
+	}
+	et.lock.Lock()
+	et.pruneLocked(time.Now())
+	et.pending = append(et.pending, echo)
+	et.lock.Unlock()
+	return echo
+}
+
+// Forget removes an expected echo that is no longer needed, e.g. because the
+// message was sent successfully and its timestamp mapping was stored.
+func (et *echoTracker) Forget(echo *pendingEcho) {
+	if echo == nil {
+		return
+	}
+	et.lock.Lock()
+	defer et.lock.Unlock()
+	for i, pending := range et.pending {
+		if pending == echo {
+			et.pending = append(et.pending[:i], et.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Match finds and removes the expected echo for a Slack message or edit.
+func (et *echoTracker) Match(author, editOf, text string) *pendingEcho {
+	text = normalizeEchoText(text)
+	et.lock.Lock()
+	defer et.lock.Unlock()
+	et.pruneLocked(time.Now())
+	for i, echo := range et.pending {
+		if echo.author == author && echo.editOf == editOf && echo.text == text {
+			et.pending = append(et.pending[:i], et.pending[i+1:]...)
+			return echo
+		}
+	}
+	return nil
+}
+
+// SeenEdit checks whether the given version of a message was already handled,
+// and marks it as handled if not.
+func (et *echoTracker) SeenEdit(ts, editedTs string) bool {
+	key := ts + "/" + editedTs
+	et.lock.Lock()
+	defer et.lock.Unlock()
+	now := time.Now()
+	et.pruneLocked(now)
+	if _, seen := et.seenEdits[key]; seen {
+		return true
+	}
+	if et.seenEdits == nil {
+		et.seenEdits = make(map[string]time.Time)
+	}
+	et.seenEdits[key] = now.Add(pendingEchoTimeout)
+	return false
+}
+
+// isSlackEcho checks whether a Slack message is an echo of something the
+// bridge sent from Matrix or a duplicate of an edit that was already bridged.
+// Echoes of messages whose sending seemed to fail are stored in the timestamp
+// mapping, so that later edits and reactions find them.
+func (portal *Portal) isSlackEcho(msg *slack.MessageEvent, existing *database.Message) bool {
+	switch msg.Msg.SubType {
+	case "message_changed":
+		if msg.SubMessage == nil {
+			return false
+		}
+		if msg.SubMessage.Edited != nil && portal.echoes.SeenEdit(msg.Msg.Timestamp, msg.SubMessage.Edited.Timestamp) {
+			portal.log.Debugfln("Dropping duplicate edit of %s", msg.Msg.Timestamp)
+			return true
+		}
+		if echo := portal.echoes.Match(msg.SubMessage.User, existing.SlackID, msg.SubMessage.Text); echo != nil {
+			portal.log.Debugfln("Dropping echo of Matrix edit %s to %s", echo.matrixID, msg.Msg.Timestamp)
+			return true
+		}
+	case "", "me_message":
+		if echo := portal.echoes.Match(msg.Msg.User, "", msg.Msg.Text); echo != nil {
+			portal.log.Infofln("Slack message %s is the echo of %s, which was posted even though sending it failed", msg.Msg.Timestamp, echo.matrixID)
+			// The Matrix event was sent as a single Slack message, so it's the only part
+			portal.markMessageHandled(nil, msg.Msg.Timestamp, msg.Msg.ThreadTimestamp, msg.Msg.SubType, 0, echo.matrixID, msg.Msg.User)
+			portal.sendStatusEvent(echo.matrixID, "", nil)
+			return true
+		}
+	}
+	return false
+}
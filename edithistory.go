@@ -0,0 +1,85 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const editHistoryField = "fi.mau.slack.previous_content"
+
+func (portal *Portal) getEditHistoryMode() database.EditHistoryMode {
+	if portal.EditHistory != database.EditHistoryDefault {
+		return portal.EditHistory
+	}
+	return portal.bridge.bridgeConfig().EditHistory
+}
+
+// getEditHistoryContent renders the text of a message before it was edited
+// the same way as the new text, or returns nil if edit history isn't kept in
+// this room or the content filter rejects the previous text.
+func (portal *Portal) getEditHistoryContent(sender string, previous *slack.Msg) *event.MessageEventContent {
+	if previous == nil || portal.getEditHistoryMode() == database.EditHistoryOff {
+		return nil
+	}
+	content := portal.convertSlackText(previous)
+	if content == nil {
+		return nil
+	}
+	portal.translateSlackMessage(content)
+	if err := portal.filterSlackContent(sender, content); err != nil {
+		portal.log.Debugfln("Not keeping edit history of %s: %v", previous.Timestamp, err)
+		return nil
+	}
+	return content
+}
+
+// sendEditHistoryNotice sends the previous text of an edited message in the
+// thread of the message, or however threads are shown in this room, so that
+// it stays visible in clients that hide the edit history.
+func (portal *Portal) sendEditHistoryNotice(edited *database.Message, threadTs string, previous *event.MessageEventContent) {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Previous version of the edited message:\n\n%s", previous.Body),
+	}
+	if previous.FormattedBody != "" {
+		content.Format = event.FormatHTML
+		content.FormattedBody = fmt.Sprintf("Previous version of the edited message:<blockquote>%s</blockquote>", previous.FormattedBody)
+	}
+	if threadTs != "" && threadTs != edited.SlackID {
+		portal.addThreadMetadata(content, threadTs)
+	} else {
+		switch portal.getThreadMode() {
+		case database.ThreadModeFlatten:
+			portal.addThreadQuote(content, edited.MatrixID)
+		case database.ThreadModeReply:
+			content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(edited.MatrixID)
+		default:
+			content.RelatesTo = (&event.RelatesTo{}).SetThread(edited.MatrixID, edited.MatrixID)
+		}
+	}
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, content, nil, 0)
+	if err != nil {
+		portal.log.Warnfln("Failed to send edit history of %s: %v", edited.SlackID, err)
+	}
+}
@@ -0,0 +1,49 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// canSendNativeEmote checks whether a new Matrix emote can be sent as a Slack
+// /me message. Slack doesn't support /me messages in threads or with the
+// username overrides used for relayed messages.
+func (portal *Portal) canSendNativeEmote(sender id.UserID, userTeam *database.UserTeam, threadTs string) bool {
+	return portal.bridge.bridgeConfig().UseNativeEmotes() && userTeam.Key.MXID == sender && threadTs == ""
+}
+
+// convertMatrixEmote formats the text of a Matrix emote for Slack, and
+// returns whether it should be sent as a Slack /me message instead.
+func (portal *Portal) convertMatrixEmote(sender *User, userTeam *database.UserTeam, text, threadTs, existingTs, existingSubtype string) (string, bool) {
+	switch {
+	case existingTs != "" && existingSubtype == "me_message":
+		// Edits keep the /me subtype of the original message
+		return text, false
+	case userTeam.Key.MXID != sender.MXID:
+		// The relay prefix already contains the sender's name
+		return "_" + text + "_", false
+	case existingTs == "" && portal.canSendNativeEmote(sender.MXID, userTeam, threadTs):
+		return text, true
+	default:
+		displayname := portal.getRelayTemplateData(sender, event.MsgEmote).Displayname
+		return portal.bridge.bridgeConfig().FormatEmote(displayname, text), false
+	}
+}
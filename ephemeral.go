@@ -0,0 +1,67 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+
+	"github.com/slack-go/slack"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// handleSlackEphemeral bridges a message that Slack only shows to one user,
+// like the response to a slash command. Matrix rooms can't have messages
+// only one member sees, so it's sent to the management room of the user
+// instead of the portal.
+func (portal *Portal) handleSlackEphemeral(user *User, userTeam *database.UserTeam, msg *slack.Msg) {
+	if !portal.bridge.bridgeConfig().EphemeralMessages {
+		portal.log.Debugfln("Ignoring ephemeral message %s", msg.Timestamp)
+		return
+	} else if user.ManagementRoom == "" {
+		portal.log.Debugfln("Ignoring ephemeral message %s: %s doesn't have a management room", msg.Timestamp, user.MXID)
+		return
+	}
+	if msg.User == "" && msg.BotID == "" {
+		// Ephemeral messages from Slack itself don't always have a sender
+		fixed := *msg
+		fixed.User = "USLACKBOT"
+		msg = &fixed
+	}
+	content := portal.ConvertSlackMessage(userTeam, msg).Event
+	if content == nil {
+		portal.log.Debugfln("Ignoring ephemeral message %s: no content", msg.Timestamp)
+		return
+	}
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = html.EscapeString(content.Body)
+	}
+	location := html.EscapeString(portal.Name)
+	if portal.MXID != "" {
+		location = fmt.Sprintf(`<a href="https://matrix.to/#/%s?via=%s">%s</a>`, portal.MXID, portal.bridge.AS.HomeserverDomain, location)
+	}
+	content.MsgType = event.MsgNotice
+	content.Body = fmt.Sprintf("\U0001F512 Only visible to you in %s:\n%s", portal.Name, content.Body)
+	content.FormattedBody = fmt.Sprintf("<em>\U0001F512 Only visible to you in %s:</em><br>%s", location, content.FormattedBody)
+	_, err := portal.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, content)
+	if err != nil {
+		portal.log.Warnfln("Failed to send ephemeral message %s to %s: %v", msg.Timestamp, user.ManagementRoom, err)
+	}
+}
@@ -0,0 +1,99 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const eventArchivePruneInterval = 10 * time.Minute
+
+func (user *User) archiveSlackEvent(userTeam *database.UserTeam, evt slack.RTMEvent) {
+	data, err := json.Marshal(evt.Data)
+	if err != nil {
+		user.log.Warnfln("Failed to marshal %s event for archiving: %v", evt.Type, err)
+		return
+	}
+	archived := user.bridge.DB.EventArchive.New()
+	archived.UserMXID = user.MXID
+	archived.TeamID = userTeam.Key.TeamID
+	archived.SlackUserID = getArchivedEventUser(data)
+	archived.EventType = evt.Type
+	archived.Data = string(data)
+	archived.ReceivedAt = time.Now()
+	archived.Insert()
+}
+
+// getArchivedEventUser finds the Slack user an event is about, which is in the
+// user field of most events, either as an ID or as a user object.
+func getArchivedEventUser(data []byte) string {
+	var evt struct {
+		User json.RawMessage `json:"user"`
+	}
+	if json.Unmarshal(data, &evt) != nil || len(evt.User) == 0 {
+		return ""
+	}
+	var userID string
+	if json.Unmarshal(evt.User, &userID) == nil {
+		return userID
+	}
+	var user struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(evt.User, &user)
+	return user.ID
+}
+
+// replayArchivedEvent handles an archived Slack event again as if it had just
+// been received by the user who originally received it.
+func (br *SlackBridge) replayArchivedEvent(archived *database.ArchivedEvent) error {
+	target, ok := slack.EventMapping[archived.EventType]
+	if !ok {
+		return fmt.Errorf("unknown event type %s", archived.EventType)
+	}
+	user := br.GetUserByMXID(archived.UserMXID)
+	if user == nil {
+		return fmt.Errorf("user %s not found", archived.UserMXID)
+	}
+	userTeam := user.GetUserTeam(archived.TeamID)
+	if userTeam == nil || userTeam.Client == nil {
+		return fmt.Errorf("%s is not connected to team %s", archived.UserMXID, archived.TeamID)
+	}
+
+	data := reflect.New(reflect.TypeOf(target)).Interface()
+	err := json.Unmarshal([]byte(archived.Data), data)
+	if err != nil {
+		return fmt.Errorf("failed to parse event: %w", err)
+	}
+	user.handleSlackEvent(userTeam, data)
+	return nil
+}
+
+func (br *SlackBridge) pruneEventArchiveLoop() {
+	cfg := br.bridgeConfig().EventArchive
+	for {
+		br.DB.EventArchive.Prune(cfg.MaxEvents, cfg.MaxAge)
+		time.Sleep(eventArchivePruneInterval)
+	}
+}
@@ -0,0 +1,233 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const (
+	externalUploadShareAttempts = 10
+	externalUploadShareDelay    = 1 * time.Second
+)
+
+type errExternalUploadStatus int
+
+func (status errExternalUploadStatus) Error() string {
+	return fmt.Sprintf("unexpected status code %d", int(status))
+}
+
+// isRetriableUploadError checks whether an upload attempt failed because of
+// a network error or a server-side error, rather than a rejected request.
+func isRetriableUploadError(err error) bool {
+	var status errExternalUploadStatus
+	if errors.As(err, &status) {
+		return status >= 500 || status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errMediaTooLarge)
+}
+
+type externalUploadURLResponse struct {
+	slack.SlackResponse
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+// externalUploader uploads files to Slack with the files.getUploadURLExternal
+// and files.completeUploadExternal flow. The file is spooled to disk first,
+// so that a failed upload can be retried without downloading it again.
+type externalUploader struct {
+	portal   *Portal
+	userTeam *database.UserTeam
+	client   *http.Client
+}
+
+func (portal *Portal) newExternalUploader(userTeam *database.UserTeam) *externalUploader {
+	return &externalUploader{
+		portal:   portal,
+		userTeam: userTeam,
+		client:   portal.bridge.getSlackHTTPClient(portal.Key.TeamID),
+	}
+}
+
+func (eu *externalUploader) newRequest(ctx context.Context, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+eu.userTeam.Token)
+	if eu.userTeam.CookieToken != "" {
+		req.AddCookie(&http.Cookie{Name: "d", Value: url.QueryEscape(eu.userTeam.CookieToken)})
+	}
+	return req, nil
+}
+
+func (eu *externalUploader) callMethod(ctx context.Context, method string, values url.Values, resp interface{ Err() error }) error {
+	req, err := eu.newRequest(ctx, slack.APIURL+method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpResp, err := eu.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return errExternalUploadStatus(httpResp.StatusCode)
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", method, err)
+	}
+	return resp.Err()
+}
+
+// withRetries calls fn until it succeeds, fails with a non-retriable error
+// or runs out of attempts, backing off exponentially between attempts.
+func (eu *externalUploader) withRetries(ctx context.Context, action string, fn func() error) error {
+	maxRetries := eu.portal.bridge.bridgeConfig().Media.UploadRetries
+	delay := 1 * time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxRetries || !isRetriableUploadError(err) {
+			return err
+		}
+		eu.portal.log.Warnfln("Failed to %s (attempt %d/%d), retrying in %s: %v", action, attempt+1, maxRetries+1, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Upload sends the file to Slack and returns the timestamp of the message
+// that shares it in the portal's channel.
+func (eu *externalUploader) Upload(ctx context.Context, params *slack.FileUploadParameters) (string, error) {
+	spool, err := os.CreateTemp("", "mautrix-slack-upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+	size, err := io.Copy(spool, params.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to download file: %w", err)
+	}
+
+	var uploadURL externalUploadURLResponse
+	err = eu.withRetries(ctx, "get upload URL", func() error {
+		return eu.callMethod(ctx, "files.getUploadURLExternal", url.Values{
+			"filename": {params.Filename},
+			"length":   {strconv.FormatInt(size, 10)},
+		}, &uploadURL)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get upload URL: %w", err)
+	}
+
+	err = eu.withRetries(ctx, "upload file", func() error {
+		return eu.uploadSpooled(ctx, uploadURL.UploadURL, spool, size)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
+	}
+
+	files, _ := json.Marshal([]map[string]string{{"id": uploadURL.FileID, "title": params.Filename}})
+	completeValues := url.Values{
+		"files":      {string(files)},
+		"channel_id": {eu.portal.Key.ChannelID},
+	}
+	if params.InitialComment != "" {
+		completeValues.Set("initial_comment", params.InitialComment)
+	}
+	if params.ThreadTimestamp != "" {
+		completeValues.Set("thread_ts", params.ThreadTimestamp)
+	}
+	var completeResp slack.SlackResponse
+	err = eu.withRetries(ctx, "complete upload", func() error {
+		return eu.callMethod(ctx, "files.completeUploadExternal", completeValues, &completeResp)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete upload: %w", err)
+	}
+	return eu.waitForShare(ctx, uploadURL.FileID)
+}
+
+func (eu *externalUploader) uploadSpooled(ctx context.Context, uploadURL string, spool *os.File, size int64) error {
+	_, err := spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	// Wrap the file so the HTTP client doesn't close it after the first attempt
+	req, err := eu.newRequest(ctx, uploadURL, io.NopCloser(spool))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := eu.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errExternalUploadStatus(resp.StatusCode)
+	}
+	return nil
+}
+
+// waitForShare polls the file info until Slack has shared the file in the
+// channel, as completeUploadExternal shares files asynchronously.
+func (eu *externalUploader) waitForShare(ctx context.Context, fileID string) (string, error) {
+	channelID := eu.portal.Key.ChannelID
+	for i := 0; i < externalUploadShareAttempts; i++ {
+		file, _, _, err := eu.userTeam.Client.GetFileInfoContext(ctx, fileID, 0, 0)
+		if err != nil {
+			return "", err
+		}
+		if info, found := file.Shares.Private[channelID]; found && len(info) > 0 {
+			return info[0].Ts, nil
+		} else if info, found = file.Shares.Public[channelID]; found && len(info) > 0 {
+			return info[0].Ts, nil
+		}
+		select {
+		case <-time.After(externalUploadShareDelay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	return "", fmt.Errorf("file %s wasn't shared in %s after uploading", fileID, channelID)
+}
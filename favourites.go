@@ -0,0 +1,118 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const favouriteTag = "m.favourite"
+
+func (user *User) doublePuppetIntent() *appservice.IntentAPI {
+	if puppet := user.bridge.GetPuppetByCustomMXID(user.MXID); puppet != nil {
+		return puppet.CustomIntent()
+	}
+	return nil
+}
+
+func isChannelStar(item slack.StarredItem) bool {
+	return item.Type == slack.TYPE_CHANNEL || item.Type == slack.TYPE_IM || item.Type == slack.TYPE_GROUP
+}
+
+// setFavourite tags or untags the portal with m.favourite through the double
+// puppet of the user.
+func (user *User) setFavourite(portal *Portal, favourite bool) {
+	intent := user.doublePuppetIntent()
+	if intent == nil || portal.MXID == "" {
+		return
+	}
+	user.favouritesLock.Lock()
+	known, ok := user.favourites[portal.MXID]
+	user.favourites[portal.MXID] = favourite
+	user.favouritesLock.Unlock()
+	if ok && known == favourite {
+		return
+	}
+	var err error
+	if favourite {
+		err = intent.AddTag(portal.MXID, favouriteTag, 0.5)
+	} else {
+		err = intent.RemoveTag(portal.MXID, favouriteTag)
+	}
+	if err != nil {
+		portal.log.Warnfln("Failed to update favourite tag of %s: %v", user.MXID, err)
+	}
+}
+
+// syncFavourites tags the rooms of channels the user has starred in Slack.
+// Tags are only added here, so favourites added in Matrix while the bridge
+// was offline aren't lost.
+func (user *User) syncFavourites(userTeam *database.UserTeam) {
+	if !user.bridge.bridgeConfig().SyncFavourites || user.doublePuppetIntent() == nil {
+		return
+	}
+	items, err := userTeam.Client.ListAllStarsContext(withBackgroundPriority(context.Background()))
+	if err != nil {
+		user.log.Warnfln("Failed to get starred channels of %s: %v", userTeam.Key, err)
+		return
+	}
+	for _, item := range items {
+		if isChannelStar(slack.StarredItem(item)) {
+			portal := user.bridge.GetPortalByID(database.NewPortalKey(userTeam.Key.TeamID, item.Channel))
+			user.setFavourite(portal, true)
+		}
+	}
+}
+
+// handleMatrixTags stars or unstars the channel in Slack when the user adds or
+// removes the favourite tag in Matrix. Tags are received through the sync of
+// the double puppet.
+func (user *User) handleMatrixTags(roomID id.RoomID, tags *event.TagEventContent) {
+	portal := user.bridge.GetPortalByMXID(roomID)
+	if portal == nil {
+		return
+	}
+	userTeam := user.GetUserTeam(portal.Key.TeamID)
+	if userTeam == nil || userTeam.Client == nil {
+		return
+	}
+	_, favourite := tags.Tags[favouriteTag]
+	user.favouritesLock.Lock()
+	known, ok := user.favourites[roomID]
+	user.favourites[roomID] = favourite
+	user.favouritesLock.Unlock()
+	if ok && known == favourite {
+		return
+	}
+	var err error
+	if favourite {
+		err = userTeam.Client.AddStar(portal.Key.ChannelID, slack.ItemRef{})
+	} else {
+		err = userTeam.Client.RemoveStar(portal.Key.ChannelID, slack.ItemRef{})
+	}
+	if err != nil && err.Error() != "already_starred" && err.Error() != "not_starred" {
+		portal.log.Warnfln("Failed to update Slack star of %s: %v", user.MXID, err)
+	}
+}
@@ -18,41 +18,17 @@ package main
 
 import (
 	"fmt"
-	"regexp"
 	"strings"
 
 	"github.com/slack-go/slack"
-	"github.com/yuin/goldmark"
-	"github.com/yuin/goldmark/ast"
-	"github.com/yuin/goldmark/parser"
-	"github.com/yuin/goldmark/renderer"
-	"github.com/yuin/goldmark/text"
-	goldmarkUtil "github.com/yuin/goldmark/util"
-	"go.mau.fi/mautrix-slack/database"
-	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util"
 )
 
-var escapeFixer = regexp.MustCompile(`\\(__[^_]|\*\*[^*])`)
-
-const mentionedUsersContextKey = "fi.mau.slack.mentioned_users"
-
 func (portal *Portal) renderSlackMarkdown(text string) *event.MessageEventContent {
-	text = replaceShortcodesWithEmojis(text)
-
-	text = escapeFixer.ReplaceAllStringFunc(text, func(s string) string {
-		return s[:2] + `\` + s[2:]
-	})
-
-	mdRenderer := goldmark.New(
-		format.Extensions, format.HTMLOptions,
-		goldmark.WithExtensions(&SlackTag{portal}),
-	)
-
-	content := format.RenderMarkdownCustom(text, mdRenderer)
+	content := format.HTMLToContent(portal.mrkdwnToHTML(text))
 	return &content
 }
 
@@ -121,174 +97,3 @@ func NewParser(bridge *SlackBridge) *format.HTMLParser {
 		MonospaceBlockConverter: func(text, language string, _ format.Context) string { return fmt.Sprintf("```%s```", text) },
 	}
 }
-
-type astSlackTag struct {
-	ast.BaseInline
-
-	label string
-}
-
-var _ ast.Node = (*astSlackTag)(nil)
-var astKindSlackTag = ast.NewNodeKind("SlackTag")
-
-func (n *astSlackTag) Dump(source []byte, level int) {
-	ast.DumpHelper(n, source, level, nil, nil)
-}
-
-func (n *astSlackTag) Kind() ast.NodeKind {
-	return astKindSlackTag
-}
-
-type astSlackUserMention struct {
-	astSlackTag
-
-	userID string
-}
-
-func (n *astSlackUserMention) String() string {
-	if n.label != "" {
-		return fmt.Sprintf("<@%s|%s>", n.userID, n.label)
-	} else {
-		return fmt.Sprintf("<@%s>", n.userID)
-	}
-}
-
-type astSlackChannelMention struct {
-	astSlackTag
-
-	channelID string
-}
-
-func (n *astSlackChannelMention) String() string {
-	if n.label != "" {
-		return fmt.Sprintf("<#%s|%s>", n.channelID, n.label)
-	} else {
-		return fmt.Sprintf("<#%s>", n.channelID)
-	}
-}
-
-type astSlackURL struct {
-	astSlackTag
-
-	url string
-}
-
-func (n *astSlackURL) String() string {
-	if n.label != n.url {
-		return fmt.Sprintf("<%s|%s>", n.url, n.label)
-	} else {
-		return fmt.Sprintf("<%s>", n.url)
-	}
-}
-
-type slackTagParser struct{}
-
-// Regex matching Slack docs at https://api.slack.com/reference/surfaces/formatting#retrieving-messages
-var slackTagRegex = regexp.MustCompile(`<(#|@|!|)([^|>]+)(\|([^|>]*))?>`)
-var defaultSlackTagParser = &slackTagParser{}
-
-func (s *slackTagParser) Trigger() []byte {
-	return []byte{'<'}
-}
-
-func (s *slackTagParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
-	//before := block.PrecendingCharacter()
-	line, _ := block.PeekLine()
-	match := slackTagRegex.FindSubmatch(line)
-	if match == nil {
-		return nil
-	}
-	//seg := segment.WithStop(segment.Start + len(match[0]))
-	block.Advance(len(match[0]))
-
-	sigil := string(match[1])
-	content := string(match[2])
-	text := string(match[4])
-
-	tag := astSlackTag{label: text}
-	switch sigil {
-	case "@":
-		return &astSlackUserMention{astSlackTag: tag, userID: content}
-	case "#":
-		return &astSlackChannelMention{astSlackTag: tag, channelID: content}
-	case "":
-		return &astSlackURL{astSlackTag: tag, url: content}
-	default:
-		return nil
-	}
-}
-
-func (s *slackTagParser) CloseBlock(parent ast.Node, pc parser.Context) {
-	// nothing to do
-}
-
-type slackTagHTMLRenderer struct {
-	portal *Portal
-}
-
-func (r *slackTagHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
-	reg.Register(astKindSlackTag, r.renderSlackTag)
-}
-
-func (r *slackTagHTMLRenderer) renderSlackTag(w goldmarkUtil.BufWriter, source []byte, n ast.Node, entering bool) (status ast.WalkStatus, err error) {
-	status = ast.WalkContinue
-	if !entering {
-		return
-	}
-	switch node := n.(type) {
-	case *astSlackUserMention:
-		puppet := r.portal.bridge.GetPuppetByID(r.portal.Key.TeamID, node.userID)
-		if puppet != nil && puppet.MXID != "" {
-			_, _ = fmt.Fprintf(w, `<a href="https://matrix.to/#/%s">%s</a>`, puppet.MXID, puppet.Name)
-		} else { // TODO: get puppet info if not exist
-			if node.label != "" {
-				_, _ = fmt.Fprintf(w, `@%s`, node.label)
-			} else {
-				_, _ = fmt.Fprintf(w, `@%s`, node.userID)
-			}
-		}
-		return
-	case *astSlackChannelMention:
-		portal := r.portal.bridge.DB.Portal.GetByID(database.PortalKey{
-			TeamID:    r.portal.Key.TeamID,
-			ChannelID: node.channelID,
-		})
-		if portal != nil && portal.MXID != "" {
-			_, _ = fmt.Fprintf(w, `<a href="https://matrix.to/#/%s?via=%s">%s</a>`, portal.MXID, r.portal.bridge.AS.HomeserverDomain, portal.Name)
-		} else { // TODO: get portal info if not exist
-			if node.label != "" {
-				_, _ = fmt.Fprintf(w, `#%s`, node.label)
-			} else {
-				_, _ = fmt.Fprintf(w, `#%s`, node.channelID)
-			}
-		}
-		return
-	case *astSlackURL:
-		label := node.label
-		if label == "" {
-			label = node.url
-		}
-		_, _ = fmt.Fprintf(w, `<a href="%s">%s</a>`, node.url, label)
-		return
-	}
-	stringifiable, ok := n.(mautrix.Stringifiable)
-	if ok {
-		_, _ = w.WriteString(stringifiable.String())
-	} else {
-		_, _ = w.Write(source)
-	}
-	return
-}
-
-type SlackTag struct {
-	Portal *Portal
-}
-
-func (e *SlackTag) Extend(m goldmark.Markdown) {
-	m.Parser().AddOptions(parser.WithInlineParsers(
-		goldmarkUtil.Prioritized(defaultSlackTagParser, 150),
-	))
-	m.Renderer().AddOptions(renderer.WithNodeRenderers(
-		goldmarkUtil.Prioritized(&slackTagHTMLRenderer{e.Portal}, 150),
-	))
-}
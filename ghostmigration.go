@@ -0,0 +1,168 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// checkGhostFormat remembers the ghost user ID format on the first start and
+// warns on later starts if the username template or homeserver domain has
+// changed, as existing ghosts won't be moved automatically.
+func (br *SlackBridge) checkGhostFormat() {
+	oldTemplate, oldDomain := br.getStoredGhostFormat()
+	if oldTemplate == "" && oldDomain == "" {
+		br.storeGhostFormat()
+	} else if br.ghostFormatChanged(oldTemplate, oldDomain) {
+		br.Log.Warnfln("Ghost user ID format changed from %q on %s to %q on %s. "+
+			"Existing ghosts will stay in rooms with their old IDs until you run the migrate-ghosts command.",
+			oldTemplate, oldDomain, br.bridgeConfig().UsernameTemplate, br.Config.Homeserver.Domain)
+	}
+}
+
+func (br *SlackBridge) getStoredGhostFormat() (string, string) {
+	return br.DB.KV.Get(database.KVGhostUsernameTemplate), br.DB.KV.Get(database.KVGhostDomain)
+}
+
+func (br *SlackBridge) storeGhostFormat() {
+	br.DB.KV.Set(database.KVGhostUsernameTemplate, br.bridgeConfig().UsernameTemplate)
+	br.DB.KV.Set(database.KVGhostDomain, br.Config.Homeserver.Domain)
+}
+
+func (br *SlackBridge) ghostFormatChanged(oldTemplate, oldDomain string) bool {
+	return oldTemplate != br.bridgeConfig().UsernameTemplate || oldDomain != br.Config.Homeserver.Domain
+}
+
+// migrateGhosts moves every known ghost from its user ID in the old format to
+// the current one. The new ghost gets the old ghost's profile, is joined to
+// all portals the old ghost was in with the same power level, and the old
+// ghost leaves those portals if the bridge still controls it. The new format
+// is only remembered once every ghost has been migrated, so that the command
+// can be run again if some of them failed.
+func (br *SlackBridge) migrateGhosts(oldTemplate, oldDomain string) (ghosts, rooms int, err error) {
+	tpl, err := template.New("old_username").Parse(oldTemplate)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse old username template: %w", err)
+	}
+	// The old ghosts can only be controlled if they're on our homeserver, and
+	// the registration still has to cover their namespace for this to work.
+	oldIsOurs := oldDomain == br.Config.Homeserver.Domain
+	portals := br.GetAllPortals()
+	failed := 0
+	for _, puppet := range br.GetAllPuppets() {
+		var localpart strings.Builder
+		err = tpl.Execute(&localpart, strings.ToLower(puppet.Key()))
+		if err != nil {
+			return ghosts, rooms, fmt.Errorf("failed to format old user ID of %s: %w", puppet.Key(), err)
+		}
+		oldMXID := id.NewUserID(localpart.String(), oldDomain)
+		if oldMXID == puppet.MXID {
+			continue
+		}
+		var oldIntent *appservice.IntentAPI
+		if oldIsOurs {
+			oldIntent = br.AS.Intent(oldMXID)
+		}
+		ghosts++
+		migratedRooms, ok := br.migrateGhost(puppet, oldMXID, oldIntent, portals)
+		rooms += migratedRooms
+		if !ok {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return ghosts, rooms, fmt.Errorf("%d of %d ghosts weren't fully migrated, check the logs and run the command again", failed, ghosts)
+	}
+	br.storeGhostFormat()
+	return ghosts, rooms, nil
+}
+
+func (br *SlackBridge) migrateGhost(puppet *Puppet, oldMXID id.UserID, oldIntent *appservice.IntentAPI, portals []*Portal) (rooms int, ok bool) {
+	log := br.Log.Sub("GhostMigration").Sub(puppet.Key())
+	newIntent := puppet.DefaultIntent()
+	err := newIntent.EnsureRegistered()
+	if err != nil {
+		log.Warnfln("Failed to register %s: %v", puppet.MXID, err)
+		return 0, false
+	}
+	if puppet.Name != "" {
+		if err = newIntent.SetDisplayName(puppet.Name); err != nil {
+			log.Warnfln("Failed to copy displayname to %s: %v", puppet.MXID, err)
+		}
+	}
+	if !puppet.AvatarURL.IsEmpty() {
+		if err = newIntent.SetAvatarURL(puppet.AvatarURL); err != nil {
+			log.Warnfln("Failed to copy avatar to %s: %v", puppet.MXID, err)
+		}
+	}
+
+	ok = true
+	for _, portal := range portals {
+		if portal.MXID == "" || !br.StateStore.IsInRoom(portal.MXID, oldMXID) {
+			continue
+		}
+		joinVia := oldIntent
+		if joinVia == nil {
+			joinVia = br.Bot
+		}
+		err = newIntent.EnsureJoined(portal.MXID, appservice.EnsureJoinedParams{BotOverride: joinVia.Client})
+		if err != nil {
+			log.Warnfln("Failed to join %s to %s: %v", puppet.MXID, portal.MXID, err)
+			ok = false
+			continue
+		}
+		br.copyGhostPowerLevel(log, portal.MXID, oldMXID, puppet.MXID, joinVia)
+		if oldIntent != nil {
+			_, err = oldIntent.LeaveRoom(portal.MXID)
+			if err != nil {
+				log.Warnfln("Failed to remove %s from %s: %v", oldMXID, portal.MXID, err)
+				ok = false
+			}
+		}
+		rooms++
+	}
+	log.Infofln("Migrated %s to %s in %d rooms", oldMXID, puppet.MXID, rooms)
+	return
+}
+
+func (br *SlackBridge) copyGhostPowerLevel(log log.Logger, roomID id.RoomID, oldMXID, newMXID id.UserID, intent *appservice.IntentAPI) {
+	levels, err := intent.PowerLevels(roomID)
+	if err != nil {
+		log.Warnfln("Failed to get power levels of %s: %v", roomID, err)
+		return
+	}
+	level := levels.GetUserLevel(oldMXID)
+	if level == levels.UsersDefault || levels.GetUserLevel(newMXID) == level {
+		return
+	}
+	levels.SetUserLevel(newMXID, level)
+	_, err = intent.SetPowerLevels(roomID, levels)
+	if err != nil && intent != br.Bot {
+		_, err = br.Bot.SetPowerLevels(roomID, levels)
+	}
+	if err != nil {
+		log.Warnfln("Failed to copy power level of %s to %s in %s: %v", oldMXID, newMXID, roomID, err)
+	}
+}
@@ -3,29 +3,33 @@ module go.mau.fi/mautrix-slack
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.0
+	github.com/getsentry/sentry-go v0.16.0
+	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/lib/pq v1.10.7
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/slack-go/slack v0.10.3
-	github.com/yuin/goldmark v1.5.2
+	golang.org/x/image v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
+	maunium.net/go/mauflag v1.0.0
 	maunium.net/go/maulogger/v2 v2.3.2
 	maunium.net/go/mautrix v0.12.3-0.20221104105050-0b958ab2a7b6
 )
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/mattn/go-colorable v0.1.12 // indirect
-	github.com/mattn/go-isatty v0.0.14 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/rs/zerolog v1.28.0 // indirect
 	github.com/tidwall/gjson v1.14.3 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
+	github.com/yuin/goldmark v1.5.2 // indirect
 	golang.org/x/crypto v0.1.0 // indirect
 	golang.org/x/net v0.1.0 // indirect
 	golang.org/x/sys v0.1.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	maunium.net/go/mauflag v1.0.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
 
 replace github.com/slack-go/slack => github.com/beeper/slackgo v0.0.0-20221107180248-9f4b7f55f00d
@@ -0,0 +1,66 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// updateGuest records whether the Slack user is a single- or multi-channel
+// guest. The caller must save the puppet if this returns true.
+func (puppet *Puppet) updateGuest(guest bool) bool {
+	if puppet.Guest == guest {
+		return false
+	}
+	puppet.Guest = guest
+	return true
+}
+
+func (puppet *Puppet) placeholderName() string {
+	return fmt.Sprintf("Unknown Slack user (%s)", puppet.UserID)
+}
+
+func (puppet *Puppet) hasPlaceholderProfile() bool {
+	return puppet.Name == puppet.placeholderName()
+}
+
+// setPlaceholderProfile gives a name to the ghost of a user whose profile
+// can't be fetched with any token, e.g. users of other workspaces in shared
+// channels. Names that were fetched earlier are kept.
+func (puppet *Puppet) setPlaceholderProfile() {
+	if puppet.Name != "" {
+		return
+	}
+	err := puppet.DefaultIntent().EnsureRegistered()
+	if err != nil {
+		puppet.log.Errorln("Failed to ensure registered:", err)
+	}
+	if puppet.UpdateName(puppet.placeholderName()) {
+		puppet.Update(nil)
+	}
+}
+
+// shouldJoinPortal checks whether the ghost should be added to the portal
+// when syncing members. Ghosts still join any room they send messages to.
+func (puppet *Puppet) shouldJoinPortal(portal *Portal) bool {
+	if puppet.Guest && portal.Type == database.ChannelTypeChannel {
+		return puppet.bridge.bridgeConfig().GuestChannelMembership
+	}
+	return true
+}
@@ -37,7 +37,7 @@ import (
 // region history sync handling
 
 func (bridge *SlackBridge) handleHistorySyncsLoop() {
-	if !bridge.Config.Bridge.Backfill.Enable {
+	if !bridge.bridgeConfig().BackfillEnabledForAnyTeam() {
 		return
 	}
 
@@ -55,12 +55,20 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 	backfillState.SetDispatched(true)
 	defer backfillState.SetDispatched(false)
 
-	maxMessages := bridge.Config.Bridge.Backfill.Incremental.MaxMessages.GetMaxMessagesFor(portal.Type)
+	backfillConfig := bridge.getTeamConfig(portal.Key.TeamID).Backfill
+	if !backfillConfig.Enable {
+		backfillState.BackfillComplete = true
+		backfillState.Upsert()
+		bridge.Log.Debugfln("Backfill is disabled for the team of %s, not filling", portal.Key)
+		return
+	}
+	maxMessages := backfillConfig.Incremental.MaxMessages.GetMaxMessagesFor(portal.Type)
 
 	if maxMessages > 0 && backfillState.MessageCount >= maxMessages {
 		backfillState.BackfillComplete = true
 		backfillState.Upsert()
 		bridge.Log.Infofln("Backfilling complete for portal %s, not filling any more", portal.Key)
+		portal.sendBackfillCompleteNotice(backfillState)
 		return
 	}
 
@@ -103,11 +111,16 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 		bridge.Log.Errorfln("Couldn't find logged in user with access to %s for backfilling!", portal.Key)
 		return
 	}
-	if userTeam.CookieToken != "" {
-		userTeam.Client = slack.New(userTeam.Token, slack.OptionCookie("d", userTeam.CookieToken))
+	var slackOptions []slack.Option
+	if user := bridge.GetUserByMXID(userTeam.Key.MXID); user != nil {
+		slackOptions = user.getSlackClientOptions(userTeam.Key.TeamID, apiPriorityBackground)
 	} else {
-		userTeam.Client = slack.New(userTeam.Token)
+		slackOptions = bridge.getSlackClientOptions(userTeam.Key.TeamID)
+	}
+	if userTeam.CookieToken != "" {
+		slackOptions = append(slackOptions, slack.OptionCookie("d", userTeam.CookieToken))
 	}
+	userTeam.Client = slack.New(userTeam.Token, slackOptions...)
 
 	// Fetch actual messages from Slack.
 	resp, err := userTeam.Client.GetConversationHistory(&slackReqParams)
@@ -131,7 +144,7 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 	if !backfillState.ImmediateComplete {
 		maxBatchEvents = -1
 	} else {
-		maxBatchEvents = bridge.Config.Bridge.Backfill.Incremental.MessagesPerBatch
+		maxBatchEvents = backfillConfig.Incremental.MessagesPerBatch
 	}
 
 	bridge.Log.Infofln("Backfilling %d messages in %s, %d messages at a time", len(allMsgs), portal.Key, maxBatchEvents)
@@ -148,7 +161,7 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 		}
 
 		if len(msgs) > 0 {
-			time.Sleep(time.Duration(bridge.Config.Bridge.Backfill.Incremental.PostBatchDelay) * time.Second)
+			time.Sleep(time.Duration(backfillConfig.Incremental.PostBatchDelay) * time.Second)
 			bridge.Log.Debugfln("Backfilling %d messages in %s", len(msgs), portal.Key)
 			resp := portal.backfill(userTeam, msgs, !backfillState.ImmediateComplete, isLatestEvents, forwardPrevID)
 			if resp != nil && (resp.BaseInsertionEventID != "" || !isLatestEvents) {
@@ -178,12 +191,13 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 		// Slack said there's no more history to backfill.
 		backfillState.BackfillComplete = true
 		portal.updateBackfillStatus(backfillState)
+		portal.sendBackfillCompleteNotice(backfillState)
 	}
 
 	backfillState.Upsert()
 
 	// TODO: add these config options
-	// if bridge.Config.Bridge.HistorySync.UnreadHoursThreshold > 0 && conv.LastMessageTimestamp.Before(time.Now().Add(time.Duration(-bridge.Config.Bridge.HistorySync.UnreadHoursThreshold)*time.Hour)) {
+	// if bridge.bridgeConfig().HistorySync.UnreadHoursThreshold > 0 && conv.LastMessageTimestamp.Before(time.Now().Add(time.Duration(-bridge.bridgeConfig().HistorySync.UnreadHoursThreshold)*time.Hour)) {
 	// 	user.markSelfReadFull(portal)
 	// }
 }
@@ -240,12 +254,12 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 // 	// If this was the initial bootstrap, enqueue immediate backfills for the
 // 	// most recent portals. If it's the last history sync event, start
 // 	// backfilling the rest of the history of the portals.
-// 	if bridge.Config.Bridge.HistorySync.Backfill {
+// 	if bridge.bridgeConfig().HistorySync.Backfill {
 // 		if evt.GetSyncType() != waProto.HistorySync_INITIAL_BOOTSTRAP && evt.GetProgress() < 98 {
 // 			return
 // 		}
 
-// 		nMostRecent := bridge.DB.HistorySync.GetNMostRecentConversations(user.MXID, bridge.Config.Bridge.HistorySync.MaxInitialConversations)
+// 		nMostRecent := bridge.DB.HistorySync.GetNMostRecentConversations(user.MXID, bridge.bridgeConfig().HistorySync.MaxInitialConversations)
 // 		if len(nMostRecent) > 0 {
 // 			// Find the portals for all of the conversations.
 // 			portals := []*Portal{}
@@ -276,7 +290,7 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 
 // func (bridge *SlackBridge) EnqueueImmedateBackfills(portals []*Portal) {
 // 	for _, portal := range portals {
-// 		maxMessages := bridge.Config.Bridge.Backfill.ImmediateMessages
+// 		maxMessages := bridge.bridgeConfig().Backfill.ImmediateMessages
 // 		initialBackfill := bridge.DB.Backfill.NewWithValues(database.BackfillImmediate, &portal.Key, maxMessages, maxMessages, 0)
 // 		initialBackfill.Insert()
 // 	}
@@ -286,9 +300,9 @@ func (bridge *SlackBridge) backfillInChunks(backfillState *database.BackfillStat
 // 	for _, portal := range portals {
 // 		backfillMessages := bridge.DB.Backfill.NewWithValues(
 // 			database.BackfillDeferred, &portal.Key,
-// 			bridge.Config.Bridge.Backfill.Incremental.MessagesPerBatch,
-// 			bridge.Config.Bridge.Backfill.Incremental.MaxMessages.GetMaxMessagesFor(portal.Type),
-// 			bridge.Config.Bridge.Backfill.Incremental.PostBatchDelay,
+// 			bridge.bridgeConfig().Backfill.Incremental.MessagesPerBatch,
+// 			bridge.bridgeConfig().Backfill.Incremental.MaxMessages.GetMaxMessagesFor(portal.Type),
+// 			bridge.bridgeConfig().Backfill.Incremental.PostBatchDelay,
 // 		)
 // 		backfillMessages.Insert()
 // 	}
@@ -342,16 +356,22 @@ func (portal *Portal) getLastEventID(msg *ConvertedSlackMessage) *id.EventID {
 	return &eventID
 }
 
-func (portal *Portal) makeBackfillEvent(intent *appservice.IntentAPI, msg *event.MessageEventContent, partName string, info *ConvertedSlackMessage, threadInfos *map[string]SlackThreadInfo) *event.Event {
+func (portal *Portal) makeBackfillEvent(intent *appservice.IntentAPI, msg *event.MessageEventContent, extra map[string]interface{}, partName string, info *ConvertedSlackMessage, threadInfos *map[string]SlackThreadInfo) *event.Event {
 	content := event.Content{
 		Parsed: msg,
+		Raw:    extra,
 	}
 	if portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry {
 		if info.SlackThreadTs != "" && info.SlackThreadTs != info.SlackTimestamp {
 			threadInfo, found := (*threadInfos)[info.SlackThreadTs]
-			if found {
+			threadMode := portal.getThreadMode()
+			if found && threadMode != database.ThreadModeFlatten {
 				content.Parsed.(*event.MessageEventContent).RelatesTo = &event.RelatesTo{}
-				content.Parsed.(*event.MessageEventContent).RelatesTo.SetThread(threadInfo.ThreadOrigin, threadInfo.ThreadLatest)
+				if threadMode == database.ThreadModeReply {
+					content.Parsed.(*event.MessageEventContent).RelatesTo.SetReplyTo(threadInfo.ThreadLatest)
+				} else {
+					content.Parsed.(*event.MessageEventContent).RelatesTo.SetThread(threadInfo.ThreadOrigin, threadInfo.ThreadLatest)
+				}
 				threadInfo.ThreadLatest = portal.deterministicEventID(info.SlackAuthor, info.SlackTimestamp, partName)
 				(*threadInfos)[info.SlackThreadTs] = threadInfo
 			}
@@ -444,11 +464,11 @@ func (portal *Portal) backfill(userTeam *database.UserTeam, messages []slack.Mes
 		}
 		intent := puppet.IntentFor(portal)
 		for i, file := range converted.FileAttachments {
-			e := portal.makeBackfillEvent(intent, file.Event, fmt.Sprintf("file%d", i), &converted, &threadInfos)
+			e := portal.makeBackfillEvent(intent, file.Event, file.Extra, fmt.Sprintf("file%d", i), &converted, &threadInfos)
 			req.Events = append(req.Events, e)
 		}
 		if converted.Event != nil {
-			e := portal.makeBackfillEvent(intent, converted.Event, "text", &converted, &threadInfos)
+			e := portal.makeBackfillEvent(intent, converted.Event, nil, "text", &converted, &threadInfos)
 			req.Events = append(req.Events, e)
 		}
 		// Sending reactions in the same batch requires deterministic event IDs, so only do it on hungryserv
@@ -572,7 +592,7 @@ func (portal *Portal) backfill(userTeam *database.UserTeam, messages []slack.Mes
 // func (portal *Portal) requestMediaRetries(source *User, eventIDs []id.EventID, infos []*wrappedInfo) {
 // 	for i, info := range infos {
 // 		if info != nil && info.Error == database.MsgErrMediaNotFound && info.MediaKey != nil {
-// 			switch portal.bridge.Config.Bridge.HistorySync.MediaRequests.RequestMethod {
+// 			switch portal.bridge.bridgeConfig().HistorySync.MediaRequests.RequestMethod {
 // 			case config.MediaRequestMethodImmediate:
 // 				err := source.Client.SendMediaRetryReceipt(info.MessageInfo, info.MediaKey)
 // 				if err != nil {
@@ -589,7 +609,7 @@ func (portal *Portal) backfill(userTeam *database.UserTeam, messages []slack.Mes
 // }
 
 // func (portal *Portal) appendBatchEvents(converted *ConvertedMessage, info *types.MessageInfo, raw *waProto.WebMessageInfo, eventsArray *[]*event.Event, infoArray *[]*wrappedInfo) error {
-// 	if portal.bridge.Config.Bridge.CaptionInMessage {
+// 	if portal.bridge.bridgeConfig().CaptionInMessage {
 // 		converted.MergeCaption()
 // 	}
 // 	mainEvt, err := portal.wrapBatchEvent(info, converted.Intent, converted.Type, converted.Content, converted.Extra, "")
@@ -691,7 +711,9 @@ func (portal *Portal) finishBatch(txn dbutil.Transaction, eventIDs []id.EventID,
 				portal.log.Errorln("Server returned fewer event IDs than events in our batch!")
 				return
 			}
-			portal.markMessageHandled(txn, converted.SlackTimestamp, "", eventIDs[idx], converted.SlackAuthor)
+			// The files of the message are sent before the text
+			partIndex := len(converted.FileAttachments)
+			portal.markMessageHandled(txn, converted.SlackTimestamp, converted.SlackThreadTs, converted.SlackSubtype, partIndex, eventIDs[idx], converted.SlackAuthor)
 			idx += 1
 		}
 		if portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry {
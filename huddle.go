@@ -0,0 +1,139 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// slackHuddleRoom is the room object of huddle_thread messages, which
+// slackgo doesn't parse.
+type slackHuddleRoom struct {
+	ID                 string   `json:"id"`
+	Name               string   `json:"name"`
+	CreatedBy          string   `json:"created_by"`
+	DateStart          int64    `json:"date_start"`
+	DateEnd            int64    `json:"date_end"`
+	Participants       []string `json:"participants"`
+	ParticipantHistory []string `json:"participant_history"`
+	HasEnded           bool     `json:"has_ended"`
+	HuddleLink         string   `json:"huddle_link"`
+}
+
+type huddleHistoryResponse struct {
+	slack.SlackResponse
+	Messages []struct {
+		Timestamp string           `json:"ts"`
+		Room      *slackHuddleRoom `json:"room"`
+	} `json:"messages"`
+}
+
+// getSlackHuddleRoom fetches the huddle info of a huddle_thread message.
+func (portal *Portal) getSlackHuddleRoom(userTeam *database.UserTeam, ts string) (*slackHuddleRoom, error) {
+	var resp huddleHistoryResponse
+	err := portal.bridge.callSlackMethod(context.Background(), userTeam, "conversations.history", url.Values{
+		"channel":   {portal.Key.ChannelID},
+		"latest":    {ts},
+		"oldest":    {ts},
+		"inclusive": {"true"},
+		"limit":     {"1"},
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range resp.Messages {
+		if msg.Timestamp == ts && msg.Room != nil {
+			return msg.Room, nil
+		}
+	}
+	return nil, fmt.Errorf("message didn't contain huddle info")
+}
+
+func formatHuddleDuration(duration time.Duration) string {
+	minutes := int(duration.Round(time.Minute).Minutes())
+	switch {
+	case minutes < 1:
+		return "less than a minute"
+	case minutes == 1:
+		return "1 minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%d h", minutes/60)
+	default:
+		return fmt.Sprintf("%d h %d min", minutes/60, minutes%60)
+	}
+}
+
+// formatSlackHuddle renders huddle info as mrkdwn, so that participants are
+// rendered as mentions like in normal messages.
+func formatSlackHuddle(room *slackHuddleRoom) string {
+	var text strings.Builder
+	text.WriteString("\U0001F4DE *Huddle*")
+	if room.CreatedBy != "" {
+		_, _ = fmt.Fprintf(&text, " started by <@%s>", room.CreatedBy)
+	}
+	participants := room.Participants
+	if room.HasEnded {
+		participants = room.ParticipantHistory
+		if room.DateStart > 0 && room.DateEnd >= room.DateStart {
+			_, _ = fmt.Fprintf(&text, " ended after %s", formatHuddleDuration(time.Duration(room.DateEnd-room.DateStart)*time.Second))
+		} else {
+			text.WriteString(" has ended")
+		}
+	} else {
+		text.WriteString(" is ongoing")
+	}
+	if len(participants) > 0 {
+		mentions := make([]string, len(participants))
+		for i, participant := range participants {
+			mentions[i] = fmt.Sprintf("<@%s>", participant)
+		}
+		_, _ = fmt.Fprintf(&text, "\nParticipants (%d): %s", len(participants), strings.Join(mentions, ", "))
+	}
+	if room.HuddleLink != "" && !room.HasEnded {
+		_, _ = fmt.Fprintf(&text, "\n<%s|Join the huddle in Slack>", room.HuddleLink)
+	}
+	return text.String()
+}
+
+// convertSlackHuddle fills the text of a huddle_thread message, which Slack
+// sends without any text, with a summary of the huddle. Files in the message,
+// like huddle notes and recordings, are kept.
+func (portal *Portal) convertSlackHuddle(userTeam *database.UserTeam, msg *slack.Msg) *slack.Msg {
+	converted := *msg
+	converted.Blocks = slack.Blocks{}
+	room, err := portal.getSlackHuddleRoom(userTeam, msg.Timestamp)
+	if err != nil {
+		portal.log.Warnfln("Failed to get huddle info of %s: %v", msg.Timestamp, err)
+		converted.Text = "\U0001F4DE *Huddle*"
+		if msg.User != "" {
+			converted.Text += fmt.Sprintf(" started by <@%s>", msg.User)
+		}
+	} else {
+		converted.Text = formatSlackHuddle(room)
+	}
+	return &converted
+}
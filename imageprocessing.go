@@ -0,0 +1,352 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	jpegReencodeQuality = 90
+
+	thumbnailSize    = 800
+	thumbnailQuality = 80
+	blurhashSize     = 32
+	blurhashXComp    = 4
+	blurhashYComp    = 3
+)
+
+var (
+	errNotJPEG = errors.New("not a JPEG image")
+	errNotPNG  = errors.New("not a PNG image")
+)
+
+// processImage strips metadata from and downscales JPEG and PNG images
+// according to the media config. Other formats and images that don't need
+// changes are returned as-is. The returned dimensions are zero if they're
+// unknown.
+func (br *SlackBridge) processImage(data []byte, mimeType string) (processed []byte, width, height int, err error) {
+	cfg := br.bridgeConfig().Media
+	if !cfg.StripEXIF && cfg.MaxImageDimension <= 0 {
+		return data, 0, 0, nil
+	}
+	var orientation int
+	switch mimeType {
+	case "image/jpeg":
+		if cfg.StripEXIF {
+			data, orientation, err = stripJPEGMetadata(data)
+		}
+	case "image/png":
+		if cfg.StripEXIF {
+			data, err = stripPNGMetadata(data)
+		}
+	default:
+		return data, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	width, height = imgCfg.Width, imgCfg.Height
+	if orientation > 4 {
+		// Orientations 5-8 are rotated by 90 degrees
+		width, height = height, width
+	}
+	tooLarge := cfg.MaxImageDimension > 0 && (width > cfg.MaxImageDimension || height > cfg.MaxImageDimension)
+	// The orientation was stored in the EXIF data that was just removed, so it has to be applied to the pixels
+	if !tooLarge && orientation <= 1 {
+		return data, width, height, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	img = applyOrientation(img, orientation)
+	if tooLarge {
+		img = downscaleImage(img, cfg.MaxImageDimension)
+	}
+	var buf bytes.Buffer
+	if mimeType == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegReencodeQuality})
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	bounds := img.Bounds()
+	return buf.Bytes(), bounds.Dx(), bounds.Dy(), nil
+}
+
+func downscaleImage(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		height = height * maxDimension / width
+		width = maxDimension
+	} else {
+		width = width * maxDimension / height
+		height = maxDimension
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// applyOrientation rotates and flips the image according to an EXIF
+// orientation value, so that it displays correctly without the EXIF data.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation > 4 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flipped horizontally
+				dx, dy = width-1-x, y
+			case 3: // rotated 180°
+				dx, dy = width-1-x, height-1-y
+			case 4: // flipped vertically
+				dx, dy = x, height-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = height-1-y, x
+			case 7: // transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, width-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXMPHeader  = []byte("http://ns.adobe.com/xap/1.0/")
+)
+
+// stripJPEGMetadata removes the EXIF and XMP (APP1), Photoshop/IPTC (APP13)
+// and comment segments from a JPEG without re-encoding it. It returns the
+// EXIF orientation that was stored in the removed data, or 0 if there was none.
+func stripJPEGMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errNotJPEG
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	orientation := 0
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, 0, errNotJPEG
+		}
+		marker := data[pos+1]
+		// Everything after the start of scan marker is image data
+		if marker == 0xDA {
+			break
+		}
+		segmentLength := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + segmentLength
+		if segmentLength < 2 || end > len(data) {
+			return nil, 0, errNotJPEG
+		}
+		payload := data[pos+4 : end]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegExifHeader):
+			orientation = parseEXIFOrientation(payload[len(jpegExifHeader):])
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegXMPHeader),
+			marker == 0xED, marker == 0xFE:
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	out = append(out, data[pos:]...)
+	return out, orientation, nil
+}
+
+// parseEXIFOrientation finds the orientation tag in the first IFD of EXIF data.
+func parseEXIFOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if ifdOffset+2 > len(tiff) {
+		return 0
+	}
+	entryCount := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entryCount; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the ancillary PNG chunks that can contain metadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"iTXt": true,
+	"zTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata removes EXIF, text and timestamp chunks from a PNG without
+// re-encoding it.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errNotPNG
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		chunkLength := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + chunkLength
+		if chunkLength < 0 || end > len(data) {
+			return nil, errNotPNG
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		if crc32.ChecksumIEEE(data[pos+4:end-4]) != binary.BigEndian.Uint32(data[end-4:]) {
+			return nil, errNotPNG
+		}
+		if !pngMetadataChunks[chunkType] {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out, nil
+}
+
+// addImagePreviews uploads a thumbnail for a large image and computes its
+// blurhash. The blurhash is returned as extra content to merge into the
+// event, since event.FileInfo doesn't have a field for it.
+func (portal *Portal) addImagePreviews(intent *appservice.IntentAPI, data []byte, content *event.MessageEventContent, isAnimated bool) map[string]interface{} {
+	cfg := portal.bridge.bridgeConfig().Media
+	if !cfg.Blurhash && !cfg.Thumbnails {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		portal.log.Debugfln("Failed to decode %s for previews: %v", content.Body, err)
+		return nil
+	}
+	bounds := img.Bounds()
+
+	// Clients display the thumbnail instead of the full image, so animations would become static
+	if cfg.Thumbnails && !isAnimated && (bounds.Dx() > thumbnailSize || bounds.Dy() > thumbnailSize) {
+		err = portal.uploadThumbnail(intent, downscaleImage(img, thumbnailSize), content)
+		if err != nil {
+			portal.log.Warnfln("Failed to upload thumbnail for %s: %v", content.Body, err)
+		}
+	}
+
+	if !cfg.Blurhash {
+		return nil
+	}
+	small := img
+	if bounds.Dx() > blurhashSize || bounds.Dy() > blurhashSize {
+		small = downscaleImage(img, blurhashSize)
+	}
+	return map[string]interface{}{
+		"info": map[string]interface{}{
+			"xyz.amorgan.blurhash": encodeBlurhash(small, blurhashXComp, blurhashYComp),
+		},
+	}
+}
+
+func (portal *Portal) uploadThumbnail(intent *appservice.IntentAPI, thumbnail image.Image, content *event.MessageEventContent) error {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	size := len(data)
+	uploadMimeType, file := portal.encryptFileInPlace(data, "image/jpeg")
+	uploaded, err := intent.UploadMedia(mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  uploadMimeType,
+	})
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		file.URL = uploaded.ContentURI.CUString()
+		content.Info.ThumbnailFile = file
+	} else {
+		content.Info.ThumbnailURL = uploaded.ContentURI.CUString()
+	}
+	bounds := thumbnail.Bounds()
+	content.Info.ThumbnailInfo = &event.FileInfo{
+		MimeType: "image/jpeg",
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		Size:     size,
+	}
+	return nil
+}
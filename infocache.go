@@ -0,0 +1,329 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const (
+	infoCacheTypeUser    = "user"
+	infoCacheTypeChannel = "channel"
+)
+
+const (
+	// userListThreshold is the number of uncached users above which
+	// GetUsersInfo pages through users.list instead of calling users.info
+	// for each of them.
+	userListThreshold = 20
+	userListPageSize  = 1000
+)
+
+type infoCacheKey struct {
+	TeamID   string
+	ObjectID string
+}
+
+type infoCacheEntry struct {
+	value     interface{}
+	fetchedAt time.Time
+}
+
+// SlackInfoCache keeps the results of users.info and conversations.info calls
+// in memory and in the database, so that they don't have to be fetched for
+// every message. Entries expire after the TTL set in the config, and are
+// replaced or dropped when Slack sends an event saying the object changed.
+// At most max_entries objects are kept in memory; the oldest ones are dropped
+// first when the limit is reached.
+type SlackInfoCache struct {
+	bridge *SlackBridge
+	log    log.Logger
+
+	entries map[infoCacheKey]infoCacheEntry
+	lock    sync.Mutex
+}
+
+func NewSlackInfoCache(br *SlackBridge) *SlackInfoCache {
+	return &SlackInfoCache{
+		bridge:  br,
+		log:     br.Log.Sub("InfoCache"),
+		entries: make(map[infoCacheKey]infoCacheEntry),
+	}
+}
+
+func (cache *SlackInfoCache) lookup(key infoCacheKey, ttl time.Duration, target interface{}) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := cache.entries[key]
+	if ok && time.Since(entry.fetchedAt) < ttl {
+		return entry.value
+	}
+	data, fetchedAt := cache.bridge.DB.InfoCache.Get(key.TeamID, key.ObjectID)
+	if data == nil || time.Since(fetchedAt) >= ttl {
+		return nil
+	}
+	err := json.Unmarshal(data, target)
+	if err != nil {
+		cache.log.Warnfln("Failed to parse cached info of %s/%s: %v", key.TeamID, key.ObjectID, err)
+		return nil
+	}
+	cache.makeRoom(1)
+	cache.entries[key] = infoCacheEntry{value: target, fetchedAt: fetchedAt}
+	return target
+}
+
+// makeRoom drops entries from memory so that n more fit under the size limit.
+// Expired entries go first, then the ones that were fetched longest ago. The
+// caller must hold the lock.
+func (cache *SlackInfoCache) makeRoom(n int) {
+	limit := cache.bridge.bridgeConfig().InfoCache.MaxEntries
+	if limit <= 0 || len(cache.entries)+n <= limit {
+		return
+	}
+	cache.dropExpired()
+	excess := len(cache.entries) + n - limit
+	if excess <= 0 {
+		return
+	}
+	keys := make([]infoCacheKey, 0, len(cache.entries))
+	for key := range cache.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cache.entries[keys[i]].fetchedAt.Before(cache.entries[keys[j]].fetchedAt)
+	})
+	if excess > len(keys) {
+		excess = len(keys)
+	}
+	for _, key := range keys[:excess] {
+		delete(cache.entries, key)
+	}
+}
+
+// dropExpired removes entries older than the longest TTL from memory. The
+// caller must hold the lock.
+func (cache *SlackInfoCache) dropExpired() {
+	ttl := cache.bridge.bridgeConfig().InfoCache.UserTTL
+	if channelTTL := cache.bridge.bridgeConfig().InfoCache.ChannelTTL; channelTTL > ttl {
+		ttl = channelTTL
+	}
+	for key, entry := range cache.entries {
+		if time.Since(entry.fetchedAt) >= ttl {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+func (cache *SlackInfoCache) store(key infoCacheKey, objectType string, ttl time.Duration, value interface{}) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	cache.lock.Lock()
+	cache.makeRoom(1)
+	cache.entries[key] = infoCacheEntry{value: value, fetchedAt: now}
+	cache.lock.Unlock()
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		cache.log.Warnfln("Failed to marshal info of %s/%s for caching: %v", key.TeamID, key.ObjectID, err)
+		return
+	}
+	cache.bridge.DB.InfoCache.Put(key.TeamID, key.ObjectID, objectType, data, now)
+}
+
+// storeMany caches many objects of the same team, writing them to the
+// database in one transaction.
+func (cache *SlackInfoCache) storeMany(teamID, objectType string, ttl time.Duration, values map[string]interface{}) {
+	if ttl <= 0 || len(values) == 0 {
+		return
+	}
+	now := time.Now()
+	data := make(map[string][]byte, len(values))
+	cache.lock.Lock()
+	cache.makeRoom(len(values))
+	for objectID, value := range values {
+		cache.entries[infoCacheKey{teamID, objectID}] = infoCacheEntry{value: value, fetchedAt: now}
+	}
+	cache.lock.Unlock()
+	for objectID, value := range values {
+		marshaled, err := json.Marshal(value)
+		if err != nil {
+			cache.log.Warnfln("Failed to marshal info of %s/%s for caching: %v", teamID, objectID, err)
+			continue
+		}
+		data[objectID] = marshaled
+	}
+	cache.bridge.DB.InfoCache.PutMany(teamID, objectType, data, now)
+}
+
+// Invalidate drops a cached user or channel, so the next lookup fetches it from Slack.
+func (cache *SlackInfoCache) Invalidate(teamID, objectID string) {
+	cache.lock.Lock()
+	delete(cache.entries, infoCacheKey{teamID, objectID})
+	cache.lock.Unlock()
+	cache.bridge.DB.InfoCache.Delete(teamID, objectID)
+}
+
+func (cache *SlackInfoCache) GetUserInfo(userTeam *database.UserTeam, userID string) (*slack.User, error) {
+	key := infoCacheKey{userTeam.Key.TeamID, userID}
+	ttl := cache.bridge.bridgeConfig().InfoCache.UserTTL
+	if cached, ok := cache.lookup(key, ttl, &slack.User{}).(*slack.User); ok {
+		return cached, nil
+	}
+	info, err := userTeam.Client.GetUserInfo(userID)
+	if err != nil {
+		return nil, err
+	}
+	cache.store(key, infoCacheTypeUser, ttl, info)
+	return info, nil
+}
+
+// GetUsersInfo looks up many users at once. If many of them aren't cached,
+// they're fetched by paging through users.list, which also caches the other
+// users of the team. Users that aren't found are left out of the result, so
+// the caller can fall back to GetUserInfo for them.
+func (cache *SlackInfoCache) GetUsersInfo(userTeam *database.UserTeam, userIDs []string) map[string]*slack.User {
+	teamID := userTeam.Key.TeamID
+	ttl := cache.bridge.bridgeConfig().InfoCache.UserTTL
+	result := make(map[string]*slack.User, len(userIDs))
+	missing := make(map[string]struct{})
+	for _, userID := range userIDs {
+		if cached, ok := cache.lookup(infoCacheKey{teamID, userID}, ttl, &slack.User{}).(*slack.User); ok {
+			result[userID] = cached
+		} else {
+			missing[userID] = struct{}{}
+		}
+	}
+	if len(missing) < userListThreshold || userTeam.Client == nil {
+		return result
+	}
+
+	cache.log.Debugfln("Fetching %d users of %s through users.list", len(missing), teamID)
+	// Listing all users is only done when syncing members, so it's a background job
+	ctx := withBackgroundPriority(context.Background())
+	page := userTeam.Client.GetUsersPaginated(slack.GetUsersOptionLimit(userListPageSize), slack.GetUsersOptionTeamID(teamID))
+	var err error
+	for len(missing) > 0 {
+		page, err = page.Next(ctx)
+		if rateLimitErr, ok := err.(*slack.RateLimitedError); ok {
+			time.Sleep(rateLimitErr.RetryAfter)
+			continue
+		} else if err != nil {
+			break
+		}
+		users := make(map[string]interface{}, len(page.Users))
+		for i := range page.Users {
+			user := &page.Users[i]
+			users[user.ID] = user
+			if _, ok := missing[user.ID]; ok {
+				result[user.ID] = user
+				delete(missing, user.ID)
+			}
+		}
+		cache.storeMany(teamID, infoCacheTypeUser, ttl, users)
+	}
+	if err = page.Failure(err); err != nil {
+		cache.log.Warnfln("Failed to list users of %s: %v", teamID, err)
+	}
+	return result
+}
+
+// UpdateUser replaces the cached info of a user with the data from a user_change event.
+func (cache *SlackInfoCache) UpdateUser(teamID string, info *slack.User) {
+	cache.store(infoCacheKey{teamID, info.ID}, infoCacheTypeUser, cache.bridge.bridgeConfig().InfoCache.UserTTL, info)
+}
+
+// GetConversationInfo returns the info of a channel. The cache is shared by
+// all users of a team, so DMs and group DMs, whose info depends on the user
+// asking, are always fetched from Slack, and the per-user fields (is_open,
+// is_member, last_read and so on) are left empty in cached channels.
+func (cache *SlackInfoCache) GetConversationInfo(userTeam *database.UserTeam, channelID string) (*slack.Channel, error) {
+	key := infoCacheKey{userTeam.Key.TeamID, channelID}
+	ttl := cache.bridge.bridgeConfig().InfoCache.ChannelTTL
+	if cached, ok := cache.lookup(key, ttl, &slack.Channel{}).(*slack.Channel); ok {
+		return cached, nil
+	}
+	info, err := userTeam.Client.GetConversationInfo(channelID, true)
+	if err != nil {
+		return nil, err
+	} else if info.IsIM || info.IsMpIM {
+		return info, nil
+	}
+	shared := *info
+	shared.IsOpen = false
+	shared.IsMember = false
+	shared.LastRead = ""
+	shared.Latest = nil
+	shared.UnreadCount = 0
+	shared.UnreadCountDisplay = 0
+	shared.Priority = 0
+	cache.store(key, infoCacheTypeChannel, ttl, &shared)
+	return &shared, nil
+}
+
+// pruneLoop periodically removes expired entries from memory and the database.
+func (cache *SlackInfoCache) pruneLoop() {
+	for {
+		time.Sleep(time.Hour)
+		cache.Prune()
+	}
+}
+
+// Prune removes expired entries from memory and the database.
+func (cache *SlackInfoCache) Prune() {
+	cache.lock.Lock()
+	cache.dropExpired()
+	cache.lock.Unlock()
+	now := time.Now()
+	cache.bridge.DB.InfoCache.DeleteOlderThan(infoCacheTypeUser, now.Add(-cache.bridge.bridgeConfig().InfoCache.UserTTL))
+	cache.bridge.DB.InfoCache.DeleteOlderThan(infoCacheTypeChannel, now.Add(-cache.bridge.bridgeConfig().InfoCache.ChannelTTL))
+}
+
+func (user *User) handleSlackInfoChange(userTeam *database.UserTeam, data interface{}) {
+	defer user.bridge.recoverPanic(fmt.Sprintf("handling Slack %T", data), user.sentryTags(userTeam))
+	cache := user.bridge.InfoCache
+	switch event := data.(type) {
+	case *slack.UserChangeEvent:
+		cache.UpdateUser(userTeam.Key.TeamID, &event.User)
+		if puppet := user.bridge.GetPuppetByID(userTeam.Key.TeamID, event.User.ID); puppet != nil && puppet.Name != "" {
+			go puppet.UpdateInfo(userTeam, &event.User)
+		}
+	case *slack.ChannelRenameEvent:
+		cache.Invalidate(userTeam.Key.TeamID, event.Channel.ID)
+	case *slack.GroupRenameEvent:
+		cache.Invalidate(userTeam.Key.TeamID, event.Group.ID)
+	case *slack.IMOpenEvent:
+		cache.Invalidate(userTeam.Key.TeamID, event.Channel)
+	case *slack.IMCloseEvent:
+		cache.Invalidate(userTeam.Key.TeamID, event.Channel)
+	}
+}
@@ -0,0 +1,135 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/slack-go/slack"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// Slack Lists are shared as files with the list filetype, and links to list
+// items are unfurled as attachments with the item's fields. Neither has any
+// content that could be bridged as a file or as plain attachment text.
+
+func isSlackListFile(file *slack.File) bool {
+	return file.Filetype == "list" || file.Mode == "list"
+}
+
+func isSlackListLink(link string) bool {
+	parsed, err := url.Parse(link)
+	return err == nil && link != "" && strings.Contains(parsed.Path, "/lists/")
+}
+
+func isSlackListAttachment(attachment *slack.Attachment) bool {
+	return isSlackListLink(attachment.TitleLink) || isSlackListLink(attachment.FromURL) || isSlackListLink(attachment.OriginalURL)
+}
+
+// isSlackListUpdate checks whether a message is a notification about changes
+// to list items, rather than a user sharing a list item.
+func isSlackListUpdate(msg *slack.Msg) bool {
+	if msg.Text != "" || len(msg.Attachments) == 0 || (msg.BotID == "" && msg.User != "USLACKBOT") {
+		return false
+	}
+	for i := range msg.Attachments {
+		if !isSlackListAttachment(&msg.Attachments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatSlackListItem renders an unfurled list item as mrkdwn with its
+// title, description and fields like the assignee or status.
+func formatSlackListItem(attachment *slack.Attachment) string {
+	var text strings.Builder
+	if attachment.Pretext != "" {
+		text.WriteString(attachment.Pretext)
+		text.WriteByte('\n')
+	}
+	title := attachment.Title
+	if title == "" {
+		title = "List item"
+	}
+	link := attachment.TitleLink
+	if link == "" {
+		link = attachment.FromURL
+	}
+	if link != "" {
+		_, _ = fmt.Fprintf(&text, "\U0001F4CB *<%s|%s>*", link, title)
+	} else {
+		_, _ = fmt.Fprintf(&text, "\U0001F4CB *%s*", title)
+	}
+	if attachment.Text != "" {
+		text.WriteByte('\n')
+		text.WriteString(attachment.Text)
+	}
+	for _, field := range attachment.Fields {
+		if field.Value == "" {
+			continue
+		}
+		_, _ = fmt.Fprintf(&text, "\n*%s*: %s", field.Title, field.Value)
+	}
+	return text.String()
+}
+
+// addSlackListItems appends the list items unfurled in a message to the
+// converted content. They're appended separately from other attachments, as
+// they're needed even if the message text is rendered from blocks.
+func (portal *Portal) addSlackListItems(content *event.MessageEventContent, attachments []slack.Attachment) *event.MessageEventContent {
+	var items []string
+	for i := range attachments {
+		if isSlackListAttachment(&attachments[i]) {
+			items = append(items, portal.mrkdwnToHTML(formatSlackListItem(&attachments[i])))
+		}
+	}
+	if len(items) == 0 {
+		return content
+	}
+	itemsHTML := strings.Join(items, "<br><br>")
+	if content == nil {
+		converted := format.HTMLToContent(itemsHTML)
+		return &converted
+	}
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	content.FormattedBody += "<br><br>" + itemsHTML
+	content.Body += "\n\n" + format.HTMLToText(itemsHTML)
+	return content
+}
+
+// renderSlackListFile renders a shared list as a link, as lists can't be
+// downloaded like normal files.
+func renderSlackListFile(file *slack.File) *event.MessageEventContent {
+	title := file.Title
+	if title == "" {
+		title = file.Name
+	}
+	return &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          fmt.Sprintf("\U0001F4CB List: %s (%s)", title, file.Permalink),
+		Format:        event.FormatHTML,
+		FormattedBody: fmt.Sprintf("\U0001F4CB List: <a href=\"%s\">%s</a>", html.EscapeString(file.Permalink), html.EscapeString(title)),
+	}
+}
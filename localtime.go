@@ -0,0 +1,69 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// getSlackUserLocation returns the timezone from the Slack profile of a user,
+// or nil if it's not known.
+func (portal *Portal) getSlackUserLocation(userTeam *database.UserTeam, userID string) *time.Location {
+	if userTeam == nil || userTeam.Client == nil || userID == "" {
+		return nil
+	}
+	info, err := portal.bridge.InfoCache.GetUserInfo(userTeam, userID)
+	if err != nil {
+		portal.log.Debugfln("Failed to get info of %s for local time: %v", userID, err)
+		return nil
+	} else if info.TZ == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(info.TZ)
+	if err != nil {
+		loc = time.FixedZone(info.TZLabel, info.TZOffset)
+	}
+	return loc
+}
+
+// addSenderLocalTime appends the local time of the sender at the time of
+// sending to a message, if sender_local_time is set to message. Bots don't
+// have profiles, so their messages are left as-is.
+func (portal *Portal) addSenderLocalTime(userTeam *database.UserTeam, content *event.MessageEventContent, userID string, ts time.Time) {
+	if portal.bridge.bridgeConfig().SenderLocalTime != "message" {
+		return
+	}
+	loc := portal.getSlackUserLocation(userTeam, userID)
+	if loc == nil {
+		return
+	}
+	localTime := ts.In(loc)
+	footer := fmt.Sprintf("\U0001F552 %s local time (%s)", localTime.Format("Mon 15:04"), localTime.Format("MST"))
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	content.Body += "\n" + footer
+	content.FormattedBody += "<br><sub>" + html.EscapeString(footer) + "</sub>"
+}
@@ -0,0 +1,228 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// Texts shorter than this are too common to tell apart from echoes.
+const minLoopTextLength = 8
+
+const loopNoticeInterval = 1 * time.Hour
+
+type bridgedText struct {
+	text    string
+	senders []string
+	at      time.Time
+}
+
+// relayPrefixRegex matches the sender name other bridges usually put in front
+// of relayed messages, like "<name>", "[name]", "**name**:" or "name:".
+var relayPrefixRegex = regexp.MustCompile(`^(<[^>]{1,64}>|\[[^\]]{1,64}\]|\*\*[^*]{1,64}\*\*:?|[^\s:]{1,32}:)\s+`)
+
+// loopDetector remembers the texts recently bridged in a portal and who they
+// were bridged for, so that another bridge in the same room relaying them back
+// can be noticed before the messages start bouncing between the two bridges.
+type loopDetector struct {
+	recent     []bridgedText
+	lastNotice time.Time
+	lock       sync.Mutex
+}
+
+func normalizeLoopText(text string) string {
+	text = strings.ToLower(normalizeEchoText(text))
+	text = strings.Map(func(r rune) rune {
+		switch r {
+		case '*', '_', '~', '`':
+			return -1
+		}
+		return r
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// remember stores a bridged text along with the Slack and Matrix IDs of the
+// user it was bridged for.
+func (ld *loopDetector) remember(text string, senders []string, window time.Duration) {
+	text = normalizeLoopText(text)
+	if window <= 0 || len(text) < minLoopTextLength {
+		return
+	}
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	ld.pruneLocked(time.Now().Add(-window))
+	ld.recent = append(ld.recent, bridgedText{text: text, senders: senders, at: time.Now()})
+}
+
+func (ld *loopDetector) pruneLocked(cutoff time.Time) {
+	i := 0
+	for ; i < len(ld.recent) && ld.recent[i].at.Before(cutoff); i++ {
+	}
+	ld.recent = ld.recent[i:]
+}
+
+// isEcho checks whether an incoming text from the given sender repeats a text
+// that was recently bridged for the same user in either direction. Both
+// directions matter, as the other bridge relays the messages sent by this
+// bridge as well as the original ones. The text has to match exactly, apart
+// from a relay prefix with the sender's name that the other bridge may add.
+func (ld *loopDetector) isEcho(text, sender string, window time.Duration) bool {
+	text = normalizeLoopText(text)
+	if window <= 0 || sender == "" || len(text) < minLoopTextLength {
+		return false
+	}
+	stripped := relayPrefixRegex.ReplaceAllString(text, "")
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	ld.pruneLocked(time.Now().Add(-window))
+	for _, bridged := range ld.recent {
+		if (bridged.text == text || bridged.text == stripped) && containsString(bridged.senders, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+func (ld *loopDetector) shouldSendNotice() bool {
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+	if time.Since(ld.lastNotice) < loopNoticeInterval {
+		return false
+	}
+	ld.lastNotice = time.Now()
+	return true
+}
+
+func (br *SlackBridge) isGatewayBot(msg *slack.Msg) bool {
+	for _, id := range br.bridgeConfig().LoopPrevention.GatewayBots {
+		if id == "" {
+			continue
+		} else if id == msg.User || id == msg.BotID || (msg.BotProfile != nil && id == msg.BotProfile.AppID) {
+			return true
+		}
+	}
+	return false
+}
+
+// getEchoWindow returns how long bridged texts are remembered for detecting
+// echoes. Echo detection is only enabled if gateway bots are configured, as
+// it's only needed when another bridge is known to relay the same channels.
+func (portal *Portal) getEchoWindow() time.Duration {
+	cfg := portal.bridge.bridgeConfig().LoopPrevention
+	if len(cfg.GatewayBots) == 0 {
+		return 0
+	}
+	return cfg.EchoWindow
+}
+
+// rememberBridgedText stores the text of a message that was just bridged so
+// that echoes of it can be detected. The senders are the Slack and Matrix IDs
+// of the user the message was bridged for.
+func (portal *Portal) rememberBridgedText(text string, senders ...string) {
+	portal.loops.remember(text, senders, portal.getEchoWindow())
+}
+
+func getSlackMessageSender(msg *slack.Msg) string {
+	if msg.User != "" {
+		return msg.User
+	}
+	return msg.BotID
+}
+
+// rememberSlackBridgedText stores the text of a Slack message that was just
+// bridged, along with the Matrix user of the sender if they use the bridge.
+func (portal *Portal) rememberSlackBridgedText(userTeam *database.UserTeam, msg *slack.Msg) {
+	if portal.getEchoWindow() <= 0 {
+		return
+	}
+	senders := []string{getSlackMessageSender(msg)}
+	if msg.User != "" {
+		if user := portal.bridge.GetUserByID(userTeam.Key.TeamID, msg.User); user != nil {
+			senders = append(senders, user.MXID.String())
+		}
+	}
+	portal.rememberBridgedText(msg.Text, senders...)
+}
+
+// isSlackLoop checks whether a new Slack message was posted by another bridge
+// or gateway, either because it's a known gateway bot or because it repeats a
+// message that was just bridged.
+func (portal *Portal) isSlackLoop(msg *slack.Msg) bool {
+	if portal.bridge.isGatewayBot(msg) {
+		portal.log.Debugfln("Dropping message %s from gateway bot %s%s", msg.Timestamp, msg.User, msg.BotID)
+		portal.warnAboutOtherBridge(fmt.Sprintf("messages from %s%s", msg.User, msg.BotID))
+		return true
+	} else if portal.loops.isEcho(msg.Text, getSlackMessageSender(msg), portal.getEchoWindow()) {
+		portal.log.Debugfln("Dropping message %s by %s%s: it repeats a message that was just bridged", msg.Timestamp, msg.User, msg.BotID)
+		portal.warnAboutOtherBridge(fmt.Sprintf("%s%s repeating a message that was just bridged", msg.User, msg.BotID))
+		return true
+	}
+	return false
+}
+
+// isMatrixLoop checks whether a Matrix message repeats a message that was just
+// bridged, which means another bridge is relaying the same channel.
+func (portal *Portal) isMatrixLoop(evt *event.Event) bool {
+	content := evt.Content.AsMessage()
+	if content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace {
+		return false
+	}
+	body := event.TrimReplyFallbackText(content.Body)
+	if !portal.loops.isEcho(body, evt.Sender.String(), portal.getEchoWindow()) {
+		return false
+	}
+	portal.log.Debugfln("Dropping %s from %s: it repeats a message that was just bridged", evt.ID, evt.Sender)
+	portal.warnAboutOtherBridge(fmt.Sprintf("%s repeating a message that was just bridged", evt.Sender))
+	return true
+}
+
+func (portal *Portal) warnAboutOtherBridge(reason string) {
+	if !portal.bridge.bridgeConfig().LoopPrevention.Notice || portal.MXID == "" || !portal.loops.shouldSendNotice() {
+		return
+	}
+	portal.log.Warnfln("This channel seems to be bridged by another bridge too (detected %s)", reason)
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body: fmt.Sprintf("This channel seems to be bridged to Matrix by another bridge too (detected %s). "+
+			"Messages that look like they were relayed by the other bridge aren't bridged, to avoid sending them back and forth. "+
+			"Remove one of the bridges from this room to stop this.", reason),
+	}
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, content, nil, 0)
+	if err != nil {
+		portal.log.Warnfln("Failed to send notice about another bridge: %v", err)
+	}
+}
@@ -18,7 +18,17 @@ package main
 
 import (
 	_ "embed"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	flag "maunium.net/go/mauflag"
 
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
@@ -26,6 +36,7 @@ import (
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/configupgrade"
 
+	"go.mau.fi/mautrix-slack/auth"
 	"go.mau.fi/mautrix-slack/config"
 	"go.mau.fi/mautrix-slack/database"
 )
@@ -38,6 +49,15 @@ var (
 	BuildTime = "unknown"
 )
 
+var migrateDryRun = flag.Make().LongKey("migrate-dry-run").Usage("Print the pending database migrations and quit without applying them").Default("false").Bool()
+var importMXPuppetDB = flag.Make().LongKey("import-mx-puppet-db").Usage("Import rooms, ghosts and message mappings from the mx-puppet-slack database at this path or postgres:// URI, then quit").String()
+var importMXPuppetRegistration = flag.Make().LongKey("import-mx-puppet-registration").Usage("The registration file of mx-puppet-slack, used with --import-mx-puppet-db").String()
+var importMatterbridge = flag.Make().LongKey("import-matterbridge").Usage("Plumb the Slack-Matrix gateways of the matterbridge config at this path as portals, then quit").String()
+var importMatterbridgeRelay = flag.Make().LongKey("import-matterbridge-relay").Usage("Matrix user whose Slack login relays messages in portals plumbed with --import-matterbridge").String()
+var exportUserData = flag.Make().LongKey("export-user-data").Usage("Print everything stored about a Matrix user (@user:example.com) or Slack user (TEAMID-USERID) as JSON, then quit").String()
+var purgeUserData = flag.Make().LongKey("purge-user-data").Usage("Delete the data printed by --export-user-data afterwards. Stop the bridge before purging.").Default("false").Bool()
+var validateConfig = flag.Make().LongKey("validate-config").Usage("Check the config, homeserver connection, database and Slack logins, then quit").Default("false").Bool()
+
 //go:embed example-config.yaml
 var ExampleConfig string
 
@@ -47,10 +67,46 @@ type SlackBridge struct {
 	Config *config.Config
 	DB     *database.Database
 
+	// The bridge config after the latest reload, see bridgeConfig
+	currentBridgeConfig atomic.Value
+
+	teamConfigs     map[string]*config.BridgeConfig
+	teamConfigsBase *config.BridgeConfig
+	teamConfigsLock sync.Mutex
+
 	provisioning *ProvisioningAPI
 
 	MatrixHTMLParser *format.HTMLParser
 
+	InfoCache     *SlackInfoCache
+	ContentFilter ContentFilter
+	Translator    Translator
+
+	circuitBreakers     map[string]*circuitBreaker
+	circuitBreakersLock sync.Mutex
+
+	// Background status sends that a graceful shutdown should wait for
+	backgroundSends sync.WaitGroup
+
+	proxyClients proxyClients
+
+	usergroups usergroupCache
+
+	apiWarningsSeen sync.Map
+	apiStats        slackAPIStats
+
+	mediaLinkKey     []byte
+	mediaLinkKeyOnce sync.Once
+
+	debugServer *http.Server
+
+	// Matrix messages sent before this are retried after startup instead of timing out
+	startedAt time.Time
+
+	portalScheduler *portalScheduler
+	slackScheduler  *slackEventScheduler
+	statusBatcher   *statusBatcher
+
 	BackfillQueue          *BackfillQueue
 	historySyncLoopStarted bool
 
@@ -65,8 +121,9 @@ type SlackBridge struct {
 	portalsByID   map[database.PortalKey]*Portal
 	portalsLock   sync.Mutex
 
-	puppets             map[string]*Puppet
+	puppets             *puppetCache
 	puppetsByCustomMXID map[id.UserID]*Puppet
+	puppetLoads         map[string]*puppetLoad
 	puppetsLock         sync.Mutex
 }
 
@@ -82,17 +139,148 @@ func (br *SlackBridge) GetConfigPtr() interface{} {
 	return br.Config
 }
 
+// getTeamConfig returns the bridge config with the overrides for the given
+// Slack team applied. The result is cached until the config is reloaded or
+// the team's domain changes.
+func (br *SlackBridge) getTeamConfig(teamID string) *config.BridgeConfig {
+	base := br.bridgeConfig()
+	br.teamConfigsLock.Lock()
+	defer br.teamConfigsLock.Unlock()
+	if br.teamConfigsBase != base {
+		br.teamConfigs = make(map[string]*config.BridgeConfig)
+		br.teamConfigsBase = base
+	} else if cached, ok := br.teamConfigs[teamID]; ok {
+		return cached
+	}
+	teamConfig := base.ForTeam(teamID, func() string {
+		if teamInfo := br.DB.TeamInfo.GetBySlackTeam(teamID); teamInfo != nil {
+			return teamInfo.TeamDomain
+		}
+		return ""
+	})
+	br.teamConfigs[teamID] = teamConfig
+	return teamConfig
+}
+
+// forgetTeamConfig drops the cached config of a team, so that overrides set
+// for its domain are looked up again.
+func (br *SlackBridge) forgetTeamConfig(teamID string) {
+	br.teamConfigsLock.Lock()
+	delete(br.teamConfigs, teamID)
+	br.teamConfigsLock.Unlock()
+}
+
+// PreInit adds the SQLite tuning options to the database URI before the
+// connection is opened.
+func (br *SlackBridge) PreInit() {
+	dbConfig := &br.Config.AppService.Database
+	if dbConfig.Type != "sqlite3" {
+		return
+	}
+	sqliteConfig := br.bridgeConfig().SQLite
+	params := map[string]string{
+		"_journal_mode": sqliteConfig.JournalMode,
+		"_synchronous":  sqliteConfig.Synchronous,
+	}
+	if sqliteConfig.BusyTimeout > 0 {
+		params["_busy_timeout"] = strconv.Itoa(sqliteConfig.BusyTimeout)
+	}
+	dbConfig.URI = addSQLiteParams(dbConfig.URI, params)
+}
+
+func addSQLiteParams(uri string, params map[string]string) string {
+	path, rawQuery, _ := strings.Cut(uri, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return uri
+	}
+	changed := false
+	for key, value := range params {
+		if value != "" && !query.Has(key) {
+			query.Set(key, value)
+			changed = true
+		}
+	}
+	if !changed {
+		return uri
+	}
+	return path + "?" + query.Encode()
+}
+
 func (br *SlackBridge) Init() {
+	br.initSentry()
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
+	br.Config.BaseConfig.Bridge = reloadableBridgeConfig{br}
+
+	br.checkAppserviceEncryption()
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
+	br.initTokenCipher()
+	if *migrateDryRun {
+		br.printPendingMigrations()
+	} else if *validateConfig {
+		br.validateConfigAndExit()
+	} else if *importMXPuppetDB != "" {
+		br.importMXPuppetAndExit(*importMXPuppetDB, *importMXPuppetRegistration)
+	} else if *importMatterbridge != "" {
+		br.importMatterbridgeAndExit(*importMatterbridge, id.UserID(*importMatterbridgeRelay))
+	} else if *exportUserData != "" {
+		br.exportUserDataAndExit(*exportUserData, *purgeUserData)
+	}
 
 	br.MatrixHTMLParser = NewParser(br)
+	br.InfoCache = NewSlackInfoCache(br)
+	auth.HTTPClient = br.getSlackHTTPClient("")
+	br.ContentFilter = newContentFilter(br)
+	br.Translator = newTranslator(br)
+	br.portalScheduler.Start(br.bridgeConfig().PortalWorkers)
+	br.slackScheduler.Start(br.bridgeConfig().SlackEventWorkers)
+}
+
+const tokenEncryptionKeyEnv = "MAUTRIX_SLACK_TOKEN_ENCRYPTION_KEY"
+
+func (br *SlackBridge) initTokenCipher() {
+	key := br.bridgeConfig().TokenEncryptionKey
+	if envKey := os.Getenv(tokenEncryptionKeyEnv); envKey != "" {
+		key = envKey
+	}
+	if key == "" {
+		return
+	}
+	tokenCipher, err := database.NewAESTokenCipher(key)
+	if err != nil {
+		br.Log.Fatalln("Failed to initialize token encryption:", err)
+		os.Exit(13)
+	}
+	br.DB.TokenCipher = tokenCipher
+}
+
+func (br *SlackBridge) printPendingMigrations() {
+	version, pending, err := br.DB.PendingUpgrades()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to check database version:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Database is on v%d\n", version)
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+	} else {
+		fmt.Println("Pending migrations (each runs in its own transaction):")
+		for _, upgrade := range pending {
+			fmt.Println("  " + upgrade)
+		}
+	}
+	os.Exit(0)
 }
 
 func (br *SlackBridge) Start() {
-	if br.Config.Bridge.Provisioning.SharedSecret != "disable" {
+	br.startedAt = time.Now()
+	if br.bridgeConfig().StatusBatching.Interval > 0 {
+		br.statusBatcher = newStatusBatcher(br)
+		go br.statusBatcher.loop()
+	}
+	if br.bridgeConfig().Provisioning.SharedSecret != "disable" {
 		br.provisioning = newProvisioningAPI(br)
 	}
 
@@ -102,14 +290,53 @@ func (br *SlackBridge) Start() {
 		log:             br.Log.Sub("BackfillQueue"),
 	}
 
+	br.DB.UserTeam.EncryptExistingTokens()
+	br.checkGhostFormat()
+	br.InfoCache.Prune()
+
+	// Portals can enable proxied links with their media policy even if they're disabled by default
+	if br.bridgeConfig().Media.ProxyLinks || br.bridgeConfig().Media.PublicAddress != "" {
+		br.registerMediaProxy()
+	}
+
+	if br.bridgeConfig().SlackApp.SigningSecret != "" {
+		br.registerSlashCommand()
+	}
+
+	go br.reactionResyncLoop()
+	go br.retentionLoop()
+	go br.pruneHandledEventsLoop()
+	go br.InfoCache.pruneLoop()
+
+	if br.bridgeConfig().EventArchive.Enable {
+		go br.pruneEventArchiveLoop()
+	}
+
+	if br.bridgeConfig().DebugListener != "" {
+		br.startDebugListener()
+	}
+
+	go br.handleReloadSignals()
 	go br.startUsers()
+
+	if br.bridgeConfig().AdminNotices.StartStop {
+		go br.sendAdminNotice("%s started", br.VersionDesc)
+	}
 }
 
 func (br *SlackBridge) Stop() {
+	if br.bridgeConfig().AdminNotices.StartStop {
+		br.sendAdminNotice("Bridge is shutting down")
+	}
+	br.Log.Infoln("Finishing queued Matrix messages before stopping")
+	br.drainPortals()
+
 	for _, user := range br.usersByMXID {
 		br.Log.Debugln("Disconnecting", user.MXID)
 		user.Disconnect()
 	}
+	br.stopDebugListener()
+	br.flushSentry()
 }
 
 func (br *SlackBridge) GetIPortal(mxid id.RoomID) bridge.Portal {
@@ -155,8 +382,16 @@ func main() {
 		portalsByMXID: make(map[id.RoomID]*Portal),
 		portalsByID:   make(map[database.PortalKey]*Portal),
 
-		puppets:             make(map[string]*Puppet),
+		puppets:             newPuppetCache(),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+		puppetLoads:         make(map[string]*puppetLoad),
+
+		circuitBreakers: make(map[string]*circuitBreaker),
+
+		proxyClients: proxyClients{clients: make(map[string]*http.Client)},
+
+		portalScheduler: newPortalScheduler(),
+		slackScheduler:  newSlackEventScheduler(),
 	}
 	br.Bridge = bridge.Bridge{
 		Name:            "mautrix-slack",
@@ -166,11 +401,13 @@ func main() {
 		ProtocolName:    "Slack",
 		CryptoPickleKey: "maunium.net/go/mautrix-whatsapp",
 
-		ConfigUpgrader: &configupgrade.StructUpgrader{
+		AdditionalLongFlags: " [--migrate-dry-run] [--validate-config] [--import-mx-puppet-db <uri> --import-mx-puppet-registration <path>] [--import-matterbridge <path> [--import-matterbridge-relay <mxid>]] [--export-user-data <user> [--purge-user-data]]",
+
+		ConfigUpgrader: config.EnvUpgrader{StructUpgrader: &configupgrade.StructUpgrader{
 			SimpleUpgrader: configupgrade.SimpleUpgrader(config.DoUpgrade),
 			Blocks:         config.SpacedBlocks,
 			Base:           ExampleConfig,
-		},
+		}},
 
 		Child: br,
 	}
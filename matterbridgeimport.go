@@ -0,0 +1,345 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// matterbridgeConfig is the part of a matterbridge.toml that's needed to
+// plumb its Slack and Matrix gateways as portals. Keys are lowercased, as
+// matterbridge doesn't care about their case either, and only string values
+// are kept for the general section and accounts.
+type matterbridgeConfig struct {
+	General  map[string]string
+	Accounts map[string]map[string]string
+	Gateways []*matterbridgeGateway
+}
+
+type matterbridgeGateway struct {
+	Name    string
+	Enabled bool
+	Links   []matterbridgeLink
+}
+
+// matterbridgeLink is a [[gateway.in]], [[gateway.out]] or [[gateway.inout]]
+// entry. In means messages are read from the channel, out means they're
+// sent to it.
+type matterbridgeLink struct {
+	Account string
+	Channel string
+	In, Out bool
+}
+
+func (gw *matterbridgeGateway) linksOf(protocol string) (links []matterbridgeLink) {
+	for _, link := range gw.Links {
+		if strings.HasPrefix(link.Account, protocol+".") {
+			links = append(links, link)
+		}
+	}
+	return
+}
+
+// lowerKeys lowercases the keys of a decoded TOML table, as matterbridge
+// reads its config case-insensitively.
+func lowerKeys(table map[string]interface{}) map[string]interface{} {
+	lowered := make(map[string]interface{}, len(table))
+	for key, value := range table {
+		lowered[strings.ToLower(key)] = value
+	}
+	return lowered
+}
+
+// stringValues keeps the string values of a TOML table with lowercased keys.
+func stringValues(table map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	for key, value := range lowerKeys(table) {
+		if str, ok := value.(string); ok {
+			values[key] = str
+		}
+	}
+	return values
+}
+
+func tableArray(value interface{}) []map[string]interface{} {
+	tables, _ := value.([]map[string]interface{})
+	return tables
+}
+
+func parseMatterbridgeConfig(data string) (*matterbridgeConfig, error) {
+	var raw map[string]interface{}
+	_, err := toml.Decode(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &matterbridgeConfig{
+		General:  make(map[string]string),
+		Accounts: make(map[string]map[string]string),
+	}
+	for section, value := range lowerKeys(raw) {
+		switch section {
+		case "general":
+			if table, ok := value.(map[string]interface{}); ok {
+				cfg.General = stringValues(table)
+			}
+		case "gateway":
+			for _, rawGateway := range tableArray(value) {
+				cfg.Gateways = append(cfg.Gateways, parseMatterbridgeGateway(lowerKeys(rawGateway)))
+			}
+		default:
+			// Everything else is a protocol with a table for each account
+			accounts, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for name, account := range accounts {
+				if table, ok := account.(map[string]interface{}); ok {
+					cfg.Accounts[section+"."+strings.ToLower(name)] = stringValues(table)
+				}
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func parseMatterbridgeGateway(raw map[string]interface{}) *matterbridgeGateway {
+	gateway := &matterbridgeGateway{Enabled: true}
+	gateway.Name, _ = raw["name"].(string)
+	if enabled, ok := raw["enable"].(bool); ok {
+		gateway.Enabled = enabled
+	}
+	for _, direction := range []string{"in", "out", "inout"} {
+		for _, rawLink := range tableArray(raw[direction]) {
+			values := stringValues(rawLink)
+			gateway.Links = append(gateway.Links, matterbridgeLink{
+				Account: strings.ToLower(values["account"]),
+				Channel: values["channel"],
+				In:      direction != "out",
+				Out:     direction != "in",
+			})
+		}
+	}
+	return gateway
+}
+
+// convertMatterbridgeNickFormat turns a matterbridge RemoteNickFormat into a
+// relay message template.
+func convertMatterbridgeNickFormat(format, gatewayName string) string {
+	return strings.NewReplacer(
+		"{NICK}", "{{.Displayname}}",
+		"{NOPINGNICK}", "{{.Displayname}}",
+		"{USERID}", "{{.UserID}}",
+		"{PROTOCOL}", "matrix",
+		"{BRIDGE}", gatewayName,
+		"{GATEWAY}", gatewayName,
+		"{LABEL}", "",
+		"{CHANNEL}", "",
+		"{TENGO}", "",
+	).Replace(format)
+}
+
+func (br *SlackBridge) importMatterbridgeAndExit(path string, relayUser id.UserID) {
+	err := br.importMatterbridge(path, relayUser)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to import matterbridge config:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// importMatterbridge plumbs every enabled matterbridge gateway between a
+// Slack channel and a Matrix room as a portal. Messages from Matrix users
+// without a Slack login are sent through the given relay user, prefixed like
+// matterbridge did. Gateways that only send messages from Slack to Matrix
+// become read-only portals.
+func (br *SlackBridge) importMatterbridge(path string, relayUser id.UserID) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	cfg, err := parseMatterbridgeConfig(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	err = br.DB.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade database: %w", err)
+	}
+	var plumbed int
+	for _, gateway := range cfg.Gateways {
+		if !gateway.Enabled {
+			continue
+		}
+		err = br.importMatterbridgeGateway(cfg, gateway, relayUser)
+		if err != nil {
+			fmt.Printf("Skipped gateway %s: %v\n", gateway.Name, err)
+		} else {
+			plumbed++
+		}
+	}
+	fmt.Printf("Plumbed %d of %d gateways\n", plumbed, len(cfg.Gateways))
+	return nil
+}
+
+func (br *SlackBridge) importMatterbridgeGateway(cfg *matterbridgeConfig, gateway *matterbridgeGateway, relayUser id.UserID) error {
+	slackLinks, matrixLinks := gateway.linksOf("slack"), gateway.linksOf("matrix")
+	if len(slackLinks) == 0 || len(matrixLinks) == 0 {
+		return fmt.Errorf("it doesn't connect Slack and Matrix")
+	} else if len(slackLinks) > 1 || len(matrixLinks) > 1 {
+		return fmt.Errorf("it has more than one Slack channel or Matrix room, which can't be plumbed as one portal")
+	}
+	slackLink, matrixLink := slackLinks[0], matrixLinks[0]
+	account := cfg.Accounts[slackLink.Account]
+	if account == nil || account["token"] == "" {
+		return fmt.Errorf("account %s has no token", slackLink.Account)
+	}
+
+	client := slack.New(account["token"], br.getSlackClientOptions("")...)
+	auth, err := client.AuthTest()
+	if err != nil {
+		return fmt.Errorf("failed to check token of %s: %w", slackLink.Account, err)
+	}
+	if !br.hasLoginInTeam(auth.TeamID) {
+		return fmt.Errorf("nobody is logged into %s (%s) on the bridge, so messages from it can't be received", auth.Team, auth.TeamID)
+	}
+	channelID, err := resolveMatterbridgeSlackChannel(client, slackLink.Channel)
+	if err != nil {
+		return err
+	}
+	channelInfo, err := client.GetConversationInfo(channelID, false)
+	if err != nil {
+		return fmt.Errorf("failed to get info of %s: %w", channelID, err)
+	}
+	roomID, err := br.resolveMatterbridgeMatrixRoom(matrixLink.Channel)
+	if err != nil {
+		return err
+	}
+
+	portal := br.GetPortalByID(database.PortalKey{TeamID: auth.TeamID, ChannelID: channelID})
+	if portal.MXID != "" {
+		return fmt.Errorf("%s is already bridged to %s", channelID, portal.MXID)
+	} else if existing := br.GetPortalByMXID(roomID); existing != nil {
+		return fmt.Errorf("%s is already a portal for %s", roomID, existing.Key)
+	}
+	if err = br.Bot.EnsureJoined(roomID); err != nil {
+		return fmt.Errorf("failed to join %s, invite %s to it first: %w", roomID, br.Bot.UserID, err)
+	}
+	if !portal.setChannelType(channelInfo) {
+		return fmt.Errorf("%s has an unknown channel type", channelID)
+	}
+	portal.MXID = roomID
+	// Matrix messages aren't sent to Slack if either side of the gateway is one-way
+	portal.ReadOnly = (slackLink.In && !slackLink.Out) || (matrixLink.Out && !matrixLink.In)
+	if relayUser != "" {
+		portal.RelayUserID = br.findMatterbridgeRelayUser(relayUser, auth.TeamID)
+	}
+	nickFormat := account["remotenickformat"]
+	if nickFormat == "" {
+		nickFormat = cfg.General["remotenickformat"]
+	}
+	if nickFormat != "" {
+		format := convertMatterbridgeNickFormat(nickFormat, gateway.Name)
+		portal.RelayTemplates = map[string]string{
+			string(event.MsgText):   format,
+			string(event.MsgNotice): format,
+			string(event.MsgEmote):  format,
+		}
+	}
+	portal.Update(nil)
+	br.portalsLock.Lock()
+	br.portalsByMXID[roomID] = portal
+	br.portalsLock.Unlock()
+
+	var notes string
+	if portal.ReadOnly {
+		notes += " (read-only)"
+	}
+	if portal.RelayUserID != "" {
+		notes += fmt.Sprintf(", relayed through %s", portal.RelayUserID)
+	}
+	fmt.Printf("Plumbed gateway %s: %s in %s (%s) <-> %s%s\n", gateway.Name, channelID, auth.Team, auth.TeamID, roomID, notes)
+	return nil
+}
+
+func (br *SlackBridge) hasLoginInTeam(teamID string) bool {
+	for _, userTeam := range br.DB.UserTeam.GetAllBySlackTeamID(teamID) {
+		if userTeam.IsLoggedIn() {
+			return true
+		}
+	}
+	return false
+}
+
+func (br *SlackBridge) findMatterbridgeRelayUser(relayUser id.UserID, teamID string) id.UserID {
+	for _, userTeam := range br.DB.UserTeam.GetAllByMXIDWithToken(relayUser) {
+		if userTeam.Key.TeamID == teamID {
+			return relayUser
+		}
+	}
+	fmt.Printf("%s isn't logged into %s, not enabling relay mode\n", relayUser, teamID)
+	return ""
+}
+
+// resolveMatterbridgeSlackChannel finds the ID of a matterbridge Slack
+// channel, which is either a name or "ID:<channel ID>".
+func resolveMatterbridgeSlackChannel(client *slack.Client, channel string) (string, error) {
+	if strings.HasPrefix(channel, "ID:") {
+		return strings.TrimPrefix(channel, "ID:"), nil
+	}
+	name := strings.TrimPrefix(channel, "#")
+	params := &slack.GetConversationsParameters{
+		Types:           []string{"public_channel", "private_channel"},
+		ExcludeArchived: true,
+		Limit:           1000,
+	}
+	for {
+		channels, cursor, err := client.GetConversations(params)
+		if err != nil {
+			return "", fmt.Errorf("failed to list channels: %w", err)
+		}
+		for _, ch := range channels {
+			if ch.Name == name {
+				return ch.ID, nil
+			}
+		}
+		if cursor == "" {
+			return "", fmt.Errorf("channel #%s not found", name)
+		}
+		params.Cursor = cursor
+	}
+}
+
+func (br *SlackBridge) resolveMatterbridgeMatrixRoom(channel string) (id.RoomID, error) {
+	if strings.HasPrefix(channel, "!") {
+		return id.RoomID(channel), nil
+	}
+	resp, err := br.Bot.ResolveAlias(id.RoomAlias(channel))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", channel, err)
+	}
+	return resp.RoomID, nil
+}
@@ -0,0 +1,177 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const slackMediaProxyPath = "/_slack/v1/media"
+
+// getMediaLinkKey returns the key used to sign proxied links, generating it
+// on first use. It's separate from the appservice tokens so that rotating one
+// doesn't affect the other.
+func (br *SlackBridge) getMediaLinkKey() []byte {
+	br.mediaLinkKeyOnce.Do(func() {
+		key, err := hex.DecodeString(br.DB.KV.Get(database.KVMediaLinkKey))
+		if err != nil || len(key) == 0 {
+			key = make([]byte, 32)
+			_, err = rand.Read(key)
+			if err != nil {
+				panic(fmt.Errorf("failed to generate media link key: %w", err))
+			}
+			br.DB.KV.Set(database.KVMediaLinkKey, hex.EncodeToString(key))
+		}
+		br.mediaLinkKey = key
+	})
+	return br.mediaLinkKey
+}
+
+// signMediaLink returns the signature for a bridge-proxied Slack file link,
+// so that the proxy can't be used to download arbitrary files, or the file
+// after the link has expired.
+func (br *SlackBridge) signMediaLink(teamID, userID, fileID string, expiry int64) string {
+	mac := hmac.New(sha256.New, br.getMediaLinkKey())
+	mac.Write([]byte(teamID + "/" + userID + "/" + fileID + "/" + strconv.FormatInt(expiry, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var errMediaBlocked = errors.New("media is blocked in this room")
+
+// shouldLinkSlackFile checks whether a Slack file should be sent to Matrix as
+// a link rather than re-uploaded, based on the portal's media policy.
+func (portal *Portal) shouldLinkSlackFile(file *slack.File) bool {
+	switch portal.MediaPolicy {
+	case database.MediaPolicyBridge:
+		return false
+	case database.MediaPolicyLink, database.MediaPolicyProxy:
+		return true
+	default:
+		threshold := portal.bridge.bridgeConfig().Media.LinkThreshold
+		return threshold > 0 && int64(file.Size) > threshold
+	}
+}
+
+// shouldProxyFileLinks checks whether links to Slack files should go through
+// the bridge's media proxy instead of pointing directly at Slack.
+func (portal *Portal) shouldProxyFileLinks() bool {
+	switch portal.MediaPolicy {
+	case database.MediaPolicyProxy:
+		return true
+	case database.MediaPolicyLink:
+		return false
+	default:
+		return portal.bridge.bridgeConfig().Media.ProxyLinks
+	}
+}
+
+func (br *SlackBridge) getSlackFileLink(userTeam *database.UserTeam, file *slack.File, proxy bool) string {
+	cfg := br.bridgeConfig().Media
+	if !proxy {
+		return file.Permalink
+	}
+	teamID, userID := userTeam.Key.TeamID, userTeam.Key.SlackID
+	expiry := time.Now().Add(cfg.ProxyLinkLifetime).Unix()
+	return fmt.Sprintf("%s%s/%s/%s/%s?exp=%d&sig=%s",
+		strings.TrimSuffix(cfg.PublicAddress, "/"), slackMediaProxyPath,
+		teamID, userID, file.ID, expiry, br.signMediaLink(teamID, userID, file.ID, expiry))
+}
+
+// makeSlackFileLink creates a message that links to a Slack file instead of
+// containing it, for files that are too large to re-upload or portals whose
+// media policy only allows links.
+func (portal *Portal) makeSlackFileLink(userTeam *database.UserTeam, file *slack.File) *event.MessageEventContent {
+	name := file.Name
+	if name == "" {
+		name = file.Title
+	}
+	link := portal.bridge.getSlackFileLink(userTeam, file, portal.shouldProxyFileLinks())
+	size := formatBytes(int64(file.Size))
+	return &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    fmt.Sprintf("\U0001F4CE %s (%s): %s", name, size, link),
+		Format:  event.FormatHTML,
+		FormattedBody: fmt.Sprintf("\U0001F4CE <a href=\"%s\">%s</a> (%s)",
+			html.EscapeString(link), html.EscapeString(name), size),
+	}
+}
+
+func (br *SlackBridge) registerMediaProxy() {
+	br.AS.Router.HandleFunc(slackMediaProxyPath+"/{teamID}/{userID}/{fileID}", br.serveSlackMedia).Methods(http.MethodGet)
+}
+
+// serveSlackMedia streams a Slack file to the client using the Slack session
+// of the user whose portal the link was sent to.
+func (br *SlackBridge) serveSlackMedia(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	teamID, userID, fileID := vars["teamID"], vars["userID"], vars["fileID"]
+	expiry, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+	expected := br.signMediaLink(teamID, userID, fileID, expiry)
+	if !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(expected)) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	} else if time.Now().Unix() > expiry {
+		http.Error(w, "The link has expired", http.StatusGone)
+		return
+	}
+	user := br.GetUserByID(teamID, userID)
+	var userTeam *database.UserTeam
+	if user != nil {
+		userTeam = user.GetUserTeam(teamID)
+	}
+	if userTeam == nil || userTeam.Client == nil {
+		http.Error(w, "The Slack account for this link is no longer connected", http.StatusGone)
+		return
+	}
+	file, _, _, err := userTeam.Client.GetFileInfoContext(r.Context(), fileID, 0, 0)
+	if err != nil {
+		br.Log.Warnfln("Failed to get info of proxied Slack file %s: %v", fileID, err)
+		http.Error(w, "Failed to get file info from Slack", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", file.Mimetype)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	if file.Size > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(file.Size))
+	}
+	err = userTeam.Client.GetFileContext(r.Context(), file.URLPrivate, w)
+	if err != nil {
+		br.Log.Warnfln("Failed to proxy Slack file %s: %v", fileID, err)
+	}
+}
@@ -0,0 +1,221 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+var errMediaTooLarge = errors.New("the file is larger than the bridge's size limit")
+
+// limitedReadCloser fails with errMediaTooLarge instead of silently
+// truncating the data like io.LimitReader does.
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (lrc *limitedReadCloser) Read(p []byte) (n int, err error) {
+	n, err = lrc.ReadCloser.Read(p)
+	lrc.remaining -= int64(n)
+	if lrc.remaining < 0 {
+		return n, errMediaTooLarge
+	}
+	return
+}
+
+func (portal *Portal) limitMediaReader(reader io.ReadCloser) io.ReadCloser {
+	maxSize := portal.bridge.bridgeConfig().Media.MaxFileSize
+	if maxSize <= 0 {
+		return reader
+	}
+	return &limitedReadCloser{ReadCloser: reader, remaining: maxSize}
+}
+
+func (portal *Portal) isMediaTooLarge(size int64) bool {
+	maxSize := portal.bridge.bridgeConfig().Media.MaxFileSize
+	return maxSize > 0 && size > maxSize
+}
+
+// canStreamMedia checks whether a file can be passed from one side to the
+// other without holding all of it in memory. Virus scanning and image
+// processing need the whole file, so they force buffering.
+func (portal *Portal) canStreamMedia(mimeType string) bool {
+	cfg := portal.bridge.bridgeConfig()
+	if cfg.Antivirus.Type != "" {
+		return false
+	}
+	processesImages := cfg.Media.StripEXIF || cfg.Media.MaxImageDimension > 0 || cfg.Media.Blurhash || cfg.Media.Thumbnails
+	return !processesImages || !strings.HasPrefix(mimeType, "image/")
+}
+
+// openMatrixAttachment starts downloading and decrypting the file in a Matrix
+// media message. If the file is encrypted, the hash is only checked when the
+// returned reader is closed.
+func (portal *Portal) openMatrixAttachment(ctx context.Context, content *event.MessageEventContent) (io.ReadCloser, error) {
+	var file *event.EncryptedFileInfo
+	rawMXC := content.URL
+	if content.File != nil {
+		file = content.File
+		rawMXC = file.URL
+	}
+	mxc, err := rawMXC.Parse()
+	if err != nil {
+		return nil, err
+	}
+	body, err := portal.MainIntent().DownloadContext(ctx, mxc)
+	if err != nil {
+		return nil, err
+	}
+	reader := portal.limitMediaReader(body)
+	if file != nil {
+		if err = file.PrepareForDecryption(); err != nil {
+			_ = reader.Close()
+			return nil, err
+		}
+		return file.DecryptStream(reader), nil
+	}
+	return reader, nil
+}
+
+// openSlackFile starts downloading a Slack file. Private files are streamed
+// through a pipe, as the Slack client only supports writing into a writer.
+func (portal *Portal) openSlackFile(ctx context.Context, userTeam *database.UserTeam, file *slack.File) (io.ReadCloser, error) {
+	if file.URLPrivate != "" {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(userTeam.Client.GetFileContext(ctx, file.URLPrivate, writer))
+		}()
+		return portal.limitMediaReader(reader), nil
+	} else if file.PermalinkPublic != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, file.PermalinkPublic, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := portal.bridge.getSlackHTTPClient(portal.Key.TeamID).Do(req)
+		if err != nil {
+			return nil, err
+		} else if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return portal.limitMediaReader(resp.Body), nil
+	}
+	return nil, errors.New("no usable URL found in file object")
+}
+
+// bridgeSlackFile downloads a Slack file and uploads it to Matrix, filling in
+// the URL and info in the content. The returned map contains extra content
+// that should be merged into the event.
+func (portal *Portal) bridgeSlackFile(userTeam *database.UserTeam, file *slack.File, content *event.MessageEventContent) (map[string]interface{}, error) {
+	if portal.isMediaTooLarge(int64(file.Size)) {
+		return nil, errMediaTooLarge
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader, err := portal.openSlackFile(ctx, userTeam, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download: %w", err)
+	}
+	defer reader.Close()
+
+	// The upload needs the length upfront, so files with an unknown size are buffered
+	if file.Size > 0 && portal.canStreamMedia(content.Info.MimeType) {
+		return nil, portal.streamMediaToMatrix(reader, int64(file.Size), content)
+	}
+
+	var data bytes.Buffer
+	_, err = data.ReadFrom(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download: %w", err)
+	}
+	fileData := data.Bytes()
+	err = portal.bridge.scanFile(ctx, file.ID, fileData)
+	if err != nil {
+		return nil, err
+	}
+	isAnimated := isAnimatedImage(fileData, content.Info.MimeType)
+	if content.MsgType == event.MsgImage && !isAnimated {
+		processed, width, height, err := portal.bridge.processImage(fileData, content.Info.MimeType)
+		if err != nil {
+			portal.log.Warnfln("Failed to process image %s, uploading original: %v", file.ID, err)
+		} else {
+			fileData = processed
+			if width != 0 && height != 0 {
+				content.Info.Width, content.Info.Height = width, height
+			}
+		}
+	}
+	err = portal.uploadMedia(portal.MainIntent(), fileData, content)
+	if err != nil {
+		return nil, err
+	}
+	if content.MsgType == event.MsgImage {
+		return portal.addImagePreviews(portal.MainIntent(), fileData, content, isAnimated), nil
+	}
+	return nil, nil
+}
+
+// streamMediaToMatrix uploads media to Matrix directly from the reader,
+// encrypting it on the fly if the portal is encrypted.
+func (portal *Portal) streamMediaToMatrix(reader io.Reader, size int64, content *event.MessageEventContent) error {
+	req := mautrix.ReqUploadMedia{
+		Content:       reader,
+		ContentLength: size,
+		ContentType:   content.Info.MimeType,
+	}
+	var file *event.EncryptedFileInfo
+	var encryptingReader io.ReadCloser
+	if portal.Encrypted {
+		file = &event.EncryptedFileInfo{
+			EncryptedFile: *attachment.NewEncryptedFile(),
+		}
+		encryptingReader = file.EncryptStream(reader)
+		req.Content = encryptingReader
+		req.ContentType = "application/octet-stream"
+	}
+	uploaded, err := portal.MainIntent().UploadMedia(req)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		// Closing the encrypting reader fills the hash in the file info
+		if err = encryptingReader.Close(); err != nil {
+			return err
+		}
+		file.URL = uploaded.ContentURI.CUString()
+		content.File = file
+	} else {
+		content.URL = uploaded.ContentURI.CUString()
+	}
+	content.Info.Size = int(size)
+	return nil
+}
@@ -0,0 +1,130 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// messageCache keeps the mappings of the latest messages in a portal in
+// memory, as edits, deletions, reactions and thread replies almost always
+// target recent messages. Only the first part of a Slack message is cached by
+// its Slack ID, as that's what GetBySlackID returns.
+type messageCache struct {
+	lock       sync.Mutex
+	bySlackID  map[string]*database.Message
+	byMatrixID map[id.EventID]*list.Element
+	order      *list.List
+}
+
+func (mc *messageCache) getBySlackID(slackID string) *database.Message {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.bySlackID[slackID]
+}
+
+func (mc *messageCache) getByMatrixID(eventID id.EventID) *database.Message {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if elem, ok := mc.byMatrixID[eventID]; ok {
+		return elem.Value.(*database.Message)
+	}
+	return nil
+}
+
+// add caches a message, evicting the oldest ones if there are more than size.
+// If first is true, the message is the first part of the Slack message.
+func (mc *messageCache) add(msg *database.Message, first bool, size int) {
+	if size <= 0 || msg.MatrixID == "" {
+		return
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if mc.order == nil {
+		mc.bySlackID = make(map[string]*database.Message)
+		mc.byMatrixID = make(map[id.EventID]*list.Element)
+		mc.order = list.New()
+	}
+	if elem, ok := mc.byMatrixID[msg.MatrixID]; ok {
+		mc.removeElement(elem)
+	}
+	mc.byMatrixID[msg.MatrixID] = mc.order.PushFront(msg)
+	if first {
+		mc.bySlackID[msg.SlackID] = msg
+	}
+	for mc.order.Len() > size {
+		mc.removeElement(mc.order.Back())
+	}
+}
+
+func (mc *messageCache) remove(msg *database.Message) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if elem, ok := mc.byMatrixID[msg.MatrixID]; ok {
+		mc.removeElement(elem)
+	}
+	if cached, ok := mc.bySlackID[msg.SlackID]; ok && cached.MatrixID == msg.MatrixID {
+		delete(mc.bySlackID, msg.SlackID)
+	}
+}
+
+func (mc *messageCache) removeElement(elem *list.Element) {
+	msg := mc.order.Remove(elem).(*database.Message)
+	delete(mc.byMatrixID, msg.MatrixID)
+	if mc.bySlackID[msg.SlackID] == msg {
+		delete(mc.bySlackID, msg.SlackID)
+	}
+}
+
+func (portal *Portal) getMessageBySlackID(slackID string) *database.Message {
+	if msg := portal.messages.getBySlackID(slackID); msg != nil {
+		return msg
+	}
+	msg := portal.bridge.DB.Message.GetBySlackID(portal.Key, slackID)
+	if msg != nil {
+		portal.messages.add(msg, true, portal.bridge.bridgeConfig().MessageCacheSize)
+	}
+	return msg
+}
+
+func (portal *Portal) getMessageByMatrixID(eventID id.EventID) *database.Message {
+	if msg := portal.messages.getByMatrixID(eventID); msg != nil {
+		return msg
+	}
+	msg := portal.bridge.DB.Message.GetByMatrixID(portal.Key, eventID)
+	if msg != nil {
+		portal.messages.add(msg, false, portal.bridge.bridgeConfig().MessageCacheSize)
+	}
+	return msg
+}
+
+// cacheMessage adds a newly bridged message to the cache.
+func (portal *Portal) cacheMessage(msg *database.Message) {
+	cached := portal.messages.getBySlackID(msg.SlackID)
+	first := cached == nil || cached.PartIndex > msg.PartIndex
+	portal.messages.add(msg, first, portal.bridge.bridgeConfig().MessageCacheSize)
+}
+
+func (portal *Portal) deleteMessage(msg *database.Message) {
+	msg.Delete()
+	portal.messages.remove(msg)
+}
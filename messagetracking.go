@@ -48,11 +48,60 @@ var (
 	errTargetIsFake                = errors.New("target is a fake event")
 	errReactionSentBySomeoneElse   = errors.New("target reaction was sent by someone else")
 	errDMSentByOtherUser           = errors.New("target message was sent by the other user in a DM")
+	errDeviceNotVerified           = errors.New("this room only accepts messages from verified devices")
+	errPortalFiltered              = errors.New("this conversation is excluded from bridging")
+	errSenderFiltered              = errors.New("your Slack account is excluded from bridging")
+	errDMUserDeactivated           = errors.New("the other user's Slack account has been deactivated")
+	errPortalReadOnly              = errors.New("this room is read-only, messages aren't bridged to Slack")
+	errBridgeLoop                  = errors.New("the message looks like an echo from another bridge in this room")
 
 	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
 	errTimeoutBeforeHandling = errors.New("message timed out before handling was started")
+	errQueuedForRetry        = errors.New("the message was sent while the bridge was restarting, it will be sent once Slack is connected")
 )
 
+func timeoutOverride(override int64, fallback time.Duration) time.Duration {
+	if override < 0 {
+		return 0
+	} else if override > 0 {
+		return time.Duration(override) * time.Millisecond
+	}
+	return fallback
+}
+
+// getMessageHandlingTimeouts returns the time after which a warning is sent
+// about a Matrix message taking long to bridge, and the time after which
+// bridging it is cancelled. Zero means there's no timeout.
+func (portal *Portal) getMessageHandlingTimeouts() (errorAfter, deadline time.Duration) {
+	cfg := portal.bridge.bridgeConfig().MessageHandlingTimeout
+	return timeoutOverride(portal.TimeoutErrorAfterMillis, cfg.ErrorAfter), timeoutOverride(portal.TimeoutDeadlineMillis, cfg.Deadline)
+}
+
+// getMessageMaxAge returns how old a Matrix message can be when it reaches the
+// bridge before it's considered too old to bridge. Zero means there's no limit.
+func (portal *Portal) getMessageMaxAge(errorAfter time.Duration) time.Duration {
+	cfg := portal.bridge.bridgeConfig().MessageHandlingTimeout
+	if cfg.MaxAgeStr == "" {
+		return errorAfter
+	}
+	return cfg.MaxAge
+}
+
+type delayedMessageContextKey struct{}
+
+// withDelayedMarker marks the message converted with the context as being
+// bridged after max_age, so the delayed marker is added to its text.
+func withDelayedMarker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, delayedMessageContextKey{}, true)
+}
+
+func (portal *Portal) getDelayedMarker(ctx context.Context) string {
+	if delayed, _ := ctx.Value(delayedMessageContextKey{}).(bool); delayed {
+		return portal.bridge.bridgeConfig().MessageHandlingTimeout.DelayedMarker
+	}
+	return ""
+}
+
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string) {
 	switch {
 	case errors.Is(err, errUnexpectedParsedContentType),
@@ -60,14 +109,34 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, ""
 	case errors.Is(err, errMNoticeDisabled):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, ""
-	case errors.Is(err, errMediaUnsupportedType):
+	case errors.Is(err, errDeviceNotVerified),
+		errors.Is(err, errPortalFiltered),
+		errors.Is(err, errSenderFiltered),
+		errors.Is(err, errDMUserDeactivated),
+		errors.Is(err, errPortalReadOnly),
+		errors.Is(err, errBridgeLoop),
+		errors.Is(err, errAppDoesNotAcceptMessages),
+		errors.Is(err, errContentRejected),
+		errors.Is(err, errFileInfected),
+		errors.Is(err, errMediaBlocked):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errMediaUnsupportedType),
+		errors.Is(err, errMediaTooLarge):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
 	case errors.Is(err, errTimeoutBeforeHandling):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, "the message was too old when it reached the bridge, so it was not handled"
 	case errors.Is(err, context.DeadlineExceeded):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, false, true, "handling the message took too long and was cancelled"
+	case errors.Is(err, errQueuedForRetry):
+		return event.MessageStatusTooOld, event.MessageStatusPending, false, false, err.Error()
 	case errors.Is(err, errMessageTakingLong):
 		return event.MessageStatusTooOld, event.MessageStatusPending, false, true, err.Error()
+	case errors.Is(err, errContentFilterFailed),
+		errors.Is(err, errAntivirusScanFailed),
+		errors.Is(err, errPortalQueueFull):
+		return event.MessageStatusGenericError, event.MessageStatusRetriable, true, true, err.Error()
+	case errors.Is(err, errSlackUnavailable):
+		return event.MessageStatusGenericError, event.MessageStatusPending, false, true, err.Error()
 	case errors.Is(err, errTargetNotFound),
 		errors.Is(err, errTargetIsFake),
 		errors.Is(err, errReactionDatabaseNotFound),
@@ -81,7 +150,7 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 }
 
 func (portal *Portal) sendErrorMessage(evt *event.Event, err error, confirmed bool, editID id.EventID) id.EventID {
-	if !portal.bridge.Config.Bridge.MessageErrorNotices {
+	if !portal.bridge.bridgeConfig().MessageErrorNotices || !portal.ErrorNotices {
 		return ""
 	}
 	certainty := "may not have been"
@@ -91,6 +160,8 @@ func (portal *Portal) sendErrorMessage(evt *event.Event, err error, confirmed bo
 	msg := fmt.Sprintf("\u26a0 Your message %s bridged: %v", certainty, err)
 	if errors.Is(err, errMessageTakingLong) {
 		msg = "\u26a0 Bridging your message is taking longer than usual"
+	} else if errors.Is(err, errSlackUnavailable) {
+		msg = "\u26a0 Slack is currently unavailable, your message will be sent when it recovers"
 	}
 	content := &event.MessageEventContent{
 		MsgType: event.MsgNotice,
@@ -110,7 +181,7 @@ func (portal *Portal) sendErrorMessage(evt *event.Event, err error, confirmed bo
 }
 
 func (portal *Portal) sendStatusEvent(evtID, lastRetry id.EventID, err error) {
-	if !portal.bridge.Config.Bridge.MessageStatusEvents {
+	if !portal.bridge.bridgeConfig().MessageStatusEvents {
 		return
 	}
 	if lastRetry == evtID {
@@ -136,6 +207,9 @@ func (portal *Portal) sendStatusEvent(evtID, lastRetry id.EventID, err error) {
 		content.Error = err.Error()
 	}
 	content.FillLegacyBooleans()
+	if !portal.bridge.statusBatcher.queueStatus(portal.MXID, intent, &content) {
+		return
+	}
 	_, err = intent.SendMessageEvent(portal.MXID, event.BeeperMessageStatus, &content)
 	if err != nil {
 		portal.log.Warnln("Failed to send message status event:", err)
@@ -143,7 +217,7 @@ func (portal *Portal) sendStatusEvent(evtID, lastRetry id.EventID, err error) {
 }
 
 func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
-	if portal.bridge.Config.Bridge.DeliveryReceipts {
+	if portal.bridge.bridgeConfig().DeliveryReceipts {
 		err := portal.bridge.Bot.MarkRead(portal.MXID, eventID)
 		if err != nil {
 			portal.log.Debugfln("Failed to send delivery receipt for %s: %v", eventID, err)
@@ -151,7 +225,17 @@ func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 	}
 }
 
-func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part string, ms *metricSender) {
+func (portal *Portal) sendMessageMetricsAsync(evt *event.Event, err error, part string) {
+	portal.bridge.backgroundSends.Add(1)
+	go func() {
+		defer portal.bridge.backgroundSends.Done()
+		portal.sendMessageMetrics(evt, err, part, true, nil)
+	}()
+}
+
+// sendMessageMetrics reports the result of handling a Matrix event. If final
+// is false, the event is still being handled, e.g. it's waiting for a retry.
+func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part string, final bool, ms *metricSender) {
 	var msgType string
 	switch evt.Type {
 	case event.EventMessage:
@@ -171,6 +255,14 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 	if retryMeta := evt.Content.AsMessage().MessageSendRetry; retryMeta != nil {
 		origEvtID = retryMeta.OriginalEventID
 	}
+	// Only final results count, so that a message that's still being retried doesn't look like a failure
+	if part != "Ignoring" && final {
+		portal.trackSendFailure(err)
+	}
+	// Ignored events would be ignored again, so only failed sends may be handled again if they're redelivered
+	if err == nil || part == "Ignoring" {
+		portal.bridge.DB.HandledEvent.MarkDone(evt.ID)
+	}
 	if err != nil {
 		level := log.LevelError
 		if part == "Ignoring" {
@@ -178,16 +270,20 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 		}
 		portal.log.Logfln(level, "%s %s %s from %s: %v", part, msgType, evtDescription, evt.Sender, err)
 		reason, statusCode, isCertain, sendNotice, _ := errorToStatusReason(err)
+		if part != "Ignoring" {
+			portal.bridge.countMatrixEventUsage(evt, err, statusCode)
+		}
 		checkpointStatus := status.ReasonToCheckpointStatus(reason, statusCode)
-		portal.bridge.SendMessageCheckpoint(evt, status.MsgStepRemote, err, checkpointStatus, ms.getRetryNum())
+		portal.bridge.sendMessageCheckpoint(evt, err, checkpointStatus, ms.getRetryNum())
 		if sendNotice {
 			ms.setNoticeID(portal.sendErrorMessage(evt, err, isCertain, ms.getNoticeID()))
 		}
 		portal.sendStatusEvent(origEvtID, evt.ID, err)
 	} else {
 		portal.log.Debugfln("Handled Matrix %s %s", msgType, evtDescription)
+		portal.bridge.countMatrixEventUsage(evt, nil, event.MessageStatusSuccess)
 		portal.sendDeliveryReceipt(evt.ID)
-		portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, ms.getRetryNum())
+		portal.bridge.sendMessageCheckpoint(evt, nil, status.MsgStatusSuccess, ms.getRetryNum())
 		portal.sendStatusEvent(origEvtID, evt.ID, nil)
 		if prevNotice := ms.popNoticeID(); prevNotice != "" {
 			_, _ = portal.MainIntent().RedactEvent(portal.MXID, prevNotice, mautrix.ReqRedact{
@@ -274,13 +370,23 @@ func (ms *metricSender) setNoticeID(evtID id.EventID) {
 	}
 }
 
+// sendMessageMetricsAsync sends the metrics in the background without
+// letting the bridge shut down before they've been sent.
+func (ms *metricSender) sendMessageMetricsAsync(evt *event.Event, err error, part string, completed bool) {
+	ms.portal.bridge.backgroundSends.Add(1)
+	go func() {
+		defer ms.portal.bridge.backgroundSends.Done()
+		ms.sendMessageMetrics(evt, err, part, completed)
+	}()
+}
+
 func (ms *metricSender) sendMessageMetrics(evt *event.Event, err error, part string, completed bool) {
 	ms.lock.Lock()
 	defer ms.lock.Unlock()
 	if !completed && ms.completed {
 		return
 	}
-	ms.portal.sendMessageMetrics(evt, err, part, ms)
+	ms.portal.sendMessageMetrics(evt, err, part, completed, ms)
 	ms.retryNum++
 	ms.completed = completed
 }
@@ -0,0 +1,458 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// Slack mrkdwn is converted to Matrix HTML in two steps: the text is split
+// into tokens, which are then parsed into a tree of formatting nodes that is
+// rendered to HTML. The text from Slack still has &, < and > escaped as HTML
+// entities, so text tokens are unescaped only when rendering.
+
+type mrkdwnTokenType int
+
+const (
+	mrkdwnTokenText mrkdwnTokenType = iota
+	// <...> tags: links, mentions, date tokens and other special commands
+	mrkdwnTokenTag
+	// One of * _ ~ ` which may start or end formatting
+	mrkdwnTokenDelimiter
+	// ``` which starts or ends a preformatted block
+	mrkdwnTokenCodeFence
+	// > at the start of a line, or >>> which quotes the rest of the message
+	mrkdwnTokenQuote
+	mrkdwnTokenQuoteRest
+	mrkdwnTokenNewline
+)
+
+type mrkdwnToken struct {
+	Type mrkdwnTokenType
+	// The original text of the token
+	Raw string
+
+	// For delimiters, whether the surrounding characters allow the delimiter
+	// to open or close formatting
+	CanOpen  bool
+	CanClose bool
+}
+
+const (
+	mrkdwnEscapedQuote     = "&gt;"
+	mrkdwnEscapedQuoteRest = "&gt;&gt;&gt;"
+)
+
+func isMrkdwnDelimiter(r rune) bool {
+	return r == '*' || r == '_' || r == '~' || r == '`'
+}
+
+// isMrkdwnBoundary checks whether a character next to a delimiter allows it
+// to start or end formatting. Formatting characters inside words, like in
+// snake_case_names, are not formatting. Underscores are still boundaries for
+// the other delimiters, so that formatting like _~this~_ can be nested.
+func isMrkdwnBoundary(r rune, delimiter byte) bool {
+	return r == utf8.RuneError || unicode.IsSpace(r) || (unicode.IsPunct(r) && (r != '_' || delimiter != '_')) || unicode.IsSymbol(r)
+}
+
+// tokenizeMrkdwn splits Slack mrkdwn into tokens.
+func tokenizeMrkdwn(text string) []mrkdwnToken {
+	var tokens []mrkdwnToken
+	var textStart int
+	flushText := func(end int) {
+		if end > textStart {
+			tokens = append(tokens, mrkdwnToken{Type: mrkdwnTokenText, Raw: text[textStart:end]})
+		}
+	}
+	lineStart := true
+	for i := 0; i < len(text); {
+		if lineStart {
+			lineStart = false
+			if strings.HasPrefix(text[i:], mrkdwnEscapedQuoteRest) || strings.HasPrefix(text[i:], ">>>") {
+				length := len(">>>")
+				if text[i] == '&' {
+					length = len(mrkdwnEscapedQuoteRest)
+				}
+				if i+length < len(text) && text[i+length] == ' ' {
+					length++
+				}
+				flushText(i)
+				tokens = append(tokens, mrkdwnToken{Type: mrkdwnTokenQuoteRest, Raw: text[i : i+length]})
+				i += length
+				textStart = i
+				continue
+			} else if strings.HasPrefix(text[i:], mrkdwnEscapedQuote) || text[i] == '>' {
+				length := 1
+				if text[i] == '&' {
+					length = len(mrkdwnEscapedQuote)
+				}
+				// The space after the quote marker isn't part of the quote
+				if i+length < len(text) && text[i+length] == ' ' {
+					length++
+				}
+				flushText(i)
+				tokens = append(tokens, mrkdwnToken{Type: mrkdwnTokenQuote, Raw: text[i : i+length]})
+				i += length
+				textStart = i
+				continue
+			}
+		}
+		switch {
+		case text[i] == '\n':
+			flushText(i)
+			tokens = append(tokens, mrkdwnToken{Type: mrkdwnTokenNewline, Raw: "\n"})
+			i++
+			textStart = i
+			lineStart = true
+		case text[i] == '<':
+			end := strings.IndexAny(text[i+1:], ">\n")
+			if end <= 0 || text[i+1+end] != '>' || text[i+1] == ' ' {
+				i++
+				continue
+			}
+			flushText(i)
+			tokens = append(tokens, mrkdwnToken{Type: mrkdwnTokenTag, Raw: text[i : i+end+2]})
+			i += end + 2
+			textStart = i
+		case strings.HasPrefix(text[i:], "```"):
+			flushText(i)
+			tokens = append(tokens, mrkdwnToken{Type: mrkdwnTokenCodeFence, Raw: "```"})
+			i += 3
+			textStart = i
+		case isMrkdwnDelimiter(rune(text[i])):
+			prev, _ := utf8.DecodeLastRuneInString(text[:i])
+			next, _ := utf8.DecodeRuneInString(text[i+1:])
+			token := mrkdwnToken{Type: mrkdwnTokenDelimiter, Raw: text[i : i+1]}
+			if text[i] == '`' {
+				// Code spans can start and end anywhere
+				token.CanOpen = next != utf8.RuneError
+				token.CanClose = prev != utf8.RuneError
+			} else {
+				token.CanOpen = isMrkdwnBoundary(prev, text[i]) && next != utf8.RuneError && !unicode.IsSpace(next)
+				token.CanClose = isMrkdwnBoundary(next, text[i]) && prev != utf8.RuneError && !unicode.IsSpace(prev)
+			}
+			flushText(i)
+			tokens = append(tokens, token)
+			i++
+			textStart = i
+		default:
+			i++
+		}
+	}
+	flushText(len(text))
+	return tokens
+}
+
+type mrkdwnNodeType int
+
+const (
+	mrkdwnNodeText mrkdwnNodeType = iota
+	mrkdwnNodeTag
+	mrkdwnNodeNewline
+	mrkdwnNodeBold
+	mrkdwnNodeItalic
+	mrkdwnNodeStrike
+	mrkdwnNodeCode
+	mrkdwnNodePre
+	mrkdwnNodeQuote
+)
+
+type mrkdwnNode struct {
+	Type     mrkdwnNodeType
+	Raw      string
+	Children []*mrkdwnNode
+}
+
+var mrkdwnDelimiterNodes = map[string]mrkdwnNodeType{
+	"*": mrkdwnNodeBold,
+	"_": mrkdwnNodeItalic,
+	"~": mrkdwnNodeStrike,
+}
+
+// parseMrkdwn parses mrkdwn tokens into a tree. Preformatted blocks are
+// found first, then quotes, and finally inline formatting within each line.
+func parseMrkdwn(tokens []mrkdwnToken) []*mrkdwnNode {
+	var nodes []*mrkdwnNode
+	var line []mrkdwnToken
+	var quote *mrkdwnNode
+	quoteRest := false
+	flushLine := func() {
+		inline := parseMrkdwnInline(line)
+		line = nil
+		if quote != nil {
+			quote.Children = append(quote.Children, inline...)
+		} else {
+			nodes = append(nodes, inline...)
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch token.Type {
+		case mrkdwnTokenCodeFence:
+			end := -1
+			for j := i + 1; j < len(tokens); j++ {
+				if tokens[j].Type == mrkdwnTokenCodeFence {
+					end = j
+					break
+				}
+			}
+			if end == -1 {
+				line = append(line, mrkdwnToken{Type: mrkdwnTokenText, Raw: token.Raw})
+				continue
+			}
+			flushLine()
+			var raw strings.Builder
+			for _, inner := range tokens[i+1 : end] {
+				raw.WriteString(inner.Raw)
+			}
+			pre := &mrkdwnNode{Type: mrkdwnNodePre, Raw: strings.Trim(raw.String(), "\n")}
+			if quote != nil {
+				quote.Children = append(quote.Children, pre)
+			} else {
+				nodes = append(nodes, pre)
+			}
+			i = end
+			// The newline after a preformatted block is implied by the block
+			if i+1 < len(tokens) && tokens[i+1].Type == mrkdwnTokenNewline {
+				i++
+			}
+		case mrkdwnTokenQuote, mrkdwnTokenQuoteRest:
+			if quote == nil {
+				quote = &mrkdwnNode{Type: mrkdwnNodeQuote}
+				nodes = append(nodes, quote)
+			}
+			quoteRest = quoteRest || token.Type == mrkdwnTokenQuoteRest
+		case mrkdwnTokenNewline:
+			flushLine()
+			nextIsQuote := i+1 < len(tokens) && (tokens[i+1].Type == mrkdwnTokenQuote || tokens[i+1].Type == mrkdwnTokenQuoteRest)
+			if quote != nil && !quoteRest && !nextIsQuote {
+				// The newline ends the quote
+				quote = nil
+			} else if quote != nil && i+1 < len(tokens) {
+				quote.Children = append(quote.Children, &mrkdwnNode{Type: mrkdwnNodeNewline})
+			} else if quote == nil {
+				nodes = append(nodes, &mrkdwnNode{Type: mrkdwnNodeNewline})
+			}
+		default:
+			line = append(line, token)
+		}
+	}
+	flushLine()
+	return nodes
+}
+
+// parseMrkdwnInline parses the formatting within a single line. Delimiters
+// that don't have a matching pair are kept as text, and code spans contain
+// their content as-is.
+func parseMrkdwnInline(tokens []mrkdwnToken) []*mrkdwnNode {
+	type openDelimiter struct {
+		delimiter string
+		// Index in nodes where the content of the formatting starts
+		start int
+	}
+	var nodes []*mrkdwnNode
+	var stack []openDelimiter
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch token.Type {
+		case mrkdwnTokenTag:
+			nodes = append(nodes, &mrkdwnNode{Type: mrkdwnNodeTag, Raw: token.Raw})
+			continue
+		case mrkdwnTokenDelimiter:
+		default:
+			nodes = append(nodes, &mrkdwnNode{Type: mrkdwnNodeText, Raw: token.Raw})
+			continue
+		}
+
+		if token.Raw == "`" && token.CanOpen {
+			end := -1
+			for j := i + 1; j < len(tokens); j++ {
+				if tokens[j].Type == mrkdwnTokenDelimiter && tokens[j].Raw == "`" && tokens[j].CanClose {
+					end = j
+					break
+				}
+			}
+			if end > i+1 {
+				var raw strings.Builder
+				for _, inner := range tokens[i+1 : end] {
+					raw.WriteString(inner.Raw)
+				}
+				nodes = append(nodes, &mrkdwnNode{Type: mrkdwnNodeCode, Raw: raw.String()})
+				i = end
+				continue
+			}
+		}
+
+		closed := false
+		if token.CanClose {
+			for j := len(stack) - 1; j >= 0; j-- {
+				if stack[j].delimiter != token.Raw {
+					continue
+				}
+				start := stack[j].start
+				if start == len(nodes) {
+					// Empty formatting like ** is just text
+					break
+				}
+				// Delimiters opened after this one can't be closed anymore
+				for _, unclosed := range stack[j+1:] {
+					nodes[unclosed.start-1].Type = mrkdwnNodeText
+				}
+				children := make([]*mrkdwnNode, len(nodes)-start)
+				copy(children, nodes[start:])
+				nodes = append(nodes[:start-1], &mrkdwnNode{Type: mrkdwnDelimiterNodes[token.Raw], Children: children})
+				stack = stack[:j]
+				closed = true
+				break
+			}
+		}
+		if closed {
+			continue
+		}
+		// The delimiter is kept as a text node, which becomes the formatting node if it's closed later
+		nodes = append(nodes, &mrkdwnNode{Type: mrkdwnNodeText, Raw: token.Raw})
+		if _, ok := mrkdwnDelimiterNodes[token.Raw]; ok && token.CanOpen {
+			alreadyOpen := false
+			for _, open := range stack {
+				alreadyOpen = alreadyOpen || open.delimiter == token.Raw
+			}
+			// The same formatting can't be nested
+			if !alreadyOpen {
+				stack = append(stack, openDelimiter{delimiter: token.Raw, start: len(nodes)})
+			}
+		}
+	}
+	return nodes
+}
+
+// mrkdwnToHTML converts Slack mrkdwn into Matrix HTML.
+func (portal *Portal) mrkdwnToHTML(text string) string {
+	var out strings.Builder
+	portal.renderMrkdwnNodes(&out, parseMrkdwn(tokenizeMrkdwn(text)))
+	return out.String()
+}
+
+func (portal *Portal) renderMrkdwnNodes(out *strings.Builder, nodes []*mrkdwnNode) {
+	for _, node := range nodes {
+		switch node.Type {
+		case mrkdwnNodeText:
+			out.WriteString(html.EscapeString(replaceShortcodesWithEmojis(html.UnescapeString(node.Raw))))
+		case mrkdwnNodeTag:
+			out.WriteString(portal.renderSlackTag(node.Raw))
+		case mrkdwnNodeNewline:
+			out.WriteString("<br>")
+		case mrkdwnNodeBold:
+			out.WriteString("<strong>")
+			portal.renderMrkdwnNodes(out, node.Children)
+			out.WriteString("</strong>")
+		case mrkdwnNodeItalic:
+			out.WriteString("<em>")
+			portal.renderMrkdwnNodes(out, node.Children)
+			out.WriteString("</em>")
+		case mrkdwnNodeStrike:
+			out.WriteString("<del>")
+			portal.renderMrkdwnNodes(out, node.Children)
+			out.WriteString("</del>")
+		case mrkdwnNodeCode:
+			out.WriteString("<code>")
+			out.WriteString(html.EscapeString(html.UnescapeString(node.Raw)))
+			out.WriteString("</code>")
+		case mrkdwnNodePre:
+			out.WriteString("<pre><code>")
+			out.WriteString(html.EscapeString(html.UnescapeString(node.Raw)))
+			out.WriteString("</code></pre>")
+		case mrkdwnNodeQuote:
+			out.WriteString("<blockquote>")
+			portal.renderMrkdwnNodes(out, node.Children)
+			out.WriteString("</blockquote>")
+		}
+	}
+}
+
+// splitSlackTag splits the content of a <...> tag into the target and the
+// label. The label comes after the last pipe, as URLs may contain pipes but
+// mention IDs don't.
+func splitSlackTag(tag string) (target, label string) {
+	content := strings.TrimSuffix(strings.TrimPrefix(tag, "<"), ">")
+	if idx := strings.LastIndexByte(content, '|'); idx >= 0 {
+		return content[:idx], html.UnescapeString(content[idx+1:])
+	}
+	return content, ""
+}
+
+// renderSlackTag renders a <...> tag from Slack mrkdwn as HTML. See
+// https://api.slack.com/reference/surfaces/formatting#retrieving-messages
+func (portal *Portal) renderSlackTag(tag string) string {
+	target, label := splitSlackTag(tag)
+	switch {
+	case strings.HasPrefix(target, "@"):
+		userID := target[1:]
+		puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, userID)
+		if puppet != nil && puppet.MXID != "" {
+			return fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, puppet.MXID, html.EscapeString(puppet.Name))
+		} else if label != "" {
+			return "@" + html.EscapeString(label)
+		}
+		return "@" + html.EscapeString(userID)
+	case strings.HasPrefix(target, "#"):
+		channelID := target[1:]
+		portalInfo := portal.bridge.DB.Portal.GetByID(database.PortalKey{TeamID: portal.Key.TeamID, ChannelID: channelID})
+		if portalInfo != nil && portalInfo.MXID != "" {
+			return fmt.Sprintf(`<a href="https://matrix.to/#/%s?via=%s">%s</a>`, portalInfo.MXID, portal.bridge.AS.HomeserverDomain, html.EscapeString(portalInfo.Name))
+		} else if label != "" {
+			return "#" + html.EscapeString(label)
+		}
+		return "#" + html.EscapeString(channelID)
+	case strings.HasPrefix(target, "!"):
+		return portal.renderSlackSpecialTag(target[1:], label)
+	default:
+		url := html.UnescapeString(target)
+		if label == "" {
+			label = strings.TrimPrefix(url, "mailto:")
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), html.EscapeString(label))
+	}
+}
+
+// renderSlackSpecialTag renders <!...> tags, which are mentions of groups of
+// users and other commands.
+func (portal *Portal) renderSlackSpecialTag(command, label string) string {
+	name, args, _ := strings.Cut(command, "^")
+	switch name {
+	case "here", "channel", "everyone":
+		return "@" + name
+	case "subteam":
+		if label != "" {
+			return html.EscapeString(label)
+		}
+		return "@" + html.EscapeString(portal.getUsergroupHandle(args))
+	case "date":
+		return portal.renderSlackDate(args, label)
+	default:
+		// Unknown commands are shown with their fallback text
+		if label != "" {
+			return html.EscapeString(label)
+		}
+		return html.EscapeString("<!" + html.UnescapeString(command) + ">")
+	}
+}
@@ -0,0 +1,157 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/mautrix-slack/config"
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// newMrkdwnTestPortal creates a portal that can render mrkdwn without a
+// database. The only known user is U1 (Alice), who is already in the puppet
+// cache.
+func newMrkdwnTestPortal() *Portal {
+	br := &SlackBridge{
+		Config:      &config.Config{},
+		puppets:     newPuppetCache(),
+		puppetLoads: make(map[string]*puppetLoad),
+	}
+	br.puppets.put(&Puppet{
+		Puppet: &database.Puppet{TeamID: "T1", UserID: "U1", Name: "Alice"},
+		MXID:   "@slack_t1-u1:example.com",
+	}, 0)
+	return &Portal{
+		Portal: &database.Portal{Key: database.PortalKey{TeamID: "T1", ChannelID: "C1"}},
+		bridge: br,
+		log:    log.Sub("Test"),
+	}
+}
+
+func TestMrkdwnToHTML(t *testing.T) {
+	portal := newMrkdwnTestPortal()
+	tests := []struct {
+		name     string
+		mrkdwn   string
+		expected string
+	}{
+		{"plain text", "hello world", "hello world"},
+		{"newline", "line 1\nline 2", "line 1<br>line 2"},
+
+		{"bold", "*bold*", "<strong>bold</strong>"},
+		{"italic", "_italic_", "<em>italic</em>"},
+		{"strikethrough", "~strike~", "<del>strike</del>"},
+		{"code", "`code`", "<code>code</code>"},
+		{"formatting in sentence", "a *b* c", "a <strong>b</strong> c"},
+		{"formatting next to punctuation", "(*b*).", "(<strong>b</strong>)."},
+
+		{"nested formatting", "*bold _italic_*", "<strong>bold <em>italic</em></strong>"},
+		{"deeply nested formatting", "*_~all~_*", "<strong><em><del>all</del></em></strong>"},
+		{"strikethrough around italic", "~_a_~", "<del><em>a</em></del>"},
+		{"same formatting isn't nested", "*a *b* c*", "<strong>a *b</strong> c*"},
+		{"overlapping formatting", "*a _b* c_", "<strong>a _b</strong> c_"},
+		{"formatting doesn't span lines", "*a\nb*", "*a<br>b*"},
+
+		{"unclosed delimiter", "*not bold", "*not bold"},
+		{"empty formatting", "**", "**"},
+		{"delimiter inside word", "snake_case_name", "snake_case_name"},
+		{"italic with underscores inside", "_snake_case_", "<em>snake_case</em>"},
+		{"multiplication", "2*3*4", "2*3*4"},
+		{"delimiter followed by space", "* not bold *", "* not bold *"},
+		{"formatting inside code", "`*not bold*`", "<code>*not bold*</code>"},
+		{"code inside word", "a`b`c", "a<code>b</code>c"},
+
+		{"escaped entities", "a &lt; b &amp;&amp; c &gt; d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"escaped tag isn't a tag", "&lt;@U1&gt;", "&lt;@U1&gt;"},
+		{"escaped entities in code", "`&lt;b&gt;`", "<code>&lt;b&gt;</code>"},
+		{"html in text", "<b>", `<a href="b">b</a>`},
+		{"unmatched angle bracket", "a < b", "a &lt; b"},
+
+		{"preformatted", "```code\nblock```", "<pre><code>code\nblock</code></pre>"},
+		{"formatting inside preformatted", "```*a* _b_```", "<pre><code>*a* _b_</code></pre>"},
+		{"text around preformatted", "before\n```code```\nafter", "before<br><pre><code>code</code></pre>after"},
+		{"unclosed preformatted", "```code", "```code"},
+
+		{"quote", "&gt; quoted", "<blockquote>quoted</blockquote>"},
+		{"quote ends at newline", "&gt; quoted\nnot quoted", "<blockquote>quoted</blockquote>not quoted"},
+		{"multiline quote", "&gt; a\n&gt; b", "<blockquote>a<br>b</blockquote>"},
+		{"quote rest", "&gt;&gt;&gt; a\nb", "<blockquote>a<br>b</blockquote>"},
+		{"formatting in quote", "&gt; *bold*", "<blockquote><strong>bold</strong></blockquote>"},
+		{"quote marker in middle of line", "a &gt; b", "a &gt; b"},
+
+		{"url", "<https://example.com>", `<a href="https://example.com">https://example.com</a>`},
+		{"url with label", "<https://example.com|Example>", `<a href="https://example.com">Example</a>`},
+		{"url with pipe", "<https://example.com/?a=b|c|Label>", `<a href="https://example.com/?a=b|c">Label</a>`},
+		{"url with escaped query", "<https://example.com/?a=1&amp;b=2>", `<a href="https://example.com/?a=1&amp;b=2">https://example.com/?a=1&amp;b=2</a>`},
+		{"url with formatting characters", "<https://example.com/a_b_c|a_b_c>", `<a href="https://example.com/a_b_c">a_b_c</a>`},
+		{"formatted url", "*<https://example.com|bold link>*", `<strong><a href="https://example.com">bold link</a></strong>`},
+		{"mailto", "<mailto:a@example.com|a@example.com>", `<a href="mailto:a@example.com">a@example.com</a>`},
+		{"mailto without label", "<mailto:a@example.com>", `<a href="mailto:a@example.com">a@example.com</a>`},
+
+		{"user mention", "<@U1>", `<a href="https://matrix.to/#/@slack_t1-u1:example.com">Alice</a>`},
+		{"user mention with label", "<@U1|alice>", `<a href="https://matrix.to/#/@slack_t1-u1:example.com">Alice</a>`},
+		{"user mention in formatting", "*hi <@U1>*", `<strong>hi <a href="https://matrix.to/#/@slack_t1-u1:example.com">Alice</a></strong>`},
+		{"here mention", "<!here>", "@here"},
+		{"channel mention", "<!channel>", "@channel"},
+		{"everyone mention", "<!everyone|everyone>", "@everyone"},
+		{"usergroup mention with label", "<!subteam^S1|@devs>", "@devs"},
+		{"unknown command", "<!foo>", "&lt;!foo&gt;"},
+		{"unknown command with label", "<!foo|bar>", "bar"},
+
+		{"date", "<!date^0^{date_num}|fallback>", "1970-01-01"},
+		{"date with link", "<!date^0^{date_num}^https://example.com|fallback>", `<a href="https://example.com">1970-01-01</a>`},
+		{"invalid date", "<!date^abc^{date_num}|fallback>", "fallback"},
+		{"date without label", "<!date^abc^{date_num}>", "&lt;!date^abc^{date_num}&gt;"},
+
+		{"emoji", ":thumbsup:", "\U0001F44D"},
+		{"emoji in formatting", "*:thumbsup:*", "<strong>\U0001F44D</strong>"},
+		{"emoji in code", "`:thumbsup:`", "<code>:thumbsup:</code>"},
+		{"unknown emoji", ":not_an_emoji_name:", ":not_an_emoji_name:"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := portal.mrkdwnToHTML(test.mrkdwn)
+			if actual != test.expected {
+				t.Errorf("mrkdwnToHTML(%q):\n  expected %q\n       got %q", test.mrkdwn, test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSplitSlackTag(t *testing.T) {
+	tests := []struct {
+		tag    string
+		target string
+		label  string
+	}{
+		{"<@U1>", "@U1", ""},
+		{"<@U1|alice>", "@U1", "alice"},
+		{"<#C1|general>", "#C1", "general"},
+		{"<https://example.com|a &amp; b>", "https://example.com", "a & b"},
+		{"<https://example.com/?x=a|b|label>", "https://example.com/?x=a|b", "label"},
+		{"<!subteam^S1|@devs>", "!subteam^S1", "@devs"},
+	}
+	for _, test := range tests {
+		target, label := splitSlackTag(test.tag)
+		if target != test.target || label != test.label {
+			t.Errorf("splitSlackTag(%q): expected (%q, %q), got (%q, %q)", test.tag, test.target, test.label, target, label)
+		}
+	}
+}
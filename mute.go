@@ -0,0 +1,231 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const slackMutedChannelsPref = "muted_channels"
+
+func parseMutedChannels(pref string) map[string]bool {
+	muted := make(map[string]bool)
+	for _, channelID := range strings.Split(pref, ",") {
+		if channelID = strings.TrimSpace(channelID); channelID != "" {
+			muted[channelID] = true
+		}
+	}
+	return muted
+}
+
+// getSlackMutedChannels fetches the muted channels of the user in the team
+// and remembers them for getCachedSlackMutedChannels.
+func (user *User) getSlackMutedChannels(ctx context.Context, userTeam *database.UserTeam) (map[string]bool, error) {
+	prefs, err := userTeam.Client.GetUserPrefsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mutedChannels := parseMutedChannels(prefs.UserPrefs.MutedChannels)
+	user.cacheSlackMutedChannels(userTeam.Key.TeamID, mutedChannels)
+	return mutedChannels, nil
+}
+
+func (user *User) cacheSlackMutedChannels(teamID string, mutedChannels map[string]bool) {
+	cached := make(map[string]bool, len(mutedChannels))
+	for channelID := range mutedChannels {
+		cached[channelID] = true
+	}
+	user.slackMutesLock.Lock()
+	user.slackMutes[teamID] = cached
+	user.slackMutesLock.Unlock()
+}
+
+// getCachedSlackMutedChannels returns the muted channels of the user in the
+// team from the last fetch or pref_change event, and only calls Slack if
+// they haven't been fetched yet.
+func (user *User) getCachedSlackMutedChannels(userTeam *database.UserTeam) (map[string]bool, error) {
+	user.slackMutesLock.Lock()
+	cached, ok := user.slackMutes[userTeam.Key.TeamID]
+	user.slackMutesLock.Unlock()
+	if ok {
+		return cached, nil
+	}
+	return user.getSlackMutedChannels(context.TODO(), userTeam)
+}
+
+// setSlackChannelMuted adds or removes the channel from the muted_channels
+// pref of the user. The pref is a single comma-separated list, so the current
+// value has to be fetched first, and changes of the same user are done one at
+// a time so that they don't overwrite each other.
+func (user *User) setSlackChannelMuted(userTeam *database.UserTeam, channelID string, muted bool) error {
+	user.slackMutesSetLock.Lock()
+	defer user.slackMutesSetLock.Unlock()
+	mutedChannels, err := user.getSlackMutedChannels(context.TODO(), userTeam)
+	if err != nil {
+		return err
+	} else if mutedChannels[channelID] == muted {
+		return nil
+	}
+	if muted {
+		mutedChannels[channelID] = true
+	} else {
+		delete(mutedChannels, channelID)
+	}
+	channelIDs := make([]string, 0, len(mutedChannels))
+	for mutedID := range mutedChannels {
+		channelIDs = append(channelIDs, mutedID)
+	}
+	sort.Strings(channelIDs)
+	values := url.Values{
+		"name":  {slackMutedChannelsPref},
+		"value": {strings.Join(channelIDs, ",")},
+	}
+	var resp slack.SlackResponse
+	err = user.bridge.callSlackMethod(context.TODO(), userTeam, "users.prefs.set", values, &resp)
+	if err != nil {
+		return err
+	}
+	user.cacheSlackMutedChannels(userTeam.Key.TeamID, mutedChannels)
+	return nil
+}
+
+// setMuted mutes or unmutes the portal with a room push rule through the
+// double puppet of the user.
+func (user *User) setMuted(portal *Portal, muted bool) {
+	if portal.MXID == "" {
+		return
+	}
+	user.mutesLock.Lock()
+	known, ok := user.mutes[portal.MXID]
+	user.mutes[portal.MXID] = muted
+	user.mutesLock.Unlock()
+	if !ok || known != muted {
+		user.updateChatMute(portal, muted)
+	}
+}
+
+// applySlackMutedChannels mutes the rooms of all channels in the given set and
+// unmutes the rooms of all other channels of the team.
+func (user *User) applySlackMutedChannels(userTeam *database.UserTeam, mutedChannels map[string]bool) {
+	for _, dbPortal := range user.bridge.DB.Portal.GetAllForUserTeam(userTeam.Key) {
+		portal := user.bridge.GetPortalByID(dbPortal.Key)
+		user.setMuted(portal, mutedChannels[portal.Key.ChannelID])
+	}
+}
+
+// syncMutes makes the room push rules of the double puppet match the muted
+// channels in Slack. Slack is treated as the source of truth, so rooms muted
+// in Matrix while the bridge was offline get unmuted.
+func (user *User) syncMutes(userTeam *database.UserTeam) {
+	if !user.bridge.bridgeConfig().SyncMutes || user.doublePuppetIntent() == nil {
+		return
+	}
+	mutedChannels, err := user.getSlackMutedChannels(withBackgroundPriority(context.Background()), userTeam)
+	if err != nil {
+		user.log.Warnfln("Failed to get muted channels of %s: %v", userTeam.Key, err)
+		return
+	}
+	user.applySlackMutedChannels(userTeam, mutedChannels)
+}
+
+// isPortalMuted returns whether the new room of the portal should be muted
+// for the user when it's created.
+func (user *User) isPortalMuted(userTeam *database.UserTeam, portal *Portal) bool {
+	if !user.bridge.bridgeConfig().SyncMutes {
+		return portal.Type == database.ChannelTypeChannel
+	}
+	mutedChannels, err := user.getCachedSlackMutedChannels(userTeam)
+	if err != nil {
+		portal.log.Warnfln("Failed to get muted channels of %s: %v", userTeam.Key, err)
+		return false
+	}
+	return mutedChannels[portal.Key.ChannelID]
+}
+
+func (user *User) handleSlackPrefChange(userTeam *database.UserTeam, evt *slack.PrefChangeEvent) {
+	if evt.Name != slackMutedChannelsPref || !user.bridge.bridgeConfig().SyncMutes {
+		return
+	}
+	var value string
+	err := json.Unmarshal(evt.Value, &value)
+	if err != nil {
+		user.log.Warnfln("Failed to parse muted channels pref change in %s: %v", userTeam.Key, err)
+		return
+	}
+	mutedChannels := parseMutedChannels(value)
+	user.cacheSlackMutedChannels(userTeam.Key.TeamID, mutedChannels)
+	user.applySlackMutedChannels(userTeam, mutedChannels)
+}
+
+func isRoomMuted(rules *pushrules.PushRuleset, roomID id.RoomID) bool {
+	rule, ok := rules.Room.Map[string(roomID)]
+	return ok && rule.Enabled && !rule.Actions.Should().Notify
+}
+
+// handleMatrixPushRules mutes or unmutes channels in Slack when the user
+// changes the room push rules of portals in Matrix. Push rules are received
+// through the sync of the double puppet.
+func (user *User) handleMatrixPushRules(rules *pushrules.PushRuleset) {
+	if rules == nil {
+		return
+	}
+	rooms := make(map[id.RoomID]struct{})
+	for ruleID := range rules.Room.Map {
+		rooms[id.RoomID(ruleID)] = struct{}{}
+	}
+	user.mutesLock.Lock()
+	for roomID, muted := range user.mutes {
+		if muted {
+			rooms[roomID] = struct{}{}
+		}
+	}
+	user.mutesLock.Unlock()
+
+	for roomID := range rooms {
+		portal := user.bridge.GetPortalByMXID(roomID)
+		if portal == nil {
+			continue
+		}
+		userTeam := user.GetUserTeam(portal.Key.TeamID)
+		if userTeam == nil || userTeam.Client == nil {
+			continue
+		}
+		muted := isRoomMuted(rules, roomID)
+		user.mutesLock.Lock()
+		known := user.mutes[roomID]
+		user.mutes[roomID] = muted
+		user.mutesLock.Unlock()
+		if known == muted {
+			continue
+		}
+		err := user.setSlackChannelMuted(userTeam, portal.Key.ChannelID, muted)
+		if err != nil {
+			portal.log.Warnfln("Failed to update Slack mute of %s: %v", user.MXID, err)
+		}
+	}
+}
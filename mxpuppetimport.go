@@ -0,0 +1,382 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// mxPuppetImporter moves an mx-puppet-slack deployment over to this bridge.
+// mx-puppet-slack identifies rooms and users as "<team ID>-<Slack ID>", which
+// maps directly onto the portal and puppet keys used here. The old bridge's
+// registration is used to act as its bot and ghosts, so that the existing
+// rooms can be handed over to this bridge's bot.
+type mxPuppetImporter struct {
+	br    *SlackBridge
+	oldDB *dbutil.Database
+	reg   *appservice.Registration
+
+	// Matrix room IDs of the old bridge's rooms, by their remote ID
+	rooms map[string]id.RoomID
+	// Slack user IDs of the old bridge's ghosts, by their remote ID
+	users map[string]string
+
+	portals, puppets, messages, ghostsRemoved int
+}
+
+func (br *SlackBridge) importMXPuppetAndExit(dbURI, registrationPath string) {
+	err := br.importMXPuppet(dbURI, registrationPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to import from mx-puppet-slack:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func (br *SlackBridge) importMXPuppet(dbURI, registrationPath string) error {
+	reg, err := appservice.LoadRegistration(registrationPath)
+	if err != nil {
+		return fmt.Errorf("failed to read registration: %w", err)
+	}
+	dialect := "sqlite3"
+	if strings.HasPrefix(dbURI, "postgres://") || strings.HasPrefix(dbURI, "postgresql://") {
+		dialect = "postgres"
+	}
+	oldDB, err := dbutil.NewWithDialect(dbURI, dialect)
+	if err != nil {
+		return fmt.Errorf("failed to open mx-puppet-slack database: %w", err)
+	}
+	defer oldDB.RawDB.Close()
+	err = br.DB.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade database: %w", err)
+	}
+
+	importer := &mxPuppetImporter{
+		br:    br,
+		oldDB: oldDB,
+		reg:   reg,
+		rooms: make(map[string]id.RoomID),
+		users: make(map[string]string),
+	}
+	if err = importer.importRooms(); err != nil {
+		return err
+	} else if err = importer.importUsers(); err != nil {
+		return err
+	} else if err = importer.importMessages(); err != nil {
+		return err
+	} else if err = importer.removeOldGhosts(); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d rooms, %d ghosts and %d messages, removed %d old ghosts from rooms\n",
+		importer.portals, importer.puppets, importer.messages, importer.ghostsRemoved)
+	return nil
+}
+
+// splitMXPuppetID splits an mx-puppet-slack remote ID into the team and
+// Slack IDs.
+func splitMXPuppetID(remoteID string) (teamID, slackID string, ok bool) {
+	parts := strings.SplitN(remoteID, "-", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return strings.ToUpper(parts[0]), strings.ToUpper(parts[1]), true
+}
+
+// oldClient returns a client that acts as the given user of the old bridge,
+// or as its bot if userID is empty.
+func (imp *mxPuppetImporter) oldClient(userID id.UserID) (*mautrix.Client, error) {
+	botMXID := id.NewUserID(imp.reg.SenderLocalpart, imp.br.Config.Homeserver.Domain)
+	client, err := mautrix.NewClient(imp.br.Config.Homeserver.Address, botMXID, imp.reg.AppToken)
+	if err != nil {
+		return nil, err
+	}
+	if userID != "" {
+		client.UserID = userID
+		client.AppServiceUserID = userID
+	}
+	return client, nil
+}
+
+func (imp *mxPuppetImporter) importRooms() error {
+	rows, err := imp.oldDB.Query("SELECT room_id, mx_id, name, topic FROM chan_store")
+	if err != nil {
+		return fmt.Errorf("failed to query rooms: %w", err)
+	}
+	defer rows.Close()
+	oldBot, err := imp.oldClient("")
+	if err != nil {
+		return fmt.Errorf("failed to create client for old bot: %w", err)
+	}
+	log := imp.br.Log.Sub("MXPuppetImport")
+	for rows.Next() {
+		var remoteID string
+		var roomID id.RoomID
+		var name, topic *string
+		if err = rows.Scan(&remoteID, &roomID, &name, &topic); err != nil {
+			return fmt.Errorf("failed to scan room: %w", err)
+		}
+		teamID, channelID, ok := splitMXPuppetID(remoteID)
+		if !ok || roomID == "" {
+			log.Warnfln("Skipping room %q (%s) with an unexpected ID", remoteID, roomID)
+			continue
+		}
+		imp.rooms[remoteID] = roomID
+		portal := imp.br.GetPortalByID(database.PortalKey{TeamID: teamID, ChannelID: channelID})
+		if portal.MXID != "" {
+			log.Infofln("%s already has a portal (%s), skipping %s", portal.Key, portal.MXID, roomID)
+			continue
+		}
+		// The old bot has to let our bot in and give it the same power level
+		_, err = oldBot.InviteUser(roomID, &mautrix.ReqInviteUser{UserID: imp.br.Bot.UserID})
+		if err != nil && !strings.Contains(err.Error(), "already in the room") {
+			log.Warnfln("Failed to invite bot to %s: %v", roomID, err)
+		}
+		if err = imp.br.Bot.EnsureJoined(roomID); err != nil {
+			log.Warnfln("Failed to join %s, skipping it: %v", roomID, err)
+			continue
+		}
+		imp.copyBotPowerLevel(oldBot, roomID)
+		portal.MXID = roomID
+		if name != nil {
+			portal.Name = *name
+			portal.NameSet = true
+		}
+		if topic != nil {
+			portal.Topic = *topic
+			portal.TopicSet = true
+		}
+		portal.Update(nil)
+		imp.portals++
+	}
+	return rows.Err()
+}
+
+func (imp *mxPuppetImporter) copyBotPowerLevel(oldBot *mautrix.Client, roomID id.RoomID) {
+	var levels event.PowerLevelsEventContent
+	err := oldBot.StateEvent(roomID, event.StatePowerLevels, "", &levels)
+	if err != nil {
+		imp.br.Log.Warnfln("Failed to get power levels of %s: %v", roomID, err)
+		return
+	}
+	level := levels.GetUserLevel(oldBot.UserID)
+	if levels.GetUserLevel(imp.br.Bot.UserID) >= level {
+		return
+	}
+	levels.SetUserLevel(imp.br.Bot.UserID, level)
+	_, err = oldBot.SendStateEvent(roomID, event.StatePowerLevels, "", &levels)
+	if err != nil {
+		imp.br.Log.Warnfln("Failed to give the bot power in %s: %v", roomID, err)
+	}
+}
+
+func (imp *mxPuppetImporter) importUsers() error {
+	rows, err := imp.oldDB.Query("SELECT user_id, name, avatar_mxc FROM user_store")
+	if err != nil {
+		return fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+	log := imp.br.Log.Sub("MXPuppetImport")
+	for rows.Next() {
+		var remoteID string
+		var name, avatarMXC *string
+		if err = rows.Scan(&remoteID, &name, &avatarMXC); err != nil {
+			return fmt.Errorf("failed to scan user: %w", err)
+		}
+		teamID, userID, ok := splitMXPuppetID(remoteID)
+		if !ok {
+			log.Warnfln("Skipping user %q with an unexpected ID", remoteID)
+			continue
+		}
+		imp.users[strings.ToLower(remoteID)] = userID
+		puppet := imp.br.GetPuppetByID(teamID, userID)
+		if puppet.NameSet {
+			continue
+		}
+		intent := puppet.DefaultIntent()
+		if err = intent.EnsureRegistered(); err != nil {
+			log.Warnfln("Failed to register %s: %v", puppet.MXID, err)
+			continue
+		}
+		if name != nil && *name != "" {
+			if err = intent.SetDisplayName(*name); err != nil {
+				log.Warnfln("Failed to set displayname of %s: %v", puppet.MXID, err)
+			} else {
+				puppet.Name = *name
+				puppet.NameSet = true
+			}
+		}
+		if avatarMXC != nil && *avatarMXC != "" {
+			if avatarURL, err := id.ParseContentURI(*avatarMXC); err == nil && intent.SetAvatarURL(avatarURL) == nil {
+				// Avatar is left empty so the next sync replaces this with the current Slack avatar
+				puppet.AvatarURL = avatarURL
+				puppet.AvatarSet = true
+			}
+		}
+		puppet.Update(nil)
+		imp.puppets++
+	}
+	return rows.Err()
+}
+
+func (imp *mxPuppetImporter) importMessages() error {
+	rows, err := imp.oldDB.Query("SELECT room_id, matrix_id, remote_id FROM event_store")
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+	oldBot, err := imp.oldClient("")
+	if err != nil {
+		return fmt.Errorf("failed to create client for old bot: %w", err)
+	}
+	log := imp.br.Log.Sub("MXPuppetImport")
+	// Slack messages that were bridged as multiple Matrix events have a row
+	// for each event, which become the parts of the message
+	parts := make(map[database.PortalKey]map[string]int)
+	for rows.Next() {
+		var remoteRoomID, slackID string
+		var eventID id.EventID
+		if err = rows.Scan(&remoteRoomID, &eventID, &slackID); err != nil {
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		teamID, channelID, ok := splitMXPuppetID(remoteRoomID)
+		roomID, roomImported := imp.rooms[remoteRoomID]
+		if !ok || !roomImported || slackID == "" {
+			continue
+		}
+		key := database.PortalKey{TeamID: teamID, ChannelID: channelID}
+		if imp.br.DB.Message.GetByMatrixID(key, eventID) != nil {
+			continue
+		}
+		authorID := imp.messageAuthor(oldBot, roomID, eventID, teamID)
+		if authorID == "" {
+			log.Warnfln("Skipping %s in %s: couldn't find the Slack user who sent it", eventID, roomID)
+			continue
+		}
+		if parts[key] == nil {
+			parts[key] = make(map[string]int)
+		}
+		partIndex, seen := parts[key][slackID]
+		if !seen {
+			partIndex = len(imp.br.DB.Message.GetAllBySlackID(key, slackID))
+		}
+		parts[key][slackID] = partIndex + 1
+		msg := imp.br.DB.Message.New()
+		msg.Channel = key
+		msg.SlackID = slackID
+		msg.MatrixID = eventID
+		msg.AuthorID = authorID
+		msg.PartIndex = partIndex
+		msg.Insert(nil)
+		imp.messages++
+	}
+	return rows.Err()
+}
+
+// messageAuthor finds the Slack user who sent an imported message. The old
+// bridge doesn't store the sender, so it's taken from the Matrix event: its
+// ghosts are mapped back to their Slack users, and Matrix users to the Slack
+// account they're logged into the team with on this bridge.
+func (imp *mxPuppetImporter) messageAuthor(oldBot *mautrix.Client, roomID id.RoomID, eventID id.EventID, teamID string) string {
+	evt, err := oldBot.GetEvent(roomID, eventID)
+	if err != nil {
+		imp.br.Log.Warnfln("Failed to get %s in %s: %v", eventID, roomID, err)
+		return ""
+	}
+	if userID, ok := imp.oldGhostUserID(evt.Sender); ok {
+		return userID
+	}
+	if imp.br.DB.User.GetByMXID(evt.Sender) == nil {
+		return ""
+	}
+	if userTeam := imp.br.GetUserByMXID(evt.Sender).GetUserTeam(teamID); userTeam != nil {
+		return userTeam.Key.SlackID
+	}
+	return ""
+}
+
+// oldGhostUserID finds the Slack user ID of one of the old bridge's ghosts.
+// Their localparts are the namespace prefix of the old registration followed
+// by the remote user ID, optionally with the old bridge's puppet ID in front.
+func (imp *mxPuppetImporter) oldGhostUserID(mxid id.UserID) (string, bool) {
+	localpart, _, err := mxid.Parse()
+	if err != nil {
+		return "", false
+	}
+	for _, namespace := range imp.reg.Namespaces.UserIDs {
+		prefix := strings.TrimPrefix(strings.TrimPrefix(namespace.Regex, "^"), "@")
+		if idx := strings.IndexAny(prefix, `.*+?[](){}|\^$`); idx >= 0 {
+			prefix = prefix[:idx]
+		}
+		if prefix == "" || !strings.HasPrefix(localpart, prefix) {
+			continue
+		}
+		remoteID := localpart[len(prefix):]
+		for {
+			if userID, ok := imp.users[remoteID]; ok {
+				return userID, true
+			}
+			var found bool
+			_, remoteID, found = strings.Cut(remoteID, "_")
+			if !found {
+				break
+			}
+		}
+	}
+	return "", false
+}
+
+// removeOldGhosts makes the old bridge's ghosts leave the imported rooms, as
+// this bridge's ghosts will be joined to them on the next sync.
+func (imp *mxPuppetImporter) removeOldGhosts() error {
+	rows, err := imp.oldDB.Query("SELECT ghost_mxid, room_mxid FROM ghost_room_store")
+	if err != nil {
+		return fmt.Errorf("failed to query old ghosts: %w", err)
+	}
+	defer rows.Close()
+	log := imp.br.Log.Sub("MXPuppetImport")
+	for rows.Next() {
+		var ghostMXID id.UserID
+		var roomID id.RoomID
+		if err = rows.Scan(&ghostMXID, &roomID); err != nil {
+			return fmt.Errorf("failed to scan old ghost: %w", err)
+		} else if imp.br.GetPortalByMXID(roomID) == nil {
+			continue
+		}
+		client, err := imp.oldClient(ghostMXID)
+		if err != nil {
+			return fmt.Errorf("failed to create client for old ghost: %w", err)
+		}
+		_, err = client.LeaveRoom(roomID)
+		if err != nil {
+			log.Warnfln("Failed to remove %s from %s: %v", ghostMXID, roomID, err)
+			continue
+		}
+		imp.ghostsRemoved++
+	}
+	return rows.Err()
+}
@@ -21,6 +21,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -47,6 +48,13 @@ type portalMatrixMessage struct {
 	evt        *event.Event
 	user       *User
 	receivedAt time.Time
+
+	// Set when the message is a manual retry of a previously failed message
+	retryNum    int
+	retryNotice id.EventID
+
+	// Set for markers used to wait until everything queued before them has been handled
+	flushed chan struct{}
 }
 
 type Portal struct {
@@ -59,13 +67,30 @@ type Portal struct {
 	encryptLock             sync.Mutex
 	backfillLock            sync.Mutex
 	latestEventBackfillLock sync.Mutex
+	bookmarksLock           sync.Mutex
+	retentionLock           sync.Mutex
 
-	matrixMessages chan portalMatrixMessage
+	matrixQueue          []portalMatrixMessage
+	matrixQueueLock      sync.Mutex
+	matrixQueueScheduled bool
 
 	slackMessageLock sync.Mutex
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+
+	echoes echoTracker
+	loops  loopDetector
+
+	// Number of Matrix messages in a row that failed to send, for admin notices
+	sendFailures int32
+
+	// The max_lifetime of the retention state event in the room
+	retentionStateLifetime int64
+	retentionStateSynced   bool
+
+	messages  messageCache
+	deletions slackDeletionQueue
 }
 
 var (
@@ -87,9 +112,129 @@ func (portal *Portal) MarkEncrypted() {
 }
 
 func (portal *Portal) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
-	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser /*|| portal.HasRelaybot()*/ {
-		portal.matrixMessages <- portalMatrixMessage{user: user.(*User), evt: evt, receivedAt: time.Now()}
+	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser || portal.HasRelaybot() {
+		err := portal.queueMatrixMessage(portalMatrixMessage{user: user.(*User), evt: evt, receivedAt: time.Now()})
+		if err != nil {
+			portal.sendMessageMetricsAsync(evt, err, "Dropping")
+		}
+	}
+}
+
+// RetryMatrixMessage queues a previously failed Matrix message to be sent to
+// Slack again. The error notice of the previous attempt is replaced with the
+// result of the retry.
+func (portal *Portal) RetryMatrixMessage(user *User, evt *event.Event, errorNotice id.EventID) {
+	retryMeta := evt.Content.AsMessage().MessageSendRetry
+	if retryMeta == nil {
+		retryMeta = &event.BeeperRetryMetadata{OriginalEventID: evt.ID}
+		evt.Content.AsMessage().MessageSendRetry = retryMeta
+	}
+	retryMeta.RetryCount++
+	err := portal.queueMatrixMessage(portalMatrixMessage{
+		user:        user,
+		evt:         evt,
+		receivedAt:  time.Now(),
+		retryNum:    retryMeta.RetryCount,
+		retryNotice: errorNotice,
+	})
+	if err != nil {
+		portal.sendMessageMetricsAsync(evt, err, "Dropping")
+	}
+}
+
+// getEncryptionEventContent returns the m.room.encryption content for the
+// portal, including the Megolm session rotation settings.
+func (portal *Portal) getEncryptionEventContent() *event.EncryptionEventContent {
+	content := &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
+	rotation := portal.bridge.bridgeConfig().Encryption.Rotation
+	if rotation.EnableCustom {
+		content.RotationPeriodMillis = rotation.Milliseconds
+		content.RotationPeriodMessages = rotation.Messages
+	}
+	if portal.RotationPeriodMillis > 0 {
+		content.RotationPeriodMillis = portal.RotationPeriodMillis
+	}
+	if portal.RotationPeriodMessages > 0 {
+		content.RotationPeriodMessages = portal.RotationPeriodMessages
+	}
+	return content
+}
+
+// UpdateEncryptionSettings sends the current rotation settings to the room
+// and discards the current Megolm session, so that the next message starts a
+// session with the new settings.
+func (portal *Portal) UpdateEncryptionSettings() error {
+	if portal.MXID == "" || !portal.Encrypted {
+		return nil
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, event.StateEncryption, "", portal.getEncryptionEventContent())
+	if err != nil {
+		return err
+	}
+	if portal.bridge.Crypto != nil {
+		portal.bridge.Crypto.ResetSession(portal.MXID)
 	}
+	return nil
+}
+
+func (portal *Portal) HasRelaybot() bool {
+	return portal.RelayUserID != "" && portal.bridge.getTeamConfig(portal.Key.TeamID).Relay.Enabled
+}
+
+// getRelayUserTeam returns the Slack login of the portal's relay user, if
+// relay mode is enabled and the relay user is still logged into the team.
+func (portal *Portal) getRelayUserTeam() *database.UserTeam {
+	if !portal.HasRelaybot() {
+		return nil
+	}
+	relayUser := portal.bridge.GetUserByMXID(portal.RelayUserID)
+	if relayUser == nil {
+		return nil
+	}
+	userTeam := relayUser.GetUserTeam(portal.Key.TeamID)
+	if userTeam == nil || userTeam.Client == nil {
+		return nil
+	}
+	return userTeam
+}
+
+func (portal *Portal) getRelayTemplateData(sender *User, msgType event.MessageType) *config.RelayTemplateData {
+	data := &config.RelayTemplateData{
+		UserID:      sender.MXID,
+		Displayname: sender.MXID.String(),
+		MsgType:     msgType,
+	}
+	member := portal.bridge.StateStore.GetMember(portal.MXID, sender.MXID)
+	if member != nil && member.Displayname != "" {
+		data.Displayname = member.Displayname
+	}
+	if member != nil && member.AvatarURL != "" {
+		if avatarURL, err := member.AvatarURL.Parse(); err == nil && !avatarURL.IsEmpty() {
+			data.AvatarURL = portal.bridge.Bot.GetDownloadURL(avatarURL)
+		}
+	}
+	return data
+}
+
+// formatRelayTemplate executes the portal's relay template for the given key
+// if it has one, and the template from the bridge config otherwise.
+func (portal *Portal) formatRelayTemplate(key string, data *config.RelayTemplateData) string {
+	keys := []string{key}
+	switch event.MessageType(key) {
+	case event.MsgImage, event.MsgAudio, event.MsgVideo:
+		keys = append(keys, string(event.MsgFile))
+	}
+	for _, key = range keys {
+		if source, ok := portal.RelayTemplates[key]; ok {
+			tpl, err := config.ParseRelayTemplate(key, source)
+			if err != nil {
+				portal.log.Warnfln("Invalid relay template %s in portal: %v", key, err)
+				break
+			}
+			return config.ExecuteRelayTemplate(tpl, data)
+		}
+	}
+	return config.ExecuteRelayTemplate(portal.bridge.getTeamConfig(portal.Key.TeamID).Relay.GetTemplate(keys[0]), data)
 }
 
 func (portal *Portal) HandleMatrixReadReceipt(sender bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
@@ -105,7 +250,7 @@ func (portal *Portal) markSlackRead(user *User, userTeam *database.UserTeam, eve
 		return
 	}
 
-	message := portal.bridge.DB.Message.GetByMatrixID(portal.Key, eventID)
+	message := portal.getMessageByMatrixID(eventID)
 	if message == nil {
 		portal.log.Debugfln("Not marking Slack channel for portal %s as read: unknown message", portal.Key)
 		return
@@ -185,8 +330,12 @@ func (br *SlackBridge) GetAllPortalsForUserTeam(utk database.UserTeamKey) []*Por
 	return br.dbPortalsToPortals(br.DB.Portal.GetAllForUserTeam(utk))
 }
 
-func (br *SlackBridge) GetDMPortalsWith(otherUserID string) []*Portal {
-	return br.dbPortalsToPortals(br.DB.Portal.FindPrivateChatsWith(otherUserID))
+func (br *SlackBridge) GetDMPortalsWith(teamID, otherUserID string) []*Portal {
+	return br.dbPortalsToPortals(br.DB.Portal.FindPrivateChatsWith(teamID, otherUserID))
+}
+
+func (br *SlackBridge) GetDMPortalsBetween(teamID, userA, userB string) []*Portal {
+	return br.dbPortalsToPortals(br.DB.Portal.FindPrivateChatBetween(teamID, userA, userB))
 }
 
 func (br *SlackBridge) dbPortalsToPortals(dbPortals []*database.Portal) []*Portal {
@@ -215,25 +364,13 @@ func (br *SlackBridge) NewPortal(dbPortal *database.Portal) *Portal {
 		Portal: dbPortal,
 		bridge: br,
 		log:    br.Log.Sub(fmt.Sprintf("Portal/%s", dbPortal.Key)),
-
-		matrixMessages: make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
 	}
 
-	go portal.messageLoop()
 	go portal.slackRepeatTypingUpdater()
 
 	return portal
 }
 
-func (portal *Portal) messageLoop() {
-	for {
-		select {
-		case msg := <-portal.matrixMessages:
-			portal.handleMatrixMessages(msg)
-		}
-	}
-}
-
 func (portal *Portal) IsPrivateChat() bool {
 	return portal.Type == database.ChannelTypeDM
 }
@@ -247,10 +384,44 @@ func (portal *Portal) MainIntent() *appservice.IntentAPI {
 }
 
 func (portal *Portal) syncParticipants(source *User, sourceTeam *database.UserTeam, participants []string) {
+	puppets := make([]*Puppet, 0, len(participants))
+	var needInfo []string
 	for _, participant := range participants {
 		puppet := portal.bridge.GetPuppetByID(sourceTeam.Key.TeamID, participant)
+		if puppet == nil {
+			continue
+		}
+		puppets = append(puppets, puppet)
+		if puppet.Name == "" || puppet.hasPlaceholderProfile() {
+			needInfo = append(needInfo, participant)
+		}
+	}
+	var infos map[string]*slack.User
+	if len(needInfo) > 0 {
+		infos = portal.bridge.InfoCache.GetUsersInfo(sourceTeam, needInfo)
+	}
 
-		puppet.UpdateInfo(sourceTeam, nil)
+	// The profiles are synced first and saved in one transaction, so that
+	// syncing a big channel doesn't need a database write for every member.
+	joinable := puppets[:0]
+	var changed []*Puppet
+	for _, puppet := range puppets {
+		ok, puppetChanged := puppet.syncInfo(sourceTeam, infos[puppet.UserID], false)
+		if puppetChanged {
+			changed = append(changed, puppet)
+		}
+		if !ok {
+			portal.log.Debugfln("Not adding %s to %s: their Slack profile can't be fetched", puppet.UserID, portal.MXID)
+		} else if !puppet.shouldJoinPortal(portal) {
+			portal.log.Debugfln("Not adding guest %s to %s", puppet.UserID, portal.MXID)
+		} else {
+			joinable = append(joinable, puppet)
+		}
+	}
+	portal.bridge.savePuppets(changed)
+
+	for _, puppet := range joinable {
+		participant := puppet.UserID
 
 		user := portal.bridge.GetUserByID(sourceTeam.Key.TeamID, participant)
 		if user != nil {
@@ -279,6 +450,12 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 	channel = portal.UpdateInfo(user, userTeam, channel, false)
 	if channel == nil {
 		return fmt.Errorf("didn't find channel metadata")
+	} else if portal.isFilteredOut() {
+		portal.log.Debugln("Not creating Matrix room: channel is excluded by the bridge filter")
+		return errPortalFiltered
+	} else if portal.relinkDMPortal(userTeam) {
+		portal.ensureUserInvited(user)
+		return nil
 	}
 
 	intent := portal.MainIntent()
@@ -303,11 +480,11 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 
 	var invite []id.UserID
 
-	if portal.bridge.Config.Bridge.Encryption.Default {
+	if portal.bridge.bridgeConfig().Encryption.Default {
 		initialState = append(initialState, &event.Event{
 			Type: event.StateEncryption,
 			Content: event.Content{
-				Parsed: event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1},
+				Parsed: portal.getEncryptionEventContent(),
 			},
 		})
 		portal.Encrypted = true
@@ -318,6 +495,29 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 		}
 	}
 
+	if portal.IsPrivateChat() && portal.DMUserID != "" {
+		// Encryption affects whether DMs get a name and avatar
+		puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, portal.DMUserID)
+		portal.UpdateNameDirect(puppet.Name)
+		portal.UpdateAvatarFromPuppet(puppet)
+	}
+	if retention := portal.getRetentionEventContent(); retention.MaxLifetime > 0 {
+		initialState = append(initialState, &event.Event{
+			Type:    StateRetention,
+			Content: event.Content{Parsed: retention},
+		})
+		portal.retentionStateSynced = true
+		portal.retentionStateLifetime = retention.MaxLifetime
+	}
+	if !portal.AvatarURL.IsEmpty() {
+		initialState = append(initialState, &event.Event{
+			Type: event.StateRoomAvatar,
+			Content: event.Content{
+				Parsed: &event.RoomAvatarEventContent{URL: portal.AvatarURL},
+			},
+		})
+	}
+
 	resp, err := intent.CreateRoom(&mautrix.ReqCreateRoom{
 		Visibility:      "private",
 		Name:            portal.Name,
@@ -335,6 +535,7 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 
 	portal.NameSet = portal.Name != ""
 	portal.TopicSet = true
+	portal.AvatarSet = !portal.AvatarURL.IsEmpty()
 	portal.MXID = resp.RoomID
 	portal.bridge.portalsLock.Lock()
 	portal.bridge.portalsByMXID[portal.MXID] = portal
@@ -344,6 +545,9 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 	portal.InsertUser(userTeam.Key)
 
 	portal.log.Infoln("Matrix room created:", portal.MXID)
+	if spaceID := user.ensureTeamSpace(userTeam); spaceID != "" {
+		user.addSpaceChild(spaceID, portal.MXID)
+	}
 
 	if portal.Encrypted && portal.IsPrivateChat() {
 		err = portal.bridge.Bot.EnsureJoined(portal.MXID, appservice.EnsureJoinedParams{BotOverride: portal.MainIntent().Client})
@@ -361,9 +565,9 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 	}
 	var members []string
 	// no members are included in channels, only in group DMs
+	user.setMuted(portal, user.isPortalMuted(userTeam, portal))
 	switch portal.Type {
 	case database.ChannelTypeChannel:
-		user.updateChatMute(portal, true)
 		members = portal.getChannelMembers(userTeam, 3) // TODO: this just fetches 3 members so channels don't have to look like DMs
 	case database.ChannelTypeDM:
 		members = []string{channel.User, userTeam.Key.SlackID}
@@ -391,12 +595,13 @@ func (portal *Portal) CreateMatrixRoom(user *User, userTeam *database.UserTeam,
 	backfillState := portal.bridge.DB.Backfill.NewBackfillState(&portal.Key)
 	backfillState.Upsert()
 	portal.bridge.BackfillQueue.ReCheck()
+	go portal.syncBookmarks(withBackgroundPriority(context.Background()), userTeam)
 
 	return nil
 }
 
 func (portal *Portal) getChannelMembers(userTeam *database.UserTeam, limit int) []string {
-	members, _, err := userTeam.Client.GetUsersInConversation(&slack.GetUsersInConversationParameters{
+	members, _, err := userTeam.Client.GetUsersInConversationContext(withBackgroundPriority(context.Background()), &slack.GetUsersInConversationParameters{
 		ChannelID: portal.Key.ChannelID,
 		Limit:     limit,
 	})
@@ -412,14 +617,21 @@ func (portal *Portal) ensureUserInvited(user *User) bool {
 	return user.ensureInvited(portal.MainIntent(), portal.MXID, portal.IsPrivateChat())
 }
 
-func (portal *Portal) markMessageHandled(txn dbutil.Transaction, slackID string, slackThreadID string, mxid id.EventID, authorID string) *database.Message {
+func (portal *Portal) markMessageHandled(txn dbutil.Transaction, slackID, slackThreadID, subtype string, partIndex int, mxid id.EventID, authorID string) *database.Message {
 	msg := portal.bridge.DB.Message.New()
 	msg.Channel = portal.Key
 	msg.SlackID = slackID
 	msg.MatrixID = mxid
 	msg.AuthorID = authorID
 	msg.SlackThreadID = slackThreadID
+	msg.Subtype = subtype
+	msg.PartIndex = partIndex
 	msg.Insert(txn)
+	portal.bridge.DB.Backfill.MarkBridged(txn, portal.Key, slackID)
+	if txn == nil {
+		// Backfilled messages aren't cached, as the transaction may still be rolled back
+		portal.cacheMessage(msg)
+	}
 
 	return msg
 }
@@ -487,7 +699,19 @@ func (portal *Portal) sendMatrixMessage(intent *appservice.IntentAPI, eventType
 	}
 }
 
+// requiresVerifiedDevice checks whether the event has to be rejected because
+// the room only accepts events from verified devices. In an encrypted room
+// that also applies to events that weren't encrypted, as they can't come from
+// a verified device. Redactions are the exception, as they're never encrypted.
+func (portal *Portal) requiresVerifiedDevice(evt *event.Event) bool {
+	if !portal.RequireVerification || !portal.Encrypted || evt.Type == event.EventRedaction {
+		return false
+	}
+	return !evt.Mautrix.WasEncrypted || evt.Mautrix.TrustState < id.TrustStateCrossSignedTOFU
+}
+
 func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
+	defer portal.bridge.recoverPanic(fmt.Sprintf("handling Matrix event %s", msg.evt.ID), portal.sentryTags(msg.user))
 
 	evtTS := time.UnixMilli(msg.evt.Timestamp)
 	timings := messageTimings{
@@ -496,10 +720,43 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 		portalQueue:  time.Since(msg.receivedAt),
 		totalReceive: time.Since(evtTS),
 	}
-	ms := metricSender{portal: portal, timings: &timings}
+	if msg.retryNum > 0 {
+		// Retried messages are old by definition, so only count the time since the retry was requested
+		timings.totalReceive = time.Since(msg.receivedAt)
+	}
+	ms := metricSender{portal: portal, timings: &timings, retryNum: msg.retryNum, previousNotice: msg.retryNotice}
+
+	// Retries reuse the event ID of the original event, so they're never duplicates
+	if msg.retryNum == 0 && !portal.bridge.DB.HandledEvent.Claim(msg.evt.ID, portal.MXID, portal.bridge.handledEventClaimStaleBefore()) {
+		portal.log.Debugfln("Ignoring %s, it was already handled before", msg.evt.ID)
+		return
+	}
+
+	if portal.isFilteredOut() {
+		ms.sendMessageMetricsAsync(msg.evt, errPortalFiltered, "Ignoring", true)
+		return
+	} else if userTeam := msg.user.GetUserTeam(portal.Key.TeamID); userTeam != nil && !portal.getFilter().IsUserAllowed(userTeam.Key.SlackID) {
+		ms.sendMessageMetricsAsync(msg.evt, errSenderFiltered, "Ignoring", true)
+		return
+	}
+
+	if portal.requiresVerifiedDevice(msg.evt) {
+		ms.sendMessageMetricsAsync(msg.evt, errDeviceNotVerified, "Error handling", true)
+		return
+	} else if portal.isReadOnly() {
+		ms.sendMessageMetricsAsync(msg.evt, errPortalReadOnly, "Ignoring", true)
+		return
+	} else if msg.evt.Type != event.EventRedaction && portal.isDMUserDeactivated() {
+		ms.sendMessageMetricsAsync(msg.evt, errDMUserDeactivated, "Ignoring", true)
+		return
+	}
 
 	switch msg.evt.Type {
 	case event.EventMessage:
+		if portal.isMatrixLoop(msg.evt) {
+			ms.sendMessageMetricsAsync(msg.evt, errBridgeLoop, "Ignoring", true)
+			return
+		}
 		portal.handleMatrixMessage(msg.user, msg.evt, &ms)
 	case event.EventRedaction:
 		portal.handleMatrixRedaction(msg.user, msg.evt)
@@ -516,40 +773,52 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event, ms *me
 
 	start := time.Now()
 
-	userTeam := sender.GetUserTeam(portal.Key.TeamID)
+	userTeam := portal.getSendingUserTeam(sender)
 	if userTeam == nil {
 		portal.log.Warnfln("User %s not logged into team %s", sender.MXID, portal.Key.TeamID)
-		go ms.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring", true)
+		ms.sendMessageMetricsAsync(evt, errUserNotLoggedIn, "Ignoring", true)
 		return
 	}
 	if userTeam.Client == nil {
+		if ms.retryNum == 0 && portal.queueRetryAfterRestart(sender, userTeam, evt, ms) {
+			return
+		}
 		portal.log.Errorfln("Client for userteam %s is nil!", userTeam.Key)
 		return
 	}
 
-	existing := portal.bridge.DB.Message.GetByMatrixID(portal.Key, evt.ID)
+	existing := portal.getMessageByMatrixID(evt.ID)
 	if existing != nil {
 		portal.log.Debugln("not handling duplicate message", evt.ID)
-		go ms.sendMessageMetrics(evt, nil, "", true)
+		ms.sendMessageMetricsAsync(evt, nil, "", true)
 		return
 	}
 
 	messageAge := ms.timings.totalReceive
-	errorAfter := portal.bridge.Config.Bridge.MessageHandlingTimeout.ErrorAfter
-	deadline := portal.bridge.Config.Bridge.MessageHandlingTimeout.Deadline
+	errorAfter, deadline := portal.getMessageHandlingTimeouts()
+	maxAge := portal.getMessageMaxAge(errorAfter)
 	isScheduled, _ := evt.Content.Raw["com.beeper.scheduled"].(bool)
 	if isScheduled {
 		portal.log.Debugfln("%s is a scheduled message, extending handling timeouts", evt.ID)
 		errorAfter *= 10
 		deadline *= 10
+		maxAge *= 10
 	}
 
-	if errorAfter > 0 {
-		remainingTime := errorAfter - messageAge
-		if remainingTime < 0 {
-			go ms.sendMessageMetrics(evt, errTimeoutBeforeHandling, "Timeout handling", true)
+	ctx := context.Background()
+	if maxAge > 0 && messageAge > maxAge {
+		if ms.retryNum == 0 && portal.queueRetryAfterRestart(sender, userTeam, evt, ms) {
+			return
+		} else if !portal.bridge.bridgeConfig().MessageHandlingTimeout.BridgeDelayed {
+			ms.sendMessageMetricsAsync(evt, errTimeoutBeforeHandling, "Timeout handling", true)
 			return
-		} else if remainingTime < 1*time.Second {
+		}
+		portal.log.Debugfln("Message %s is %s old, bridging it as delayed", evt.ID, messageAge)
+		ctx = withDelayedMarker(ctx)
+	}
+
+	if remainingTime := errorAfter - messageAge; errorAfter > 0 && remainingTime > 0 {
+		if remainingTime < 1*time.Second {
 			portal.log.Warnfln("Message %s was delayed before reaching the bridge, only have %s (of %s timeout) until delay warning", evt.ID, remainingTime, errorAfter)
 		}
 		go func() {
@@ -558,12 +827,20 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event, ms *me
 		}()
 	}
 
-	ctx := context.Background()
 	if deadline > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, deadline)
 		defer cancel()
 	}
+	breaker := portal.bridge.getCircuitBreaker(userTeam)
+	if breaker.IsOpen() {
+		portal.log.Debugfln("Slack API for %s is failing, waiting before sending %s", userTeam.Key, evt.ID)
+		ms.sendMessageMetricsAsync(evt, errSlackUnavailable, "Paused sending", false)
+		if err := breaker.Wait(ctx); err != nil {
+			ms.sendMessageMetricsAsync(evt, err, "Error sending", true)
+			return
+		}
+	}
 	ms.timings.preproc = time.Since(start)
 
 	start = time.Now()
@@ -573,24 +850,61 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event, ms *me
 	start = time.Now()
 	var timestamp string
 	if options == nil && fileUpload == nil {
-		go ms.sendMessageMetrics(evt, err, "Error converting", true)
+		ms.sendMessageMetricsAsync(evt, err, "Error converting", true)
 		return
 	} else if options != nil {
 		portal.log.Debugfln("Sending message %s to Slack %s %s", evt.ID, portal.Key.TeamID, portal.Key.ChannelID)
+		echo := portal.echoes.Expect(evt.ID, userTeam.Key.SlackID, options)
 		_, timestamp, err = userTeam.Client.PostMessage(
 			portal.Key.ChannelID,
 			slack.MsgOptionAsUser(true),
 			slack.MsgOptionCompose(options...))
+		breaker.Record(err)
+		err = checkAppDMError(err)
 		if err != nil {
-			go ms.sendMessageMetrics(evt, err, "Error sending", true)
+			// The message may have been posted anyway, so its echo stays expected until it times out
+			ms.sendMessageMetricsAsync(evt, err, "Error sending", true)
 			return
+		} else if echo != nil && echo.editOf == "" {
+			// The timestamp mapping stored below takes care of echoes of new messages
+			portal.echoes.Forget(echo)
 		}
+		defer portal.broadcastSlackMessage(userTeam, evt, options, timestamp, threadTs)
+		portal.rememberBridgedText(event.TrimReplyFallbackText(evt.Content.AsMessage().Body), sender.MXID.String(), userTeam.Key.SlackID)
 	} else if fileUpload != nil {
 		portal.log.Debugfln("Uploading file from message %s to Slack %s %s", evt.ID, portal.Key.TeamID, portal.Key.ChannelID)
-		file, err := userTeam.Client.UploadFile(*fileUpload)
-		if err != nil {
+		if portal.shouldUseExternalUpload(evt) {
+			timestamp, err = portal.newExternalUploader(userTeam).Upload(ctx, fileUpload)
+			if closer, ok := fileUpload.Reader.(io.Closer); ok {
+				_ = closer.Close()
+			}
+			breaker.Record(err)
+			if errors.Is(err, errMediaTooLarge) {
+				ms.sendMessageMetricsAsync(evt, err, "Error uploading", true)
+				return
+			} else if err != nil {
+				portal.log.Errorfln("Failed to upload %s to Slack with external upload: %v", evt.ID, err)
+				ms.sendMessageMetricsAsync(evt, errMediaSlackUploadFailed, "Error uploading", true)
+				return
+			}
+			ms.timings.totalSend = time.Since(start)
+			ms.sendMessageMetricsAsync(evt, nil, "", true)
+			portal.storeSentMatrixMessage(evt, userTeam, timestamp, threadTs)
+			return
+		}
+		file, err := userTeam.Client.UploadFileContext(ctx, *fileUpload)
+		if closer, ok := fileUpload.Reader.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				portal.log.Warnfln("Error finishing download of %s: %v", evt.ID, closeErr)
+			}
+		}
+		breaker.Record(err)
+		if errors.Is(err, errMediaTooLarge) {
+			ms.sendMessageMetricsAsync(evt, err, "Error uploading", true)
+			return
+		} else if err != nil {
 			portal.log.Errorfln("Failed to upload slack attachment: %v", err)
-			go ms.sendMessageMetrics(evt, errMediaSlackUploadFailed, "Error uploading", true)
+			ms.sendMessageMetricsAsync(evt, errMediaSlackUploadFailed, "Error uploading", true)
 			return
 		}
 		var shareInfo slack.ShareFileInfo
@@ -600,24 +914,46 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event, ms *me
 		} else if info, found := file.Shares.Public[portal.Key.ChannelID]; found && len(info) > 0 {
 			shareInfo = info[0]
 		} else {
-			go ms.sendMessageMetrics(evt, errMediaSlackUploadFailed, "Error uploading", true)
+			ms.sendMessageMetricsAsync(evt, errMediaSlackUploadFailed, "Error uploading", true)
 			return
 		}
 		timestamp = shareInfo.Ts
 	}
 	ms.timings.totalSend = time.Since(start)
-	go ms.sendMessageMetrics(evt, err, "Error sending", true)
+	ms.sendMessageMetricsAsync(evt, err, "Error sending", true)
 	// TODO: store these timings in some way
 
-	if timestamp != "" {
-		dbMsg := portal.bridge.DB.Message.New()
-		dbMsg.Channel = portal.Key
-		dbMsg.SlackID = timestamp
-		dbMsg.MatrixID = evt.ID
-		dbMsg.AuthorID = userTeam.Key.SlackID
-		dbMsg.SlackThreadID = threadTs
-		dbMsg.Insert(nil)
+	portal.storeSentMatrixMessage(evt, userTeam, timestamp, threadTs)
+}
+
+func (portal *Portal) storeSentMatrixMessage(evt *event.Event, userTeam *database.UserTeam, timestamp, threadTs string) {
+	if timestamp == "" {
+		return
 	}
+	dbMsg := portal.bridge.DB.Message.New()
+	dbMsg.Channel = portal.Key
+	dbMsg.SlackID = timestamp
+	dbMsg.MatrixID = evt.ID
+	dbMsg.AuthorID = userTeam.Key.SlackID
+	dbMsg.SlackThreadID = threadTs
+	if evt.Content.AsMessage().MsgType == event.MsgEmote && portal.canSendNativeEmote(evt.Sender, userTeam, threadTs) {
+		dbMsg.Subtype = "me_message"
+	}
+	dbMsg.Insert(nil)
+	portal.bridge.DB.Backfill.MarkBridged(nil, portal.Key, timestamp)
+	portal.cacheMessage(dbMsg)
+}
+
+// shouldUseExternalUpload checks whether a Matrix file is large enough to be
+// uploaded with the retryable external upload flow. Files with an unknown
+// size use it too, as they might be large.
+func (portal *Portal) shouldUseExternalUpload(evt *event.Event) bool {
+	threshold := portal.bridge.bridgeConfig().Media.ExternalUploadThreshold
+	if threshold <= 0 {
+		return false
+	}
+	content := evt.Content.AsMessage()
+	return content.Info == nil || content.Info.Size == 0 || int64(content.Info.Size) > threshold
 }
 
 func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, userTeam *database.UserTeam, evt *event.Event) (options []slack.MsgOption, fileUpload *slack.FileUploadParameters, threadTs string, err error) {
@@ -626,25 +962,26 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, us
 		return nil, nil, "", errUnexpectedParsedContentType
 	}
 
-	var existingTs string
+	var existingTs, existingSubtype string
 	if content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace { // fetch the slack original TS for editing purposes
-		existing := portal.bridge.DB.Message.GetByMatrixID(portal.Key, content.RelatesTo.EventID)
+		existing := portal.getMessageByMatrixID(content.RelatesTo.EventID)
 		if existing != nil && existing.SlackID != "" {
 			existingTs = existing.SlackID
+			existingSubtype = existing.Subtype
 			content = content.NewContent
 		} else {
 			portal.log.Errorfln("Matrix message %s is an edit, but can't find the original Slack message ID", evt.ID)
 			return nil, nil, "", errTargetNotFound
 		}
 	} else if content.RelatesTo != nil && content.RelatesTo.Type == event.RelThread { // fetch the thread root ID via Matrix thread
-		rootMessage := portal.bridge.DB.Message.GetByMatrixID(portal.Key, content.RelatesTo.GetThreadParent())
+		rootMessage := portal.getMessageByMatrixID(content.RelatesTo.GetThreadParent())
 		if rootMessage != nil {
 			threadTs = rootMessage.SlackID
 		}
 	} else if threadTs == "" && content.RelatesTo != nil && content.RelatesTo.InReplyTo != nil { // if the first method failed, try via Matrix reply
 		var slackMessageID string
 		var slackThreadID string
-		parentMessage := portal.bridge.DB.Message.GetByMatrixID(portal.Key, content.RelatesTo.GetReplyTo())
+		parentMessage := portal.getMessageByMatrixID(content.RelatesTo.GetReplyTo())
 		if parentMessage != nil {
 			slackMessageID = parentMessage.SlackID
 			slackThreadID = parentMessage.SlackThreadID
@@ -662,35 +999,125 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, us
 		}
 	}
 
+	// Messages sent through the relay user are prefixed with the real sender's name
+	var relayPrefix, relayUsername, relayIconURL string
+	if userTeam.Key.MXID != sender.MXID {
+		relayData := portal.getRelayTemplateData(sender, content.MsgType)
+		relayPrefix = portal.formatRelayTemplate(string(content.MsgType), relayData)
+		relayUsername = portal.formatRelayTemplate(config.RelayTemplateUsername, relayData)
+		relayIconURL = portal.formatRelayTemplate(config.RelayTemplateIconURL, relayData)
+	}
+
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
+		text := content.Body
 		if content.Format == event.FormatHTML {
-			options = []slack.MsgOption{slack.MsgOptionText(portal.bridge.ParseMatrix(content.FormattedBody), false)}
-		} else {
-			options = []slack.MsgOption{slack.MsgOptionText(content.Body, false)}
+			text = portal.bridge.ParseMatrix(content.FormattedBody)
 		}
+		text = portal.translateMatrixMessage(ctx, content, text)
+		text, err = portal.filterContent(ctx, ContentFilterMatrixToSlack, sender.MXID.String(), text)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		var nativeEmote bool
+		if content.MsgType == event.MsgEmote {
+			text, nativeEmote = portal.convertMatrixEmote(sender, userTeam, text, threadTs, existingTs, existingSubtype)
+		} else if content.MsgType == event.MsgNotice {
+			switch portal.getNoticePolicy() {
+			case database.NoticePolicyDrop:
+				return nil, nil, "", errMNoticeDisabled
+			case database.NoticePolicyPrefix:
+				text = portal.bridge.bridgeConfig().NoticePrefix + text
+			}
+		}
+		if existingTs == "" {
+			text += portal.getDelayedMarker(ctx)
+		}
+		options = []slack.MsgOption{slack.MsgOptionText(relayPrefix+text, false)}
 		if threadTs != "" {
 			options = append(options, slack.MsgOptionTS(threadTs))
 		}
 		if existingTs != "" {
 			options = append(options, slack.MsgOptionUpdate(existingTs))
 		}
-		if content.MsgType == event.MsgEmote {
+		if nativeEmote {
 			options = append(options, slack.MsgOptionMeMessage())
 		}
+		options = append(options, portal.getUnfurlOptions()...)
+		// Slack ignores the username and icon overrides when posting as the user
+		if existingTs == "" && (relayUsername != "" || relayIconURL != "") {
+			options = append(options, slack.MsgOptionAsUser(false))
+			if relayUsername != "" {
+				options = append(options, slack.MsgOptionUsername(relayUsername))
+			}
+			if relayIconURL != "" {
+				options = append(options, slack.MsgOptionIconURL(relayIconURL))
+			}
+		}
 		return options, nil, threadTs, nil
 	case event.MsgAudio, event.MsgFile, event.MsgImage, event.MsgVideo:
-		data, err := portal.downloadMatrixAttachment(content)
+		if portal.MediaPolicy == database.MediaPolicyBlock {
+			return nil, nil, "", errMediaBlocked
+		}
+		var mimeType string
+		if content.Info != nil {
+			mimeType = content.Info.MimeType
+			if portal.isMediaTooLarge(int64(content.Info.Size)) {
+				return nil, nil, "", errMediaTooLarge
+			}
+		}
+		// The body is a caption if the file name is sent separately, otherwise
+		// it's the file name. Either way it's shown in Slack, so it's filtered.
+		filename, caption := content.Body, ""
+		if content.FileName != "" && content.FileName != content.Body {
+			filename, caption = content.FileName, content.Body
+		}
+		if caption != "" {
+			caption, err = portal.filterContent(ctx, ContentFilterMatrixToSlack, sender.MXID.String(), caption)
+		} else {
+			filename, err = portal.filterContent(ctx, ContentFilterMatrixToSlack, sender.MXID.String(), filename)
+		}
 		if err != nil {
-			portal.log.Errorfln("Failed to download matrix attachment: %v", err)
-			return nil, nil, "", errMediaDownloadFailed
+			return nil, nil, "", err
+		}
+		var reader io.Reader
+		if portal.canStreamMedia(mimeType) && !portal.needsAnimationConversion(evt, mimeType) {
+			// The reader is closed by handleMatrixMessage after the upload
+			reader, err = portal.openMatrixAttachment(ctx, content)
+			if err != nil {
+				portal.log.Errorfln("Failed to download matrix attachment: %v", err)
+				return nil, nil, "", errMediaDownloadFailed
+			}
+		} else {
+			data, err := portal.downloadMatrixAttachment(ctx, content)
+			if errors.Is(err, errMediaTooLarge) {
+				return nil, nil, "", err
+			} else if err != nil {
+				portal.log.Errorfln("Failed to download matrix attachment: %v", err)
+				return nil, nil, "", errMediaDownloadFailed
+			}
+			err = portal.bridge.scanFile(ctx, string(evt.ID), data)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			data, mimeType, filename = portal.convertAnimationForSlack(ctx, evt, data, mimeType, filename)
+			if content.MsgType == event.MsgImage && !isAnimatedImage(data, mimeType) {
+				processed, _, _, err := portal.bridge.processImage(data, mimeType)
+				if err != nil {
+					portal.log.Warnfln("Failed to process image in %s, sending original: %v", evt.ID, err)
+				} else {
+					data = processed
+				}
+			}
+			reader = bytes.NewReader(data)
 		}
 		fileUpload = &slack.FileUploadParameters{
-			Filename:        content.Body,
-			Filetype:        content.Info.MimeType,
-			Reader:          bytes.NewReader(data),
+			Filename:        filename,
+			Filetype:        mimeType,
+			Reader:          reader,
 			Channels:        []string{portal.Key.ChannelID},
 			ThreadTimestamp: threadTs,
+			InitialComment:  strings.TrimSpace(relayPrefix + caption),
 		}
 		return nil, fileUpload, threadTs, nil
 	default:
@@ -703,8 +1130,13 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event, ms *m
 	defer portal.slackMessageLock.Unlock()
 
 	userTeam := sender.GetUserTeam(portal.Key.TeamID)
+	var relayed bool
+	if userTeam == nil {
+		userTeam = portal.getRelayUserTeam()
+		relayed = userTeam != nil
+	}
 	if userTeam == nil {
-		go ms.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring", true)
+		ms.sendMessageMetricsAsync(evt, errUserNotLoggedIn, "Ignoring", true)
 		return
 	}
 
@@ -717,7 +1149,7 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event, ms *m
 
 	var slackID string
 
-	msg := portal.bridge.DB.Message.GetByMatrixID(portal.Key, reaction.RelatesTo.EventID)
+	msg := portal.getMessageByMatrixID(reaction.RelatesTo.EventID)
 
 	// Due to the differences in attachments between Slack and Matrix, if a
 	// user reacts to a media message on discord our lookup above will fail
@@ -739,13 +1171,18 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event, ms *m
 	} else {
 		slackID = msg.SlackID
 	}
-	if msg.SlackID == "" {
+	if slackID == "" {
 		portal.log.Debugf("Message %s has not yet been sent to slack", reaction.RelatesTo.EventID)
 		ms.sendMessageMetrics(evt, errReactionTargetNotFound, "Error sending", true)
 		return
 	}
 
-	emojiID := emojiToShortcode(reaction.RelatesTo.Key)
+	var emojiID string
+	if savedReaction := portal.bridge.bridgeConfig().SavedItems.Reaction; !relayed && savedReaction != "" && reaction.RelatesTo.Key == savedReaction {
+		emojiID = savedItemReactionName
+	} else {
+		emojiID = emojiToShortcode(reaction.RelatesTo.Key)
+	}
 	if emojiID == "" {
 		portal.log.Errorfln("Couldn't find shortcode for emoji %s", reaction.RelatesTo.Key)
 		ms.sendMessageMetrics(evt, errEmojiShortcodeNotFound, "Error sending", true)
@@ -766,10 +1203,22 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event, ms *m
 	// 	emojiID = emoji.APIName()
 	// }
 
-	err := userTeam.Client.AddReaction(emojiID, slack.ItemRef{
-		Channel:   portal.Key.ChannelID,
-		Timestamp: slackID,
-	})
+	if relayed {
+		err := portal.sendRelayedReaction(sender, userTeam, evt, slackID, reaction.RelatesTo.Key, emojiID)
+		ms.sendMessageMetrics(evt, err, "Error sending", true)
+		return
+	}
+
+	var err error
+	if emojiID == savedItemReactionName {
+		err = portal.setSlackMessageSaved(userTeam, slackID, true)
+	} else {
+		err = userTeam.Client.AddReaction(emojiID, slack.ItemRef{
+			Channel:   portal.Key.ChannelID,
+			Timestamp: slackID,
+		})
+		portal.bridge.getCircuitBreaker(userTeam).Record(err)
+	}
 	ms.sendMessageMetrics(evt, err, "Error sending", true)
 	if err != nil {
 		portal.log.Debugfln("Failed to send reaction %s id:%s: %v", portal.Key, slackID, err)
@@ -791,26 +1240,33 @@ func (portal *Portal) handleMatrixRedaction(user *User, evt *event.Event) {
 	portal.slackMessageLock.Lock()
 	defer portal.slackMessageLock.Unlock()
 
+	// Relayed reactions are removed through the relay user even if the sender has logged in since
+	if relayed := portal.bridge.DB.RelayedReaction.GetByMatrixID(portal.Key, evt.Redacts); relayed != nil {
+		portal.handleRelayedReactionRedaction(evt, relayed)
+		return
+	}
+
 	userTeam := user.GetUserTeam(portal.Key.TeamID)
 	if userTeam == nil {
-		go portal.sendMessageMetrics(evt, errUserNotLoggedIn, "Ignoring", nil)
+		portal.sendMessageMetricsAsync(evt, errUserNotLoggedIn, "Ignoring")
 		return
 	}
 	portal.log.Debugfln("Received redaction %s from %s", evt.ID, evt.Sender)
 
 	// First look if we're redacting a message
-	message := portal.bridge.DB.Message.GetByMatrixID(portal.Key, evt.Redacts)
+	message := portal.getMessageByMatrixID(evt.Redacts)
 	if message != nil {
 		if message.SlackID != "" {
-			_, _, err := userTeam.Client.DeleteMessage(portal.Key.ChannelID, message.SlackID)
+			err := portal.deleteSlackMessage(userTeam, portal.Key.ChannelID, message.SlackID)
 			if err != nil {
 				portal.log.Debugfln("Failed to delete slack message %s: %v", message.SlackID, err)
 			} else {
-				message.Delete()
+				portal.deleteMessage(message)
+				portal.deleteBroadcastCopies(userTeam, message.SlackID)
 			}
-			go portal.sendMessageMetrics(evt, err, "Error sending", nil)
+			portal.sendMessageMetricsAsync(evt, err, "Error sending")
 		} else {
-			go portal.sendMessageMetrics(evt, errTargetNotFound, "Error sending", nil)
+			portal.sendMessageMetricsAsync(evt, errTargetNotFound, "Error sending")
 		}
 		return
 	}
@@ -819,28 +1275,34 @@ func (portal *Portal) handleMatrixRedaction(user *User, evt *event.Event) {
 	reaction := portal.bridge.DB.Reaction.GetByMatrixID(portal.Key, evt.Redacts)
 	if reaction != nil {
 		if reaction.SlackName != "" {
-			err := userTeam.Client.RemoveReaction(reaction.SlackName, slack.ItemRef{
-				Channel:   portal.Key.ChannelID,
-				Timestamp: reaction.SlackMessageID,
-			})
-			if err != nil && err.Error() != "no_reaction" {
+			var err error
+			if reaction.SlackName == savedItemReactionName {
+				err = portal.setSlackMessageSaved(userTeam, reaction.SlackMessageID, false)
+			} else {
+				err = userTeam.Client.RemoveReaction(reaction.SlackName, slack.ItemRef{
+					Channel:   portal.Key.ChannelID,
+					Timestamp: reaction.SlackMessageID,
+				})
+				portal.bridge.getCircuitBreaker(userTeam).Record(err)
+			}
+			if err != nil && err.Error() != "no_reaction" && err.Error() != "not_starred" {
 				portal.log.Debugfln("Failed to delete reaction %s for message %s: %v", reaction.SlackName, reaction.SlackMessageID, err)
-			} else if err != nil && err.Error() == "no_reaction" {
+			} else if err != nil {
 				portal.log.Warnfln("Didn't delete Slack reaction %s for message %s: reaction doesn't exist on Slack", reaction.SlackName, reaction.SlackMessageID)
 				reaction.Delete()
 				err = nil // not reporting an error for this
 			} else {
 				reaction.Delete()
 			}
-			go portal.sendMessageMetrics(evt, err, "Error sending", nil)
+			portal.sendMessageMetricsAsync(evt, err, "Error sending")
 		} else {
-			go portal.sendMessageMetrics(evt, errUnknownEmoji, "Error sending", nil)
+			portal.sendMessageMetricsAsync(evt, errUnknownEmoji, "Error sending")
 		}
 		return
 	}
 
 	portal.log.Warnfln("Failed to redact %s@%s: no event found", portal.Key, evt.Redacts)
-	go portal.sendMessageMetrics(evt, errReactionTargetNotFound, "Error sending", nil)
+	portal.sendMessageMetricsAsync(evt, errReactionTargetNotFound, "Error sending")
 }
 
 func typingDiff(prev, new []id.UserID) (started []id.UserID) {
@@ -905,6 +1367,10 @@ func (portal *Portal) sendSlackRepeatTyping() {
 
 func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
 	portal.log.Debugln("User left private chat portal, cleaning up and deleting...")
+	portal.bridge.audit(brSender.GetMXID(), "delete_portal", portal.Key.String(), map[string]string{
+		"room_id": portal.MXID.String(),
+		"reason":  "left private chat",
+	})
 	portal.delete()
 	portal.cleanup(false)
 
@@ -944,6 +1410,10 @@ func (portal *Portal) cleanupIfEmpty() {
 
 	if len(users) == 0 {
 		portal.log.Infoln("Room seems to be empty, cleaning up...")
+		portal.bridge.audit(portal.bridge.Bot.UserID, "delete_portal", portal.Key.String(), map[string]string{
+			"room_id": portal.MXID.String(),
+			"reason":  "room empty",
+		})
 		portal.delete()
 		portal.cleanup(false)
 	}
@@ -996,6 +1466,27 @@ func (portal *Portal) cleanup(puppetsOnly bool) {
 	}
 }
 
+// deleteRoom deletes the portal room using the Synapse admin API, which only
+// works if the bridge bot is a server admin. Otherwise, the room is made
+// invite-only and everyone is kicked, so that it's at least unusable.
+func (portal *Portal) deleteRoom() {
+	if portal.MXID == "" {
+		return
+	}
+	url := portal.bridge.Bot.BuildURL(mautrix.BaseURLPath{"_synapse", "admin", "v1", "rooms", portal.MXID})
+	_, err := portal.bridge.Bot.MakeRequest(http.MethodDelete, url, map[string]interface{}{"purge": true}, nil)
+	if err == nil {
+		portal.log.Infoln("Deleted portal room", portal.MXID)
+		return
+	}
+	portal.log.Warnfln("Failed to delete portal room with the admin API, kicking everyone instead: %v", err)
+	_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateJoinRules, "", &event.JoinRulesEventContent{JoinRule: event.JoinRuleInvite})
+	if err != nil {
+		portal.log.Warnln("Failed to make portal room invite-only:", err)
+	}
+	portal.cleanup(false)
+}
+
 func (portal *Portal) getMatrixUsers() ([]id.UserID, error) {
 	members, err := portal.MainIntent().JoinedMembers(portal.MXID)
 	if err != nil {
@@ -1114,6 +1605,22 @@ func (portal *Portal) setChannelType(channel *slack.Channel) bool {
 	return false
 }
 
+// shouldSetDMMeta returns whether the name and avatar of the room should be
+// synced from Slack. Channels always get them, DMs depend on the config.
+func (portal *Portal) shouldSetDMMeta() bool {
+	if !portal.IsPrivateChat() {
+		return true
+	}
+	switch portal.bridge.bridgeConfig().PrivateChatPortalMeta {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return portal.Encrypted
+	}
+}
+
 func (portal *Portal) GetPlainName(meta *slack.Channel) string {
 	if portal.Type == database.ChannelTypeDM || portal.Type == database.ChannelTypeGroupDM {
 		return ""
@@ -1125,7 +1632,7 @@ func (portal *Portal) GetPlainName(meta *slack.Channel) string {
 func (portal *Portal) UpdateNameDirect(name string) bool {
 	if portal.Name == name && (portal.NameSet || portal.MXID == "") {
 		return false
-	} else if !portal.Encrypted && !portal.bridge.Config.Bridge.PrivateChatPortalMeta && portal.IsPrivateChat() {
+	} else if !portal.shouldSetDMMeta() {
 		return false
 	}
 	portal.log.Debugfln("Updating name %q -> %q", portal.Name, name)
@@ -1148,7 +1655,7 @@ func (portal *Portal) UpdateName(meta *slack.Channel, sourceTeam *database.UserT
 	plainNameChanged := portal.PlainName != plainName
 	portal.PlainName = plainName
 
-	formattedName := portal.bridge.Config.Bridge.FormatChannelName(config.ChannelNameParams{
+	formattedName := portal.bridge.getTeamConfig(portal.Key.TeamID).FormatChannelName(config.ChannelNameParams{
 		Name: plainName,
 		Type: portal.Type,
 		TeamName: sourceTeam.TeamName,
@@ -1172,6 +1679,8 @@ func (portal *Portal) updateRoomAvatar() {
 func (portal *Portal) UpdateAvatarFromPuppet(puppet *Puppet) bool {
 	if portal.Avatar == puppet.Avatar && portal.AvatarURL == puppet.AvatarURL && (portal.AvatarSet || portal.MXID == "") {
 		return false
+	} else if !portal.shouldSetDMMeta() {
+		return false
 	}
 
 	portal.log.Debugfln("Updating avatar from puppet %q -> %q", portal.Avatar, puppet.Avatar)
@@ -1233,6 +1742,53 @@ func (portal *Portal) UpdateTopic(meta *slack.Channel, sourceTeam *database.User
 	return portal.UpdateTopicDirect(matrixTopic) || changed
 }
 
+// getFilter returns the channel and user filters for this portal's team.
+func (portal *Portal) getFilter() *config.FilterConfig {
+	return &portal.bridge.getTeamConfig(portal.Key.TeamID).Filter
+}
+
+// isFilteredOut checks whether the channel filter excludes this portal.
+// DMs are also excluded if the other user is blocked.
+func (portal *Portal) isFilteredOut() bool {
+	filter := portal.getFilter()
+	var name string
+	if portal.Type == database.ChannelTypeChannel {
+		name = portal.PlainName
+	}
+	if !filter.IsChannelAllowed(portal.Key.ChannelID, name) {
+		return true
+	}
+	return portal.Type == database.ChannelTypeDM && !filter.IsUserAllowed(portal.DMUserID)
+}
+
+// isReadOnly checks whether Matrix messages shouldn't be bridged to Slack in
+// this portal, either because of the per-portal flag or the config.
+func (portal *Portal) isReadOnly() bool {
+	if portal.ReadOnly {
+		return true
+	}
+	var name string
+	if portal.Type == database.ChannelTypeChannel {
+		name = portal.PlainName
+	}
+	return portal.getFilter().IsChannelReadOnly(portal.Key.ChannelID, name)
+}
+
+// isSlackSenderAllowed checks the user and bot filters for an incoming
+// Slack message. For edits, the sender is in the sub-message.
+func (portal *Portal) isSlackSenderAllowed(msg *slack.MessageEvent) bool {
+	filter := portal.getFilter()
+	sender := &msg.Msg
+	if msg.Msg.SubType == "message_changed" && msg.SubMessage != nil {
+		sender = msg.SubMessage
+	}
+	isBot := sender.SubType == "bot_message" || sender.BotID != ""
+	if isBot && filter.BlockBots {
+		return false
+	}
+	return filter.IsUserAllowed(sender.User) && filter.IsUserAllowed(sender.BotID)
+}
+
 func (portal *Portal) UpdateInfo(source *User, sourceTeam *database.UserTeam, meta *slack.Channel, force bool) *slack.Channel {
 	portal.log.Debugfln("Updating info for portal %s", portal.Key)
 	changed := false
@@ -1240,7 +1796,7 @@ func (portal *Portal) UpdateInfo(source *User, sourceTeam *database.UserTeam, me
 	if meta == nil {
 		portal.log.Debugfln("UpdateInfo called without metadata, fetching from server via %s", sourceTeam.Key.SlackID)
 		var err error
-		meta, err = sourceTeam.Client.GetConversationInfo(portal.Key.ChannelID, true)
+		meta, err = portal.bridge.InfoCache.GetConversationInfo(sourceTeam, portal.Key.ChannelID)
 		if err != nil {
 			portal.log.Errorfln("Failed to fetch meta via %s: %v", sourceTeam.Key.SlackID, err)
 			return nil
@@ -1254,12 +1810,20 @@ func (portal *Portal) UpdateInfo(source *User, sourceTeam *database.UserTeam, me
 		portal.log.Infoln("Found other user ID:", portal.DMUserID)
 		changed = true
 	}
+	if portal.DMReceiverID == "" && portal.IsPrivateChat() && sourceTeam != nil {
+		portal.DMReceiverID = sourceTeam.Key.SlackID
+		changed = true
+	}
 
-	if portal.Type == database.ChannelTypeChannel {
+	if portal.IsPrivateChat() && portal.DMUserID != "" {
+		puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, portal.DMUserID)
+		puppet.UpdateInfo(sourceTeam, nil)
+		changed = portal.UpdateNameDirect(puppet.Name) || changed
+		changed = portal.UpdateAvatarFromPuppet(puppet) || changed
+	} else {
 		changed = portal.UpdateName(meta, sourceTeam) || changed
+		changed = portal.updateAvatarFromTeam(portal.bridge.DB.TeamInfo.GetBySlackTeam(portal.Key.TeamID)) || changed
 	}
-
-	changed = portal.UpdateName(meta, sourceTeam) || changed
 	changed = portal.UpdateTopic(meta, sourceTeam) || changed
 
 	if changed || force {
@@ -1272,6 +1836,7 @@ func (portal *Portal) UpdateInfo(source *User, sourceTeam *database.UserTeam, me
 
 type ConvertedSlackFile struct {
 	Event       *event.MessageEventContent
+	Extra       map[string]interface{}
 	SlackFileID string
 }
 
@@ -1280,6 +1845,7 @@ type ConvertedSlackMessage struct {
 	Event           *event.MessageEventContent
 	SlackTimestamp  string
 	SlackThreadTs   string
+	SlackSubtype    string
 	SlackAuthor     string
 	SlackReactions  []slack.ItemReaction
 	SlackThread     []slack.Message
@@ -1295,25 +1861,35 @@ func (portal *Portal) HandleSlackMessage(user *User, userTeam *database.UserTeam
 		return
 	}
 	if msg.Msg.IsEphemeral {
-		portal.log.Debugfln("Ignoring ephemeral message")
+		portal.handleSlackEphemeral(user, userTeam, &msg.Msg)
 		return
 	}
 
 	if portal.MXID == "" {
-		channel, err := userTeam.Client.GetConversationInfo(msg.Channel, true)
+		channel, err := portal.bridge.InfoCache.GetConversationInfo(userTeam, msg.Channel)
 		if err != nil {
 			portal.log.Errorln("failed to lookup channel info:", err)
 			return
 		}
 
 		portal.log.Debugln("Creating Matrix room from incoming message")
-		if err := portal.CreateMatrixRoom(user, userTeam, channel, false); err != nil {
+		if err := portal.CreateMatrixRoom(user, userTeam, channel, false); errors.Is(err, errPortalFiltered) {
+			return
+		} else if err != nil {
 			portal.log.Errorln("Failed to create portal room:", err)
 			return
 		}
+	} else if portal.isFilteredOut() {
+		portal.log.Debugfln("Dropping message %s: channel is excluded by the bridge filter", msg.Msg.Timestamp)
+		return
 	}
 
-	existing := portal.bridge.DB.Message.GetBySlackID(portal.Key, msg.Msg.Timestamp)
+	if portal.bridge.DB.RelayedReaction.IsCountMessage(portal.Key, msg.Msg.Timestamp) {
+		portal.log.Debugfln("Dropping reaction count message %s", msg.Msg.Timestamp)
+		return
+	}
+
+	existing := portal.getMessageBySlackID(msg.Msg.Timestamp)
 	if existing != nil && msg.Msg.SubType != "message_changed" { // Slack reuses the same message ID on message edits
 		portal.log.Debugln("Dropping duplicate message:", msg.Msg.Timestamp)
 		return
@@ -1322,6 +1898,9 @@ func (portal *Portal) HandleSlackMessage(user *User, userTeam *database.UserTeam
 		portal.log.Debugfln("Not sending edit for nonexistent message %s", msg.Msg.Timestamp)
 		return
 	}
+	if portal.isSlackEcho(msg, existing) {
+		return
+	}
 
 	if msg.Msg.User == "" {
 		portal.log.Debugfln("Starting handling of %s (no sender), subtype %s", msg.Msg.Timestamp, msg.Msg.SubType)
@@ -1329,38 +1908,45 @@ func (portal *Portal) HandleSlackMessage(user *User, userTeam *database.UserTeam
 		portal.log.Debugfln("Starting handling of %s by %s, subtype %s", msg.Msg.Timestamp, msg.Msg.User, msg.Msg.SubType)
 	}
 
+	if !portal.isBotMessageAllowed(userTeam, &msg.Msg) {
+		portal.log.Debugfln("Ignoring bot message %s, bot messages are disabled in this portal", msg.Msg.Timestamp)
+		return
+	}
+	if !portal.isSlackSenderAllowed(msg) {
+		portal.log.Debugfln("Dropping message %s: sender is excluded by the bridge filter", msg.Msg.Timestamp)
+		return
+	}
+
 	switch msg.Msg.SubType {
 	case "", "me_message", "bot_message": // Regular messages and /me
-		portal.HandleSlackNormalMessage(user, userTeam, &msg.Msg, nil)
+		if portal.isSlackLoop(&msg.Msg) {
+			return
+		}
+		portal.rememberSlackBridgedText(userTeam, &msg.Msg)
+		portal.HandleSlackNormalMessage(user, userTeam, &msg.Msg, nil, nil)
 	case "message_changed":
-		portal.HandleSlackNormalMessage(user, userTeam, msg.SubMessage, existing)
+		if msg.SubMessage != nil && msg.SubMessage.SubType == "tombstone" {
+			portal.handleSlackTombstone(msg.SubMessage)
+		} else if msg.SubMessage != nil && msg.SubMessage.SubType == "huddle_thread" {
+			// Huddle messages are edited whenever someone joins, so the edits don't get edit history
+			portal.HandleSlackNormalMessage(user, userTeam, portal.convertSlackHuddle(userTeam, msg.SubMessage), existing, nil)
+		} else {
+			portal.HandleSlackNormalMessage(user, userTeam, msg.SubMessage, existing, msg.PreviousMessage)
+		}
+	case "huddle_thread":
+		portal.HandleSlackNormalMessage(user, userTeam, portal.convertSlackHuddle(userTeam, &msg.Msg), nil, nil)
 	case "channel_topic", "channel_purpose", "channel_name", "group_topic", "group_purpose", "group_name":
 		portal.UpdateInfo(user, userTeam, nil, false)
 		portal.log.Debugfln("Received %s update, updating portal name and topic", msg.Msg.SubType)
 	case "message_deleted":
-		// Slack doesn't tell us who deleted a message, so there is no intent here
-		message := portal.bridge.DB.Message.GetBySlackID(portal.Key, msg.Msg.DeletedTimestamp)
-		if message == nil {
-			portal.log.Warnfln("Failed to redact %s: Matrix event not known", msg.Msg.DeletedTimestamp)
+		portal.handleSlackDeletion(msg.Msg.DeletedTimestamp)
+	case "group_join", "channel_join", "group_leave", "channel_leave":
+		if portal.BridgeJoinLeave {
+			portal.handleSlackMembership(msg.Msg.User, strings.HasSuffix(msg.Msg.SubType, "_join"))
 		} else {
-			_, err := portal.MainIntent().RedactEvent(portal.MXID, message.MatrixID)
-			if err != nil {
-				portal.log.Errorfln("Failed to redact %s: %v", message.MatrixID, err)
-			} else {
-				message.Delete()
-			}
-		}
-
-		attachments := portal.bridge.DB.Attachment.GetAllBySlackMessageID(portal.Key, msg.Msg.DeletedTimestamp)
-		for _, attachment := range attachments {
-			_, err := portal.MainIntent().RedactEvent(portal.MXID, attachment.MatrixEventID)
-			if err != nil {
-				portal.log.Errorfln("Failed to redact %s: %v", attachment.MatrixEventID, err)
-			} else {
-				attachment.Delete()
-			}
+			portal.log.Debugfln("Ignoring %s of %s, join/leave bridging is disabled in this portal", msg.Msg.SubType, msg.Msg.User)
 		}
-	case "message_replied", "group_join", "group_leave", "channel_join", "channel_leave", "thread_broadcast": // Not yet an exhaustive list.
+	case "message_replied", "thread_broadcast", "tombstone": // Not yet an exhaustive list.
 		// These subtypes are simply ignored, because they're handled elsewhere/in other ways (Slack sends multiple info of these events)
 		portal.log.Debugfln("Received message subtype %s, which is ignored", msg.Msg.SubType)
 	default:
@@ -1368,14 +1954,54 @@ func (portal *Portal) HandleSlackMessage(user *User, userTeam *database.UserTeam
 	}
 }
 
+func (portal *Portal) handleSlackMembership(userID string, joined bool) {
+	if userID == "" {
+		return
+	}
+	puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, userID)
+	if puppet == nil {
+		return
+	}
+	var err error
+	if joined {
+		err = puppet.DefaultIntent().EnsureJoined(portal.MXID)
+	} else {
+		_, err = puppet.DefaultIntent().LeaveRoom(portal.MXID)
+	}
+	if err != nil {
+		portal.log.Warnfln("Failed to bridge membership change of %s (joined: %t): %v", userID, joined, err)
+	}
+}
+
 func (portal *Portal) addThreadMetadata(content *event.MessageEventContent, threadTs string) (hasThread bool, hasReply bool) {
 	// fetch thread metadata and add to message
 	if threadTs != "" {
+		latestThreadMessage := portal.bridge.DB.Message.GetLastInThread(portal.Key, threadTs)
+		rootThreadMessage := portal.getMessageBySlackID(threadTs)
+
+		switch portal.getThreadMode() {
+		case database.ThreadModeFlatten:
+			if rootThreadMessage != nil {
+				portal.addThreadQuote(content, rootThreadMessage.MatrixID)
+			}
+			return false, false
+		case database.ThreadModeReply:
+			if latestThreadMessage == nil {
+				latestThreadMessage = rootThreadMessage
+			}
+			if latestThreadMessage != nil {
+				if content.RelatesTo == nil {
+					content.RelatesTo = &event.RelatesTo{}
+				}
+				content.RelatesTo.SetReplyTo(latestThreadMessage.MatrixID)
+				return false, true
+			}
+			return false, false
+		}
+
 		if content.RelatesTo == nil {
 			content.RelatesTo = &event.RelatesTo{}
 		}
-		latestThreadMessage := portal.bridge.DB.Message.GetLastInThread(portal.Key, threadTs)
-		rootThreadMessage := portal.bridge.DB.Message.GetBySlackID(portal.Key, threadTs)
 
 		var latestThreadMessageID id.EventID
 		if latestThreadMessage != nil {
@@ -1395,21 +2021,17 @@ func (portal *Portal) addThreadMetadata(content *event.MessageEventContent, thre
 	return false, false
 }
 
-func (portal *Portal) ConvertSlackMessage(userTeam *database.UserTeam, msg *slack.Msg) (converted ConvertedSlackMessage) {
-	if msg.User != "" {
-		converted.SlackAuthor = msg.User
-	} else if msg.BotID != "" {
-		converted.SlackAuthor = msg.BotID
-	} else {
-		portal.log.Errorfln("Couldn't convert text message %s: no user or bot ID in message", msg.Timestamp)
-		return
-	}
-	converted.SlackTimestamp = msg.Timestamp
+// convertSlackText renders the text, attachments and blocks of a Slack
+// message, or returns nil if the message has no text.
+func (portal *Portal) convertSlackText(msg *slack.Msg) *event.MessageEventContent {
 	var text string
 	if msg.Text != "" {
 		text = msg.Text
 	}
 	for _, attachment := range msg.Attachments {
+		if isSlackListAttachment(&attachment) {
+			continue
+		}
 		if text != "" {
 			text += "\n"
 		}
@@ -1420,15 +2042,64 @@ func (portal *Portal) ConvertSlackMessage(userTeam *database.UserTeam, msg *slac
 		}
 	}
 
+	var content *event.MessageEventContent
 	if len(msg.Blocks.BlockSet) != 0 {
 		var err error
-		converted.Event, err = portal.SlackBlocksToMatrix(msg.Blocks)
+		content, err = portal.SlackBlocksToMatrix(msg.Blocks)
 		if err != nil {
 			portal.log.Warnfln("Error rendering Slack blocks: %v", err)
-			converted.Event = nil
+			content = nil
 		}
 	} else if text != "" {
-		converted.Event = portal.renderSlackMarkdown(text)
+		content = portal.renderSlackMarkdown(text)
+	}
+	return portal.addSlackListItems(content, msg.Attachments)
+}
+
+func (portal *Portal) ConvertSlackMessage(userTeam *database.UserTeam, msg *slack.Msg) ConvertedSlackMessage {
+	converted, _ := portal.convertSlackMessage(userTeam, msg, false)
+	return converted
+}
+
+// convertAndFilterSlackMessage converts a Slack message that's bridged live.
+// The text is translated, and the text and file captions are passed through
+// the content filter before any file is uploaded to Matrix, so that rejected
+// messages don't leak their attachments to the homeserver.
+func (portal *Portal) convertAndFilterSlackMessage(userTeam *database.UserTeam, msg *slack.Msg) (ConvertedSlackMessage, error) {
+	return portal.convertSlackMessage(userTeam, msg, true)
+}
+
+func (portal *Portal) convertSlackMessage(userTeam *database.UserTeam, msg *slack.Msg, live bool) (converted ConvertedSlackMessage, err error) {
+	if msg.User != "" {
+		converted.SlackAuthor = msg.User
+	} else if author := portal.getAppDMAuthor(userTeam, msg); author != "" {
+		converted.SlackAuthor = author
+	} else if msg.BotID != "" {
+		converted.SlackAuthor = msg.BotID
+	} else {
+		portal.log.Errorfln("Couldn't convert text message %s: no user or bot ID in message", msg.Timestamp)
+		return
+	}
+	filter := func(content *event.MessageEventContent) error {
+		if !live {
+			return nil
+		}
+		return portal.filterSlackContent(converted.SlackAuthor, content)
+	}
+	converted.SlackTimestamp = msg.Timestamp
+	converted.SlackSubtype = msg.SubType
+	converted.Event = portal.convertSlackText(msg)
+	// set m.emote if it's a /me message
+	if converted.Event != nil && msg.SubType == "me_message" {
+		converted.Event.MsgType = event.MsgEmote
+	} else if converted.Event != nil && (msg.SubType == "huddle_thread" || isSlackListUpdate(msg)) {
+		converted.Event.MsgType = event.MsgNotice
+	}
+	if live && converted.Event != nil {
+		portal.translateSlackMessage(converted.Event)
+		if err = filter(converted.Event); err != nil {
+			return
+		}
 	}
 
 	for _, file := range msg.Files {
@@ -1436,40 +2107,50 @@ func (portal *Portal) ConvertSlackMessage(userTeam *database.UserTeam, msg *slac
 			SlackFileID: file.ID,
 		}
 		content := portal.renderSlackFile(file)
-		portal.addThreadMetadata(&content, msg.ThreadTimestamp)
-		var data bytes.Buffer
-		var err error
-		if file.URLPrivate != "" {
-			err = userTeam.Client.GetFile(file.URLPrivate, &data)
-		} else if file.PermalinkPublic != "" {
-			client := http.Client{}
-			var resp *http.Response
-			resp, err = client.Get(file.PermalinkPublic)
-			if err != nil {
-				portal.log.Errorfln("Error downloading Slack file %s: %v", file.ID, err)
-				continue
+		if isSlackListFile(&file) {
+			convertedFile.Event = renderSlackListFile(&file)
+		} else if portal.MediaPolicy == database.MediaPolicyBlock {
+			convertedFile.Event = &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("\u26a0 %s was not bridged: %v", file.Name, errMediaBlocked),
 			}
-			_, err = data.ReadFrom(resp.Body)
-		} else {
-			portal.log.Errorln("No usable URL found in file object, not bridging file")
+		} else if portal.shouldLinkSlackFile(&file) {
+			convertedFile.Event = portal.makeSlackFileLink(userTeam, &file)
+		}
+		if convertedFile.Event != nil {
+			if err = filter(convertedFile.Event); err != nil {
+				return
+			}
+			converted.FileAttachments = append(converted.FileAttachments, convertedFile)
 			continue
 		}
-		if err != nil {
-			portal.log.Errorfln("Error downloading Slack file %s: %v", file.ID, err)
+		// The caption is filtered before the file is uploaded to Matrix
+		if err = filter(&content); err != nil {
+			return
+		}
+		convertedFile.Extra, err = portal.bridgeSlackFile(userTeam, &file, &content)
+		if errors.Is(err, errMediaTooLarge) || errors.Is(err, errFileInfected) || errors.Is(err, errAntivirusScanFailed) {
+			convertedFile.Event = &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("\u26a0 %s was not bridged: %v", file.Name, err),
+			}
+			converted.FileAttachments = append(converted.FileAttachments, convertedFile)
+			continue
+		} else if errors.Is(err, mautrix.MTooLarge) {
+			portal.log.Errorfln("File %s too large for Matrix server: %v", file.ID, err)
+			continue
+		} else if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(413) {
+			portal.log.Errorfln("Proxy rejected too large file %s: %v", file.ID, err)
+			continue
+		} else if err != nil {
+			portal.log.Errorfln("Error bridging Slack file %s to Matrix: %v", file.ID, err)
 			continue
 		}
-		err = portal.uploadMedia(portal.MainIntent(), data.Bytes(), &content)
-		if err != nil {
-			if errors.Is(err, mautrix.MTooLarge) {
-				portal.log.Errorfln("File %s too large for Matrix server: %v", file.ID, err)
-				continue
-			} else if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(413) {
-				portal.log.Errorfln("Proxy rejected too large file %s: %v", file.ID, err)
-				continue
-			} else {
-				portal.log.Errorfln("Error uploading file %s to Matrix: %v", file.ID, err)
-				continue
+		for key, value := range portal.convertSlackClip(userTeam, &file, &content) {
+			if convertedFile.Extra == nil {
+				convertedFile.Extra = make(map[string]interface{})
 			}
+			convertedFile.Extra[key] = value
 		}
 		convertedFile.Event = &content
 		converted.FileAttachments = append(converted.FileAttachments, convertedFile)
@@ -1477,12 +2158,18 @@ func (portal *Portal) ConvertSlackMessage(userTeam *database.UserTeam, msg *slac
 
 	converted.SlackThreadTs = msg.ThreadTimestamp
 
-	return converted
+	return converted, nil
 }
 
-func (portal *Portal) HandleSlackNormalMessage(user *User, userTeam *database.UserTeam, msg *slack.Msg, editExisting *database.Message) {
+func (portal *Portal) HandleSlackNormalMessage(user *User, userTeam *database.UserTeam, msg *slack.Msg, editExisting *database.Message, previous *slack.Msg) {
 	ts := parseSlackTimestamp(msg.Timestamp)
-	e := portal.ConvertSlackMessage(userTeam, msg)
+	// Resolved before converting so that the usergroup handles are cached for rendering
+	mentions := portal.getUsergroupMentions(userTeam, msg)
+	e, err := portal.convertAndFilterSlackMessage(userTeam, msg)
+	if err != nil {
+		portal.log.Debugfln("Dropping message %s: %v", msg.Timestamp, err)
+		return
+	}
 
 	puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, e.SlackAuthor)
 	if puppet == nil {
@@ -1491,16 +2178,23 @@ func (portal *Portal) HandleSlackNormalMessage(user *User, userTeam *database.Us
 	}
 	intent := puppet.IntentFor(portal)
 
+	// The number of Matrix events the message has been bridged as so far
+	var parts int
 	for _, file := range e.FileAttachments {
+		// Thread metadata is only added here, after filtering, so that flattened threads get exactly one quote
 		if editExisting == nil {
 			portal.addThreadMetadata(file.Event, msg.ThreadTimestamp)
 		}
 
-		resp, err := portal.sendMatrixMessage(intent, event.EventMessage, file.Event, nil, ts.UnixMilli())
+		resp, err := portal.sendMatrixMessage(intent, event.EventMessage, file.Event, file.Extra, ts.UnixMilli())
 		if err != nil {
 			portal.log.Warnfln("Failed to send media message %s to matrix: %v", ts, err)
+			portal.bridge.countUsage(user.MXID, database.StatErrors, 1)
 			continue
 		}
+		if editExisting == nil && file.Event.Info != nil {
+			portal.bridge.countUsage(user.MXID, database.StatMediaBytesToMatrix, int64(file.Event.Info.Size))
+		}
 		go portal.sendDeliveryReceipt(resp.EventID)
 		attachment := portal.bridge.DB.Attachment.New()
 		attachment.Channel = portal.Key
@@ -1509,27 +2203,41 @@ func (portal *Portal) HandleSlackNormalMessage(user *User, userTeam *database.Us
 		attachment.MatrixEventID = resp.EventID
 		attachment.SlackThreadID = msg.ThreadTimestamp
 		attachment.Insert(nil)
+		parts++
 	}
 
 	if e.Event != nil {
-		// set m.emote if it's a /me message
-		if msg.SubType == "me_message" {
-			e.Event.MsgType = event.MsgEmote
-		}
-
+		portal.addSenderLocalTime(userTeam, e.Event, msg.User, ts)
+		var extra map[string]interface{}
+		var previousContent *event.MessageEventContent
 		if editExisting != nil {
+			previousContent = portal.getEditHistoryContent(e.SlackAuthor, previous)
+			if previousContent != nil {
+				extra = map[string]interface{}{editHistoryField: previousContent}
+			}
 			e.Event.SetEdit(editExisting.MatrixID)
 		} else {
 			portal.addThreadMetadata(e.Event, msg.ThreadTimestamp)
+			// Edits don't mention anyone, so usergroups only notify their members on the original message
+			if len(mentions) > 0 {
+				extra = map[string]interface{}{"m.mentions": map[string]interface{}{"user_ids": mentions}}
+			}
 		}
 
-		resp, err := portal.sendMatrixMessage(intent, event.EventMessage, e.Event, nil, ts.UnixMilli())
+		resp, err := portal.sendMatrixMessage(intent, event.EventMessage, e.Event, extra, ts.UnixMilli())
 		if err != nil {
 			portal.log.Warnfln("Failed to send message %s to matrix: %v", msg.Timestamp, err)
+			portal.bridge.countUsage(user.MXID, database.StatErrors, 1)
 			return
 		}
+		if previousContent != nil && portal.getEditHistoryMode() == database.EditHistoryThread {
+			portal.sendEditHistoryNotice(editExisting, msg.ThreadTimestamp, previousContent)
+		}
 
-		portal.markMessageHandled(nil, msg.Timestamp, msg.ThreadTimestamp, resp.EventID, e.SlackAuthor)
+		if editExisting == nil {
+			portal.markMessageHandled(nil, msg.Timestamp, msg.ThreadTimestamp, msg.SubType, parts, resp.EventID, e.SlackAuthor)
+			portal.bridge.countUsage(user.MXID, database.StatMessagesToMatrix, 1)
+		}
 		go portal.sendDeliveryReceipt(resp.EventID)
 		return
 	}
@@ -1546,6 +2254,11 @@ func (portal *Portal) HandleSlackReaction(user *User, userTeam *database.UserTea
 
 	portal.log.Debugfln("Handling Slack reaction: %v %s %s", portal.Key, msg.Item.Timestamp, msg.Reaction)
 
+	if portal.isFilteredOut() || !portal.getFilter().IsUserAllowed(msg.User) {
+		portal.log.Debugfln("Dropping reaction from %s: excluded by the bridge filter", msg.User)
+		return
+	}
+
 	if portal.MXID == "" {
 		portal.log.Warnfln("No Matrix portal created for room %s %s, not bridging reaction")
 	}
@@ -1564,7 +2277,7 @@ func (portal *Portal) HandleSlackReaction(user *User, userTeam *database.UserTea
 	puppet.UpdateInfo(userTeam, nil)
 	intent := puppet.IntentFor(portal)
 
-	targetMessage := portal.bridge.DB.Message.GetBySlackID(portal.Key, msg.Item.Timestamp)
+	targetMessage := portal.getMessageBySlackID(msg.Item.Timestamp)
 	if targetMessage == nil {
 		portal.log.Errorfln("Not sending reaction: can't find Matrix message for %s %s %s", portal.Key.TeamID, portal.Key.ChannelID, msg.Item.Timestamp)
 		return
@@ -1581,8 +2294,10 @@ func (portal *Portal) HandleSlackReaction(user *User, userTeam *database.UserTea
 	resp, err := intent.SendMassagedMessageEvent(portal.MXID, event.EventReaction, &content, parseSlackTimestamp(msg.EventTimestamp).UnixMilli())
 	if err != nil {
 		portal.log.Errorfln("Failed to bridge reaction: %v", err)
+		portal.bridge.countUsage(user.MXID, database.StatErrors, 1)
 		return
 	}
+	portal.bridge.countUsage(user.MXID, database.StatReactionsToMatrix, 1)
 
 	dbReaction := portal.bridge.DB.Reaction.New()
 	dbReaction.Channel = portal.Key
@@ -1604,6 +2319,8 @@ func (portal *Portal) HandleSlackReactionRemoved(user *User, userTeam *database.
 	if msg.Type != "reaction_removed" {
 		portal.log.Warnln("ignoring unknown message type:", msg.Type)
 		return
+	} else if portal.isFilteredOut() || !portal.getFilter().IsUserAllowed(msg.User) {
+		return
 	}
 
 	dbReaction := portal.bridge.DB.Reaction.GetBySlackID(portal.Key, msg.User, msg.Item.Timestamp, msg.Reaction)
@@ -1621,6 +2338,10 @@ func (portal *Portal) HandleSlackReactionRemoved(user *User, userTeam *database.
 	intent := puppet.IntentFor(portal)
 
 	_, err := intent.RedactEvent(portal.MXID, dbReaction.MatrixEventID)
+	if err != nil && intent != portal.MainIntent() {
+		// Reactions bridged from Matrix were sent by the Matrix user, so the ghost can't redact them
+		_, err = portal.MainIntent().RedactEvent(portal.MXID, dbReaction.MatrixEventID)
+	}
 	if err != nil {
 		portal.log.Errorfln("Failed to redact reaction %v %s %s %s: %v", portal.Key, msg.User, msg.Item.Timestamp, msg.Reaction, err)
 		return
@@ -1630,7 +2351,7 @@ func (portal *Portal) HandleSlackReactionRemoved(user *User, userTeam *database.
 }
 
 func (portal *Portal) HandleSlackTyping(user *User, userTeam *database.UserTeam, msg *slack.UserTypingEvent) {
-	if portal.MXID == "" {
+	if portal.MXID == "" || portal.isFilteredOut() || !portal.getFilter().IsUserAllowed(msg.User) {
 		return
 	}
 	puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, msg.User)
@@ -1659,7 +2380,7 @@ func (portal *Portal) HandleSlackChannelMarked(user *User, userTeam *database.Us
 	puppet.UpdateInfo(userTeam, nil)
 	intent := puppet.IntentFor(portal)
 
-	message := portal.bridge.DB.Message.GetBySlackID(portal.Key, msg.Timestamp)
+	message := portal.getMessageBySlackID(msg.Timestamp)
 
 	if message == nil {
 		portal.log.Debugfln("Couldn't mark portal %s as read: no Matrix room", portal.Key)
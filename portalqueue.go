@@ -0,0 +1,207 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+var errPortalQueueFull = errors.New("too many messages are waiting to be bridged in this room, please try again later")
+
+// portalScheduler runs Matrix messages of all portals on a bounded pool of
+// workers. A portal is only ever handled by one worker at a time, which keeps
+// its messages in order, and workers move on to other portals after each
+// message, so one slow room can't hold up the others.
+type portalScheduler struct {
+	ready []*Portal
+	lock  sync.Mutex
+	cond  *sync.Cond
+}
+
+func newPortalScheduler() *portalScheduler {
+	ps := &portalScheduler{}
+	ps.cond = sync.NewCond(&ps.lock)
+	return ps
+}
+
+func (ps *portalScheduler) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go ps.worker()
+	}
+}
+
+func (ps *portalScheduler) schedule(portal *Portal) {
+	ps.lock.Lock()
+	ps.ready = append(ps.ready, portal)
+	ps.lock.Unlock()
+	ps.cond.Signal()
+}
+
+func (ps *portalScheduler) next() *Portal {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for len(ps.ready) == 0 {
+		ps.cond.Wait()
+	}
+	portal := ps.ready[0]
+	ps.ready[0] = nil
+	ps.ready = ps.ready[1:]
+	return portal
+}
+
+func (ps *portalScheduler) worker() {
+	for {
+		ps.next().handleNextMatrixMessage()
+	}
+}
+
+// queueMatrixMessage adds a message to the portal's queue and schedules the
+// portal if it isn't already waiting for or being handled by a worker. Flush
+// markers are always accepted, other messages are rejected if the queue is
+// full instead of blocking event handling for every other room.
+func (portal *Portal) queueMatrixMessage(msg portalMatrixMessage) error {
+	portal.matrixQueueLock.Lock()
+	defer portal.matrixQueueLock.Unlock()
+	if msg.flushed == nil && len(portal.matrixQueue) >= portal.bridge.bridgeConfig().PortalMessageBuffer {
+		return errPortalQueueFull
+	}
+	portal.matrixQueue = append(portal.matrixQueue, msg)
+	if !portal.matrixQueueScheduled {
+		portal.matrixQueueScheduled = true
+		portal.bridge.portalScheduler.schedule(portal)
+	}
+	return nil
+}
+
+// queueMatrixRetries puts messages that were sent before everything currently
+// in the portal's queue in front of the queue.
+func (portal *Portal) queueMatrixRetries(msgs []portalMatrixMessage) {
+	portal.matrixQueueLock.Lock()
+	defer portal.matrixQueueLock.Unlock()
+	portal.matrixQueue = append(msgs, portal.matrixQueue...)
+	if !portal.matrixQueueScheduled {
+		portal.matrixQueueScheduled = true
+		portal.bridge.portalScheduler.schedule(portal)
+	}
+}
+
+func (portal *Portal) handleNextMatrixMessage() {
+	portal.matrixQueueLock.Lock()
+	if len(portal.matrixQueue) == 0 {
+		portal.matrixQueueScheduled = false
+		portal.matrixQueueLock.Unlock()
+		return
+	}
+	msg := portal.matrixQueue[0]
+	if breaker := portal.getOpenCircuitBreaker(msg); breaker != nil {
+		// Leave the message at the front of the queue and stay scheduled, so
+		// that later messages keep waiting behind it without using a worker.
+		portal.matrixQueueLock.Unlock()
+		go portal.waitForCircuitBreaker(breaker, msg)
+		return
+	}
+	portal.matrixQueue[0] = portalMatrixMessage{}
+	portal.matrixQueue = portal.matrixQueue[1:]
+	portal.matrixQueueLock.Unlock()
+
+	if msg.flushed != nil {
+		close(msg.flushed)
+	} else {
+		portal.handleMatrixMessages(msg)
+	}
+
+	portal.matrixQueueLock.Lock()
+	if len(portal.matrixQueue) == 0 {
+		portal.matrixQueueScheduled = false
+	} else {
+		// Go to the back of the line so that other portals get a turn too
+		portal.bridge.portalScheduler.schedule(portal)
+	}
+	portal.matrixQueueLock.Unlock()
+}
+
+// getSendingUserTeam returns the userteam that messages of the user are sent
+// to Slack with, which is the relay user's if the user isn't logged in.
+func (portal *Portal) getSendingUserTeam(user *User) *database.UserTeam {
+	userTeam := user.GetUserTeam(portal.Key.TeamID)
+	if userTeam == nil {
+		userTeam = portal.getRelayUserTeam()
+	}
+	return userTeam
+}
+
+func (portal *Portal) getOpenCircuitBreaker(msg portalMatrixMessage) *circuitBreaker {
+	if msg.flushed != nil || msg.evt.Type != event.EventMessage {
+		return nil
+	}
+	userTeam := portal.getSendingUserTeam(msg.user)
+	if userTeam == nil || userTeam.Client == nil {
+		return nil
+	}
+	breaker := portal.bridge.getCircuitBreaker(userTeam)
+	if !breaker.IsOpen() {
+		return nil
+	}
+	return breaker
+}
+
+// waitForCircuitBreaker waits for the Slack API to recover before the message
+// at the front of the queue is sent, then puts the portal back in line. The
+// message fails if the API doesn't recover before the handling deadline.
+func (portal *Portal) waitForCircuitBreaker(breaker *circuitBreaker, msg portalMatrixMessage) {
+	portal.log.Debugfln("Slack API for %s is failing, waiting before sending %s", breaker.getUserTeam().Key, msg.evt.ID)
+	ms := metricSender{portal: portal, timings: &messageTimings{}, retryNum: msg.retryNum, previousNotice: msg.retryNotice}
+	ms.sendMessageMetrics(msg.evt, errSlackUnavailable, "Paused sending", false)
+
+	ctx := context.Background()
+	if _, deadline := portal.getMessageHandlingTimeouts(); deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	err := breaker.Wait(ctx)
+
+	portal.matrixQueueLock.Lock()
+	// The queue may have been emptied by a shutdown while waiting
+	isHead := len(portal.matrixQueue) > 0 && portal.matrixQueue[0].evt == msg.evt
+	if isHead && err != nil {
+		portal.matrixQueue[0] = portalMatrixMessage{}
+		portal.matrixQueue = portal.matrixQueue[1:]
+	} else if isHead {
+		portal.matrixQueue[0].retryNotice = ms.getNoticeID()
+	}
+	portal.matrixQueueLock.Unlock()
+	if isHead && err != nil {
+		ms.sendMessageMetrics(msg.evt, err, "Error sending", true)
+	}
+	portal.bridge.portalScheduler.schedule(portal)
+}
+
+// takeMatrixQueue removes and returns everything currently in the queue.
+func (portal *Portal) takeMatrixQueue() []portalMatrixMessage {
+	portal.matrixQueueLock.Lock()
+	defer portal.matrixQueueLock.Unlock()
+	queue := portal.matrixQueue
+	portal.matrixQueue = nil
+	return queue
+}
@@ -25,6 +25,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -50,7 +51,7 @@ func newProvisioningAPI(br *SlackBridge) *ProvisioningAPI {
 		log:    br.Log.Sub("Provisioning"),
 	}
 
-	prefix := br.Config.Bridge.Provisioning.Prefix
+	prefix := br.bridgeConfig().Provisioning.Prefix
 
 	p.log.Debugln("Enabling provisioning API at", prefix)
 
@@ -61,6 +62,7 @@ func newProvisioningAPI(br *SlackBridge) *ProvisioningAPI {
 	r.HandleFunc("/v1/ping", p.ping).Methods(http.MethodGet)
 	r.HandleFunc("/v1/login", p.login).Methods(http.MethodPost)
 	r.HandleFunc("/v1/logout", p.logout).Methods(http.MethodPost)
+	r.HandleFunc("/v1/stats", p.stats).Methods(http.MethodGet)
 	p.bridge.AS.Router.HandleFunc("/_matrix/app/com.beeper.asmux/ping", p.BridgeStatePing).Methods(http.MethodPost)
 	p.bridge.AS.Router.HandleFunc("/_matrix/app/com.beeper.bridge_state", p.BridgeStatePing).Methods(http.MethodPost)
 
@@ -114,7 +116,7 @@ func (p *ProvisioningAPI) authMiddleware(h http.Handler) http.Handler {
 		// Special case the login endpoint
 		auth = strings.TrimPrefix(auth, "Bearer ")
 
-		if auth != p.bridge.Config.Bridge.Provisioning.SharedSecret {
+		if auth != p.bridge.bridgeConfig().Provisioning.SharedSecret {
 			jsonResponse(w, http.StatusForbidden, map[string]interface{}{
 				"error":   "Invalid auth token",
 				"errcode": "M_FORBIDDEN",
@@ -132,6 +134,11 @@ func (p *ProvisioningAPI) authMiddleware(h http.Handler) http.Handler {
 		duration := time.Since(start).Seconds()
 
 		p.log.Infofln("%s %s from %s took %.2f seconds and returned status %d", r.Method, r.URL.Path, user.MXID, duration, wWrap.statusCode)
+		if r.Method != http.MethodGet {
+			p.bridge.audit(user.MXID, "provisioning", r.Method+" "+r.URL.Path, map[string]string{
+				"status": strconv.Itoa(wWrap.statusCode),
+			})
+		}
 	})
 }
 
@@ -179,6 +186,27 @@ func (p *ProvisioningAPI) ping(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, http.StatusOK, resp)
 }
 
+func (p *ProvisioningAPI) stats(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	if !p.bridge.bridgeConfig().UsageStats {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Usage stats are disabled",
+			ErrCode: "M_NOT_FOUND",
+		})
+		return
+	}
+	stats := p.bridge.DB.UserStats.Get(user.MXID)
+	if stats == nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to get usage stats",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, stats)
+}
+
 func (p *ProvisioningAPI) logout(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
 	user := p.bridge.GetUserByMXID(id.UserID(userID))
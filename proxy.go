@@ -0,0 +1,101 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/slack-go/slack"
+)
+
+// proxyClients caches HTTP clients by proxy URL, so connections are reused
+// between requests instead of each request getting its own transport.
+type proxyClients struct {
+	clients map[string]*http.Client
+	lock    sync.Mutex
+}
+
+func (br *SlackBridge) getProxyURL(teamID string) *url.URL {
+	proxy := br.bridgeConfig().Proxy
+	if teamProxy, ok := br.bridgeConfig().TeamProxies[teamID]; ok {
+		proxy = teamProxy
+	}
+	if proxy == "" {
+		return nil
+	}
+	// The URLs are validated when the config is loaded
+	proxyURL, _ := url.Parse(proxy)
+	return proxyURL
+}
+
+// getSlackHTTPClient returns the HTTP client that should be used for requests
+// to Slack on behalf of the given team. The team ID may be empty when it's
+// not known yet, e.g. while logging in.
+func (br *SlackBridge) getSlackHTTPClient(teamID string) *http.Client {
+	proxyURL := br.getProxyURL(teamID)
+	if proxyURL == nil {
+		return http.DefaultClient
+	}
+
+	br.proxyClients.lock.Lock()
+	defer br.proxyClients.lock.Unlock()
+	client, ok := br.proxyClients.clients[proxyURL.String()]
+	if !ok {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		client = &http.Client{Transport: transport}
+		br.proxyClients.clients[proxyURL.String()] = client
+	}
+	return client
+}
+
+func (br *SlackBridge) getSlackTransport(teamID string) http.RoundTripper {
+	base := br.getSlackHTTPClient(teamID).Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &slackStatsTransport{bridge: br, teamID: teamID, base: &slackWarningTransport{bridge: br, base: base}}
+}
+
+func (br *SlackBridge) getSlackClientOptions(teamID string) []slack.Option {
+	return []slack.Option{slack.OptionHTTPClient(&http.Client{Transport: br.getSlackTransport(teamID)})}
+}
+
+// getSlackClientOptions returns the options for a Slack client that makes API
+// calls on behalf of the user, which go through the user's API limiter.
+func (user *User) getSlackClientOptions(teamID string, priority apiPriority) []slack.Option {
+	return []slack.Option{slack.OptionHTTPClient(&http.Client{Transport: &slackLimitTransport{
+		limiter:  &user.apiLimiter,
+		priority: priority,
+		base:     user.bridge.getSlackTransport(teamID),
+	}})}
+}
+
+func (br *SlackBridge) getSlackRTMOptions(teamID string) []slack.RTMOption {
+	proxyURL := br.getProxyURL(teamID)
+	if proxyURL == nil {
+		return nil
+	}
+	return []slack.RTMOption{slack.RTMOptionDialer(&websocket.Dialer{
+		Proxy:            http.ProxyURL(proxyURL),
+		HandshakeTimeout: 45 * time.Second,
+	})}
+}
@@ -21,6 +21,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -45,6 +46,12 @@ type Puppet struct {
 	customUser   *User
 
 	syncLock sync.Mutex
+	// When fetching the Slack profile last failed, to avoid retrying on every event
+	infoFailedAt time.Time
+
+	// Removes the status emoji from the displayname when the status expires
+	statusExpiry     *time.Timer
+	statusExpiryLock sync.Mutex
 }
 
 var _ bridge.Ghost = (*Puppet)(nil)
@@ -69,7 +76,7 @@ func (br *SlackBridge) ParsePuppetMXID(mxid id.UserID) (string, string, bool) {
 	if userIDRegex == nil {
 		pattern := fmt.Sprintf(
 			"^@%s:%s$",
-			br.Config.Bridge.FormatUsername("([A-Za-z0-9]+)-([A-Za-z0-9]+)"),
+			br.bridgeConfig().FormatUsername("([A-Za-z0-9]+)-([A-Za-z0-9]+)"),
 			br.Config.Homeserver.Domain,
 		)
 
@@ -93,24 +100,64 @@ func (br *SlackBridge) GetPuppetByMXID(mxid id.UserID) *Puppet {
 	return br.GetPuppetByID(team, id)
 }
 
+// GetPuppetByID returns the puppet of the given Slack user, creating it if
+// it doesn't exist yet. The database is only accessed while holding the lock
+// of that specific puppet, so lookups of other puppets aren't blocked.
 func (br *SlackBridge) GetPuppetByID(teamID, userID string) *Puppet {
+	key := teamID + "-" + userID
 	br.puppetsLock.Lock()
-	defer br.puppetsLock.Unlock()
+	if puppet := br.puppets.get(key); puppet != nil {
+		br.puppetsLock.Unlock()
+		return puppet
+	}
+	load, loading := br.puppetLoads[key]
+	if !loading {
+		load = &puppetLoad{done: make(chan struct{})}
+		br.puppetLoads[key] = load
+	}
+	br.puppetsLock.Unlock()
+	if loading {
+		<-load.done
+		return load.puppet
+	}
+	// Waiters get a nil puppet if loading panics, instead of waiting forever
+	defer func() {
+		br.puppetsLock.Lock()
+		delete(br.puppetLoads, key)
+		br.puppetsLock.Unlock()
+		close(load.done)
+	}()
+
+	dbPuppet := br.DB.Puppet.Get(teamID, userID)
+	if dbPuppet == nil {
+		dbPuppet = br.DB.Puppet.New()
+		dbPuppet.TeamID = teamID
+		dbPuppet.UserID = userID
+		dbPuppet.Insert()
+	}
 
-	puppet, ok := br.puppets[teamID+"-"+userID]
-	if !ok {
-		dbPuppet := br.DB.Puppet.Get(teamID, userID)
-		if dbPuppet == nil {
-			dbPuppet = br.DB.Puppet.New()
-			dbPuppet.TeamID = teamID
-			dbPuppet.UserID = userID
-			dbPuppet.Insert()
-		}
+	br.puppetsLock.Lock()
+	load.puppet = br.cachePuppet(dbPuppet)
+	br.puppetsLock.Unlock()
+	return load.puppet
+}
 
-		puppet = br.NewPuppet(dbPuppet)
-		br.puppets[puppet.Key()] = puppet
+// cachePuppet wraps a puppet loaded from the database and adds it to the
+// cache, unless it's already cached. The caller must hold puppetsLock.
+func (br *SlackBridge) cachePuppet(dbPuppet *database.Puppet) *Puppet {
+	if puppet := br.puppets.get(dbPuppet.TeamID + "-" + dbPuppet.UserID); puppet != nil {
+		return puppet
+	}
+	if dbPuppet.CustomMXID != "" {
+		if puppet, ok := br.puppetsByCustomMXID[dbPuppet.CustomMXID]; ok {
+			return puppet
+		}
+	}
+	puppet := br.NewPuppet(dbPuppet)
+	br.puppets.put(puppet, br.bridgeConfig().PuppetCacheSize)
+	if puppet.CustomMXID != "" {
+		br.puppetsByCustomMXID[puppet.CustomMXID] = puppet
 	}
-
 	return puppet
 }
 
@@ -125,9 +172,7 @@ func (br *SlackBridge) GetPuppetByCustomMXID(mxid id.UserID) *Puppet {
 			return nil
 		}
 
-		puppet = br.NewPuppet(dbPuppet)
-		br.puppets[puppet.Key()] = puppet
-		br.puppetsByCustomMXID[puppet.CustomMXID] = puppet
+		puppet = br.cachePuppet(dbPuppet)
 	}
 
 	return puppet
@@ -151,17 +196,7 @@ func (br *SlackBridge) dbPuppetsToPuppets(dbPuppets []*database.Puppet) []*Puppe
 			continue
 		}
 
-		puppet, ok := br.puppets[dbPuppet.TeamID+"-"+dbPuppet.UserID]
-		if !ok {
-			puppet = br.NewPuppet(dbPuppet)
-			br.puppets[puppet.Key()] = puppet
-
-			if dbPuppet.CustomMXID != "" {
-				br.puppetsByCustomMXID[dbPuppet.CustomMXID] = puppet
-			}
-		}
-
-		output[index] = puppet
+		output[index] = br.cachePuppet(dbPuppet)
 	}
 
 	return output
@@ -169,7 +204,7 @@ func (br *SlackBridge) dbPuppetsToPuppets(dbPuppets []*database.Puppet) []*Puppe
 
 func (br *SlackBridge) FormatPuppetMXID(did string) id.UserID {
 	return id.NewUserID(
-		br.Config.Bridge.FormatUsername(strings.ToLower(did)),
+		br.bridgeConfig().FormatUsername(strings.ToLower(did)),
 		br.Config.Homeserver.Domain,
 	)
 }
@@ -195,7 +230,7 @@ func (puppet *Puppet) Key() string {
 }
 
 func (puppet *Puppet) updatePortalMeta(meta func(portal *Portal)) {
-	for _, portal := range puppet.bridge.GetDMPortalsWith(puppet.UserID) {
+	for _, portal := range puppet.bridge.GetDMPortalsWith(puppet.TeamID, puppet.UserID) {
 		// Get room create lock to prevent races between receiving contact info and room creation.
 		portal.roomCreateLock.Lock()
 		meta(portal)
@@ -205,19 +240,22 @@ func (puppet *Puppet) updatePortalMeta(meta func(portal *Portal)) {
 
 func (puppet *Puppet) updateName(source *User) bool {
 	userTeam := source.GetUserTeam(puppet.TeamID)
-	user, err := userTeam.Client.GetUserInfo(puppet.UserID)
+	user, err := puppet.bridge.InfoCache.GetUserInfo(userTeam, puppet.UserID)
 	if err != nil {
 		puppet.log.Warnln("failed to get user from id:", err)
 		return false
 	}
 
-	newName := puppet.bridge.Config.Bridge.FormatDisplayname(user)
+	newName := puppet.bridge.getTeamConfig(puppet.TeamID).FormatDisplayname(user)
+	if puppet.updateDeactivated(user.Deleted, newName) {
+		puppet.Update(nil)
+	}
 
 	if puppet.Name != newName {
 		err := puppet.DefaultIntent().SetDisplayName(newName)
 		if err == nil {
 			puppet.Name = newName
-			puppet.Update()
+			puppet.Update(nil)
 		} else {
 			puppet.log.Warnln("failed to set display name:", err)
 		}
@@ -306,7 +344,7 @@ func (puppet *Puppet) SyncContact(source *User) {
 	}
 
 	if update {
-		puppet.Update()
+		puppet.Update(nil)
 	}
 }
 
@@ -331,23 +369,39 @@ func (puppet *Puppet) UpdateName(newName string) bool {
 	return true
 }
 
-func (puppet *Puppet) UpdateAvatar(url string) bool {
-	if puppet.Avatar == url && puppet.AvatarSet {
-		return false
+// UpdateAvatar updates the avatar of the puppet. If the Slack avatar hash is
+// known, it's used to skip reuploading images that haven't changed even if
+// the URL has, and to reuse images already uploaded for other puppets.
+func (puppet *Puppet) UpdateAvatar(url, hash string) bool {
+	sameHash := hash != "" && hash == puppet.AvatarHash && !puppet.AvatarURL.IsEmpty()
+	if puppet.AvatarSet && (puppet.Avatar == url || sameHash) {
+		if puppet.Avatar == url {
+			return false
+		}
+		puppet.Avatar = url
+		return true
 	}
-	avatarChanged := url != puppet.Avatar
+	avatarChanged := url != puppet.Avatar && !sameHash
 	puppet.Avatar = url
+	puppet.AvatarHash = hash
 	puppet.AvatarSet = false
-	puppet.AvatarURL = id.ContentURI{}
 
 	// TODO should we just use slack's default avatars for users with no avatar?
-	if puppet.Avatar != "" && (puppet.AvatarURL.IsEmpty() || avatarChanged) {
-		url, err := uploadAvatar(puppet.DefaultIntent(), url)
-		if err != nil {
-			puppet.log.Warnfln("Failed to reupload user avatar %s: %v", puppet.Avatar, err)
-			return true
+	if puppet.Avatar == "" {
+		puppet.AvatarURL = id.ContentURI{}
+	} else if puppet.AvatarURL.IsEmpty() || avatarChanged {
+		puppet.AvatarURL = id.ContentURI{}
+		if hash != "" {
+			puppet.AvatarURL = puppet.bridge.DB.Puppet.GetAvatarURLByHash(hash)
+		}
+		if puppet.AvatarURL.IsEmpty() {
+			url, err := uploadAvatar(puppet.bridge.getSlackHTTPClient(puppet.TeamID), puppet.DefaultIntent(), url)
+			if err != nil {
+				puppet.log.Warnfln("Failed to reupload user avatar %s: %v", puppet.Avatar, err)
+				return true
+			}
+			puppet.AvatarURL = url
 		}
-		puppet.AvatarURL = url
 	}
 
 	err := puppet.DefaultIntent().SetAvatarURL(puppet.AvatarURL)
@@ -365,22 +419,69 @@ func (puppet *Puppet) UpdateAvatar(url string) bool {
 	return true
 }
 
+// savePuppets saves many puppets in one database transaction.
+func (br *SlackBridge) savePuppets(puppets []*Puppet) {
+	if len(puppets) == 0 {
+		return
+	}
+	txn, err := br.DB.Begin()
+	if err != nil {
+		br.Log.Warnfln("Failed to start transaction to save %d puppets: %v", len(puppets), err)
+		return
+	}
+	for _, puppet := range puppets {
+		puppet.Update(txn)
+	}
+	err = txn.Commit()
+	if err != nil {
+		br.Log.Warnfln("Failed to commit %d puppets: %v", len(puppets), err)
+	}
+}
+
 func (puppet *Puppet) UpdateInfo(userTeam *database.UserTeam, info *slack.User) {
+	puppet.updateInfo(userTeam, info, true)
+}
+
+// updateInfo syncs the profile of the puppet, fetching it from Slack if info
+// is nil and the puppet doesn't have a name yet. It returns false if the
+// profile couldn't be fetched, in which case the puppet gets a placeholder
+// profile if usePlaceholder is true, so that it can still send events.
+func (puppet *Puppet) updateInfo(userTeam *database.UserTeam, info *slack.User, usePlaceholder bool) bool {
+	ok, changed := puppet.syncInfo(userTeam, info, usePlaceholder)
+	if changed {
+		puppet.Update(nil)
+	}
+	return ok
+}
+
+// syncInfo is updateInfo without saving the puppet, so that the caller can
+// save many puppets at once. The second return value is true if the puppet
+// needs to be saved.
+func (puppet *Puppet) syncInfo(userTeam *database.UserTeam, info *slack.User, usePlaceholder bool) (bool, bool) {
 	puppet.syncLock.Lock()
 	defer puppet.syncLock.Unlock()
 
 	if info == nil {
-		if puppet.Name != "" {
-			return
+		if puppet.Name != "" && !puppet.hasPlaceholderProfile() {
+			return true, false
+		} else if time.Since(puppet.infoFailedAt) < puppet.bridge.bridgeConfig().InfoCache.UserTTL {
+			if usePlaceholder {
+				puppet.setPlaceholderProfile()
+			}
+			return false, false
 		}
 
 		var err error
 		puppet.log.Debugfln("Fetching info through team %s to update", userTeam.Key.TeamID)
 
-		info, err = userTeam.Client.GetUserInfo(puppet.UserID)
+		info, err = puppet.bridge.InfoCache.GetUserInfo(userTeam, puppet.UserID)
 		if err != nil {
 			puppet.log.Errorfln("Failed to fetch info through %s: %v", userTeam.Key.TeamID, err)
-			return
+			puppet.infoFailedAt = time.Now()
+			if usePlaceholder {
+				puppet.setPlaceholderProfile()
+			}
+			return false, false
 		}
 	}
 
@@ -391,13 +492,85 @@ func (puppet *Puppet) UpdateInfo(userTeam *database.UserTeam, info *slack.User)
 
 	changed := false
 
-	newName := puppet.bridge.Config.Bridge.FormatDisplayname(info)
+	newName := puppet.bridge.getTeamConfig(puppet.TeamID).FormatDisplayname(info)
+	if puppet.bridge.bridgeConfig().StatusEmoji {
+		newName = puppet.addStatusEmoji(userTeam, info, newName)
+	}
 	changed = puppet.UpdateName(newName) || changed
-	changed = puppet.UpdateAvatar(info.Profile.ImageOriginal) || changed
+	changed = puppet.UpdateAvatar(info.Profile.ImageOriginal, info.Profile.AvatarHash) || changed
+	changed = puppet.updateDeactivated(info.Deleted, newName) || changed
+	changed = puppet.updateGuest(info.IsRestricted || info.IsUltraRestricted) || changed
+	return true, changed
+}
 
-	if changed {
-		puppet.Update()
+// addStatusEmoji puts the status emoji of the user in front of their
+// displayname. Slack doesn't always send a user_change event when a status
+// expires, so the name is updated again when it does.
+func (puppet *Puppet) addStatusEmoji(userTeam *database.UserTeam, info *slack.User, name string) string {
+	if info.Profile.StatusEmoji == "" {
+		puppet.setStatusExpiry(userTeam, 0)
+		return name
+	}
+	var expiresIn time.Duration
+	if info.Profile.StatusExpiration > 0 {
+		expiresIn = time.Until(time.Unix(int64(info.Profile.StatusExpiration), 0))
+		if expiresIn <= 0 {
+			puppet.setStatusExpiry(userTeam, 0)
+			return name
+		}
+	}
+	emoji := shortcodeToEmoji(info.Profile.StatusEmoji)
+	if strings.HasPrefix(emoji, ":") {
+		// Custom emojis don't have a Unicode equivalent
+		puppet.setStatusExpiry(userTeam, 0)
+		return name
+	}
+	puppet.setStatusExpiry(userTeam, expiresIn)
+	return emoji + " " + name
+}
+
+// setStatusExpiry replaces the timer that updates the displayname when the
+// current status expires. Zero means the status doesn't expire.
+func (puppet *Puppet) setStatusExpiry(userTeam *database.UserTeam, expiresIn time.Duration) {
+	puppet.statusExpiryLock.Lock()
+	defer puppet.statusExpiryLock.Unlock()
+	if puppet.statusExpiry != nil {
+		puppet.statusExpiry.Stop()
+		puppet.statusExpiry = nil
+	}
+	if expiresIn <= 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(expiresIn, func() {
+		puppet.statusExpiryLock.Lock()
+		current := puppet.statusExpiry == timer
+		puppet.statusExpiry = nil
+		puppet.statusExpiryLock.Unlock()
+		if !current || userTeam.Client == nil {
+			return
+		}
+		// The cached info still has the expired status, so fetch it again
+		puppet.bridge.InfoCache.Invalidate(puppet.TeamID, puppet.UserID)
+		latestInfo, err := puppet.bridge.InfoCache.GetUserInfo(userTeam, puppet.UserID)
+		if err != nil {
+			puppet.log.Warnfln("Failed to get info to remove expired status emoji: %v", err)
+			return
+		}
+		puppet.UpdateInfo(userTeam, latestInfo)
+	})
+	puppet.statusExpiry = timer
+}
+
+// stopStatusExpiry cancels the status expiry timer when the puppet is dropped
+// from the cache, so that the timer doesn't keep it alive.
+func (puppet *Puppet) stopStatusExpiry() {
+	puppet.statusExpiryLock.Lock()
+	if puppet.statusExpiry != nil {
+		puppet.statusExpiry.Stop()
+		puppet.statusExpiry = nil
 	}
+	puppet.statusExpiryLock.Unlock()
 }
 
 func (puppet *Puppet) UpdateInfoBot(userTeam *database.UserTeam) {
@@ -418,11 +591,11 @@ func (puppet *Puppet) UpdateInfoBot(userTeam *database.UserTeam) {
 
 	changed := false
 
-	newName := puppet.bridge.Config.Bridge.FormatBotDisplayname(info)
+	newName := puppet.bridge.getTeamConfig(puppet.TeamID).FormatBotDisplayname(info)
 	changed = puppet.UpdateName(newName) || changed
-	changed = puppet.UpdateAvatar(info.Icons.Image72) || changed
+	changed = puppet.UpdateAvatar(info.Icons.Image72, "") || changed
 
 	if changed {
-		puppet.Update()
+		puppet.Update(nil)
 	}
 }
@@ -0,0 +1,128 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// puppetEvictionGrace is how long a puppet has to be unused before it can be
+// evicted. Goroutines may still hold a puppet for a while after looking it up,
+// and evicting it then would let the next lookup create a second instance of
+// the same puppet, which would update the same database row concurrently.
+const puppetEvictionGrace = 30 * time.Minute
+
+type puppetCacheEntry struct {
+	puppet   *Puppet
+	lastUsed time.Time
+}
+
+// puppetCache keeps the most recently used puppets in memory. Puppets with a
+// custom MXID (double puppets) are never evicted, as they hold the state of
+// the double puppet sync and are also looked up by their custom MXID. Puppets
+// used within puppetEvictionGrace aren't evicted either, so the cache can
+// temporarily grow beyond its size.
+//
+// The cache isn't safe for concurrent use, callers must hold puppetsLock.
+type puppetCache struct {
+	byKey map[string]*list.Element
+	order *list.List
+}
+
+func newPuppetCache() *puppetCache {
+	return &puppetCache{
+		byKey: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (pc *puppetCache) get(key string) *Puppet {
+	elem, ok := pc.byKey[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*puppetCacheEntry)
+	entry.lastUsed = time.Now()
+	pc.order.MoveToFront(elem)
+	return entry.puppet
+}
+
+// put adds a puppet to the cache and evicts the least recently used puppets
+// if there are more than size puppets. Zero means there's no limit.
+func (pc *puppetCache) put(puppet *Puppet, size int) {
+	key := puppet.Key()
+	if elem, ok := pc.byKey[key]; ok {
+		if old := elem.Value.(*puppetCacheEntry).puppet; old != puppet {
+			old.stopStatusExpiry()
+		}
+		elem.Value = &puppetCacheEntry{puppet: puppet, lastUsed: time.Now()}
+		pc.order.MoveToFront(elem)
+		return
+	}
+	pc.byKey[key] = pc.order.PushFront(&puppetCacheEntry{puppet: puppet, lastUsed: time.Now()})
+	pc.evict(size)
+}
+
+func (pc *puppetCache) evict(size int) {
+	if size <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-puppetEvictionGrace)
+	elem := pc.order.Back()
+	for pc.order.Len() > size && elem != nil {
+		entry := elem.Value.(*puppetCacheEntry)
+		if entry.lastUsed.After(cutoff) {
+			// Everything after this was used even more recently
+			break
+		}
+		prev := elem.Prev()
+		if entry.puppet.CustomMXID == "" {
+			pc.order.Remove(elem)
+			delete(pc.byKey, entry.puppet.Key())
+			entry.puppet.stopStatusExpiry()
+		}
+		elem = prev
+	}
+}
+
+func (pc *puppetCache) remove(key string) {
+	if elem, ok := pc.byKey[key]; ok {
+		pc.order.Remove(elem)
+		delete(pc.byKey, key)
+		elem.Value.(*puppetCacheEntry).puppet.stopStatusExpiry()
+	}
+}
+
+// removeIf drops all cached puppets that match the given function.
+func (pc *puppetCache) removeIf(fn func(puppet *Puppet) bool) {
+	for key, elem := range pc.byKey {
+		if puppet := elem.Value.(*puppetCacheEntry).puppet; fn(puppet) {
+			pc.order.Remove(elem)
+			delete(pc.byKey, key)
+			puppet.stopStatusExpiry()
+		}
+	}
+}
+
+// puppetLoad is a puppet that's being loaded from or created in the database.
+// Concurrent lookups of the same puppet wait for the first one to finish
+// instead of creating the puppet twice.
+type puppetLoad struct {
+	done   chan struct{}
+	puppet *Puppet
+}
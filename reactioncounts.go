@@ -0,0 +1,151 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// sendRelayedReaction bridges a reaction from a Matrix user without a Slack
+// login through the relay user. Slack only allows one reaction per emoji per
+// user, so if the relay user already has the reaction, the Matrix reaction
+// is only counted in the reaction count message.
+func (portal *Portal) sendRelayedReaction(sender *User, userTeam *database.UserTeam, evt *event.Event, slackID, matrixName, emojiID string) error {
+	existing := portal.bridge.DB.Reaction.GetBySlackID(portal.Key, userTeam.Key.SlackID, slackID, emojiID)
+	if existing == nil {
+		err := userTeam.Client.AddReaction(emojiID, slack.ItemRef{
+			Channel:   portal.Key.ChannelID,
+			Timestamp: slackID,
+		})
+		portal.bridge.getCircuitBreaker(userTeam).Record(err)
+		if err != nil && err.Error() != "already_reacted" {
+			portal.log.Debugfln("Failed to send relayed reaction %s id:%s: %v", portal.Key, slackID, err)
+			return err
+		}
+		dbReaction := portal.bridge.DB.Reaction.New()
+		dbReaction.Channel = portal.Key
+		dbReaction.MatrixEventID = evt.ID
+		dbReaction.SlackMessageID = slackID
+		dbReaction.AuthorID = userTeam.Key.SlackID
+		dbReaction.MatrixName = matrixName
+		dbReaction.SlackName = emojiID
+		dbReaction.Insert(nil)
+	}
+	portal.bridge.DB.RelayedReaction.Add(portal.Key, slackID, emojiID, evt.ID, sender.MXID)
+	portal.updateReactionCountMessage(userTeam, slackID)
+	return nil
+}
+
+// updateReactionCountMessage posts, edits or deletes the thread reply that
+// shows how many Matrix users reacted with each emoji that the relay user
+// could only add once on Slack.
+func (portal *Portal) updateReactionCountMessage(userTeam *database.UserTeam, slackID string) {
+	var parts []string
+	for name, count := range portal.bridge.DB.RelayedReaction.GetCounts(portal.Key, slackID) {
+		// The relay user's own reaction shares the Slack reaction with the relayed ones
+		own := portal.bridge.DB.Reaction.GetBySlackID(portal.Key, userTeam.Key.SlackID, slackID, name)
+		if own != nil && !portal.bridge.DB.RelayedReaction.IsRelayed(portal.Key, own.MatrixEventID) {
+			count++
+		}
+		if count > 1 {
+			parts = append(parts, fmt.Sprintf("%d× :%s:", count, name))
+		}
+	}
+	sort.Strings(parts)
+
+	countTs := portal.bridge.DB.RelayedReaction.GetCountMessage(portal.Key, slackID)
+	if len(parts) == 0 {
+		if countTs != "" {
+			_, _, err := userTeam.Client.DeleteMessage(portal.Key.ChannelID, countTs)
+			if err != nil && err.Error() != "message_not_found" {
+				portal.log.Warnfln("Failed to delete reaction count message of %s: %v", slackID, err)
+				return
+			}
+			portal.bridge.DB.RelayedReaction.DeleteCountMessage(portal.Key, slackID)
+		}
+		return
+	}
+
+	options := []slack.MsgOption{slack.MsgOptionText("Reactions from Matrix: "+strings.Join(parts, ", "), false)}
+	if countTs != "" {
+		options = append(options, slack.MsgOptionUpdate(countTs))
+	} else {
+		threadTs := slackID
+		if target := portal.getMessageBySlackID(slackID); target != nil && target.SlackThreadID != "" {
+			threadTs = target.SlackThreadID
+		}
+		options = append(options, slack.MsgOptionTS(threadTs))
+	}
+	_, ts, err := userTeam.Client.PostMessage(portal.Key.ChannelID, slack.MsgOptionAsUser(true), slack.MsgOptionCompose(options...))
+	portal.bridge.getCircuitBreaker(userTeam).Record(err)
+	if err != nil {
+		portal.log.Warnfln("Failed to send reaction count message of %s: %v", slackID, err)
+	} else if countTs == "" {
+		portal.bridge.DB.RelayedReaction.SetCountMessage(portal.Key, slackID, ts)
+	}
+}
+
+// handleRelayedReactionRedaction removes a reaction that was sent through the
+// relay user. The Slack reaction is only removed when no other relayed
+// reactions share it, otherwise it's handed over to one of them.
+func (portal *Portal) handleRelayedReactionRedaction(evt *event.Event, relayed *database.RelayedReaction) {
+	if relayed.MatrixSender != evt.Sender {
+		portal.sendMessageMetricsAsync(evt, errReactionSentBySomeoneElse, "Ignoring")
+		return
+	}
+	userTeam := portal.getRelayUserTeam()
+	if userTeam == nil {
+		portal.sendMessageMetricsAsync(evt, errUserNotLoggedIn, "Ignoring")
+		return
+	}
+	portal.log.Debugfln("Received redaction %s of relayed reaction %s from %s", evt.ID, relayed.MatrixEventID, evt.Sender)
+
+	var err error
+	dbReaction := portal.bridge.DB.Reaction.GetByMatrixID(portal.Key, relayed.MatrixEventID)
+	if dbReaction != nil {
+		if other := portal.bridge.DB.RelayedReaction.GetAnother(portal.Key, relayed); other != "" {
+			dbReaction.SetMatrixEventID(other)
+		} else {
+			err = userTeam.Client.RemoveReaction(relayed.SlackName, slack.ItemRef{
+				Channel:   portal.Key.ChannelID,
+				Timestamp: relayed.SlackMessageID,
+			})
+			portal.bridge.getCircuitBreaker(userTeam).Record(err)
+			if err != nil && err.Error() == "no_reaction" {
+				err = nil
+			}
+			if err == nil {
+				dbReaction.Delete()
+			}
+		}
+	}
+	if err != nil {
+		portal.log.Debugfln("Failed to delete relayed reaction %s for message %s: %v", relayed.SlackName, relayed.SlackMessageID, err)
+	} else {
+		portal.bridge.DB.RelayedReaction.Delete(portal.Key, relayed.MatrixEventID)
+		portal.updateReactionCountMessage(userTeam, relayed.SlackMessageID)
+	}
+	portal.sendMessageMetricsAsync(evt, err, "Error sending")
+}
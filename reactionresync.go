@@ -0,0 +1,134 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// reactionResyncIdleInterval is how often the resync loop checks whether
+// resyncing has been enabled by a config reload.
+const reactionResyncIdleInterval = 1 * time.Minute
+
+func (br *SlackBridge) reactionResyncLoop() {
+	for {
+		interval := br.bridgeConfig().ReactionResync.Interval
+		if interval <= 0 {
+			time.Sleep(reactionResyncIdleInterval)
+			continue
+		}
+		time.Sleep(interval)
+		br.resyncAllReactions()
+	}
+}
+
+// resyncAllReactions resyncs the reactions of recent messages in every portal,
+// using the first logged-in user found in each portal.
+func (br *SlackBridge) resyncAllReactions() {
+	limit := br.bridgeConfig().ReactionResync.Messages
+	if limit <= 0 {
+		return
+	}
+	done := make(map[database.PortalKey]struct{})
+	for _, dbUserTeam := range br.DB.UserTeam.GetAllWithToken() {
+		if dbUserTeam == nil {
+			continue
+		}
+		user := br.GetUserByMXID(dbUserTeam.Key.MXID)
+		if user == nil {
+			continue
+		}
+		userTeam := user.GetUserTeam(dbUserTeam.Key.TeamID)
+		if userTeam == nil || userTeam.Client == nil || br.getCircuitBreaker(userTeam).IsOpen() {
+			continue
+		}
+		for _, portal := range br.GetAllPortalsForUserTeam(userTeam.Key) {
+			if _, ok := done[portal.Key]; ok || portal.MXID == "" || portal.isFilteredOut() {
+				continue
+			}
+			done[portal.Key] = struct{}{}
+			for _, msg := range br.DB.Message.GetRecent(portal.Key, limit) {
+				portal.resyncSlackReactions(user, userTeam, msg.SlackID)
+			}
+		}
+	}
+}
+
+// resyncSlackReactions fetches the reactions of a Slack message and bridges
+// any that are missing in Matrix, or redacts Matrix reactions that no longer
+// exist on Slack.
+func (portal *Portal) resyncSlackReactions(user *User, userTeam *database.UserTeam, slackID string) {
+	ctx := withBackgroundPriority(context.Background())
+	reactions, err := userTeam.Client.GetReactionsContext(ctx, slack.ItemRef{
+		Channel:   portal.Key.ChannelID,
+		Timestamp: slackID,
+	}, slack.GetReactionsParameters{Full: true})
+	if err != nil {
+		portal.log.Debugfln("Failed to get reactions of %s for resync: %v", slackID, err)
+		return
+	}
+
+	onSlack := make(map[string]bool)
+	// Slack may not list all users of popular reactions, so removals can only be trusted for complete lists
+	complete := make(map[string]bool)
+	for _, reaction := range reactions {
+		complete[reaction.Name] = len(reaction.Users) >= reaction.Count
+		for _, slackUser := range reaction.Users {
+			onSlack[slackUser+"/"+reaction.Name] = true
+		}
+	}
+	inMatrix := make(map[string]bool)
+	for _, dbReaction := range portal.bridge.DB.Reaction.GetAllBySlackMessageID(portal.Key, slackID) {
+		inMatrix[dbReaction.AuthorID+"/"+dbReaction.SlackName] = true
+		if dbReaction.SlackName == savedItemReactionName {
+			// Saved items aren't Slack reactions
+			continue
+		} else if !onSlack[dbReaction.AuthorID+"/"+dbReaction.SlackName] && (complete[dbReaction.SlackName] || !hasReaction(reactions, dbReaction.SlackName)) {
+			portal.log.Debugfln("Resync: %s's reaction %s on %s is gone from Slack", dbReaction.AuthorID, dbReaction.SlackName, slackID)
+			evt := &slack.ReactionRemovedEvent{Type: "reaction_removed", User: dbReaction.AuthorID, Reaction: dbReaction.SlackName}
+			evt.Item.Channel, evt.Item.Timestamp = portal.Key.ChannelID, slackID
+			portal.HandleSlackReactionRemoved(user, userTeam, evt)
+		}
+	}
+	now := fmt.Sprintf("%d.000000", time.Now().Unix())
+	for _, reaction := range reactions {
+		for _, slackUser := range reaction.Users {
+			if inMatrix[slackUser+"/"+reaction.Name] {
+				continue
+			}
+			portal.log.Debugfln("Resync: %s's reaction %s on %s is missing in Matrix", slackUser, reaction.Name, slackID)
+			evt := &slack.ReactionAddedEvent{Type: "reaction_added", User: slackUser, Reaction: reaction.Name, EventTimestamp: now}
+			evt.Item.Channel, evt.Item.Timestamp = portal.Key.ChannelID, slackID
+			portal.HandleSlackReaction(user, userTeam, evt)
+		}
+	}
+}
+
+func hasReaction(reactions []slack.ItemReaction, name string) bool {
+	for _, reaction := range reactions {
+		if reaction.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// bulkDeletionThreshold is the number of deleted Slack messages waiting to be
+// redacted above which redactions are rate limited.
+const bulkDeletionThreshold = 10
+
+// slackDeletionQueue collects deleted Slack messages so that they can be
+// redacted in the background. Slack sends a separate event for every message
+// when e.g. the messages of a spammer are purged, and redacting all of them
+// in real time would hold up other messages in the portal.
+type slackDeletionQueue struct {
+	lock    sync.Mutex
+	pending []string
+	running bool
+}
+
+func isSlackDeletionRestricted(err error) bool {
+	switch err.Error() {
+	case "cant_delete_message", "compliance_exports_prevent_deletion":
+		return true
+	default:
+		return false
+	}
+}
+
+// deleteSlackMessage deletes a Slack message for a Matrix redaction, or edits
+// it to the placeholder text if the config says so.
+func (portal *Portal) deleteSlackMessage(userTeam *database.UserTeam, channelID, slackID string) error {
+	cfg := portal.bridge.bridgeConfig().Redactions
+	circuitBreaker := portal.bridge.getCircuitBreaker(userTeam)
+	if cfg.MatrixToSlack != "replace" {
+		_, _, err := userTeam.Client.DeleteMessage(channelID, slackID)
+		circuitBreaker.Record(err)
+		if err == nil || cfg.MatrixToSlack == "delete" || !isSlackDeletionRestricted(err) {
+			return err
+		}
+		portal.log.Debugfln("Deleting %s isn't allowed, replacing it with the placeholder instead: %v", slackID, err)
+	}
+	_, _, _, err := userTeam.Client.SendMessage(channelID,
+		slack.MsgOptionText(cfg.Placeholder, false), slack.MsgOptionUpdate(slackID))
+	circuitBreaker.Record(err)
+	return err
+}
+
+// handleSlackDeletion queues the Matrix events of a deleted Slack message to
+// be redacted, or edited to the placeholder text if the config says so.
+func (portal *Portal) handleSlackDeletion(slackID string) {
+	queue := &portal.deletions
+	queue.lock.Lock()
+	queue.pending = append(queue.pending, slackID)
+	start := !queue.running
+	queue.running = true
+	queue.lock.Unlock()
+	if start {
+		go portal.processSlackDeletions()
+	}
+}
+
+// processSlackDeletions redacts queued deletions until the queue is empty.
+// Single deletions are redacted immediately, but if many messages are
+// deleted at once, the redactions are rate limited to avoid hitting the
+// homeserver's rate limits.
+func (portal *Portal) processSlackDeletions() {
+	queue := &portal.deletions
+	var ticker *time.Ticker
+	throttle := func() {
+		if ticker != nil {
+			<-ticker.C
+		}
+	}
+	handled := 0
+	for {
+		queue.lock.Lock()
+		batch := queue.pending
+		queue.pending = nil
+		if len(batch) == 0 {
+			queue.running = false
+			queue.lock.Unlock()
+			break
+		}
+		queue.lock.Unlock()
+
+		if rate := portal.bridge.bridgeConfig().Redactions.BulkRate; ticker == nil && rate > 0 && handled+len(batch) >= bulkDeletionThreshold {
+			portal.log.Infofln("Many Slack messages were deleted at once, redacting them at %d events per second", rate)
+			ticker = time.NewTicker(time.Second / time.Duration(rate))
+		}
+		for _, slackID := range batch {
+			portal.redactSlackDeletion(slackID, throttle)
+		}
+		handled += len(batch)
+	}
+	if ticker != nil {
+		ticker.Stop()
+		portal.log.Infofln("Finished redacting %d deleted Slack messages", handled)
+	}
+}
+
+// redactSlackDeletion removes the Matrix events of a deleted Slack message,
+// calling throttle before each one.
+func (portal *Portal) redactSlackDeletion(slackID string, throttle func()) {
+	// Slack doesn't tell us who deleted a message, so there is no intent here
+	messages := portal.bridge.DB.Message.GetAllBySlackID(portal.Key, slackID)
+	attachments := portal.bridge.DB.Attachment.GetAllBySlackMessageID(portal.Key, slackID)
+	if len(messages) == 0 && len(attachments) == 0 {
+		portal.log.Warnfln("Failed to redact %s: Matrix event not known", slackID)
+		return
+	}
+	intent := portal.MainIntent()
+	if len(messages) > 0 {
+		if puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, messages[0].AuthorID); puppet != nil {
+			intent = puppet.IntentFor(portal)
+		}
+	}
+
+	for _, message := range messages {
+		throttle()
+		if portal.removeMatrixEvent(intent, message.MatrixID) {
+			portal.deleteMessage(message)
+		}
+	}
+	for _, attachment := range attachments {
+		throttle()
+		if portal.removeMatrixEvent(intent, attachment.MatrixEventID) {
+			attachment.Delete()
+		}
+	}
+}
+
+// handleSlackTombstone edits the Matrix events of a message whose content was
+// removed in Slack, but which stays in the channel as a tombstone. This
+// happens e.g. when a thread root is deleted or removed by channel management.
+// The message stays in the database so that the thread can still be bridged.
+func (portal *Portal) handleSlackTombstone(msg *slack.Msg) {
+	text := msg.Text
+	if text == "" {
+		text = "This message was deleted."
+	}
+	messages := portal.bridge.DB.Message.GetAllBySlackID(portal.Key, msg.Timestamp)
+	attachments := portal.bridge.DB.Attachment.GetAllBySlackMessageID(portal.Key, msg.Timestamp)
+	intent := portal.MainIntent()
+	if len(messages) > 0 {
+		if puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, messages[0].AuthorID); puppet != nil {
+			intent = puppet.IntentFor(portal)
+		}
+	}
+	portal.log.Debugfln("Message %s was replaced with a tombstone, editing %d Matrix events", msg.Timestamp, len(messages)+len(attachments))
+	for _, message := range messages {
+		if err := portal.editMatrixEventText(intent, message.MatrixID, text); err != nil {
+			portal.log.Errorfln("Failed to edit %s to tombstone: %v", message.MatrixID, err)
+		}
+	}
+	for _, attachment := range attachments {
+		if err := portal.editMatrixEventText(intent, attachment.MatrixEventID, text); err != nil {
+			portal.log.Errorfln("Failed to edit %s to tombstone: %v", attachment.MatrixEventID, err)
+		}
+	}
+}
+
+func (portal *Portal) editMatrixEventText(intent *appservice.IntentAPI, eventID id.EventID, text string) error {
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	}
+	content.SetEdit(eventID)
+	_, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, 0)
+	return err
+}
+
+func (portal *Portal) removeMatrixEvent(intent *appservice.IntentAPI, eventID id.EventID) bool {
+	var err error
+	if portal.bridge.bridgeConfig().Redactions.SlackToMatrix == "edit" {
+		err = portal.editMatrixEventText(intent, eventID, portal.bridge.bridgeConfig().Redactions.Placeholder)
+	} else {
+		_, err = portal.MainIntent().RedactEvent(portal.MXID, eventID)
+	}
+	if err != nil {
+		portal.log.Errorfln("Failed to remove %s: %v", eventID, err)
+		return false
+	}
+	return true
+}
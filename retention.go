@@ -0,0 +1,157 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const retentionBatchSize = 100
+
+// StateRetention is the room retention policy from MSC1763, which clients
+// can show to let users know that messages in the room will disappear.
+var StateRetention = event.Type{Type: "m.room.retention", Class: event.StateEventType}
+
+type RetentionEventContent struct {
+	MaxLifetime int64 `json:"max_lifetime,omitempty"`
+}
+
+func (br *SlackBridge) retentionLoop() {
+	for {
+		time.Sleep(br.bridgeConfig().Retention.Interval)
+		for _, portal := range br.GetAllPortals() {
+			if portal.MXID != "" {
+				portal.syncRetentionState()
+				portal.enforceRetention()
+			}
+		}
+	}
+}
+
+// getRetentionDays returns how many days messages are kept in the portal, or
+// zero if they're kept forever. DMs and group DMs can have a separate default,
+// as Slack workspaces can set a different retention period for them.
+func (portal *Portal) getRetentionDays() int {
+	cfg := portal.bridge.getTeamConfig(portal.Key.TeamID).Retention
+	days := portal.RetentionDays
+	if days == 0 && portal.Type != database.ChannelTypeChannel {
+		days = cfg.DMDays
+	}
+	if days == 0 {
+		days = cfg.Days
+	}
+	if days < 0 {
+		return 0
+	}
+	return days
+}
+
+func (portal *Portal) getRetentionEventContent() *RetentionEventContent {
+	content := &RetentionEventContent{}
+	if days := portal.getRetentionDays(); days > 0 {
+		content.MaxLifetime = (time.Duration(days) * 24 * time.Hour).Milliseconds()
+	}
+	return content
+}
+
+// syncRetentionState updates the retention state event of the room if the
+// retention period has changed since it was last synced.
+func (portal *Portal) syncRetentionState() {
+	content := portal.getRetentionEventContent()
+	if portal.retentionStateSynced && portal.retentionStateLifetime == content.MaxLifetime {
+		return
+	}
+	var existing RetentionEventContent
+	err := portal.MainIntent().StateEvent(portal.MXID, StateRetention, "", &existing)
+	if errors.Is(err, mautrix.MNotFound) && content.MaxLifetime == 0 {
+		err = nil
+	} else if err != nil || existing != *content {
+		_, err = portal.MainIntent().SendStateEvent(portal.MXID, StateRetention, "", content)
+	}
+	if err != nil {
+		portal.log.Warnfln("Failed to update retention state event: %v", err)
+		return
+	}
+	portal.retentionStateSynced = true
+	portal.retentionStateLifetime = content.MaxLifetime
+}
+
+// enforceRetention redacts the Matrix events of messages that are older than
+// the retention period of the portal and forgets them in the database. The
+// redactions are rate limited like bulk deletions from Slack.
+func (portal *Portal) enforceRetention() {
+	portal.retentionLock.Lock()
+	defer portal.retentionLock.Unlock()
+	days := portal.getRetentionDays()
+	if days <= 0 {
+		return
+	}
+	beforeTs := strconv.FormatInt(time.Now().AddDate(0, 0, -days).Unix(), 10)
+	var throttle <-chan time.Time
+	if rate := portal.bridge.bridgeConfig().Redactions.BulkRate; rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	redact := func(eventID id.EventID) {
+		if throttle != nil {
+			<-throttle
+		}
+		_, err := portal.MainIntent().RedactEvent(portal.MXID, eventID, mautrix.ReqRedact{Reason: "Message retention period expired"})
+		if err != nil {
+			portal.log.Warnfln("Failed to redact %s for retention: %v", eventID, err)
+		}
+	}
+
+	removed := 0
+	for {
+		messages := portal.bridge.DB.Message.GetOlderThan(portal.Key, beforeTs, retentionBatchSize)
+		if len(messages) == 0 {
+			break
+		}
+		for _, message := range messages {
+			redact(message.MatrixID)
+			// The row is deleted even if redacting failed, so that one broken
+			// event doesn't stop the rest from being removed
+			portal.deleteMessage(message)
+			removed++
+		}
+	}
+	for {
+		attachments := portal.bridge.DB.Attachment.GetOlderThan(portal.Key, beforeTs, retentionBatchSize)
+		if len(attachments) == 0 {
+			break
+		}
+		for _, attachment := range attachments {
+			redact(attachment.MatrixEventID)
+			attachment.Delete()
+			removed++
+		}
+	}
+	portal.bridge.DB.Reaction.DeleteOlderThan(portal.Key, beforeTs)
+	if removed > 0 {
+		portal.log.Infofln("Removed %d Matrix events older than %d days", removed, days)
+	}
+}
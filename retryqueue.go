@@ -0,0 +1,134 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// handledEventRetention is how long handled Matrix event IDs are remembered
+// to ignore redelivered events. The homeserver only redelivers transactions
+// that the bridge didn't acknowledge, so this only needs to cover downtime.
+const handledEventRetention = 7 * 24 * time.Hour
+
+// handledEventClaimExpiry is how long an event that's still being handled is
+// protected from being handled again. Claims from before the bridge started
+// are always expired, as nothing is handling them anymore.
+const handledEventClaimExpiry = 10 * time.Minute
+
+func (br *SlackBridge) handledEventClaimStaleBefore() time.Time {
+	staleBefore := time.Now().Add(-handledEventClaimExpiry)
+	if staleBefore.Before(br.startedAt) {
+		return br.startedAt
+	}
+	return staleBefore
+}
+
+func (br *SlackBridge) pruneHandledEventsLoop() {
+	for {
+		br.DB.HandledEvent.DeleteOlderThan(time.Now().Add(-handledEventRetention))
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// fetchMatrixEvent gets an event from the homeserver and decrypts it if
+// necessary.
+func (br *SlackBridge) fetchMatrixEvent(intent *appservice.IntentAPI, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := intent.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if evt.Type == event.EventEncrypted {
+		if br.Crypto == nil {
+			return nil, fmt.Errorf("event is encrypted, but encryption is not enabled")
+		}
+		err = evt.Content.ParseRaw(evt.Type)
+		if err != nil {
+			return nil, err
+		}
+		evt, err = br.Crypto.Decrypt(evt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt event: %w", err)
+		}
+	} else {
+		err = evt.Content.ParseRaw(evt.Type)
+		if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+			return nil, err
+		}
+	}
+	return evt, nil
+}
+
+// queueRetryAfterRestart stores a message that was sent while the bridge was
+// down, so that it's sent when the Slack connection is up instead of failing
+// because it's too old. Only the event ID is stored, the message is fetched
+// again from the homeserver when retrying.
+func (portal *Portal) queueRetryAfterRestart(sender *User, userTeam *database.UserTeam, evt *event.Event, ms *metricSender) bool {
+	if !portal.bridge.bridgeConfig().MessageHandlingTimeout.RetryAfterRestart ||
+		!time.UnixMilli(evt.Timestamp).Before(portal.bridge.startedAt) {
+		return false
+	}
+	portal.bridge.DB.RetryQueue.Add(evt.ID, portal.MXID, sender.MXID, portal.Key.TeamID)
+	ms.sendMessageMetricsAsync(evt, errQueuedForRetry, "Delaying", false)
+	if userTeam.Client != nil {
+		go sender.retryQueuedMessages(userTeam)
+	}
+	return true
+}
+
+// retryQueuedMessages sends the messages of the user that were queued while
+// the bridge was restarting. The messages of each portal are put in front of
+// its queue in the order they were sent, as any messages already in the queue
+// were sent after them.
+func (user *User) retryQueuedMessages(userTeam *database.UserTeam) {
+	user.retryQueueLock.Lock()
+	defer user.retryQueueLock.Unlock()
+	var portals []*Portal
+	retries := make(map[*Portal][]portalMatrixMessage)
+	for _, retry := range user.bridge.DB.RetryQueue.TakeAll(user.MXID, userTeam.Key.TeamID) {
+		portal := user.bridge.GetPortalByMXID(retry.RoomID)
+		if portal == nil {
+			continue
+		}
+		evt, err := user.bridge.fetchMatrixEvent(portal.MainIntent(), portal.MXID, retry.EventID)
+		if err != nil {
+			user.log.Warnfln("Failed to get queued message %s for retrying: %v", retry.EventID, err)
+			continue
+		}
+		user.log.Debugfln("Retrying %s in %s, which was queued at %s", retry.EventID, retry.RoomID, retry.QueuedAt)
+		if _, ok := retries[portal]; !ok {
+			portals = append(portals, portal)
+		}
+		retries[portal] = append(retries[portal], portalMatrixMessage{
+			user:       user,
+			evt:        evt,
+			receivedAt: time.Now(),
+			retryNum:   1,
+		})
+	}
+	for _, portal := range portals {
+		portal.queueMatrixRetries(retries[portal])
+	}
+}
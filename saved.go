@@ -0,0 +1,126 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const (
+	// savedItemReactionName is stored as the Slack name of reactions that
+	// saved a message instead of reacting to it, so that redacting them
+	// removes the message from saved items.
+	savedItemReactionName = "fi.mau.slack.saved"
+	// savedMessagesAccountDataType lists the saved messages of a room in the
+	// room account data of the user.
+	savedMessagesAccountDataType = "fi.mau.slack.saved_messages"
+	// savedMessagesTag is set on rooms that have saved messages.
+	savedMessagesTag = "u.slack.saved"
+)
+
+type savedMessagesContent struct {
+	EventIDs []id.EventID `json:"event_ids"`
+}
+
+// getSlackMessageID finds the Slack message that a Matrix event was bridged
+// from or to, including file attachments.
+func (portal *Portal) getSlackMessageID(eventID id.EventID) string {
+	if msg := portal.getMessageByMatrixID(eventID); msg != nil {
+		return msg.SlackID
+	} else if attachment := portal.bridge.DB.Attachment.GetByMatrixID(portal.Key, eventID); attachment != nil {
+		return attachment.SlackMessageID
+	}
+	return ""
+}
+
+func (portal *Portal) setSlackMessageSaved(userTeam *database.UserTeam, slackID string, saved bool) error {
+	var err error
+	if saved {
+		err = userTeam.Client.AddStar(portal.Key.ChannelID, slack.NewRefToMessage(portal.Key.ChannelID, slackID))
+	} else {
+		err = userTeam.Client.RemoveStar(portal.Key.ChannelID, slack.NewRefToMessage(portal.Key.ChannelID, slackID))
+	}
+	portal.bridge.getCircuitBreaker(userTeam).Record(err)
+	return err
+}
+
+// handleSlackStar handles messages being saved or unsaved and channels being
+// starred or unstarred in Slack.
+func (user *User) handleSlackStar(userTeam *database.UserTeam, item slack.StarredItem, saved bool) {
+	if isChannelStar(item) {
+		if user.bridge.bridgeConfig().SyncFavourites {
+			user.setFavourite(user.bridge.GetPortalByID(database.NewPortalKey(userTeam.Key.TeamID, item.Channel)), saved)
+		}
+		return
+	} else if item.Type != slack.TYPE_MESSAGE || item.Message == nil || !user.bridge.bridgeConfig().SavedItems.Sync {
+		return
+	}
+	portal := user.bridge.GetPortalByID(database.NewPortalKey(userTeam.Key.TeamID, item.Channel))
+	if portal == nil || portal.MXID == "" {
+		return
+	}
+	msg := portal.getMessageBySlackID(item.Message.Timestamp)
+	if msg == nil {
+		portal.log.Debugfln("Not marking %s as saved: message not found", item.Message.Timestamp)
+		return
+	}
+	if intent := user.doublePuppetIntent(); intent != nil {
+		user.setMatrixMessageSaved(intent, portal, msg.MatrixID, saved)
+	}
+}
+
+// setMatrixMessageSaved updates the list of saved messages in the room account
+// data, and tags the room if it has any saved messages.
+func (user *User) setMatrixMessageSaved(intent *appservice.IntentAPI, portal *Portal, eventID id.EventID, saved bool) {
+	var content savedMessagesContent
+	err := intent.GetRoomAccountData(portal.MXID, savedMessagesAccountDataType, &content)
+	if err != nil {
+		portal.log.Debugln("Failed to get saved messages, assuming there are none:", err)
+	}
+	index := -1
+	for i, savedID := range content.EventIDs {
+		if savedID == eventID {
+			index = i
+			break
+		}
+	}
+	if saved && index < 0 {
+		content.EventIDs = append(content.EventIDs, eventID)
+	} else if !saved && index >= 0 {
+		content.EventIDs = append(content.EventIDs[:index], content.EventIDs[index+1:]...)
+	} else {
+		return
+	}
+	err = intent.SetRoomAccountData(portal.MXID, savedMessagesAccountDataType, &content)
+	if err != nil {
+		portal.log.Warnfln("Failed to update saved messages of %s: %v", user.MXID, err)
+		return
+	}
+	if len(content.EventIDs) > 0 {
+		err = intent.AddTag(portal.MXID, savedMessagesTag, 0.5)
+	} else {
+		err = intent.RemoveTag(portal.MXID, savedMessagesTag)
+	}
+	if err != nil {
+		portal.log.Warnfln("Failed to update saved messages tag of %s: %v", user.MXID, err)
+	}
+}
@@ -0,0 +1,94 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const sentryFlushTimeout = 5 * time.Second
+
+func (br *SlackBridge) initSentry() {
+	cfg := br.bridgeConfig().Sentry
+	if cfg.DSN == "" {
+		return
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.DSN,
+		Environment: cfg.Environment,
+		SampleRate:  cfg.SampleRate,
+		Release:     fmt.Sprintf("%s@%s", br.Name, br.Version),
+	})
+	if err != nil {
+		br.Log.Fatalln("Failed to initialize Sentry:", err)
+		os.Exit(13)
+	}
+	br.Log.Infoln("Sentry error reporting enabled")
+}
+
+func (br *SlackBridge) flushSentry() {
+	if br.bridgeConfig().Sentry.DSN != "" {
+		sentry.Flush(sentryFlushTimeout)
+	}
+}
+
+// recoverPanic recovers from a panic in an event handler, logs it and reports
+// it to Sentry with the given tags, so that a crash in conversion code only
+// drops the event being handled. It must be called directly with defer.
+func (br *SlackBridge) recoverPanic(action string, tags map[string]string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	br.Log.Errorfln("Panic while %s: %v\n%s", action, recovered, debug.Stack())
+	if br.bridgeConfig().Sentry.DSN == "" {
+		return
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("action", action)
+		scope.SetTags(tags)
+		hub.Recover(recovered)
+	})
+}
+
+func (portal *Portal) sentryTags(user *User) map[string]string {
+	tags := map[string]string{
+		"team_id":    portal.Key.TeamID,
+		"channel_id": portal.Key.ChannelID,
+		"room_id":    portal.MXID.String(),
+	}
+	if user != nil {
+		tags["user_id"] = user.MXID.String()
+	}
+	return tags
+}
+
+func (user *User) sentryTags(userTeam *database.UserTeam) map[string]string {
+	return map[string]string{
+		"user_id":       user.MXID.String(),
+		"team_id":       userTeam.Key.TeamID,
+		"slack_user_id": userTeam.Key.SlackID,
+	}
+}
@@ -0,0 +1,124 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errBridgeShuttingDown = errors.New("the bridge was shut down before the message could be sent")
+
+// drainMatrixEvents handles Matrix events that were received from the
+// homeserver but not dispatched before the event processor was stopped.
+func (br *SlackBridge) drainMatrixEvents() {
+	for {
+		select {
+		case evt := <-br.AS.Events:
+			br.EventProcessor.Dispatch(evt)
+		default:
+			return
+		}
+	}
+}
+
+func (br *SlackBridge) getAllLoadedPortals() []*Portal {
+	br.portalsLock.Lock()
+	defer br.portalsLock.Unlock()
+
+	portals := make([]*Portal, 0, len(br.portalsByID))
+	for _, portal := range br.portalsByID {
+		portals = append(portals, portal)
+	}
+	return portals
+}
+
+// flushMatrixMessages waits until everything currently in the portal's queue
+// has been handled, or until the context is done.
+func (portal *Portal) flushMatrixMessages(ctx context.Context) bool {
+	flushed := make(chan struct{})
+	_ = portal.queueMatrixMessage(portalMatrixMessage{flushed: flushed})
+	select {
+	case <-flushed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// failQueuedMatrixMessages reports the messages that are still in the
+// portal's queue as failed, so that users know to resend them.
+func (portal *Portal) failQueuedMatrixMessages() int {
+	count := 0
+	for _, msg := range portal.takeMatrixQueue() {
+		if msg.flushed != nil {
+			close(msg.flushed)
+			continue
+		}
+		portal.sendMessageMetrics(msg.evt, errBridgeShuttingDown, "Dropping", true, nil)
+		count++
+	}
+	return count
+}
+
+// drainPortals finishes handling the Matrix messages that are already queued
+// in portals. Messages that can't be handled before the shutdown timeout are
+// reported as failed instead of being dropped silently.
+func (br *SlackBridge) drainPortals() {
+	br.drainMatrixEvents()
+
+	ctx, cancel := context.WithTimeout(context.Background(), br.bridgeConfig().ShutdownTimeout)
+	defer cancel()
+	portals := br.getAllLoadedPortals()
+	var wg sync.WaitGroup
+	var timedOut []*Portal
+	var timedOutLock sync.Mutex
+	wg.Add(len(portals))
+	for _, portal := range portals {
+		go func(portal *Portal) {
+			defer wg.Done()
+			if !portal.flushMatrixMessages(ctx) {
+				timedOutLock.Lock()
+				timedOut = append(timedOut, portal)
+				timedOutLock.Unlock()
+			}
+		}(portal)
+	}
+	wg.Wait()
+
+	for _, portal := range timedOut {
+		if count := portal.failQueuedMatrixMessages(); count > 0 {
+			portal.log.Warnfln("Couldn't send %d queued messages before shutting down", count)
+		}
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		br.backgroundSends.Wait()
+		if br.statusBatcher != nil {
+			br.statusBatcher.flush(true)
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		br.Log.Warnln("Timed out waiting for message status events to be sent")
+	}
+}
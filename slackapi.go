@@ -0,0 +1,57 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// callSlackMethod calls a Slack web API method that slackgo doesn't support,
+// such as the ones only used by the official clients.
+func (br *SlackBridge) callSlackMethod(ctx context.Context, userTeam *database.UserTeam, method string, values url.Values, resp interface{ Err() error }) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slack.APIURL+method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+userTeam.Token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if userTeam.CookieToken != "" {
+		req.AddCookie(&http.Cookie{Name: "d", Value: url.QueryEscape(userTeam.CookieToken)})
+	}
+	httpResp, err := br.getSlackHTTPClient(userTeam.Key.TeamID).Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", method, httpResp.StatusCode)
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", method, err)
+	}
+	return resp.Err()
+}
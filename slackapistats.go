@@ -0,0 +1,245 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slackAPITierLimits are the per-minute rate limits Slack advertises for the
+// API methods the bridge uses. Methods with special limits, like posting
+// messages, aren't listed, as their limits don't depend on the call count.
+var slackAPITierLimits = map[string]int{
+	"rtm.connect":           1,
+	"conversations.list":    20,
+	"users.list":            20,
+	"emoji.list":            20,
+	"files.upload":          20,
+	"reactions.remove":      20,
+	"pins.add":              20,
+	"pins.remove":           20,
+	"usergroups.list":       20,
+	"users.setPresence":     20,
+	"bookmarks.list":        20,
+	"stars.add":             20,
+	"stars.remove":          20,
+	"conversations.history": 50,
+	"conversations.replies": 50,
+	"conversations.info":    50,
+	"conversations.open":    50,
+	"conversations.mark":    50,
+	"users.conversations":   50,
+	"team.info":             50,
+	"bots.info":             50,
+	"dnd.info":              50,
+	"reactions.add":         50,
+	"chat.update":           50,
+	"chat.delete":           50,
+	"users.profile.set":     50,
+	"conversations.members": 100,
+	"users.info":            100,
+	"users.profile.get":     100,
+	"files.info":            100,
+	"auth.test":             100,
+	"chat.getPermalink":     100,
+}
+
+type slackMethodStats struct {
+	Calls       int64 `json:"calls"`
+	Errors      int64 `json:"errors"`
+	RateLimited int64 `json:"rate_limited"`
+	LastMinute  int   `json:"last_minute"`
+
+	windowStart time.Time
+	warnedAt    time.Time
+}
+
+// slackAPIStats counts the Slack API calls the bridge makes per team and
+// method, so that operators can see what's using up the rate limits.
+type slackAPIStats struct {
+	lock  sync.Mutex
+	teams map[string]map[string]*slackMethodStats
+}
+
+// record counts a call and returns the number of calls to the method in the
+// current minute if it's close to Slack's limit and a warning is due.
+func (sas *slackAPIStats) record(teamID, method string, statusCode int, failed bool, warnAt float64) (callsInMinute, limit int) {
+	sas.lock.Lock()
+	defer sas.lock.Unlock()
+	if sas.teams == nil {
+		sas.teams = make(map[string]map[string]*slackMethodStats)
+	}
+	methods, ok := sas.teams[teamID]
+	if !ok {
+		methods = make(map[string]*slackMethodStats)
+		sas.teams[teamID] = methods
+	}
+	stats, ok := methods[method]
+	if !ok {
+		stats = &slackMethodStats{}
+		methods[method] = stats
+	}
+	stats.Calls++
+	if failed {
+		stats.Errors++
+	}
+	if statusCode == http.StatusTooManyRequests {
+		stats.RateLimited++
+	}
+	now := time.Now()
+	if now.Sub(stats.windowStart) >= time.Minute {
+		stats.windowStart = now
+		stats.LastMinute = 0
+	}
+	stats.LastMinute++
+	limit = slackAPITierLimits[method]
+	if limit > 0 && warnAt > 0 && float64(stats.LastMinute) >= warnAt*float64(limit) && now.Sub(stats.warnedAt) >= time.Hour {
+		stats.warnedAt = now
+		return stats.LastMinute, limit
+	}
+	return 0, limit
+}
+
+func (sas *slackAPIStats) reset(teamID string) {
+	sas.lock.Lock()
+	if teamID == "" {
+		sas.teams = nil
+	} else {
+		delete(sas.teams, teamID)
+	}
+	sas.lock.Unlock()
+}
+
+// snapshot returns a copy of the stats of all teams.
+func (sas *slackAPIStats) snapshot() map[string]map[string]slackMethodStats {
+	sas.lock.Lock()
+	defer sas.lock.Unlock()
+	teams := make(map[string]map[string]slackMethodStats, len(sas.teams))
+	for teamID, methods := range sas.teams {
+		teamCopy := make(map[string]slackMethodStats, len(methods))
+		for method, stats := range methods {
+			statsCopy := *stats
+			if time.Since(stats.windowStart) >= time.Minute {
+				statsCopy.LastMinute = 0
+			}
+			teamCopy[method] = statsCopy
+		}
+		teams[teamID] = teamCopy
+	}
+	return teams
+}
+
+func formatSlackAPIStats(teamID string, methods map[string]slackMethodStats) string {
+	names := make([]string, 0, len(methods))
+	var total, rateLimited int64
+	for method, stats := range methods {
+		names = append(names, method)
+		total += stats.Calls
+		rateLimited += stats.RateLimited
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return methods[names[i]].Calls > methods[names[j]].Calls
+	})
+	var out strings.Builder
+	if teamID == "" {
+		teamID = "Without team"
+	}
+	_, _ = fmt.Fprintf(&out, "**%s**: %d calls, %d rate limited\n\n", teamID, total, rateLimited)
+	for _, method := range names {
+		stats := methods[method]
+		_, _ = fmt.Fprintf(&out, "* `%s`: %d calls, %d errors, %d rate limited, %d in the last minute", method, stats.Calls, stats.Errors, stats.RateLimited, stats.LastMinute)
+		if limit := slackAPITierLimits[method]; limit > 0 {
+			_, _ = fmt.Fprintf(&out, " (limit %d/min)", limit)
+		}
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+// slackStatsTransport counts the Slack API calls made for a team, and
+// optionally logs them.
+type slackStatsTransport struct {
+	bridge *SlackBridge
+	teamID string
+	base   http.RoundTripper
+}
+
+func (sst *slackStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/api/") {
+		return sst.base.RoundTrip(req)
+	}
+	method := strings.TrimPrefix(req.URL.Path, "/api/")
+	start := time.Now()
+	resp, err := sst.base.RoundTrip(req)
+	var statusCode int
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	cfg := sst.bridge.bridgeConfig().APIStats
+	if cfg.LogCalls {
+		sst.bridge.Log.Debugfln("Slack API call %s for %s: HTTP %d in %s (error: %v)", method, sst.teamID, statusCode, time.Since(start), err)
+	}
+	if statusCode == http.StatusTooManyRequests {
+		sst.bridge.Log.Warnfln("Slack API call %s for %s was rate limited, retry after %s seconds", method, sst.teamID, resp.Header.Get("Retry-After"))
+	}
+	failed := err != nil || statusCode >= 400
+	if err == nil && statusCode == http.StatusOK {
+		var ok bool
+		ok, err = slackResponseOK(resp)
+		if err != nil {
+			resp = nil
+		}
+		failed = failed || !ok
+	}
+	calls, limit := sst.bridge.apiStats.record(sst.teamID, method, statusCode, failed, cfg.QuotaWarning)
+	if calls > 0 {
+		sst.bridge.Log.Warnfln("Made %d calls to Slack API method %s for %s in the last minute, Slack's limit is about %d per minute", calls, method, sst.teamID, limit)
+		go sst.bridge.sendAdminNotice("The bridge made %d calls to the Slack API method `%s` for team %s in a minute, close to Slack's limit of about %d per minute. "+
+			"Consider lowering backfill or sync settings.", calls, method, sst.teamID, limit)
+	}
+	return resp, err
+}
+
+// slackResponseOK checks the ok field of a Slack API response. Slack reports
+// most errors with HTTP 200, so the status code alone doesn't say whether a
+// call failed. The body is buffered and put back for the actual caller.
+func slackResponseOK(resp *http.Response) (bool, error) {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return true, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var parsed struct {
+		OK *bool `json:"ok"`
+	}
+	if json.Unmarshal(body, &parsed) != nil || parsed.OK == nil {
+		return true, nil
+	}
+	return *parsed.OK, nil
+}
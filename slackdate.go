@@ -0,0 +1,111 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slack date tokens look like <!date^1392734382^Posted {date_short} at {time}^https://example.com|fallback>.
+// Slack renders them in the reader's timezone and language, and relative
+// tokens like {date_pretty} say "today" or "yesterday". Bridged messages are
+// the same for everyone and don't change later, so they're rendered as
+// absolute timestamps in the configured timezone instead.
+// See https://api.slack.com/reference/surfaces/formatting#date-formatting
+
+var slackDateTokenRegex = regexp.MustCompile(`{[a-z_]+}`)
+
+func ordinalDay(day int) string {
+	suffix := "th"
+	if day < 11 || day > 13 {
+		switch day % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return strconv.Itoa(day) + suffix
+}
+
+func formatSlackDateToken(token string, ts time.Time) (string, error) {
+	switch token {
+	case "{date_num}":
+		return ts.Format("2006-01-02"), nil
+	case "{date}", "{date_pretty}":
+		return fmt.Sprintf("%s %s, %d", ts.Month(), ordinalDay(ts.Day()), ts.Year()), nil
+	case "{date_short}", "{date_short_pretty}":
+		return ts.Format("Jan 2, 2006"), nil
+	case "{date_long}", "{date_long_pretty}":
+		return fmt.Sprintf("%s, %s %s, %d", ts.Weekday(), ts.Month(), ordinalDay(ts.Day()), ts.Year()), nil
+	case "{time}":
+		return ts.Format("3:04 PM MST"), nil
+	case "{time_secs}":
+		return ts.Format("3:04:05 PM MST"), nil
+	case "{ago}":
+		return ts.Format("Jan 2, 2006 3:04 PM MST"), nil
+	default:
+		return "", fmt.Errorf("unknown date token %s", token)
+	}
+}
+
+// formatSlackDate fills the date tokens in a Slack date token string.
+func formatSlackDate(format string, ts time.Time) (string, error) {
+	var err error
+	formatted := slackDateTokenRegex.ReplaceAllStringFunc(format, func(token string) string {
+		value, tokenErr := formatSlackDateToken(token, ts)
+		if tokenErr != nil {
+			err = tokenErr
+		}
+		return value
+	})
+	return formatted, err
+}
+
+// renderSlackDate renders the arguments of a <!date^...> tag as HTML. The
+// fallback text from Slack is used if the tag can't be parsed.
+func (portal *Portal) renderSlackDate(args, fallback string) string {
+	parts := strings.SplitN(args, "^", 3)
+	var formatted string
+	var unixTS int64
+	var err error
+	if len(parts) < 2 {
+		err = errors.New("missing token string")
+	} else if unixTS, err = strconv.ParseInt(parts[0], 10, 64); err == nil {
+		ts := time.Unix(unixTS, 0).In(portal.bridge.bridgeConfig().DateLocation())
+		formatted, err = formatSlackDate(html.UnescapeString(parts[1]), ts)
+	}
+	if err != nil {
+		portal.log.Debugfln("Failed to render date token %q, using fallback text: %v", args, err)
+		formatted = fallback
+		if formatted == "" {
+			formatted = html.UnescapeString("<!date^" + args + ">")
+		}
+	}
+	if len(parts) == 3 && parts[2] != "" {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(html.UnescapeString(parts[2])), html.EscapeString(formatted))
+	}
+	return html.EscapeString(formatted)
+}
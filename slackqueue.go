@@ -0,0 +1,133 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+type queuedSlackEvent struct {
+	user     *User
+	userTeam *database.UserTeam
+	data     interface{}
+}
+
+type slackEventQueue struct {
+	key       database.PortalKey
+	events    []queuedSlackEvent
+	scheduled bool
+}
+
+// slackEventScheduler runs incoming Slack events on a bounded pool of workers.
+// Events are queued per channel, and like with portalScheduler, a channel is
+// only ever handled by one worker at a time, which keeps its events in order,
+// while a burst of events in one busy channel doesn't delay the others.
+type slackEventScheduler struct {
+	queues map[database.PortalKey]*slackEventQueue
+	ready  []*slackEventQueue
+	lock   sync.Mutex
+	cond   *sync.Cond
+}
+
+func newSlackEventScheduler() *slackEventScheduler {
+	ses := &slackEventScheduler{queues: make(map[database.PortalKey]*slackEventQueue)}
+	ses.cond = sync.NewCond(&ses.lock)
+	return ses
+}
+
+func (ses *slackEventScheduler) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		go ses.worker()
+	}
+}
+
+// dispatch adds an event to the queue of the channel it belongs to. Events of
+// the same channel are handled in the order they're dispatched, even if they
+// were received through different users.
+func (ses *slackEventScheduler) dispatch(user *User, userTeam *database.UserTeam, data interface{}) {
+	key := database.NewPortalKey(userTeam.Key.TeamID, getSlackEventChannelID(data))
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+	queue, ok := ses.queues[key]
+	if !ok {
+		queue = &slackEventQueue{key: key}
+		ses.queues[key] = queue
+	}
+	queue.events = append(queue.events, queuedSlackEvent{user: user, userTeam: userTeam, data: data})
+	if !queue.scheduled {
+		queue.scheduled = true
+		ses.ready = append(ses.ready, queue)
+		ses.cond.Signal()
+	}
+}
+
+func (ses *slackEventScheduler) next() (*slackEventQueue, queuedSlackEvent) {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+	for len(ses.ready) == 0 {
+		ses.cond.Wait()
+	}
+	queue := ses.ready[0]
+	ses.ready[0] = nil
+	ses.ready = ses.ready[1:]
+	evt := queue.events[0]
+	queue.events[0] = queuedSlackEvent{}
+	queue.events = queue.events[1:]
+	return queue, evt
+}
+
+func (ses *slackEventScheduler) done(queue *slackEventQueue) {
+	ses.lock.Lock()
+	defer ses.lock.Unlock()
+	if len(queue.events) == 0 {
+		queue.scheduled = false
+		delete(ses.queues, queue.key)
+	} else {
+		// Go to the back of the line so that other channels get a turn too
+		ses.ready = append(ses.ready, queue)
+		ses.cond.Signal()
+	}
+}
+
+func (ses *slackEventScheduler) worker() {
+	for {
+		queue, evt := ses.next()
+		evt.user.handleSlackEvent(evt.userTeam, evt.data)
+		ses.done(queue)
+	}
+}
+
+func getSlackEventChannelID(data interface{}) string {
+	switch event := data.(type) {
+	case *slack.MessageEvent:
+		return event.Channel
+	case *slack.ReactionAddedEvent:
+		return event.Item.Channel
+	case *slack.ReactionRemovedEvent:
+		return event.Item.Channel
+	case *slack.UserTypingEvent:
+		return event.Channel
+	case *slack.ChannelMarkedEvent:
+		return event.Channel
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,79 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const slackSlashCommandPath = "/_slack/v1/command"
+
+// maxSlashCommandBody limits how much of a slash command request is read
+// before the signature has been checked.
+const maxSlashCommandBody = 64 * 1024
+
+func (br *SlackBridge) registerSlashCommand() {
+	br.AS.Router.HandleFunc(slackSlashCommandPath, br.serveSlashCommand).Methods(http.MethodPost)
+}
+
+// serveSlashCommand handles the Slack app slash command, which replies with a
+// link to the Matrix room of the channel the command was used in. The reply
+// is ephemeral, so only the person who used the command sees it.
+func (br *SlackBridge) serveSlashCommand(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSlashCommandBody))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	verifier, err := slack.NewSecretsVerifier(r.Header, br.bridgeConfig().SlackApp.SigningSecret)
+	if err == nil {
+		_, _ = verifier.Write(body)
+		err = verifier.Ensure()
+	}
+	if err != nil {
+		br.Log.Debugfln("Rejected slash command request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	cmd, err := slack.SlashCommandParse(r)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	br.Log.Debugfln("%s-%s used %s in %s", cmd.TeamID, cmd.UserID, cmd.Command, cmd.ChannelID)
+	jsonResponse(w, http.StatusOK, &slack.Msg{
+		ResponseType: slack.ResponseTypeEphemeral,
+		Text:         br.slashCommandReply(cmd),
+	})
+}
+
+func (br *SlackBridge) slashCommandReply(cmd slack.SlashCommand) string {
+	portal := br.DB.Portal.GetByID(database.PortalKey{TeamID: cmd.TeamID, ChannelID: cmd.ChannelID})
+	if portal == nil || portal.MXID == "" {
+		return "This channel isn't bridged to Matrix."
+	}
+	link := fmt.Sprintf("https://matrix.to/#/%s?via=%s", portal.MXID, br.AS.HomeserverDomain)
+	return fmt.Sprintf("This channel is bridged to <%s|%s> on Matrix.", link, portal.MXID)
+}
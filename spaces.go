@@ -0,0 +1,245 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// SlackChannelSectionsEvent is sent when the user reorganizes their sidebar.
+// Only the type is needed, as the sections are fetched again anyway.
+type SlackChannelSectionsEvent struct {
+	Type string `json:"type"`
+}
+
+func init() {
+	for _, evtType := range []string{"channel_sections_upserted", "channel_sections_channels_upserted",
+		"channel_sections_channels_removed", "channel_section_deleted"} {
+		slack.EventMapping[evtType] = SlackChannelSectionsEvent{}
+	}
+}
+
+type slackChannelSection struct {
+	ID             string `json:"channel_section_id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	ChannelIDsPage struct {
+		ChannelIDs []string `json:"channel_ids"`
+	} `json:"channel_ids_page"`
+}
+
+type channelSectionsResponse struct {
+	slack.SlackResponse
+	ChannelSections []slackChannelSection `json:"channel_sections"`
+}
+
+// getChannelSections fetches the sidebar sections of the user. Only the first
+// page of channels is used for each section, which covers everything except
+// very large sections.
+func (user *User) getChannelSections(userTeam *database.UserTeam) ([]slackChannelSection, error) {
+	var resp channelSectionsResponse
+	err := user.bridge.callSlackMethod(context.Background(), userTeam, "users.channelSections.list", url.Values{}, &resp)
+	return resp.ChannelSections, err
+}
+
+// ensureTeamSpace creates the personal space of the user for the workspace
+// if spaces are enabled and it doesn't exist yet.
+func (user *User) ensureTeamSpace(userTeam *database.UserTeam) id.RoomID {
+	if !user.bridge.bridgeConfig().Spaces.Enable {
+		return ""
+	}
+	user.spaceLock.Lock()
+	defer user.spaceLock.Unlock()
+	if userTeam.SpaceRoom != "" {
+		return userTeam.SpaceRoom
+	}
+
+	var avatarURL id.ContentURI
+	if teamInfo := user.bridge.DB.TeamInfo.GetBySlackTeam(userTeam.Key.TeamID); teamInfo != nil {
+		avatarURL = teamInfo.AvatarUrl
+	}
+	roomID, err := user.createSpace(userTeam.TeamName, avatarURL)
+	if err != nil {
+		user.log.Errorfln("Failed to create space for %s: %v", userTeam.Key, err)
+		return ""
+	}
+	user.log.Infofln("Created space %s for %s", roomID, userTeam.Key)
+	userTeam.SpaceRoom = roomID
+	userTeam.Upsert()
+	return roomID
+}
+
+func (user *User) createSpace(name string, avatarURL id.ContentURI) (id.RoomID, error) {
+	req := &mautrix.ReqCreateRoom{
+		Visibility: "private",
+		Name:       name,
+		Preset:     "private_chat",
+		CreationContent: map[string]interface{}{
+			"type": event.RoomTypeSpace,
+		},
+		PowerLevelOverride: &event.PowerLevelsEventContent{
+			Users: map[id.UserID]int{
+				user.bridge.Bot.UserID: 9001,
+				user.MXID:              50,
+			},
+		},
+	}
+	if !avatarURL.IsEmpty() {
+		req.InitialState = append(req.InitialState, &event.Event{
+			Type:    event.StateRoomAvatar,
+			Content: event.Content{Parsed: &event.RoomAvatarEventContent{URL: avatarURL}},
+		})
+	}
+	resp, err := user.bridge.Bot.CreateRoom(req)
+	if err != nil {
+		return "", err
+	}
+	user.ensureInvited(user.bridge.Bot, resp.RoomID, false)
+	return resp.RoomID, nil
+}
+
+func (user *User) addSpaceChild(spaceID, childID id.RoomID) {
+	_, err := user.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, childID.String(), &event.SpaceChildEventContent{
+		Via: []string{user.bridge.Config.Homeserver.Domain},
+	})
+	if err != nil {
+		user.log.Warnfln("Failed to add %s to space %s: %v", childID, spaceID, err)
+	}
+}
+
+// setSpaceChildren makes the children of the space match the given set.
+func (user *User) setSpaceChildren(spaceID id.RoomID, children map[id.RoomID]bool) {
+	state, err := user.bridge.Bot.State(spaceID)
+	if err != nil {
+		user.log.Warnfln("Failed to get state of space %s: %v", spaceID, err)
+		return
+	}
+	for stateKey, evt := range state[event.StateSpaceChild] {
+		childID := id.RoomID(stateKey)
+		content, ok := evt.Content.Parsed.(*event.SpaceChildEventContent)
+		if !ok || len(content.Via) == 0 {
+			continue
+		} else if children[childID] {
+			delete(children, childID)
+		} else {
+			_, err = user.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, stateKey, struct{}{})
+			if err != nil {
+				user.log.Warnfln("Failed to remove %s from space %s: %v", childID, spaceID, err)
+			}
+		}
+	}
+	for childID := range children {
+		user.addSpaceChild(spaceID, childID)
+	}
+}
+
+// syncSpaces puts all portals of the workspace in the user's space. If
+// sections are enabled, starred and custom sidebar sections get their own
+// sub-spaces, and portals in those sections are moved there.
+func (user *User) syncSpaces(userTeam *database.UserTeam) {
+	teamSpace := user.ensureTeamSpace(userTeam)
+	if teamSpace == "" {
+		return
+	}
+	user.spaceLock.Lock()
+	defer user.spaceLock.Unlock()
+
+	roomsByChannel := make(map[string]id.RoomID)
+	parents := make(map[id.RoomID]id.RoomID)
+	for _, portal := range user.bridge.GetAllPortalsForUserTeam(userTeam.Key) {
+		if portal.MXID != "" {
+			roomsByChannel[portal.Key.ChannelID] = portal.MXID
+			parents[portal.MXID] = teamSpace
+		}
+	}
+	children := map[id.RoomID]map[id.RoomID]bool{teamSpace: {}}
+
+	if user.bridge.bridgeConfig().Spaces.Sections {
+		sections, err := user.getChannelSections(userTeam)
+		if err != nil {
+			user.log.Warnfln("Failed to get sidebar sections of %s: %v", userTeam.Key, err)
+		} else {
+			stored := user.bridge.DB.SectionSpace.GetAll(userTeam.Key)
+			for _, section := range sections {
+				space := user.ensureSectionSpace(userTeam, stored[section.ID], &section)
+				if space == nil {
+					continue
+				}
+				delete(stored, section.ID)
+				children[teamSpace][space.SpaceRoom] = true
+				children[space.SpaceRoom] = make(map[id.RoomID]bool)
+				for _, channelID := range section.ChannelIDsPage.ChannelIDs {
+					if roomID, ok := roomsByChannel[channelID]; ok {
+						parents[roomID] = space.SpaceRoom
+					}
+				}
+			}
+			for sectionID, space := range stored {
+				user.log.Debugfln("Sidebar section %s of %s was removed, emptying %s", sectionID, userTeam.Key, space.SpaceRoom)
+				user.setSpaceChildren(space.SpaceRoom, map[id.RoomID]bool{})
+				user.bridge.DB.SectionSpace.Delete(userTeam.Key, sectionID)
+			}
+		}
+	}
+
+	for roomID, parent := range parents {
+		children[parent][roomID] = true
+	}
+	for spaceID, spaceChildren := range children {
+		user.setSpaceChildren(spaceID, spaceChildren)
+	}
+}
+
+func (user *User) ensureSectionSpace(userTeam *database.UserTeam, space *database.SectionSpace, section *slackChannelSection) *database.SectionSpace {
+	name := section.Name
+	switch section.Type {
+	case "stars":
+		if name == "" {
+			name = "Starred"
+		}
+	case "standard":
+	default:
+		// Built-in sections like channels and DMs stay in the workspace space
+		return nil
+	}
+	if space == nil {
+		roomID, err := user.createSpace(name, id.ContentURI{})
+		if err != nil {
+			user.log.Errorfln("Failed to create space for sidebar section %s of %s: %v", section.ID, userTeam.Key, err)
+			return nil
+		}
+		space = &database.SectionSpace{SectionID: section.ID, Name: name, SpaceRoom: roomID}
+		user.bridge.DB.SectionSpace.Upsert(userTeam.Key, space)
+	} else if space.Name != name {
+		_, err := user.bridge.Bot.SetRoomName(space.SpaceRoom, name)
+		if err != nil {
+			user.log.Warnfln("Failed to rename space of sidebar section %s: %v", section.ID, err)
+		}
+		space.Name = name
+		user.bridge.DB.SectionSpace.Upsert(userTeam.Key, space)
+	}
+	return space
+}
@@ -0,0 +1,167 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type queuedStatus struct {
+	intent  *appservice.IntentAPI
+	content *event.BeeperMessageStatusEventContent
+}
+
+type roomStatusQueue struct {
+	sentInWindow int
+	order        []id.EventID
+	pending      map[id.EventID]*queuedStatus
+}
+
+// statusBatcher rate limits message status events per room and checkpoints
+// for the whole bridge. Statuses are sent immediately until the limit of the
+// current window is reached, after which they're queued and sent in later
+// windows. Queued statuses of the same message replace each other, as only
+// the latest one matters.
+type statusBatcher struct {
+	bridge     *SlackBridge
+	interval   time.Duration
+	maxPerRoom int
+
+	lock                sync.Mutex
+	rooms               map[id.RoomID]*roomStatusQueue
+	checkpointsInWindow int
+	checkpoints         []*status.MessageCheckpoint
+}
+
+func newStatusBatcher(br *SlackBridge) *statusBatcher {
+	return &statusBatcher{
+		bridge:     br,
+		interval:   br.bridgeConfig().StatusBatching.Interval,
+		maxPerRoom: br.bridgeConfig().StatusBatching.MaxPerRoom,
+		rooms:      make(map[id.RoomID]*roomStatusQueue),
+	}
+}
+
+// queueStatus returns true if the status can be sent right away. Otherwise
+// the status is queued and will be sent by the flush loop.
+func (sb *statusBatcher) queueStatus(roomID id.RoomID, intent *appservice.IntentAPI, content *event.BeeperMessageStatusEventContent) bool {
+	if sb == nil {
+		return true
+	}
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	room, ok := sb.rooms[roomID]
+	if !ok {
+		room = &roomStatusQueue{pending: make(map[id.EventID]*queuedStatus)}
+		sb.rooms[roomID] = room
+	}
+	targetID := content.RelatesTo.EventID
+	if _, alreadyQueued := room.pending[targetID]; !alreadyQueued {
+		if len(room.order) == 0 && room.sentInWindow < sb.maxPerRoom {
+			room.sentInWindow++
+			return true
+		}
+		room.order = append(room.order, targetID)
+	}
+	room.pending[targetID] = &queuedStatus{intent: intent, content: content}
+	return false
+}
+
+func (sb *statusBatcher) queueCheckpoint(checkpoint *status.MessageCheckpoint) bool {
+	if sb == nil {
+		return true
+	}
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if len(sb.checkpoints) == 0 && sb.checkpointsInWindow < sb.maxPerRoom {
+		sb.checkpointsInWindow++
+		return true
+	}
+	sb.checkpoints = append(sb.checkpoints, checkpoint)
+	return false
+}
+
+// take starts a new window and returns the queued statuses that fit in it.
+// If all is true, everything is returned regardless of the limits.
+func (sb *statusBatcher) take(all bool) (map[id.RoomID][]*queuedStatus, []*status.MessageCheckpoint) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	statuses := make(map[id.RoomID][]*queuedStatus)
+	for roomID, room := range sb.rooms {
+		count := len(room.order)
+		if !all && count > sb.maxPerRoom {
+			count = sb.maxPerRoom
+		}
+		for _, targetID := range room.order[:count] {
+			statuses[roomID] = append(statuses[roomID], room.pending[targetID])
+			delete(room.pending, targetID)
+		}
+		room.order = room.order[count:]
+		room.sentInWindow = count
+		if len(room.order) == 0 && count == 0 {
+			delete(sb.rooms, roomID)
+		}
+	}
+	checkpoints := sb.checkpoints
+	sb.checkpoints = nil
+	sb.checkpointsInWindow = 0
+	return statuses, checkpoints
+}
+
+func (sb *statusBatcher) flush(all bool) {
+	statuses, checkpoints := sb.take(all)
+	if len(checkpoints) > 0 {
+		err := sb.bridge.SendMessageCheckpoints(checkpoints)
+		if err != nil {
+			sb.bridge.Log.Warnfln("Failed to send %d batched checkpoints: %v", len(checkpoints), err)
+		}
+	}
+	for roomID, roomStatuses := range statuses {
+		for _, queued := range roomStatuses {
+			_, err := queued.intent.SendMessageEvent(roomID, event.BeeperMessageStatus, queued.content)
+			if err != nil {
+				sb.bridge.Log.Warnfln("Failed to send batched message status of %s in %s: %v", queued.content.RelatesTo.EventID, roomID, err)
+			}
+		}
+	}
+}
+
+func (sb *statusBatcher) loop() {
+	ticker := time.NewTicker(sb.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sb.flush(false)
+	}
+}
+
+// sendMessageCheckpoint sends a remote step checkpoint for a Matrix event,
+// batching it with others if there are too many.
+func (br *SlackBridge) sendMessageCheckpoint(evt *event.Event, err error, checkpointStatus status.MessageCheckpointStatus, retryNum int) {
+	checkpoint := status.NewMessageCheckpoint(evt, status.MsgStepRemote, checkpointStatus, retryNum)
+	if err != nil {
+		checkpoint.Info = err.Error()
+	}
+	if br.statusBatcher.queueCheckpoint(checkpoint) {
+		go br.SendRawMessageCheckpoint(checkpoint)
+	}
+}
@@ -0,0 +1,96 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	summaryTopSenders   = 5
+	summaryBusiestHours = 3
+)
+
+type summaryCount struct {
+	Key   string
+	Count int
+}
+
+// sortedCounts sorts the counts from largest to smallest, breaking ties by key
+// so that the output is stable.
+func sortedCounts(counts map[string]int) []summaryCount {
+	sorted := make([]summaryCount, 0, len(counts))
+	for key, count := range counts {
+		sorted = append(sorted, summaryCount{key, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// buildSummary summarizes the messages bridged in the portal during the last
+// days from the message table, without making any Slack API calls.
+func (portal *Portal) buildSummary(days int) string {
+	since := time.Now().AddDate(0, 0, -days)
+	messages := portal.bridge.DB.Message.GetSince(portal.Key, strconv.FormatInt(since.Unix(), 10))
+	if len(messages) == 0 {
+		return fmt.Sprintf("No messages were bridged in this room in the last %d days.", days)
+	}
+
+	loc := portal.bridge.bridgeConfig().DateLocation()
+	senders := make(map[string]int)
+	hours := make(map[string]int)
+	var threadReplies int
+	for _, msg := range messages {
+		senders[msg.AuthorID]++
+		hours[fmt.Sprintf("%02d:00", parseSlackTimestamp(msg.SlackID).In(loc).Hour())]++
+		if msg.SlackThreadID != "" && msg.SlackThreadID != msg.SlackID {
+			threadReplies++
+		}
+	}
+
+	var text strings.Builder
+	_, _ = fmt.Fprintf(&text, "**Summary of the last %d days**\n\n", days)
+	_, _ = fmt.Fprintf(&text, "%d messages from %d senders, %d of them in threads.\n\n", len(messages), len(senders), threadReplies)
+	text.WriteString("Top senders:\n\n")
+	for i, sender := range sortedCounts(senders) {
+		if i >= summaryTopSenders {
+			break
+		}
+		name := sender.Key
+		if puppet := portal.bridge.GetPuppetByID(portal.Key.TeamID, sender.Key); puppet != nil && puppet.Name != "" {
+			name = puppet.Name
+		}
+		_, _ = fmt.Fprintf(&text, "%d. %s: %d messages\n", i+1, name, sender.Count)
+	}
+	_, _ = fmt.Fprintf(&text, "\nBusiest hours (%s):\n\n", loc)
+	for i, hour := range sortedCounts(hours) {
+		if i >= summaryBusiestHours {
+			break
+		}
+		_, _ = fmt.Fprintf(&text, "* %s: %d messages\n", hour.Key, hour.Count)
+	}
+	return text.String()
+}
@@ -0,0 +1,228 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+type syncStage int
+
+const (
+	syncStageChannelList syncStage = iota
+	syncStageChannels
+	syncStageBackfill
+)
+
+// syncProgress reports the progress of a long Slack sync, so that users know
+// the bridge is still working. Nothing is reported for syncs that finish
+// within the configured interval. After that, the progress is sent as a bridge
+// state and as a notice in the management room, which is edited as the sync
+// goes on.
+type syncProgress struct {
+	user     *User
+	userTeam *database.UserTeam
+	interval time.Duration
+	started  time.Time
+
+	lock    sync.Mutex
+	stage   syncStage
+	total   int
+	synced  int
+	created int
+	current string
+
+	reported bool
+	noticeID id.EventID
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func (user *User) startSyncProgress(userTeam *database.UserTeam) *syncProgress {
+	progress := &syncProgress{
+		user:     user,
+		userTeam: userTeam,
+		interval: user.bridge.bridgeConfig().SyncProgress.Interval,
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if progress.interval > 0 {
+		go progress.loop()
+	} else {
+		close(progress.stopped)
+	}
+	return progress
+}
+
+func (sp *syncProgress) loop() {
+	defer close(sp.stopped)
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sp.report()
+		case <-sp.stop:
+			return
+		}
+	}
+}
+
+// setChannels moves on to syncing the given number of channels.
+func (sp *syncProgress) setChannels(total int) {
+	sp.lock.Lock()
+	sp.stage = syncStageChannels
+	sp.total = total
+	sp.lock.Unlock()
+}
+
+// syncing records the channel that's currently being synced.
+func (sp *syncProgress) syncing(name string) {
+	sp.lock.Lock()
+	sp.current = name
+	sp.lock.Unlock()
+}
+
+// channelDone counts a channel as synced.
+func (sp *syncProgress) channelDone(created bool) {
+	sp.lock.Lock()
+	sp.synced++
+	if created {
+		sp.created++
+	}
+	sp.current = ""
+	sp.lock.Unlock()
+}
+
+// finish waits until the first batch of messages has been backfilled into the
+// new rooms, then stops reporting. The final state is only sent if progress
+// was reported, so short syncs don't cause any extra noise.
+func (sp *syncProgress) finish() {
+	sp.lock.Lock()
+	waitForBackfill := sp.interval > 0 && sp.created > 0 && sp.user.bridge.getTeamConfig(sp.userTeam.Key.TeamID).Backfill.Enable
+	if waitForBackfill {
+		sp.stage = syncStageBackfill
+	}
+	sp.lock.Unlock()
+	go sp.complete(waitForBackfill)
+}
+
+func (sp *syncProgress) complete(waitForBackfill bool) {
+	if waitForBackfill {
+		ticker := time.NewTicker(5 * time.Second)
+		for range ticker.C {
+			if sp.userTeam.Client == nil || sp.user.bridge.DB.Backfill.CountPendingImmediate(sp.userTeam.Key.TeamID) == 0 {
+				break
+			}
+		}
+		ticker.Stop()
+	}
+	close(sp.stop)
+	<-sp.stopped
+	sp.lock.Lock()
+	reported := sp.reported
+	sp.lock.Unlock()
+	if reported {
+		sp.sendNotice(fmt.Sprintf("Finished syncing %d channels of %s in %s (%d new rooms)",
+			sp.synced, sp.userTeam.TeamName, time.Since(sp.started).Round(time.Second), sp.created))
+		if sp.userTeam.Client != nil {
+			sp.user.BridgeStates[sp.userTeam.Key.TeamID].Send(status.BridgeState{StateEvent: status.StateConnected})
+		}
+	}
+}
+
+func (sp *syncProgress) describe() (string, map[string]interface{}) {
+	info := map[string]interface{}{
+		"synced_channels": sp.synced,
+		"total_channels":  sp.total,
+		"created_rooms":   sp.created,
+		"elapsed_seconds": int(time.Since(sp.started).Seconds()),
+	}
+	var text string
+	switch sp.stage {
+	case syncStageChannelList:
+		info["stage"] = "channel_list"
+		text = fmt.Sprintf("Fetching the channel list of %s", sp.userTeam.TeamName)
+	case syncStageChannels:
+		info["stage"] = "channels"
+		text = fmt.Sprintf("Syncing channels of %s: %d/%d done, %d new rooms", sp.userTeam.TeamName, sp.synced, sp.total, sp.created)
+		if sp.current != "" {
+			text += fmt.Sprintf(", currently syncing %s", sp.current)
+		}
+	case syncStageBackfill:
+		pending := sp.user.bridge.DB.Backfill.CountPendingImmediate(sp.userTeam.Key.TeamID)
+		info["stage"] = "backfill"
+		info["pending_backfills"] = pending
+		text = fmt.Sprintf("Synced %d channels of %s, backfilling recent messages in %d of %d new rooms", sp.synced, sp.userTeam.TeamName, pending, sp.created)
+	}
+	return text, info
+}
+
+func (sp *syncProgress) report() {
+	sp.lock.Lock()
+	text, info := sp.describe()
+	sp.reported = true
+	sp.lock.Unlock()
+	elapsed := time.Since(sp.started).Round(time.Second)
+	sp.user.log.Infofln("%s (%s elapsed)", text, elapsed)
+	sp.user.BridgeStates[sp.userTeam.Key.TeamID].Send(status.BridgeState{
+		StateEvent: status.StateBackfilling,
+		Message:    text,
+		Info:       info,
+		// Progress is sent every interval, so make sure it isn't deduplicated
+		TTL: int(2 * sp.interval / time.Second),
+	})
+	sp.sendNotice(fmt.Sprintf("%s (%s elapsed)", text, elapsed))
+}
+
+// sendNotice sends the progress to the management room, or edits the
+// previous progress notice if there is one.
+func (sp *syncProgress) sendNotice(text string) {
+	if !sp.user.bridge.bridgeConfig().SyncProgress.Notices || sp.user.ManagementRoom == "" {
+		return
+	}
+	content := &event.MessageEventContent{MsgType: event.MsgNotice, Body: text}
+	if sp.noticeID != "" {
+		content.SetEdit(sp.noticeID)
+	}
+	resp, err := sp.user.bridge.Bot.SendMessageEvent(sp.user.ManagementRoom, event.EventMessage, content)
+	if err != nil {
+		sp.user.log.Warnfln("Failed to send sync progress to %s: %v", sp.user.ManagementRoom, err)
+	} else if sp.noticeID == "" {
+		sp.noticeID = resp.EventID
+	}
+}
+
+func syncProgressName(portal *Portal, channel *slack.Channel) string {
+	if channel.Name != "" && !channel.IsIM && !channel.IsMpIM {
+		return "#" + channel.Name
+	} else if portal.Name != "" {
+		return portal.Name
+	}
+	return portal.Key.ChannelID
+}
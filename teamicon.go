@@ -0,0 +1,89 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// TeamIconChangeEvent is sent when the workspace icon is changed. slackgo
+// doesn't know about it, so it's added to the RTM event mapping in init.
+type TeamIconChangeEvent struct {
+	Type string                 `json:"type"`
+	Icon map[string]interface{} `json:"icon"`
+}
+
+func init() {
+	slack.EventMapping["team_icon_change"] = TeamIconChangeEvent{}
+}
+
+// updateTeamAvatar reuploads the workspace icon if it has changed. Returns
+// true if the team info needs to be saved.
+func (user *User) updateTeamAvatar(userTeam *database.UserTeam, teamInfo *database.TeamInfo, icon map[string]interface{}) bool {
+	iconURL, ok := icon["image_230"].(string)
+	if !ok || teamInfo.Avatar == iconURL {
+		return false
+	}
+	avatar, err := uploadAvatar(user.bridge.getSlackHTTPClient(userTeam.Key.TeamID), user.bridge.AS.BotIntent(), iconURL)
+	if err != nil {
+		user.log.Warnfln("Error uploading new team avatar for team %s: %v", userTeam.Key.TeamID, err)
+		return false
+	}
+	teamInfo.Avatar = iconURL
+	teamInfo.AvatarUrl = avatar
+	return true
+}
+
+func (user *User) handleTeamIconChange(userTeam *database.UserTeam, evt *TeamIconChangeEvent) {
+	teamInfo := user.bridge.DB.TeamInfo.GetBySlackTeam(userTeam.Key.TeamID)
+	if teamInfo == nil || !user.updateTeamAvatar(userTeam, teamInfo, evt.Icon) {
+		return
+	}
+	teamInfo.Upsert()
+	user.log.Debugfln("Updated icon of team %s", userTeam.Key.TeamID)
+	if userTeam.SpaceRoom != "" {
+		_, err := user.bridge.Bot.SetRoomAvatar(userTeam.SpaceRoom, teamInfo.AvatarUrl)
+		if err != nil {
+			user.log.Warnfln("Failed to update avatar of space %s: %v", userTeam.SpaceRoom, err)
+		}
+	}
+	for _, portal := range user.bridge.GetAllPortals() {
+		if portal.Key.TeamID == userTeam.Key.TeamID && portal.updateAvatarFromTeam(teamInfo) {
+			portal.Update(nil)
+			portal.UpdateBridgeInfo()
+		}
+	}
+}
+
+// updateAvatarFromTeam uses the workspace icon as the room avatar of
+// channels and group DMs if enabled in the config, as Slack doesn't have
+// avatars for them.
+func (portal *Portal) updateAvatarFromTeam(teamInfo *database.TeamInfo) bool {
+	if !portal.bridge.bridgeConfig().TeamIconFallback || portal.IsPrivateChat() || teamInfo == nil || teamInfo.AvatarUrl.IsEmpty() {
+		return false
+	} else if portal.Avatar == teamInfo.Avatar && portal.AvatarURL == teamInfo.AvatarUrl && (portal.AvatarSet || portal.MXID == "") {
+		return false
+	}
+	portal.log.Debugfln("Updating avatar from team icon %q -> %q", portal.Avatar, teamInfo.Avatar)
+	portal.Avatar = teamInfo.Avatar
+	portal.AvatarURL = teamInfo.AvatarUrl
+	portal.AvatarSet = false
+	portal.updateRoomAvatar()
+	return true
+}
@@ -0,0 +1,82 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+const threadQuoteMaxLength = 100
+
+func (portal *Portal) getThreadMode() database.ThreadMode {
+	if portal.ThreadMode != database.ThreadModeDefault {
+		return portal.ThreadMode
+	}
+	return portal.bridge.getTeamConfig(portal.Key.TeamID).ThreadMode
+}
+
+// getThreadQuoteText returns the first line of the thread root's text, or an
+// empty string if it can't be read, e.g. because the room is encrypted.
+func (portal *Portal) getThreadQuoteText(rootID id.EventID) string {
+	evt, err := portal.MainIntent().GetEvent(portal.MXID, rootID)
+	if err != nil {
+		portal.log.Debugfln("Failed to get thread root %s for quote: %v", rootID, err)
+		return ""
+	} else if evt.Type != event.EventMessage {
+		return ""
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return ""
+	}
+	text, _, _ := strings.Cut(evt.Content.AsMessage().Body, "\n")
+	if len([]rune(text)) > threadQuoteMaxLength {
+		text = string([]rune(text)[:threadQuoteMaxLength]) + "…"
+	}
+	return text
+}
+
+// addThreadQuote prefixes a flattened thread message with a quote of the
+// thread root, so it can be recognized as part of the thread. Files don't
+// have a text to put the quote in, so they're sent as-is.
+func (portal *Portal) addThreadQuote(content *event.MessageEventContent, rootID id.EventID) {
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+	default:
+		return
+	}
+	quote := portal.getThreadQuoteText(rootID)
+	if quote == "" {
+		quote = "a thread"
+	}
+	link := fmt.Sprintf("https://matrix.to/#/%s/%s", portal.MXID, rootID)
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
+	}
+	content.Body = fmt.Sprintf("> In reply to %s\n\n%s", quote, content.Body)
+	content.FormattedBody = fmt.Sprintf(`<blockquote><a href="%s">In reply to</a> %s</blockquote>%s`,
+		link, html.EscapeString(quote), content.FormattedBody)
+}
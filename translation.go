@@ -0,0 +1,243 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+
+	"go.mau.fi/mautrix-slack/config"
+	"go.mau.fi/mautrix-slack/database"
+)
+
+// Translator translates the HTML of a message to another language. It
+// returns the translation and the detected source language, which is empty if
+// the backend didn't detect it.
+type Translator interface {
+	Translate(ctx context.Context, text, targetLang string) (translated, sourceLang string, err error)
+}
+
+func newTranslator(br *SlackBridge) Translator {
+	cfg := br.bridgeConfig().Translation
+	client := &http.Client{}
+	baseURL := strings.TrimSuffix(cfg.URL, "/")
+	switch cfg.Backend {
+	case config.TranslationLibreTranslate:
+		return &libreTranslator{url: baseURL + "/translate", apiKey: cfg.APIKey, client: client}
+	case config.TranslationDeepL:
+		return &deeplTranslator{url: baseURL + "/v2/translate", apiKey: cfg.APIKey, client: client}
+	default:
+		return nil
+	}
+}
+
+func postTranslationJSON(ctx context.Context, client *http.Client, url string, header http.Header, reqData, respData interface{}) error {
+	input, err := json.Marshal(reqData)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(respData)
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
+
+type libreTranslator struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+type libreTranslateRequest struct {
+	Query  string `json:"q"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Format string `json:"format"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+type libreTranslateResponse struct {
+	TranslatedText   string `json:"translatedText"`
+	DetectedLanguage struct {
+		Language string `json:"language"`
+	} `json:"detectedLanguage"`
+}
+
+func (lt *libreTranslator) Translate(ctx context.Context, text, targetLang string) (string, string, error) {
+	var resp libreTranslateResponse
+	err := postTranslationJSON(ctx, lt.client, lt.url, nil, &libreTranslateRequest{
+		Query:  text,
+		Source: "auto",
+		Target: targetLang,
+		Format: "html",
+		APIKey: lt.apiKey,
+	}, &resp)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.TranslatedText, resp.DetectedLanguage.Language, nil
+}
+
+type deeplTranslator struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+type deeplTranslateRequest struct {
+	Text        []string `json:"text"`
+	TargetLang  string   `json:"target_lang"`
+	TagHandling string   `json:"tag_handling"`
+}
+
+type deeplTranslateResponse struct {
+	Translations []struct {
+		DetectedSourceLanguage string `json:"detected_source_language"`
+		Text                   string `json:"text"`
+	} `json:"translations"`
+}
+
+func (dt *deeplTranslator) Translate(ctx context.Context, text, targetLang string) (string, string, error) {
+	var resp deeplTranslateResponse
+	header := http.Header{"Authorization": {"DeepL-Auth-Key " + dt.apiKey}}
+	err := postTranslationJSON(ctx, dt.client, dt.url, header, &deeplTranslateRequest{
+		Text:        []string{text},
+		TargetLang:  strings.ToUpper(targetLang),
+		TagHandling: "html",
+	}, &resp)
+	if err != nil {
+		return "", "", err
+	} else if len(resp.Translations) == 0 {
+		return "", "", fmt.Errorf("response didn't contain a translation")
+	}
+	return resp.Translations[0].Text, resp.Translations[0].DetectedSourceLanguage, nil
+}
+
+// sameLanguage checks if a detected language matches the target language,
+// ignoring regional variants like the US in EN-US.
+func sameLanguage(detected, target string) bool {
+	baseLang := func(lang string) string {
+		lang, _, _ = strings.Cut(strings.ToLower(lang), "-")
+		return lang
+	}
+	return detected != "" && baseLang(detected) == baseLang(target)
+}
+
+// getTranslation returns the translation settings of the portal for a
+// direction, or nil if messages in that direction aren't translated.
+func (portal *Portal) getTranslation(direction database.TranslationDirection) *database.TranslationSetting {
+	if portal.bridge.Translator == nil {
+		return nil
+	}
+	setting, ok := portal.Translation[direction]
+	if !ok || setting.TargetLang == "" {
+		return nil
+	}
+	if setting.Mode == "" {
+		setting.Mode = portal.bridge.bridgeConfig().Translation.DefaultMode
+	}
+	return &setting
+}
+
+// translateHTML translates the HTML of a message if translation is enabled
+// for the direction. It returns an empty string if the message should be
+// bridged as-is, either because it doesn't need translating or because the
+// translation failed.
+func (portal *Portal) translateHTML(ctx context.Context, direction database.TranslationDirection, text string) (string, database.TranslationMode) {
+	setting := portal.getTranslation(direction)
+	if setting == nil || strings.TrimSpace(text) == "" {
+		return "", ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, portal.bridge.bridgeConfig().Translation.Timeout)
+	defer cancel()
+	translated, sourceLang, err := portal.bridge.Translator.Translate(ctx, text, setting.TargetLang)
+	if err != nil {
+		portal.log.Warnfln("Failed to translate %s message to %s: %v", direction, setting.TargetLang, err)
+		return "", ""
+	} else if sameLanguage(sourceLang, setting.TargetLang) || translated == text {
+		return "", ""
+	}
+	return translated, setting.Mode
+}
+
+// translateSlackMessage translates a message from Slack after it has been
+// converted to Matrix content.
+func (portal *Portal) translateSlackMessage(content *event.MessageEventContent) {
+	if portal.getTranslation(database.TranslationSlackToMatrix) == nil {
+		return
+	}
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	translated, mode := portal.translateHTML(context.Background(), database.TranslationSlackToMatrix, content.FormattedBody)
+	switch mode {
+	case database.TranslationAppend:
+		content.FormattedBody += "<br><br>\U0001F310 " + translated
+		content.Body += "\n\n\U0001F310 " + format.HTMLToText(translated)
+	case database.TranslationReplace:
+		content.FormattedBody = translated
+		content.Body = format.HTMLToText(translated)
+	}
+}
+
+// translateMatrixMessage translates a message from Matrix and returns the
+// Slack mrkdwn to send. The original text is returned if the message isn't
+// translated.
+func (portal *Portal) translateMatrixMessage(ctx context.Context, content *event.MessageEventContent, text string) string {
+	if portal.getTranslation(database.TranslationMatrixToSlack) == nil {
+		return text
+	}
+	htmlText := content.FormattedBody
+	if content.Format != event.FormatHTML {
+		htmlText = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br>")
+	}
+	translated, mode := portal.translateHTML(ctx, database.TranslationMatrixToSlack, htmlText)
+	switch mode {
+	case database.TranslationAppend:
+		return text + "\n\n\U0001F310 " + portal.bridge.ParseMatrix(translated)
+	case database.TranslationReplace:
+		return portal.bridge.ParseMatrix(translated)
+	default:
+		return text
+	}
+}
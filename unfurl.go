@@ -0,0 +1,46 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/slack-go/slack"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+func (portal *Portal) getUnfurlMode() database.UnfurlMode {
+	if portal.Unfurl != database.UnfurlDefault {
+		return portal.Unfurl
+	}
+	return portal.bridge.bridgeConfig().Unfurl
+}
+
+// getUnfurlOptions returns the options that stop Slack from previewing the
+// kinds of links that shouldn't be unfurled in this portal. Slack's own
+// defaults are kept for the kinds that should be.
+func (portal *Portal) getUnfurlOptions() []slack.MsgOption {
+	var options []slack.MsgOption
+	switch portal.getUnfurlMode() {
+	case database.UnfurlLinks:
+		options = append(options, slack.MsgOptionDisableMediaUnfurl())
+	case database.UnfurlMedia:
+		options = append(options, slack.MsgOptionDisableLinkUnfurl())
+	case database.UnfurlNone:
+		options = append(options, slack.MsgOptionDisableLinkUnfurl(), slack.MsgOptionDisableMediaUnfurl())
+	}
+	return options
+}
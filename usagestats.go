@@ -0,0 +1,74 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+func (br *SlackBridge) countUsage(userID id.UserID, counter database.UserStatsCounter, amount int64) {
+	if !br.bridgeConfig().UsageStats || userID == "" || amount <= 0 {
+		return
+	}
+	br.DB.UserStats.Increment(userID, counter, amount)
+}
+
+// countMatrixEventUsage counts the result of bridging a Matrix event to Slack
+// for the user who sent it. Pending statuses aren't counted, as the final
+// result is reported later.
+func (br *SlackBridge) countMatrixEventUsage(evt *event.Event, err error, statusCode event.MessageStatus) {
+	if err != nil {
+		if statusCode != event.MessageStatusPending {
+			br.countUsage(evt.Sender, database.StatErrors, 1)
+		}
+		return
+	}
+	switch evt.Type {
+	case event.EventMessage:
+		content := evt.Content.AsMessage()
+		if content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace {
+			return
+		}
+		br.countUsage(evt.Sender, database.StatMessagesToSlack, 1)
+		switch content.MsgType {
+		case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+			if content.Info != nil {
+				br.countUsage(evt.Sender, database.StatMediaBytesToSlack, int64(content.Info.Size))
+			}
+		}
+	case event.EventReaction:
+		br.countUsage(evt.Sender, database.StatReactionsToSlack, 1)
+	}
+}
+
+func formatUserStats(stats *database.UserStats) string {
+	return fmt.Sprintf("Usage since %s:\n\n"+
+		"* **Messages**: %d sent to Slack, %d received from Slack\n"+
+		"* **Media**: %s sent to Slack, %s received from Slack\n"+
+		"* **Reactions**: %d sent to Slack, %d received from Slack\n"+
+		"* **Errors**: %d",
+		stats.Since.Format("2006-01-02 15:04 MST"),
+		stats.MessagesToSlack, stats.MessagesToMatrix,
+		formatBytes(stats.MediaBytesToSlack), formatBytes(stats.MediaBytesToMatrix),
+		stats.ReactionsToSlack, stats.ReactionsToMatrix,
+		stats.Errors)
+}
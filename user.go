@@ -17,11 +17,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -56,12 +58,62 @@ type User struct {
 	BridgeStates map[string]*bridge.BridgeStateQueue
 
 	PermissionLevel bridgeconfig.PermissionLevel
+
+	commandCooldowns     map[string]time.Time
+	commandCooldownsLock sync.Mutex
+
+	spaceLock sync.Mutex
+
+	favourites     map[id.RoomID]bool
+	favouritesLock sync.Mutex
+	mutes          map[id.RoomID]bool
+	mutesLock      sync.Mutex
+	dndSnoozed     map[string]bool
+	dndTimers      map[string]*time.Timer
+	dndLock        sync.Mutex
+	dndRuleLock    sync.Mutex
+
+	// The muted_channels pref of each team, and a lock for changing it
+	slackMutes        map[string]map[string]bool
+	slackMutesLock    sync.Mutex
+	slackMutesSetLock sync.Mutex
+
+	apiLimiter apiLimiter
+
+	retryQueueLock sync.Mutex
 }
 
 func (user *User) GetPermissionLevel() bridgeconfig.PermissionLevel {
 	return user.PermissionLevel
 }
 
+// reserveCommand starts the cooldown of the given command if it's not on
+// cooldown already, and otherwise returns how long the user still has to wait.
+// The returned function undoes the reservation, for when the command didn't
+// actually run. Admins are never limited.
+func (user *User) reserveCommand(command string) (time.Duration, func()) {
+	cooldown := user.bridge.bridgeConfig().CommandCooldowns[command]
+	if cooldown <= 0 || user.PermissionLevel >= bridgeconfig.PermissionLevelAdmin {
+		return 0, func() {}
+	}
+
+	user.commandCooldownsLock.Lock()
+	defer user.commandCooldownsLock.Unlock()
+	previous := user.commandCooldowns[command]
+	if remaining := time.Until(previous.Add(cooldown)); remaining > 0 {
+		return remaining, nil
+	}
+	reserved := time.Now()
+	user.commandCooldowns[command] = reserved
+	return 0, func() {
+		user.commandCooldownsLock.Lock()
+		if user.commandCooldowns[command].Equal(reserved) {
+			user.commandCooldowns[command] = previous
+		}
+		user.commandCooldownsLock.Unlock()
+	}
+}
+
 func (user *User) GetManagementRoomID() id.RoomID {
 	return user.ManagementRoom
 }
@@ -161,8 +213,15 @@ func (br *SlackBridge) NewUser(dbUser *database.User) *User {
 		log:    br.Log.Sub("User").Sub(string(dbUser.MXID)),
 	}
 
-	user.PermissionLevel = br.Config.Bridge.Permissions.Get(user.MXID)
+	user.PermissionLevel = br.bridgeConfig().Permissions.Get(user.MXID)
 	user.BridgeStates = make(map[string]*bridge.BridgeStateQueue)
+	user.commandCooldowns = make(map[string]time.Time)
+	user.favourites = make(map[id.RoomID]bool)
+	user.mutes = make(map[id.RoomID]bool)
+	user.slackMutes = make(map[string]map[string]bool)
+	user.dndSnoozed = make(map[string]bool)
+	user.dndTimers = make(map[string]*time.Timer)
+	user.apiLimiter.user = user
 
 	return user
 }
@@ -281,6 +340,30 @@ func (user *User) syncChatDoublePuppetDetails(portal *Portal, justCreated bool)
 	// TODO sync mute status
 }
 
+// applyAutoStatus sets the user's automatic custom status on Slack, unless they
+// already have some other custom status set.
+func (user *User) applyAutoStatus(userTeam *database.UserTeam) {
+	if user.AutoStatusText == "" && user.AutoStatusEmoji == "" {
+		return
+	}
+	client := userTeam.Client
+	if client == nil {
+		return
+	}
+	profile, err := client.GetUserProfile(&slack.GetUserProfileParameters{UserID: userTeam.Key.SlackID})
+	if err != nil {
+		user.log.Warnfln("Failed to get Slack profile of %s to apply automatic status: %v", userTeam.Key, err)
+		return
+	} else if profile.StatusText != "" || profile.StatusEmoji != "" {
+		user.log.Debugfln("Not applying automatic status for %s: another status is already set", userTeam.Key)
+		return
+	}
+	err = client.SetUserCustomStatus(user.AutoStatusText, user.AutoStatusEmoji, 0)
+	if err != nil {
+		user.log.Warnfln("Failed to apply automatic status for %s: %v", userTeam.Key, err)
+	}
+}
+
 func (user *User) login(info *auth.Info, force bool) {
 	userTeam := user.bridge.DB.UserTeam.New()
 
@@ -312,6 +395,7 @@ func (user *User) LoginTeam(email, team, password string) error {
 	if err != nil {
 		return err
 	}
+	user.auditLogin(info, "password")
 
 	go user.login(info, false)
 	return nil
@@ -322,11 +406,20 @@ func (user *User) TokenLogin(token string, cookieToken string) (*auth.Info, erro
 	if err != nil {
 		return nil, err
 	}
+	user.auditLogin(info, "token")
 
 	go user.login(info, true)
 	return info, nil
 }
 
+func (user *User) auditLogin(info *auth.Info, method string) {
+	user.bridge.audit(user.MXID, "login", info.TeamID, map[string]string{
+		"method":    method,
+		"slack_id":  info.UserID,
+		"team_name": info.TeamName,
+	})
+}
+
 func (user *User) IsLoggedIn() bool {
 	return len(user.GetLoggedInTeams()) > 0
 }
@@ -371,12 +464,14 @@ func (user *User) LogoutUserTeam(userTeam *database.UserTeam) error {
 	delete(user.Teams, userTeam.Key.TeamID)
 	user.TeamsLock.Unlock()
 
-	userTeam.Token = ""
-	userTeam.CookieToken = ""
-	userTeam.Upsert()
+	userTeam.ClearTokens()
 
 	user.Update()
 
+	user.bridge.audit(user.MXID, "logout", userTeam.Key.TeamID, map[string]string{
+		"slack_id": userTeam.Key.SlackID,
+	})
+
 	return nil
 }
 
@@ -402,6 +497,9 @@ func (user *User) slackMessageHandler(userTeam *database.UserTeam) {
 			userTeam.Upsert()
 
 			user.tryAutomaticDoublePuppeting(userTeam)
+			go user.applyAutoStatus(userTeam)
+			go user.initDNDState(userTeam)
+			go user.retryQueuedMessages(userTeam)
 			user.BridgeStates[userTeam.Key.TeamID].Send(status.BridgeState{StateEvent: status.StateConnected})
 
 			user.log.Infofln("connected to team %s as %s", userTeam.TeamName, userTeam.SlackEmail)
@@ -412,42 +510,37 @@ func (user *User) slackMessageHandler(userTeam *database.UserTeam) {
 
 			user.LogoutUserTeam(userTeam)
 			user.BridgeStates[userTeam.Key.TeamID].Send(status.BridgeState{StateEvent: status.StateBadCredentials})
+			if user.bridge.bridgeConfig().AdminNotices.TokenExpiry {
+				go user.bridge.sendAdminNotice("The Slack token of %s for %s (%s) stopped working, they need to log in again",
+					user.MXID, userTeam.TeamName, userTeam.Key.TeamID)
+			}
 
 			// TODO: Should drop a message in the management room
 
 			return
+		case *slack.StarAddedEvent:
+			go user.handleSlackStar(userTeam, event.Item, true)
+		case *slack.StarRemovedEvent:
+			go user.handleSlackStar(userTeam, event.Item, false)
+		case *slack.DNDUpdatedEvent:
+			go user.handleSlackDNDUpdate(userTeam, event)
+		case *slack.PrefChangeEvent:
+			go user.handleSlackPrefChange(userTeam, event)
+		case *SlackChannelSectionsEvent:
+			go user.syncSpaces(userTeam)
+		case *SlackBookmarkEvent:
+			go user.handleSlackBookmarkEvent(userTeam, event)
+		case *TeamIconChangeEvent:
+			go user.handleTeamIconChange(userTeam, event)
 		case *slack.LatencyReport:
 			user.log.Debugln("latency report:", event.Value)
-		case *slack.MessageEvent:
-			key := database.NewPortalKey(userTeam.Key.TeamID, event.Channel)
-			portal := user.bridge.GetPortalByID(key)
-			if portal != nil {
-				portal.HandleSlackMessage(user, userTeam, event)
-			}
-		case *slack.ReactionAddedEvent:
-			key := database.NewPortalKey(userTeam.Key.TeamID, event.Item.Channel)
-			portal := user.bridge.GetPortalByID(key)
-			if portal != nil {
-				portal.HandleSlackReaction(user, userTeam, event)
-			}
-		case *slack.ReactionRemovedEvent:
-			key := database.NewPortalKey(userTeam.Key.TeamID, event.Item.Channel)
-			portal := user.bridge.GetPortalByID(key)
-			if portal != nil {
-				portal.HandleSlackReactionRemoved(user, userTeam, event)
-			}
-		case *slack.UserTypingEvent:
-			key := database.NewPortalKey(userTeam.Key.TeamID, event.Channel)
-			portal := user.bridge.GetPortalByID(key)
-			if portal != nil {
-				portal.HandleSlackTyping(user, userTeam, event)
-			}
-		case *slack.ChannelMarkedEvent:
-			key := database.NewPortalKey(userTeam.Key.TeamID, event.Channel)
-			portal := user.bridge.GetPortalByID(key)
-			if portal != nil {
-				portal.HandleSlackChannelMarked(user, userTeam, event)
+		case *slack.MessageEvent, *slack.ReactionAddedEvent, *slack.ReactionRemovedEvent, *slack.UserTypingEvent, *slack.ChannelMarkedEvent:
+			if user.bridge.bridgeConfig().EventArchive.Enable && msg.Type != "user_typing" {
+				user.archiveSlackEvent(userTeam, msg)
 			}
+			user.bridge.slackScheduler.dispatch(user, userTeam, event)
+		case *slack.UserChangeEvent, *slack.ChannelRenameEvent, *slack.GroupRenameEvent, *slack.IMOpenEvent, *slack.IMCloseEvent:
+			user.handleSlackInfoChange(userTeam, event)
 		case *slack.RTMError:
 			user.log.Errorln("rtm error:", event.Error())
 			user.BridgeStates[userTeam.Key.TeamID].Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: event.Error()})
@@ -459,6 +552,43 @@ func (user *User) slackMessageHandler(userTeam *database.UserTeam) {
 	user.BridgeStates[userTeam.Key.TeamID].Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: "Disconnected for unknown reason"})
 }
 
+// handleSlackEvent passes a Slack event that belongs to a portal on to that portal.
+func (user *User) handleSlackEvent(userTeam *database.UserTeam, data interface{}) {
+	defer user.bridge.recoverPanic(fmt.Sprintf("handling Slack %T", data), user.sentryTags(userTeam))
+	switch event := data.(type) {
+	case *slack.MessageEvent:
+		key := database.NewPortalKey(userTeam.Key.TeamID, event.Channel)
+		portal := user.bridge.GetPortalByID(key)
+		if portal != nil {
+			portal.HandleSlackMessage(user, userTeam, event)
+		}
+	case *slack.ReactionAddedEvent:
+		key := database.NewPortalKey(userTeam.Key.TeamID, event.Item.Channel)
+		portal := user.bridge.GetPortalByID(key)
+		if portal != nil {
+			portal.HandleSlackReaction(user, userTeam, event)
+		}
+	case *slack.ReactionRemovedEvent:
+		key := database.NewPortalKey(userTeam.Key.TeamID, event.Item.Channel)
+		portal := user.bridge.GetPortalByID(key)
+		if portal != nil {
+			portal.HandleSlackReactionRemoved(user, userTeam, event)
+		}
+	case *slack.UserTypingEvent:
+		key := database.NewPortalKey(userTeam.Key.TeamID, event.Channel)
+		portal := user.bridge.GetPortalByID(key)
+		if portal != nil {
+			portal.HandleSlackTyping(user, userTeam, event)
+		}
+	case *slack.ChannelMarkedEvent:
+		key := database.NewPortalKey(userTeam.Key.TeamID, event.Channel)
+		portal := user.bridge.GetPortalByID(key)
+		if portal != nil {
+			portal.HandleSlackChannelMarked(user, userTeam, event)
+		}
+	}
+}
+
 func (user *User) connectTeam(userTeam *database.UserTeam) {
 	user.log.Infofln("Connecting %s to Slack userteam %s (%s)", user.MXID, userTeam.Key, userTeam.TeamName)
 	slackOptions := []slack.Option{
@@ -468,9 +598,10 @@ func (user *User) connectTeam(userTeam *database.UserTeam) {
 	if userTeam.CookieToken != "" {
 		slackOptions = append(slackOptions, slack.OptionCookie("d", userTeam.CookieToken))
 	}
+	slackOptions = append(slackOptions, user.getSlackClientOptions(userTeam.Key.TeamID, apiPriorityInteractive)...)
 	userTeam.Client = slack.New(userTeam.Token, slackOptions...)
 
-	userTeam.RTM = userTeam.Client.NewRTM()
+	userTeam.RTM = userTeam.Client.NewRTM(user.bridge.getSlackRTMOptions(userTeam.Key.TeamID)...)
 
 	go userTeam.RTM.ManageConnection()
 
@@ -483,7 +614,7 @@ func (user *User) isChannelOrOpenIM(channel *slack.Channel, userTeam *database.U
 	if !channel.IsIM {
 		return true
 	} else {
-		info, err := userTeam.Client.GetConversationInfo(channel.ID, true)
+		info, err := user.bridge.InfoCache.GetConversationInfo(userTeam, channel.ID)
 		if err != nil {
 			user.log.Errorfln("Error getting information about IM: %v", err)
 			return false
@@ -492,12 +623,35 @@ func (user *User) isChannelOrOpenIM(channel *slack.Channel, userTeam *database.U
 	}
 }
 
+// getConversations fetches all of the user's conversations of the given types,
+// following Slack's cursor pagination until every page has been read.
+func (user *User) getConversations(userTeam *database.UserTeam, types ...string) ([]slack.Channel, error) {
+	params := &slack.GetConversationsForUserParameters{
+		Types: types,
+		Limit: 200,
+	}
+	var channels []slack.Channel
+	for {
+		page, nextCursor, err := userTeam.Client.GetConversationsForUser(params)
+		if err != nil {
+			return channels, err
+		}
+		channels = append(channels, page...)
+		if nextCursor == "" {
+			return channels, nil
+		}
+		params.Cursor = nextCursor
+	}
+}
+
 func (user *User) SyncPortals(userTeam *database.UserTeam, force bool) error {
 	channelInfo := map[string]slack.Channel{}
+	progress := user.startSyncProgress(userTeam)
+	defer progress.finish()
 
 	if !strings.HasPrefix(userTeam.Token, "xoxs") {
 		// TODO: use pagination to make sure we get everything!
-		channels, _, err := userTeam.Client.GetConversationsForUser(&slack.GetConversationsForUserParameters{
+		channels, _, err := userTeam.Client.GetConversationsForUserContext(withBackgroundPriority(context.Background()), &slack.GetConversationsForUserParameters{
 			Types: []string{"public_channel", "private_channel", "mpim", "im"},
 		})
 		if err != nil {
@@ -512,17 +666,28 @@ func (user *User) SyncPortals(userTeam *database.UserTeam, force bool) error {
 		user.log.Warnfln("Not fetching channels for userteam %s: xoxs token type can't fetch user's joined channels", userTeam.Key)
 	}
 
+	var joinedChannels []string
 	portals := user.bridge.DB.Portal.GetAllForUserTeam(userTeam.Key)
+	newChannels := len(channelInfo)
+	for _, dbPortal := range portals {
+		if _, ok := channelInfo[dbPortal.Key.ChannelID]; ok {
+			newChannels--
+		}
+	}
+	progress.setChannels(len(portals) + newChannels)
 	for _, dbPortal := range portals {
 		// First, go through all pre-existing portals and update their info
 		portal := user.bridge.GetPortalByID(dbPortal.Key)
 		channel := channelInfo[dbPortal.Key.ChannelID]
+		progress.syncing(syncProgressName(portal, &channel))
 		if portal.MXID != "" {
 			portal.UpdateInfo(user, userTeam, &channel, force)
 			portal.ensureUserInvited(user)
-			portal.InsertUser(userTeam.Key)
+			joinedChannels = append(joinedChannels, portal.Key.ChannelID)
+			progress.channelDone(false)
 		} else {
 			portal.CreateMatrixRoom(user, userTeam, &channel, true)
+			progress.channelDone(portal.MXID != "")
 		}
 		// Delete already handled ones from the map
 		delete(channelInfo, dbPortal.Key.ChannelID)
@@ -532,13 +697,21 @@ func (user *User) SyncPortals(userTeam *database.UserTeam, force bool) error {
 		// Remaining ones in the map are new channels that weren't handled yet
 		key := database.NewPortalKey(userTeam.Key.TeamID, channel.ID)
 		portal := user.bridge.GetPortalByID(key)
+		progress.syncing(syncProgressName(portal, &channel))
 		if portal.MXID != "" {
 			portal.UpdateInfo(user, userTeam, &channel, force)
-			portal.InsertUser(userTeam.Key)
+			joinedChannels = append(joinedChannels, portal.Key.ChannelID)
+			progress.channelDone(false)
 		} else {
 			portal.CreateMatrixRoom(user, userTeam, &channel, true)
+			progress.channelDone(portal.MXID != "")
 		}
 	}
+	user.bridge.DB.Portal.InsertUserPortals(userTeam.Key, joinedChannels)
+	user.syncSpaces(userTeam)
+	user.syncFavourites(userTeam)
+	user.syncMutes(userTeam)
+	go user.syncAllBookmarks(userTeam)
 
 	return nil
 }
@@ -551,7 +724,7 @@ func (user *User) UpdateTeam(userTeam *database.UserTeam, force bool) error {
 		currentTeamInfo.TeamID = userTeam.Key.TeamID
 	}
 
-	teamInfo, err := userTeam.Client.GetTeamInfo()
+	teamInfo, err := userTeam.Client.GetTeamInfoContext(withBackgroundPriority(context.Background()))
 	if err != nil {
 		user.log.Errorfln("Error fetching info for team %s: %v", userTeam.Key.TeamID, err)
 		return err
@@ -565,21 +738,13 @@ func (user *User) UpdateTeam(userTeam *database.UserTeam, force bool) error {
 	if currentTeamInfo.TeamDomain != teamInfo.Domain {
 		currentTeamInfo.TeamDomain = teamInfo.Domain
 		changed = true
+		defer user.bridge.forgetTeamConfig(userTeam.Key.TeamID)
 	}
 	if currentTeamInfo.TeamUrl != teamInfo.URL {
 		currentTeamInfo.TeamUrl = teamInfo.URL
 		changed = true
 	}
-	if teamInfo.Icon["image_230"] != nil && currentTeamInfo.Avatar != teamInfo.Icon["image_230"] {
-		avatar, err := uploadAvatar(user.bridge.AS.BotIntent(), teamInfo.Icon["image_230"].(string))
-		if err != nil {
-			user.log.Warnfln("Error uploading new team avatar for team %s: %v", userTeam.Key.TeamID, err)
-		} else {
-			currentTeamInfo.Avatar = teamInfo.Icon["image_230"].(string)
-			currentTeamInfo.AvatarUrl = avatar
-			changed = true
-		}
-	}
+	changed = user.updateTeamAvatar(userTeam, currentTeamInfo, teamInfo.Icon) || changed
 
 	currentTeamInfo.Upsert()
 	return user.SyncPortals(userTeam, changed || force)
@@ -661,7 +826,7 @@ func (user *User) GetUserTeam(teamID string) *database.UserTeam {
 // }
 
 // func (user *User) updateDirectChats(chats map[id.UserID][]id.RoomID) {
-// 	if !user.bridge.Config.Bridge.SyncDirectChatList {
+// 	if !user.bridge.bridgeConfig().SyncDirectChatList {
 // 		return
 // 	}
 
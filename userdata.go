@@ -0,0 +1,128 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+type userDataExport struct {
+	Subject    string                       `json:"subject"`
+	ExportedAt time.Time                    `json:"exported_at"`
+	MatrixUser database.UserData            `json:"matrix_user,omitempty"`
+	SlackUsers map[string]database.UserData `json:"slack_users,omitempty"`
+	Purged     map[string]map[string]int64  `json:"purged,omitempty"`
+	Notes      []string                     `json:"notes"`
+}
+
+func (br *SlackBridge) exportUserDataAndExit(subject string, purge bool) {
+	err := br.exportUserData(os.Stdout, subject, purge)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to export user data:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// exportUserData writes everything the bridge stores about a Matrix user
+// (@user:example.com) or a Slack user (TEAMID-USERID) as JSON, for data
+// subject requests. Exporting a Matrix user includes the Slack accounts they
+// logged in with. If purge is set, the exported rows are deleted afterwards.
+func (br *SlackBridge) exportUserData(out io.Writer, subject string, purge bool) error {
+	err := br.DB.Upgrade()
+	if err != nil {
+		return fmt.Errorf("failed to upgrade database: %w", err)
+	}
+	export := &userDataExport{
+		Subject:    subject,
+		ExportedAt: time.Now().UTC(),
+		SlackUsers: make(map[string]database.UserData),
+		Notes: []string{
+			"Credentials are replaced with [redacted].",
+			"Bridged message contents are stored by the homeserver, not the bridge.",
+		},
+	}
+	var slackUsers [][2]string
+	if strings.HasPrefix(subject, "@") {
+		export.MatrixUser, err = br.DB.ExportMatrixUserData(subject)
+		if err != nil {
+			return err
+		}
+		for _, row := range export.MatrixUser["user_team"] {
+			teamID, _ := row["team_id"].(string)
+			slackID, _ := row["slack_id"].(string)
+			slackUsers = append(slackUsers, [2]string{teamID, slackID})
+		}
+	} else if teamID, userID, ok := strings.Cut(subject, "-"); ok && teamID != "" && userID != "" {
+		slackUsers = append(slackUsers, [2]string{strings.ToUpper(teamID), strings.ToUpper(userID)})
+	} else {
+		return fmt.Errorf("%q is neither a Matrix user ID nor a Slack TEAMID-USERID pair", subject)
+	}
+	for _, slackUser := range slackUsers {
+		data, err := br.DB.ExportSlackUserData(slackUser[0], slackUser[1])
+		if err != nil {
+			return err
+		}
+		export.SlackUsers[slackUser[0]+"-"+slackUser[1]] = data
+	}
+
+	if purge {
+		if err = br.checkBridgeStopped(); err != nil {
+			return err
+		}
+		export.Purged = make(map[string]map[string]int64)
+		if export.MatrixUser != nil {
+			export.Purged[subject], err = br.DB.PurgeMatrixUserData(subject)
+			if err != nil {
+				return err
+			}
+		}
+		for _, slackUser := range slackUsers {
+			key := slackUser[0] + "-" + slackUser[1]
+			export.Purged[key], err = br.DB.PurgeSlackUserData(slackUser[0], slackUser[1])
+			if err != nil {
+				return err
+			}
+		}
+		export.Notes = append(export.Notes, "The audit log is kept when purging, as it's a record of admin actions.")
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// checkBridgeStopped makes sure that the bridge isn't running before data is
+// purged, as it would keep the purged rows in memory and write them back. The
+// bridge listens on the appservice address while it's running.
+func (br *SlackBridge) checkBridgeStopped() error {
+	addr := net.JoinHostPort(br.Config.AppService.Hostname, strconv.Itoa(int(br.Config.AppService.Port)))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("the appservice address %s is in use, stop the bridge before purging data: %w", addr, err)
+	}
+	return listener.Close()
+}
@@ -0,0 +1,143 @@
+// mautrix-slack - A Matrix-Slack puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-slack/database"
+)
+
+var usergroupMentionRegex = regexp.MustCompile(`<!subteam\^([A-Z0-9]+)(?:\|[^>]*)?>`)
+
+type teamUsergroups struct {
+	groups    map[string]slack.UserGroup
+	fetchedAt time.Time
+}
+
+// usergroupCache caches the usergroups of each team with their members, so
+// that usergroup mentions can be turned into mentions of the members.
+type usergroupCache struct {
+	teams map[string]*teamUsergroups
+	lock  sync.Mutex
+}
+
+// getUsergroups returns the usergroups of the team, fetching them if they aren't cached
+// or are older than the user info cache TTL. If userTeam is nil, only the
+// cached groups are returned.
+func (br *SlackBridge) getUsergroups(teamID string, userTeam *database.UserTeam) map[string]slack.UserGroup {
+	cache := &br.usergroups
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cached := cache.teams[teamID]
+	if userTeam == nil || userTeam.Client == nil || (cached != nil && time.Since(cached.fetchedAt) < br.bridgeConfig().InfoCache.UserTTL) {
+		if cached == nil {
+			return nil
+		}
+		return cached.groups
+	}
+	groups, err := userTeam.Client.GetUserGroups(slack.GetUserGroupsOptionIncludeUsers(true))
+	if err != nil {
+		br.Log.Warnfln("Failed to get usergroups of %s: %v", teamID, err)
+		if cached == nil {
+			return nil
+		}
+		return cached.groups
+	}
+	cached = &teamUsergroups{groups: make(map[string]slack.UserGroup, len(groups)), fetchedAt: time.Now()}
+	for _, group := range groups {
+		cached.groups[group.ID] = group
+	}
+	if cache.teams == nil {
+		cache.teams = make(map[string]*teamUsergroups)
+	}
+	cache.teams[teamID] = cached
+	return cached.groups
+}
+
+// getUsergroupHandle returns the handle of a usergroup for rendering mentions
+// of it, or the ID if the group isn't cached.
+func (portal *Portal) getUsergroupHandle(groupID string) string {
+	if group, ok := portal.bridge.getUsergroups(portal.Key.TeamID, nil)[groupID]; ok && group.Handle != "" {
+		return group.Handle
+	}
+	return groupID
+}
+
+func findUsergroupMentions(msg *slack.Msg) []string {
+	var groupIDs []string
+	for _, match := range usergroupMentionRegex.FindAllStringSubmatch(msg.Text, -1) {
+		groupIDs = append(groupIDs, match[1])
+	}
+	for _, block := range msg.Blocks.BlockSet {
+		richText, ok := block.(*slack.RichTextBlock)
+		if !ok {
+			continue
+		}
+		for _, element := range richText.Elements {
+			section, ok := element.(*slack.RichTextSection)
+			if !ok {
+				continue
+			}
+			for _, sectionElement := range section.Elements {
+				if group, ok := sectionElement.(*slack.RichTextSectionUserGroupElement); ok {
+					groupIDs = append(groupIDs, group.UsergroupID)
+				}
+			}
+		}
+	}
+	return groupIDs
+}
+
+// getUsergroupMentions finds the usergroups mentioned in a Slack message and
+// returns the Matrix users that should be mentioned for them: the ghosts of
+// all members, and the Matrix accounts of members who use the bridge.
+func (portal *Portal) getUsergroupMentions(userTeam *database.UserTeam, msg *slack.Msg) []id.UserID {
+	groupIDs := findUsergroupMentions(msg)
+	if len(groupIDs) == 0 {
+		return nil
+	}
+	groups := portal.bridge.getUsergroups(portal.Key.TeamID, userTeam)
+	seen := make(map[id.UserID]struct{})
+	var mentions []id.UserID
+	add := func(userID id.UserID) {
+		if _, ok := seen[userID]; !ok && userID != "" {
+			seen[userID] = struct{}{}
+			mentions = append(mentions, userID)
+		}
+	}
+	for _, groupID := range groupIDs {
+		group, ok := groups[groupID]
+		if !ok {
+			portal.log.Debugfln("Usergroup %s mentioned in %s not found", groupID, msg.Timestamp)
+			continue
+		}
+		for _, member := range group.Users {
+			add(portal.bridge.FormatPuppetMXID(portal.Key.TeamID + "-" + member))
+			if user := portal.bridge.GetUserByID(portal.Key.TeamID, member); user != nil {
+				add(user.MXID)
+			}
+		}
+	}
+	return mentions
+}